@@ -0,0 +1,214 @@
+// Copyright (c) Pavel Sich.
+// Licensed under the MIT License.
+
+//! Access to the system clipboard via the usual command line tools.
+//!
+//! OSC 52 only lets us write to the terminal's clipboard, and only if the terminal supports it.
+//! If one of the tools below is installed, we use it instead, which also allows us to paste
+//! whatever another application copied. Otherwise we fall back to the internal clipboard.
+//!
+//! The tools are never waited for on the UI thread: Writes are handed to a background thread,
+//! which only ever writes the newest contents, and reads give up after [`READ_TIMEOUT`].
+
+use std::io::{Read as _, Write as _};
+use std::process::{Command, Stdio};
+use std::sync::{Arc, Condvar, Mutex, mpsc};
+use std::time::Duration;
+use std::{env, mem, thread};
+
+use edit::clipboard::Clipboard;
+
+/// How long to wait for the paste tool, before falling back to the internal clipboard.
+/// PowerShell can take a second to start up.
+const READ_TIMEOUT: Duration = Duration::from_secs(2);
+
+/// A pair of commands that write to and read from the system clipboard.
+#[derive(Clone, Copy)]
+struct Tools {
+    copy: &'static [&'static str],
+    paste: &'static [&'static str],
+}
+
+// Shared between the UI thread and the writer thread.
+#[derive(Default)]
+struct WriterState {
+    // The newest clipboard contents and whether they still need to be written.
+    data: Vec<u8>,
+    dirty: bool,
+    // Whether a write is pending or running.
+    busy: bool,
+    failed: bool,
+}
+
+type Writer = (Mutex<WriterState>, Condvar);
+
+/// Access to the system clipboard via one of the supported tools.
+pub struct SystemClipboard {
+    paste: &'static [&'static str],
+    writer: Arc<Writer>,
+}
+
+impl SystemClipboard {
+    /// Looks for a supported clipboard tool in `$PATH`.
+    pub fn detect() -> Option<Self> {
+        let candidates: &[(&str, Tools)] = if cfg!(windows) {
+            // clip.exe is not used, because it doesn't understand UTF-8 input.
+            &[(
+                "powershell.exe",
+                Tools {
+                    copy: &[
+                        "powershell.exe",
+                        "-NoProfile",
+                        "-NonInteractive",
+                        "-Command",
+                        "[Console]::InputEncoding = [Text.Encoding]::UTF8; Set-Clipboard -Value ([Console]::In.ReadToEnd())",
+                    ],
+                    paste: &[
+                        "powershell.exe",
+                        "-NoProfile",
+                        "-NonInteractive",
+                        "-Command",
+                        "[Console]::OutputEncoding = [Text.Encoding]::UTF8; [Console]::Out.Write((Get-Clipboard -Raw))",
+                    ],
+                },
+            )]
+        } else if cfg!(target_os = "macos") {
+            &[("pbcopy", Tools { copy: &["pbcopy"], paste: &["pbpaste"] })]
+        } else {
+            &[
+                ("wl-copy", Tools { copy: &["wl-copy"], paste: &["wl-paste", "--no-newline"] }),
+                (
+                    "xclip",
+                    Tools {
+                        copy: &["xclip", "-selection", "clipboard", "-in"],
+                        paste: &["xclip", "-selection", "clipboard", "-out"],
+                    },
+                ),
+                (
+                    "xsel",
+                    Tools {
+                        copy: &["xsel", "--clipboard", "--input"],
+                        paste: &["xsel", "--clipboard", "--output"],
+                    },
+                ),
+            ]
+        };
+
+        // The X11 and Wayland tools are useless without a display server, e.g. over SSH.
+        let has_display = |var| env::var_os(var).is_some_and(|v| !v.is_empty());
+        let is_usable = |program: &str| {
+            find_program(program)
+                && match program {
+                    "wl-copy" => has_display("WAYLAND_DISPLAY"),
+                    "xclip" | "xsel" => has_display("DISPLAY"),
+                    _ => true,
+                }
+        };
+
+        let &(_, tools) = candidates.iter().find(|(program, _)| is_usable(program))?;
+        let writer = Arc::new(Writer::default());
+        let shared = writer.clone();
+        thread::spawn(move || run_writer(tools.copy, &shared));
+        Some(Self { paste: tools.paste, writer })
+    }
+
+    /// Queues `data` to be copied to the system clipboard. If a write is still running,
+    /// only the newest data is written after it. Returns false if a previous write failed.
+    pub fn write(&self, data: &[u8]) -> bool {
+        let (state, wake) = &*self.writer;
+        let mut state = state.lock().unwrap();
+        if state.failed {
+            return false;
+        }
+        state.data.clear();
+        state.data.extend_from_slice(data);
+        state.dirty = true;
+        state.busy = true;
+        wake.notify_one();
+        true
+    }
+
+    /// Returns the contents of the system clipboard, or `None` if the tool failed
+    /// or didn't respond within [`READ_TIMEOUT`].
+    pub fn read(&self) -> Option<Vec<u8>> {
+        let mut child = Command::new(self.paste[0])
+            .args(&self.paste[1..])
+            .stdin(Stdio::null())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::null())
+            .spawn()
+            .ok()?;
+
+        let mut stdout = child.stdout.take()?;
+        let (sender, receiver) = mpsc::channel();
+        thread::spawn(move || {
+            let mut data = Vec::new();
+            _ = sender.send(stdout.read_to_end(&mut data).map(|_| data));
+        });
+
+        match receiver.recv_timeout(READ_TIMEOUT) {
+            Ok(Ok(data)) => child.wait().is_ok_and(|status| status.success()).then_some(data),
+            _ => {
+                _ = child.kill();
+                _ = child.wait();
+                None
+            }
+        }
+    }
+
+    /// Replaces the contents of the internal clipboard with those of the system clipboard.
+    /// If they're identical, the internal clipboard is left untouched,
+    /// so that a line copy (Ctrl+C without selection) still pastes as a line.
+    ///
+    /// While a write is still pending, the internal clipboard is newer and is left alone as well.
+    pub fn read_into(&self, clipboard: &mut Clipboard) {
+        if self.writer.0.lock().unwrap().busy {
+            return;
+        }
+        if let Some(data) = self.read()
+            && !data.is_empty()
+            && data != clipboard.read()
+        {
+            clipboard.write(data);
+            clipboard.mark_as_synchronized();
+        }
+    }
+}
+
+fn run_writer(copy: &[&str], writer: &Writer) {
+    let (state, wake) = writer;
+    loop {
+        let data = {
+            let mut state = wake.wait_while(state.lock().unwrap(), |s| !s.dirty).unwrap();
+            state.dirty = false;
+            mem::take(&mut state.data)
+        };
+        let ok = run_copy(copy, &data);
+        let mut state = state.lock().unwrap();
+        state.failed |= !ok;
+        state.busy = state.dirty;
+    }
+}
+
+// Returns false if the tool failed.
+fn run_copy(copy: &[&str], data: &[u8]) -> bool {
+    // The X11 and Wayland tools fork into the background to serve the clipboard.
+    // Their output must not end up in our terminal, which is why stdout/stderr are discarded.
+    let Ok(mut child) = Command::new(copy[0])
+        .args(&copy[1..])
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()
+    else {
+        return false;
+    };
+
+    let written = child.stdin.take().is_some_and(|mut stdin| stdin.write_all(data).is_ok());
+    child.wait().is_ok_and(|status| status.success()) && written
+}
+
+fn find_program(name: &str) -> bool {
+    env::var_os("PATH")
+        .is_some_and(|paths| env::split_paths(&paths).any(|dir| dir.join(name).is_file()))
+}
@@ -0,0 +1,506 @@
+// Copyright (c) Pavel Sich.
+// Licensed under the MIT License.
+
+//! Persistent editor settings.
+//!
+//! The config file is a list of `key = value` lines, which makes it a subset of TOML.
+//! `#` starts a comment, `[section]` headers are ignored, and strings may be quoted.
+//!
+//! `theme = dark` or `theme = light` picks a built-in theme. Afterwards, individual colors
+//! can be overridden with `theme.<element> = <color>`, e.g. `theme.keyword = "#c678dd"`.
+//! Since `#` starts a comment, truecolor values must be quoted.
+//!
+//! `keys.<shortcut> = <command>` lines rebind keys. See [`crate::keymap`].
+//!
+//! `backup = tilde` or `backup = numbered` keeps the previous contents of a file when saving
+//! over it, as `file~` or `file.~1~`, `file.~2~`, etc. They are written next to the file,
+//! or into `backup_dir` if it's set.
+
+use std::path::{Path, PathBuf};
+use std::{fmt, fs};
+
+use edit::buffer::TextBuffer;
+use edit::framebuffer::ColorMode;
+use edit::helpers::CoordType;
+use edit::input::InputKey;
+use edit::theme::{Theme, ThemeColor};
+use edit::{apperr, path};
+
+use crate::keymap::{BindError, Keymap};
+use crate::localization::*;
+
+const KEYS: [&str; 14] = [
+    "tab_size",
+    "indent_with_tabs",
+    "smart_indent",
+    "convert_pasted_indentation",
+    "line_numbers",
+    "relative_line_numbers",
+    "line_highlight",
+    "bracket_highlight",
+    "highlight_occurrences",
+    "word_wrap",
+    "insert_final_newline",
+    "highlight_trailing_whitespace",
+    "show_whitespace",
+    "trim_trailing_whitespace",
+];
+
+/// How the previous contents of a file are kept when saving over it.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum BackupMode {
+    Off,
+    /// `file~`, replaced on every save.
+    Tilde,
+    /// `file.~1~`, `file.~2~`, and so on. All of them are kept.
+    Numbered,
+}
+
+/// The settings that are applied to every newly opened document.
+#[derive(Clone)]
+pub struct EditorConfig {
+    pub theme: Theme,
+    pub color_mode: Option<ColorMode>, // `None` if it should be detected.
+    pub tab_size: CoordType,
+    pub indent_with_tabs: bool,
+    pub smart_indent: bool,               // For languages with braces.
+    pub convert_pasted_indentation: bool, // To tabs or spaces, see `indent_with_tabs`.
+    pub line_numbers: bool,
+    pub relative_line_numbers: bool,
+    pub line_highlight: bool,
+    pub bracket_highlight: bool,
+    pub highlight_occurrences: bool, // Of the word under the cursor.
+    pub word_wrap: bool,
+    pub insert_final_newline: bool,
+    pub highlight_trailing_whitespace: bool,
+    pub show_whitespace: bool, // Spaces, tabs and line breaks as glyphs.
+    pub trim_trailing_whitespace: bool, // Before saving.
+    pub go_format_on_save: bool,
+    pub go_formatter: &'static str, // "gofmt" or "goimports"
+    pub backup: BackupMode,
+    pub backup_dir: Option<PathBuf>, // `None` to put backups next to the file.
+}
+
+impl Default for EditorConfig {
+    fn default() -> Self {
+        Self {
+            theme: Theme::DARK,
+            color_mode: None,
+            tab_size: 4,
+            indent_with_tabs: false,
+            smart_indent: true,
+            convert_pasted_indentation: false,
+            line_numbers: true,
+            relative_line_numbers: false,
+            line_highlight: true,
+            bracket_highlight: true,
+            highlight_occurrences: true,
+            word_wrap: false,
+            insert_final_newline: !cfg!(windows), // As mandated by POSIX.
+            // Both are off by default, because trailing spaces are meaningful in e.g. Markdown.
+            highlight_trailing_whitespace: false,
+            show_whitespace: false,
+            trim_trailing_whitespace: false,
+            go_format_on_save: false,
+            go_formatter: "gofmt",
+            backup: BackupMode::Off,
+            backup_dir: None,
+        }
+    }
+}
+
+#[derive(Debug, PartialEq, Eq)]
+pub enum ConfigError {
+    UnknownKey(String),
+    InvalidValue(String),
+    UnknownCommand(String),
+    /// `set` in the command prompt without a `key=value`.
+    SetUsage,
+    /// The same shortcut was bound more than once. The last binding wins.
+    KeyConflict {
+        key: String,
+        command: String,
+    },
+}
+
+impl fmt::Display for ConfigError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let (template, key) = match self {
+            ConfigError::UnknownKey(key) => (loc(LocId::ConfigUnknownKey), key),
+            ConfigError::InvalidValue(key) => (loc(LocId::ConfigInvalidValue), key),
+            ConfigError::SetUsage => return f.write_str(loc(LocId::ConfigSetUsage)),
+            ConfigError::UnknownCommand(command) => {
+                return f
+                    .write_str(&loc(LocId::ConfigUnknownCommand).replace("{command}", command));
+            }
+            ConfigError::KeyConflict { key, command } => {
+                return f.write_str(
+                    &loc(LocId::ConfigKeyConflict)
+                        .replace("{key}", key)
+                        .replace("{command}", command),
+                );
+            }
+        };
+        f.write_str(&template.replace("{key}", key))
+    }
+}
+
+impl EditorConfig {
+    /// Returns `$XDG_CONFIG_HOME/edit/config`, falling back to `~/.config/edit/config`.
+    /// On Windows, the file is stored in `%APPDATA%\edit\config` instead.
+    pub fn path() -> Option<PathBuf> {
+        let var = |name| std::env::var_os(name).filter(|v| !v.is_empty()).map(PathBuf::from);
+        let dir = if cfg!(windows) {
+            var("APPDATA")?
+        } else {
+            var("XDG_CONFIG_HOME").or_else(|| Some(var("HOME")?.join(".config")))?
+        };
+        Some(dir.join("edit").join("config"))
+    }
+
+    /// Reads the config file. A missing file results in the default settings.
+    /// Key bindings are applied to `keymap`, on top of the default bindings.
+    /// Invalid entries are skipped and returned alongside the config, so they can be reported.
+    pub fn load(keymap: &mut Keymap) -> (Self, Vec<ConfigError>) {
+        let mut config = Self::default();
+        let mut errors = Vec::new();
+
+        if let Some(path) = Self::path()
+            && let Ok(text) = fs::read_to_string(path)
+        {
+            let mut bound = Vec::new();
+
+            for line in text.lines() {
+                let Some((key, value)) = parse_line(line) else {
+                    continue;
+                };
+
+                let res = match key.strip_prefix("keys.") {
+                    Some(shortcut) => bind_key(keymap, &mut bound, shortcut, value),
+                    None => config.set(key, value),
+                };
+                if let Err(err) = res {
+                    errors.push(err);
+                }
+            }
+        }
+
+        (config, errors)
+    }
+
+    /// Changes a single setting by name.
+    pub fn set(&mut self, key: &str, value: &str) -> Result<(), ConfigError> {
+        let invalid = || ConfigError::InvalidValue(key.to_string());
+        let parse_bool = |value: &str| match value {
+            "true" => Ok(true),
+            "false" => Ok(false),
+            _ => Err(invalid()),
+        };
+
+        match key {
+            "tab_size" => match value.parse::<CoordType>() {
+                Ok(width @ 1..=8) => self.tab_size = width,
+                _ => return Err(invalid()),
+            },
+            "indent_with_tabs" => self.indent_with_tabs = parse_bool(value)?,
+            "smart_indent" => self.smart_indent = parse_bool(value)?,
+            "convert_pasted_indentation" => self.convert_pasted_indentation = parse_bool(value)?,
+            "line_numbers" => self.line_numbers = parse_bool(value)?,
+            "relative_line_numbers" => self.relative_line_numbers = parse_bool(value)?,
+            "line_highlight" => self.line_highlight = parse_bool(value)?,
+            "bracket_highlight" => self.bracket_highlight = parse_bool(value)?,
+            "highlight_occurrences" => self.highlight_occurrences = parse_bool(value)?,
+            "word_wrap" => self.word_wrap = parse_bool(value)?,
+            "insert_final_newline" => self.insert_final_newline = parse_bool(value)?,
+            "highlight_trailing_whitespace" => {
+                self.highlight_trailing_whitespace = parse_bool(value)?
+            }
+            "show_whitespace" => self.show_whitespace = parse_bool(value)?,
+            "trim_trailing_whitespace" => self.trim_trailing_whitespace = parse_bool(value)?,
+            "go_format_on_save" => self.go_format_on_save = parse_bool(value)?,
+            "go_formatter" => {
+                self.go_formatter = match value {
+                    "gofmt" => "gofmt",
+                    "goimports" => "goimports",
+                    _ => return Err(invalid()),
+                }
+            }
+            "backup" => {
+                self.backup = match value {
+                    "off" => BackupMode::Off,
+                    "tilde" => BackupMode::Tilde,
+                    "numbered" => BackupMode::Numbered,
+                    _ => return Err(invalid()),
+                }
+            }
+            "backup_dir" => {
+                self.backup_dir = match value {
+                    "" => None,
+                    _ => Some(path::expand_home(Path::new(value)).into_owned()),
+                }
+            }
+            "color_mode" => {
+                self.color_mode = match value {
+                    "auto" => None,
+                    "truecolor" => Some(ColorMode::TrueColor),
+                    "256" => Some(ColorMode::Palette256),
+                    "16" => Some(ColorMode::Palette16),
+                    _ => return Err(invalid()),
+                }
+            }
+            // Replaces all colors, including any preceding `theme.*` overrides.
+            "theme" => self.theme = Theme::builtin(value).ok_or_else(invalid)?,
+            _ => {
+                let Some(color) =
+                    key.strip_prefix("theme.").and_then(|name| self.theme.color_mut(name))
+                else {
+                    return Err(ConfigError::UnknownKey(key.to_string()));
+                };
+                *color = ThemeColor::parse(value).ok_or_else(invalid)?;
+            }
+        }
+        Ok(())
+    }
+
+    /// Returns the configured color mode, or the one guessed from `$COLORTERM` and `$TERM`.
+    pub fn color_mode(&self) -> ColorMode {
+        self.color_mode.unwrap_or_else(|| {
+            let var = |name| std::env::var(name).unwrap_or_default();
+            let colorterm = var("COLORTERM");
+            let term = var("TERM");
+
+            if colorterm == "truecolor" || colorterm == "24bit" || term.ends_with("-direct") {
+                ColorMode::TrueColor
+            } else if term.contains("256color") {
+                ColorMode::Palette256
+            } else if cfg!(windows) && term.is_empty() {
+                // The console supports 24-bit colors since Windows 10, and it doesn't set `$TERM`.
+                ColorMode::TrueColor
+            } else {
+                ColorMode::Palette16
+            }
+        })
+    }
+
+    /// Applies all settings to the given buffer.
+    pub fn apply(&self, tb: &mut TextBuffer) {
+        for key in KEYS {
+            self.apply_setting(key, tb);
+        }
+    }
+
+    /// Applies a single setting to the given buffer, leaving the others untouched.
+    pub fn apply_setting(&self, key: &str, tb: &mut TextBuffer) {
+        match key {
+            "tab_size" => _ = tb.set_tab_size(self.tab_size),
+            "indent_with_tabs" => tb.set_indent_with_tabs(self.indent_with_tabs),
+            "smart_indent" => tb.set_smart_indent(self.smart_indent),
+            "convert_pasted_indentation" => {
+                tb.set_convert_pasted_indentation(self.convert_pasted_indentation)
+            }
+            "line_numbers" => _ = tb.set_margin_enabled(self.line_numbers),
+            "relative_line_numbers" => tb.set_margin_relative(self.relative_line_numbers),
+            "line_highlight" => tb.set_line_highlight_enabled(self.line_highlight),
+            "bracket_highlight" => tb.set_bracket_highlight_enabled(self.bracket_highlight),
+            "highlight_occurrences" => {
+                tb.set_occurrence_highlight_enabled(self.highlight_occurrences)
+            }
+            "word_wrap" => tb.set_word_wrap(self.word_wrap),
+            "insert_final_newline" => tb.set_insert_final_newline(self.insert_final_newline),
+            "highlight_trailing_whitespace" => {
+                tb.set_trailing_whitespace_highlight_enabled(self.highlight_trailing_whitespace)
+            }
+            "show_whitespace" => tb.set_whitespace_visible(self.show_whitespace),
+            "trim_trailing_whitespace" => {
+                tb.set_trim_whitespace_on_save(self.trim_trailing_whitespace)
+            }
+            _ => {}
+        }
+    }
+
+    /// Writes a single setting back to the config file.
+    /// The line for `key` is replaced (or appended), so that comments and other entries are kept.
+    pub fn write_back(key: &str, value: &str) -> apperr::Result<()> {
+        let Some(path) = Self::path() else {
+            return Ok(());
+        };
+        let text = match fs::read_to_string(&path) {
+            Ok(text) => text,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => String::new(),
+            Err(err) => return Err(err.into()),
+        };
+
+        // Quote values that would otherwise be mistaken for a comment, like "#rrggbb".
+        let entry = if value.contains('#') {
+            format!("{key} = \"{value}\"")
+        } else {
+            format!("{key} = {value}")
+        };
+        let mut found = false;
+        let mut result = String::with_capacity(text.len() + entry.len() + 1);
+
+        for line in text.lines() {
+            if !found && parse_line(line).is_some_and(|(k, _)| k == key) {
+                result.push_str(&entry);
+                found = true;
+            } else {
+                result.push_str(line);
+            }
+            result.push('\n');
+        }
+        if !found {
+            result.push_str(&entry);
+            result.push('\n');
+        }
+
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+        fs::write(&path, result)?;
+        Ok(())
+    }
+}
+
+/// Applies a `keys.<shortcut> = <command>` line. `bound` tracks the keys bound so far,
+/// so that binding one twice can be reported. The last binding wins, like for all settings.
+fn bind_key(
+    keymap: &mut Keymap,
+    bound: &mut Vec<InputKey>,
+    shortcut: &str,
+    command: &str,
+) -> Result<(), ConfigError> {
+    match keymap.bind(shortcut, command) {
+        Ok(key) if bound.contains(&key) => Err(ConfigError::KeyConflict {
+            key: format!("keys.{shortcut}"),
+            command: command.to_string(),
+        }),
+        Ok(key) => {
+            bound.push(key);
+            Ok(())
+        }
+        Err(BindError::UnknownShortcut) => Err(ConfigError::UnknownKey(format!("keys.{shortcut}"))),
+        Err(BindError::UnknownCommand) => Err(ConfigError::UnknownCommand(command.to_string())),
+    }
+}
+
+/// Splits a config line into its key and value.
+/// Returns `None` for empty lines, comments and section headers.
+pub fn parse_line(line: &str) -> Option<(&str, &str)> {
+    let line = line.trim();
+    if line.is_empty() || line.starts_with('#') || line.starts_with('[') {
+        return None;
+    }
+
+    let (key, value) = line.split_once('=').or_else(|| line.split_once(char::is_whitespace))?;
+    let key = key.trim();
+    let mut value = value.trim();
+
+    if let Some(quoted) = value.strip_prefix('"') {
+        value = quoted.split_once('"').map_or(quoted, |(s, _)| s);
+    } else if let Some((s, _)) = value.split_once('#') {
+        value = s.trim_end();
+    }
+
+    Some((key, value))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_line() {
+        assert_eq!(parse_line(""), None);
+        assert_eq!(parse_line("  # comment"), None);
+        assert_eq!(parse_line("[editor]"), None);
+        assert_eq!(parse_line("tab_size=2"), Some(("tab_size", "2")));
+        assert_eq!(parse_line("tab_size = 2 # two"), Some(("tab_size", "2")));
+        assert_eq!(parse_line("theme = \"a # b\" # c"), Some(("theme", "a # b")));
+        assert_eq!(parse_line("word_wrap true"), Some(("word_wrap", "true")));
+    }
+
+    #[test]
+    fn test_set() {
+        let mut config = EditorConfig::default();
+        assert_eq!(config.set("tab_size", "2"), Ok(()));
+        assert_eq!(config.tab_size, 2);
+        assert_eq!(config.set("smart_indent", "false"), Ok(()));
+        assert!(!config.smart_indent);
+        assert_eq!(config.set("tab_size", "9"), Err(ConfigError::InvalidValue("tab_size".into())));
+        assert_eq!(
+            config.set("word_wrap", "yes"),
+            Err(ConfigError::InvalidValue("word_wrap".into()))
+        );
+        assert_eq!(config.set("bogus", "1"), Err(ConfigError::UnknownKey("bogus".into())));
+        assert_eq!(config.tab_size, 2);
+    }
+
+    #[test]
+    fn test_bind_key() {
+        let mut keymap = Keymap::default();
+        let mut bound = Vec::new();
+        assert_eq!(bind_key(&mut keymap, &mut bound, "ctrl-e", "save"), Ok(()));
+        assert_eq!(
+            bind_key(&mut keymap, &mut bound, "ctrl-e", "find"),
+            Err(ConfigError::KeyConflict { key: "keys.ctrl-e".into(), command: "find".into() })
+        );
+        assert_eq!(
+            bind_key(&mut keymap, &mut bound, "ctrl-e", "explode"),
+            Err(ConfigError::UnknownCommand("explode".into()))
+        );
+        assert_eq!(
+            bind_key(&mut keymap, &mut bound, "ctrl-sparkle", "save"),
+            Err(ConfigError::UnknownKey("keys.ctrl-sparkle".into()))
+        );
+    }
+
+    #[test]
+    fn test_set_color_mode() {
+        let mut config = EditorConfig::default();
+        assert_eq!(config.set("color_mode", "256"), Ok(()));
+        assert_eq!(config.color_mode(), ColorMode::Palette256);
+        assert_eq!(
+            config.set("color_mode", "88"),
+            Err(ConfigError::InvalidValue("color_mode".into()))
+        );
+        assert_eq!(config.set("color_mode", "auto"), Ok(()));
+        assert_eq!(config.color_mode, None);
+    }
+
+    #[test]
+    fn test_set_backup() {
+        let mut config = EditorConfig::default();
+        assert_eq!(config.backup, BackupMode::Off);
+        assert_eq!(config.set("backup", "numbered"), Ok(()));
+        assert_eq!(config.backup, BackupMode::Numbered);
+        assert_eq!(config.set("backup", "yes"), Err(ConfigError::InvalidValue("backup".into())));
+        assert_eq!(config.backup, BackupMode::Numbered);
+
+        assert_eq!(config.set("backup_dir", "/tmp/backups"), Ok(()));
+        assert_eq!(config.backup_dir.as_deref(), Some(Path::new("/tmp/backups")));
+        assert_eq!(config.set("backup_dir", ""), Ok(()));
+        assert_eq!(config.backup_dir, None);
+    }
+
+    #[test]
+    fn test_set_theme() {
+        let mut config = EditorConfig::default();
+        assert_eq!(config.set("theme", "light"), Ok(()));
+        assert_eq!(config.theme, Theme::LIGHT);
+        assert_eq!(config.set("theme.keyword", "#ff0000"), Ok(()));
+        assert_eq!(config.theme.syntax[0], ThemeColor::Rgb(0xff0000ff));
+        assert_eq!(
+            config.set("theme", "solarized"),
+            Err(ConfigError::InvalidValue("theme".into()))
+        );
+        assert_eq!(
+            config.set("theme.keyword", "#ff"),
+            Err(ConfigError::InvalidValue("theme.keyword".into()))
+        );
+        assert_eq!(
+            config.set("theme.bogus", "red"),
+            Err(ConfigError::UnknownKey("theme.bogus".into()))
+        );
+        assert_eq!(parse_line("theme.string = \"#98c379\""), Some(("theme.string", "#98c379")));
+    }
+}
@@ -1,16 +1,44 @@
 // Copyright (c) Microsoft Corporation.
 // Licensed under the MIT License.
 
-use std::collections::LinkedList;
-use std::ffi::OsStr;
-use std::fs::File;
-use std::path::{Path, PathBuf};
+use std::borrow::Cow;
+use std::ffi::{OsStr, OsString};
+use std::fs::{self, File, OpenOptions};
+use std::path::{Component, Path, PathBuf};
+use std::time::SystemTime;
+use std::{io, mem};
 
 use edit::buffer::{RcTextBuffer, TextBuffer};
-use edit::helpers::{CoordType, Point};
+use edit::helpers::{CoordType, MEBI, Point};
 use edit::{apperr, path, sys};
 
+use crate::config::{BackupMode, EditorConfig};
+use crate::history::{FileState, History};
+use crate::jumps::JumpList;
 use crate::state::DisplayablePathBuf;
+use crate::syntax_check::SyntaxCheck;
+
+/// Files at least this large are opened without word wrap and syntax highlighting.
+/// Both look at far more than the visible part of the file (word wrap measures
+/// every line on each resize), which makes huge files sluggish to view.
+/// They're also loaded piece by piece, one chunk per frame, see [`DocumentManager::load_pending`].
+const LARGE_FILE_THRESHOLD: usize = 64 * MEBI;
+/// How much of a large file is read per frame.
+const LOAD_CHUNK_SIZE: usize = 16 * MEBI;
+
+/// What another program did to a document's file, see [`Document::poll_disk_change`].
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub enum DiskChange {
+    Modified,
+    Deleted,
+}
+
+/// The part of a large file that hasn't been read yet.
+pub struct PendingLoad {
+    file: File,
+    len: usize,
+    loaded: usize,
+}
 
 pub struct Document {
     pub buffer: RcTextBuffer,
@@ -19,45 +47,165 @@ pub struct Document {
     pub filename: String,
     pub file_id: Option<sys::FileId>,
     pub new_file_counter: usize,
+    pub loading: Option<PendingLoad>,
+    /// Only Go files are checked for syntax errors.
+    pub syntax_check: Option<SyntaxCheck>,
+    pub jumps: JumpList,
+    /// When the file was last modified, as of the last time we read or wrote it.
+    /// `None` if it doesn't exist (yet).
+    modified: Option<SystemTime>,
+    /// Whether the user asked for the document to be read-only. Unlike [`TextBuffer::is_read_only`],
+    /// this doesn't change while the file is loading.
+    read_only: bool,
+    /// Whether reading the file failed before reaching its end. Saving the document
+    /// would cut the file off, so its buffer stays read-only until it's read again.
+    incomplete: bool,
 }
 
 impl Document {
+    pub fn is_read_only(&self) -> bool {
+        self.read_only
+    }
+
+    pub fn set_read_only(&mut self, read_only: bool) {
+        self.read_only = read_only;
+        if self.loading.is_none() {
+            self.buffer.borrow_mut().set_read_only(read_only || self.incomplete);
+        }
+    }
+
+    pub fn is_incomplete(&self) -> bool {
+        self.incomplete
+    }
+
     pub fn save(&mut self, new_path: Option<PathBuf>) -> apperr::Result<()> {
+        // Saving a partially loaded file would truncate it.
+        while self.load_next()? {}
+
         let path = new_path.as_deref().unwrap_or_else(|| self.path.as_ref().unwrap().as_path());
-        let mut file = DocumentManager::open_for_writing(path)?;
 
         {
             let mut tb = self.buffer.borrow_mut();
-            tb.write_file(&mut file)?;
+            // A read-only document is saved as it is shown.
+            if tb.trims_whitespace_on_save() && !self.read_only {
+                tb.trim_trailing_whitespace();
+            }
+            DocumentManager::write_atomically(path, |file| tb.write_file(file))?;
         }
 
         if let Ok(id) = sys::file_id(None, path) {
             self.file_id = Some(id);
         }
+        self.modified = disk_modified(path);
 
         if let Some(path) = new_path {
             self.set_path(path);
         }
 
+        // The saved file is exactly what's in the buffer, so nothing's missing anymore.
+        if self.incomplete {
+            self.incomplete = false;
+            self.set_read_only(self.read_only);
+        }
+
         Ok(())
     }
 
     pub fn reread(&mut self, encoding: Option<&'static str>) -> apperr::Result<()> {
         let path = self.path.as_ref().unwrap().as_path();
         let mut file = DocumentManager::open_for_reading(path)?;
+        let len = file.metadata().map_or(0, |m| m.len() as usize);
 
-        {
+        // Large files are loaded piece by piece again, just like when they were opened.
+        let limit = if len >= LARGE_FILE_THRESHOLD { LOAD_CHUNK_SIZE } else { usize::MAX };
+        let loaded = {
             let mut tb = self.buffer.borrow_mut();
-            tb.read_file(&mut file, encoding)?;
-        }
+            let more = tb.read_file_head(&mut file, encoding, limit)?;
+            tb.set_read_only(self.read_only || more);
+            more.then(|| tb.text_length())
+        };
+        self.loading = loaded.map(|loaded| PendingLoad { file, len, loaded });
+        self.incomplete = false;
 
         if let Ok(id) = sys::file_id(None, path) {
             self.file_id = Some(id);
         }
+        self.modified = disk_modified(path);
 
         Ok(())
     }
 
+    /// Rereads the file after another program changed it. Unlike [`Document::reread`],
+    /// this keeps the encoding and the cursor position, so that the view doesn't jump.
+    pub fn reload(&mut self) -> apperr::Result<()> {
+        let (pos, encoding) = {
+            let tb = self.buffer.borrow();
+            (tb.cursor_logical_pos(), tb.encoding())
+        };
+        self.reread(Some(encoding))?;
+        self.buffer.borrow_mut().cursor_move_to_logical(pos);
+        Ok(())
+    }
+
+    /// Checks whether another program modified or deleted the file
+    /// since we last read or wrote it. Each change is only reported once.
+    pub fn poll_disk_change(&mut self) -> Option<DiskChange> {
+        let path = self.path.as_ref()?;
+        if self.loading.is_some() {
+            return None;
+        }
+
+        let modified = disk_modified(path);
+        if modified == self.modified {
+            return None;
+        }
+
+        let previous = mem::replace(&mut self.modified, modified);
+        match modified {
+            Some(_) => Some(DiskChange::Modified),
+            None if previous.is_some() => Some(DiskChange::Deleted),
+            None => None,
+        }
+    }
+
+    /// Returns how much of the file has been loaded so far in percent,
+    /// or `None` if it has been loaded completely.
+    pub fn loading_progress(&self) -> Option<usize> {
+        let load = self.loading.as_ref()?;
+        Some((load.loaded * 100 / load.len.max(1)).min(99))
+    }
+
+    /// Reads the next chunk of a file that's still being loaded.
+    /// Returns true if there's more left to read.
+    fn load_next(&mut self) -> apperr::Result<bool> {
+        let Some(load) = &mut self.loading else {
+            return Ok(false);
+        };
+
+        let mut tb = self.buffer.borrow_mut();
+        let res = tb.read_file_append(&mut load.file, LOAD_CHUNK_SIZE);
+        let more = *res.as_ref().unwrap_or(&false);
+        load.loaded = tb.text_length();
+        if !more {
+            // Edits would've interfered with the appended text. Now they're fine,
+            // unless the rest of the file is missing.
+            self.incomplete = res.is_err();
+            tb.set_read_only(self.read_only || self.incomplete);
+            self.loading = None;
+        }
+        res
+    }
+
+    /// Where the cursor is, for the [`History`]. Untitled documents have none.
+    fn file_state(&self) -> Option<FileState> {
+        let tb = self.buffer.borrow();
+        Some(FileState {
+            path: self.path.clone()?,
+            cursor: tb.cursor_logical_pos(),
+            scroll: tb.scroll_y(),
+        })
+    }
+
     fn set_path(&mut self, path: PathBuf) {
         let filename = path.file_name().unwrap_or_default().to_string_lossy().into_owned();
         let dir = path.parent().map(ToOwned::to_owned).unwrap_or_default();
@@ -70,19 +218,31 @@ impl Document {
     fn update_file_mode(&mut self) {
         let mut tb = self.buffer.borrow_mut();
         tb.set_ruler(if self.filename == "COMMIT_EDITMSG" { 72 } else { 0 });
-        
-        // Set syntax highlighting based on file extension
-        if let Some(path) = &self.path {
-            if let Some(extension) = path.extension().and_then(|e| e.to_str()) {
-                tb.set_syntax_from_extension(extension);
-            }
+
+        let is_go =
+            self.path.as_ref().is_some_and(|path| path.extension().is_some_and(|ext| ext == "go"));
+        if is_go != self.syntax_check.is_some() {
+            self.syntax_check = is_go.then(SyntaxCheck::new);
+            tb.set_error_lines(Vec::new());
+        }
+
+        // Set syntax highlighting based on file extension or shebang
+        if let Some(path) = &self.path
+            && self.loading.is_none()
+            && tb.text_length() < LARGE_FILE_THRESHOLD
+        {
+            tb.detect_syntax(path.extension().and_then(|e| e.to_str()));
         }
     }
 }
 
 #[derive(Default)]
 pub struct DocumentManager {
-    list: LinkedList<Document>,
+    // Kept in tab order. `active` indexes into it.
+    list: Vec<Document>,
+    active: usize,
+    config: EditorConfig,
+    history: History,
 }
 
 impl DocumentManager {
@@ -93,50 +253,88 @@ impl DocumentManager {
 
     #[inline]
     pub fn active(&self) -> Option<&Document> {
-        self.list.front()
+        self.list.get(self.active)
     }
 
     #[inline]
     pub fn active_mut(&mut self) -> Option<&mut Document> {
-        self.list.front_mut()
+        self.list.get_mut(self.active)
     }
 
+    /// Activates the first document for which `func` returns true.
     #[inline]
-    pub fn update_active<F: FnMut(&Document) -> bool>(&mut self, mut func: F) -> bool {
-        let mut cursor = self.list.cursor_front_mut();
-        while let Some(doc) = cursor.current() {
-            if func(doc) {
-                let list = cursor.remove_current_as_list().unwrap();
-                self.list.cursor_front_mut().splice_before(list);
-                return true;
+    pub fn update_active<F: FnMut(&Document) -> bool>(&mut self, func: F) -> bool {
+        match self.list.iter().position(func) {
+            Some(index) => {
+                self.active = index;
+                true
             }
-            cursor.move_next();
+            None => false,
+        }
+    }
+
+    /// The settings that new documents are created with.
+    pub fn config(&self) -> &EditorConfig {
+        &self.config
+    }
+
+    pub fn set_config(&mut self, config: EditorConfig) {
+        self.config = config;
+    }
+
+    /// Where the cursor was in previously opened files, which also serves as the recent files list.
+    pub fn history(&self) -> &History {
+        &self.history
+    }
+
+    /// Files opened later get their cursor position restored from the history.
+    pub fn set_history(&mut self, history: History) {
+        self.history = history;
+    }
+
+    /// Records the cursor position of all open documents in the history and writes it to disk.
+    pub fn save_history(&mut self) -> apperr::Result<()> {
+        for doc in &self.list {
+            if let Some(state) = doc.file_state() {
+                self.history.remember(state);
+            }
+        }
+        self.history.save()
+    }
+
+    /// Reads the next chunk of every document that's still being loaded.
+    pub fn load_pending(&mut self) -> apperr::Result<()> {
+        for doc in &mut self.list {
+            doc.load_next()?;
         }
-        false
+        Ok(())
+    }
+
+    pub fn is_loading(&self) -> bool {
+        self.list.iter().any(|doc| doc.loading.is_some())
     }
 
     pub fn remove_active(&mut self) {
-        self.list.pop_front();
+        self.remove_at_index(self.active);
     }
 
     /// Get the index of the currently active document
     pub fn active_index(&self) -> usize {
-        0 // The active document is always at the front (index 0)
+        self.active
     }
 
     /// Set the active document by index
     pub fn set_active_index(&mut self, index: usize) {
-        if index >= self.list.len() {
-            return;
-        }
-        
-        let mut cursor = self.list.cursor_front_mut();
-        for _ in 0..index {
-            cursor.move_next();
+        if index < self.list.len() {
+            self.active = index;
         }
-        
-        if let Some(list) = cursor.remove_current_as_list() {
-            self.list.cursor_front_mut().splice_before(list);
+    }
+
+    /// Activates the next (`delta` > 0) or previous (`delta` < 0) tab, wrapping around.
+    pub fn cycle_active(&mut self, delta: isize) {
+        let len = self.list.len() as isize;
+        if len > 0 {
+            self.active = (self.active as isize + delta).rem_euclid(len) as usize;
         }
     }
 
@@ -145,13 +343,22 @@ impl DocumentManager {
         if index >= self.list.len() {
             return;
         }
-        
-        let mut cursor = self.list.cursor_front_mut();
-        for _ in 0..index {
-            cursor.move_next();
+
+        let doc = self.list.remove(index);
+        if let Some(state) = doc.file_state() {
+            self.history.remember(state);
         }
-        
-        cursor.remove_current();
+
+        // Keep the same document active, or if it was the one that got removed,
+        // activate the tab that took its place (or the last one).
+        if index < self.active {
+            self.active -= 1;
+        }
+        self.active = self.active.min(self.list.len().saturating_sub(1));
+    }
+
+    pub fn get_mut(&mut self, index: usize) -> Option<&mut Document> {
+        self.list.get_mut(index)
     }
 
     /// Get an iterator over all documents
@@ -160,7 +367,7 @@ impl DocumentManager {
     }
 
     pub fn add_untitled(&mut self) -> apperr::Result<&mut Document> {
-        let buffer = Self::create_buffer()?;
+        let buffer = self.create_buffer()?;
         let mut doc = Document {
             buffer,
             path: None,
@@ -168,11 +375,18 @@ impl DocumentManager {
             filename: Default::default(),
             file_id: None,
             new_file_counter: 0,
+            loading: None,
+            syntax_check: None,
+            jumps: JumpList::default(),
+            modified: None,
+            read_only: false,
+            incomplete: false,
         };
         self.gen_untitled_name(&mut doc);
 
-        self.list.push_front(doc);
-        Ok(self.list.front_mut().unwrap())
+        self.list.push(doc);
+        self.active = self.list.len() - 1;
+        Ok(&mut self.list[self.active])
     }
 
     pub fn gen_untitled_name(&self, doc: &mut Document) {
@@ -197,6 +411,8 @@ impl DocumentManager {
         };
 
         let file_id = if file.is_some() { Some(sys::file_id(file.as_ref(), &path)?) } else { None };
+        let modified =
+            file.as_ref().and_then(|file| file.metadata().and_then(|m| m.modified()).ok());
 
         // Check if the file is already open.
         if file_id.is_some() && self.update_active(|doc| doc.file_id == file_id) {
@@ -207,21 +423,40 @@ impl DocumentManager {
             return Ok(doc);
         }
 
-        let buffer = Self::create_buffer()?;
+        let buffer = self.create_buffer()?;
+        let mut loading = None;
         {
             if let Some(file) = &mut file {
                 let mut tb = buffer.borrow_mut();
-                tb.read_file(file, None)?;
+                let len = file.metadata().map_or(0, |m| m.len() as usize);
+                let large = len >= LARGE_FILE_THRESHOLD;
+                if large {
+                    // Must happen before reading, as the read reflows the buffer.
+                    tb.set_word_wrap(false);
+                    tb.set_bracket_highlight_enabled(false);
+                    tb.set_occurrence_highlight_enabled(false);
+                }
 
-                // Set syntax highlighting based on file extension
-                if let Some(extension) = path.extension().and_then(|e| e.to_str()) {
-                    tb.set_syntax_from_extension(extension);
+                // Large files are shown after reading the first chunk. The rest follows frame by frame.
+                let limit = if large { LOAD_CHUNK_SIZE } else { usize::MAX };
+                if tb.read_file_head(file, None, limit)? {
+                    tb.set_read_only(true);
+                    loading = Some((len, tb.text_length()));
                 }
 
-                if let Some(goto) = goto
-                    && goto != Default::default()
-                {
-                    tb.cursor_move_to_logical(goto);
+                if let Some(goto) = goto {
+                    if goto != Default::default() {
+                        tb.cursor_move_to_logical(goto);
+                    }
+                } else if let Some(state) = self.history.get(&path) {
+                    // If the file has shrunk since, the cursor gets clamped to its end
+                    // and the old scroll position is meaningless.
+                    tb.cursor_move_to_logical(state.cursor);
+                    if tb.cursor_logical_pos() == state.cursor {
+                        tb.scroll_to(state.scroll);
+                    } else {
+                        tb.make_cursor_visible();
+                    }
                 }
             }
         }
@@ -233,21 +468,34 @@ impl DocumentManager {
             filename: Default::default(),
             file_id,
             new_file_counter: 0,
+            loading: loading.zip(file).map(|((len, loaded), file)| PendingLoad {
+                file,
+                len,
+                loaded,
+            }),
+            syntax_check: None,
+            jumps: JumpList::default(),
+            modified,
+            read_only: false,
+            incomplete: false,
         };
+        self.history.touch(&path);
         doc.set_path(path);
 
-        if let Some(active) = self.active()
+        if let Some(active) = self.active_mut()
             && active.path.is_none()
             && active.file_id.is_none()
             && !active.buffer.borrow().is_dirty()
         {
             // If the current document is a pristine Untitled document with no
             // name and no ID, replace it with the new document.
-            self.remove_active();
+            *active = doc;
+        } else {
+            self.list.push(doc);
+            self.active = self.list.len() - 1;
         }
 
-        self.list.push_front(doc);
-        Ok(self.list.front_mut().unwrap())
+        Ok(&mut self.list[self.active])
     }
 
     pub fn reflow_all(&self) {
@@ -261,18 +509,108 @@ impl DocumentManager {
         File::open(path).map_err(apperr::Error::from)
     }
 
-    pub fn open_for_writing(path: &Path) -> apperr::Result<File> {
-        File::create(path).map_err(apperr::Error::from)
+    /// Writes the file via a temporary file in the same directory, which then replaces the original.
+    /// This way, the original stays intact if the write fails halfway, e.g. because the disk is full.
+    ///
+    /// The file is overwritten in place instead if the temporary file can't be created
+    /// (e.g. the directory isn't writable) or if it has other hard links, which replacing it would
+    /// detach from the new contents.
+    pub fn write_atomically(
+        path: &Path,
+        write: impl FnOnce(&mut File) -> apperr::Result<()>,
+    ) -> apperr::Result<()> {
+        // Replace the file that a symlink points to and not the symlink itself.
+        let path = match fs::symlink_metadata(path) {
+            Ok(metadata) if metadata.is_symlink() => Cow::Owned(sys::canonicalize(path)?),
+            _ => Cow::Borrowed(path),
+        };
+        let original = match fs::metadata(&path) {
+            Ok(metadata) => {
+                // Renaming would bypass the file's write protection, so we check that it's writable.
+                let file = OpenOptions::new().write(true).open(&path)?;
+                if sys::link_count(&file) > 1 {
+                    return Self::write_in_place(&path, write);
+                }
+                Some(metadata)
+            }
+            Err(err) if err.kind() == io::ErrorKind::NotFound => None,
+            Err(err) => return Err(err.into()),
+        };
+
+        let mut temp_name = OsString::from(".");
+        temp_name.push(path.file_name().unwrap_or_default());
+        temp_name.push(format!(".{}.tmp", std::process::id()));
+        let temp_path = path.with_file_name(temp_name);
+        let Ok(mut file) = OpenOptions::new().write(true).create_new(true).open(&temp_path) else {
+            return Self::write_in_place(&path, write);
+        };
+
+        let res = (|| {
+            if let Some(metadata) = &original {
+                file.set_permissions(metadata.permissions())?;
+                sys::copy_owner(&file, metadata);
+            }
+            write(&mut file)?;
+            file.sync_all()?;
+            drop(file);
+            fs::rename(&temp_path, &path)?;
+            Ok(())
+        })();
+
+        if res.is_err() {
+            _ = fs::remove_file(&temp_path);
+        }
+        res
     }
 
-    fn create_buffer() -> apperr::Result<RcTextBuffer> {
-        let buffer = TextBuffer::new_rc(false)?;
-        {
-            let mut tb = buffer.borrow_mut();
-            tb.set_insert_final_newline(!cfg!(windows)); // As mandated by POSIX.
-            tb.set_margin_enabled(true);
-            tb.set_line_highlight_enabled(true);
+    fn write_in_place(
+        path: &Path,
+        write: impl FnOnce(&mut File) -> apperr::Result<()>,
+    ) -> apperr::Result<()> {
+        let mut file = File::create(path)?;
+        write(&mut file)?;
+        file.sync_all()?;
+        Ok(())
+    }
+
+    /// Copies the file at `path` aside before it gets overwritten, as configured by
+    /// [`EditorConfig::backup`]. Does nothing if there's no file yet.
+    pub fn write_backup(&self, path: &Path) -> apperr::Result<()> {
+        if self.config.backup == BackupMode::Off || !path.is_file() {
+            return Ok(());
+        }
+
+        let (dir, mut name) = match &self.config.backup_dir {
+            Some(dir) => {
+                fs::create_dir_all(dir)?;
+                (Cow::Borrowed(dir.as_path()), backup_dir_file_name(path))
+            }
+            None => (
+                Cow::Owned(path.parent().map(ToOwned::to_owned).unwrap_or_default()),
+                path.file_name().unwrap_or_default().to_owned(),
+            ),
+        };
+
+        match self.config.backup {
+            BackupMode::Numbered => {
+                let mut number = 0;
+                for entry in fs::read_dir(&dir)?.flatten() {
+                    if let Some(n) = parse_backup_number(&entry.file_name(), &name) {
+                        number = number.max(n);
+                    }
+                }
+                name.push(format!(".~{}~", number + 1));
+            }
+            _ => name.push("~"),
         }
+
+        fs::copy(path, dir.join(name))?;
+        Ok(())
+    }
+
+    fn create_buffer(&self) -> apperr::Result<RcTextBuffer> {
+        let buffer = TextBuffer::new_rc(false)?;
+        self.config.apply(&mut buffer.borrow_mut());
         Ok(buffer)
     }
 
@@ -334,6 +672,33 @@ impl DocumentManager {
     }
 }
 
+fn disk_modified(path: &Path) -> Option<SystemTime> {
+    fs::metadata(path).and_then(|m| m.modified()).ok()
+}
+
+// Backups of files from different directories end up next to each other in the backup directory.
+// To keep them apart, the whole path goes into the name, with the separators replaced by "!".
+fn backup_dir_file_name(path: &Path) -> OsString {
+    let mut name = OsString::new();
+    for component in path.components() {
+        if let Component::Normal(part) = component {
+            name.push("!");
+            name.push(part);
+        }
+    }
+    name
+}
+
+// Returns N for a numbered backup "<name>.~N~" of the file `name`.
+fn parse_backup_number(backup: &OsStr, name: &OsStr) -> Option<u32> {
+    let rest = backup.as_encoded_bytes().strip_prefix(name.as_encoded_bytes())?;
+    let number = rest.strip_prefix(b".~")?.strip_suffix(b"~")?;
+    if !number.iter().all(u8::is_ascii_digit) {
+        return None;
+    }
+    str::from_utf8(number).ok()?.parse().ok()
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -364,4 +729,37 @@ mod tests {
         assert_eq!(parse("file.txt:10"), ("file.txt", Some(Point { x: 0, y: 9 })));
         assert_eq!(parse("file.txt:10:5"), ("file.txt", Some(Point { x: 4, y: 9 })));
     }
+
+    #[test]
+    fn test_backup_names() {
+        #[cfg(unix)]
+        assert_eq!(backup_dir_file_name(Path::new("/home/user/a.txt")), "!home!user!a.txt");
+
+        let number = |backup: &str| parse_backup_number(OsStr::new(backup), OsStr::new("a.txt"));
+        assert_eq!(number("a.txt.~1~"), Some(1));
+        assert_eq!(number("a.txt.~12~"), Some(12));
+        assert_eq!(number("a.txt~"), None);
+        assert_eq!(number("a.txt.~~"), None);
+        assert_eq!(number("a.txt.~+1~"), None);
+        assert_eq!(number("b.txt.~1~"), None);
+        assert_eq!(number("a.txt.~1~.~2~"), None);
+    }
+
+    #[test]
+    fn test_write_atomically_hard_link() {
+        use std::io::Write as _;
+
+        let dir = std::env::temp_dir().join(format!("edit-test-{}-links", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("a.txt");
+        let link = dir.join("b.txt");
+        fs::write(&path, "foo").unwrap();
+        fs::hard_link(&path, &link).unwrap();
+
+        // Both names still refer to the same file afterwards.
+        DocumentManager::write_atomically(&path, |file| Ok(file.write_all(b"bar")?)).unwrap();
+        let contents = fs::read_to_string(&link).unwrap();
+        fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(contents, "bar");
+    }
 }
@@ -1,16 +1,24 @@
 // Copyright (c) Microsoft Corporation.
 // Licensed under the MIT License.
 
+use std::mem;
 use std::num::ParseIntError;
+use std::path::Path;
+use std::rc::Rc;
 
+use edit::buffer::RcTextBuffer;
 use edit::framebuffer::IndexedColor;
 use edit::helpers::*;
-use edit::icu;
 use edit::input::{kbmod, vk};
 use edit::tui::*;
+use edit::{apperr, icu};
 
+use crate::config::{self, ConfigError, EditorConfig};
+use crate::documents::DocumentManager;
+use crate::keymap::Command;
 use crate::localization::*;
 use crate::state::*;
+use crate::{formatter, run_command};
 
 pub fn draw_editor(ctx: &mut Context, state: &mut State) {
     if !matches!(state.wants_search.kind, StateSearchKind::Hidden | StateSearchKind::Disabled) {
@@ -24,6 +32,9 @@ pub fn draw_editor(ctx: &mut Context, state: &mut State) {
         StateSearchKind::Replace => 6,
         _ => 3,
     };
+    if state.wants_command_prompt {
+        height_reduction += 1;
+    }
     
     // Add space for AI dock if visible
     if state.ai_dock_visible {
@@ -34,9 +45,18 @@ pub fn draw_editor(ctx: &mut Context, state: &mut State) {
         };
     }
 
+    if state.split.is_some() && state.documents.active().is_some() {
+        draw_split(ctx, state, size.height - height_reduction);
+        return;
+    }
+
     if let Some(doc) = state.documents.active() {
         ctx.textarea("textarea", doc.buffer.clone());
         ctx.inherit_focus();
+        if state.wants_editor_focus {
+            state.wants_editor_focus = false;
+            ctx.steal_focus();
+        }
     } else {
         ctx.block_begin("empty");
         ctx.block_end();
@@ -45,6 +65,216 @@ pub fn draw_editor(ctx: &mut Context, state: &mut State) {
     ctx.attr_intrinsic_size(Size { width: 0, height: size.height - height_reduction });
 }
 
+fn draw_split(ctx: &mut Context, state: &mut State, height: CoordType) {
+    let Some(split) = &mut state.split else {
+        return;
+    };
+    let Some(doc) = state.documents.active() else {
+        return;
+    };
+    let active = doc.buffer.clone();
+    split.wants_focus |= mem::take(&mut state.wants_editor_focus);
+
+    // If the document in the other pane was closed, it shows the active one instead.
+    if !state.documents.iter().any(|doc| Rc::ptr_eq(&doc.buffer, &split.other)) {
+        split.other = active.clone();
+        split.other_cursor = active.borrow().cursor_logical_pos();
+    }
+
+    let cursor = active.borrow().cursor_logical_pos();
+    let panes = match split.focused {
+        0 => [active.clone(), split.other.clone()],
+        _ => [split.other.clone(), active.clone()],
+    };
+    let mut clicked = None;
+
+    // The sizes are derived from the terminal size on every frame,
+    // so that they're redistributed when it's resized.
+    match split.direction {
+        SplitDirection::Vertical => {
+            let mut width = ctx.size().width;
+            if state.folder_browser_visible {
+                width -= state.folder_browser_width;
+            }
+            // Both panes get the same width, so that a document shown in both wraps the same way.
+            let pane_width = (width - 1).max(0) / 2;
+
+            ctx.table_begin("split");
+            ctx.table_set_columns(&[pane_width, pane_width]);
+            ctx.table_set_cell_gap(Size { width: width - 2 * pane_width, height: 0 });
+            ctx.table_next_row();
+            for (index, buffer) in panes.iter().enumerate() {
+                let size = Size { width: pane_width, height };
+                if draw_split_pane(ctx, split, &active, buffer, index, size) {
+                    clicked = Some(index);
+                }
+            }
+            ctx.table_end();
+        }
+        SplitDirection::Horizontal => {
+            let top_height = (height - 1).max(0) / 2;
+
+            ctx.block_begin("split");
+            {
+                let size = Size { width: 0, height: top_height };
+                if draw_split_pane(ctx, split, &active, &panes[0], 0, size) {
+                    clicked = Some(0);
+                }
+
+                // The separator tells which file the top pane shows.
+                let top = state.documents.iter().find(|doc| Rc::ptr_eq(&doc.buffer, &panes[0]));
+                ctx.label("separator", top.map_or("", |doc| doc.filename.as_str()));
+                ctx.attr_background_rgba(state.menubar_color_bg);
+                ctx.attr_foreground_rgba(state.menubar_color_fg);
+                ctx.attr_intrinsic_size(Size { width: COORD_TYPE_SAFE_MAX, height: 1 });
+                ctx.attr_padding(Rect::two(0, 1));
+
+                let size = Size { width: 0, height: height - top_height - 1 };
+                if draw_split_pane(ctx, split, &active, &panes[1], 1, size) {
+                    clicked = Some(1);
+                }
+            }
+            ctx.block_end();
+        }
+    }
+
+    // The user clicked into the other pane. Unlike with split_focus(), the click
+    // already placed the cursor, so only the previous position needs to be remembered.
+    if let Some(index) = clicked {
+        let other = mem::replace(&mut split.other, active);
+        split.other_cursor = cursor;
+        split.focused = index;
+        state.documents.update_active(|doc| Rc::ptr_eq(&doc.buffer, &other));
+        ctx.needs_rerender();
+    }
+}
+
+// Returns true if the pane isn't supposed to be focused, but has the focus anyway.
+fn draw_split_pane(
+    ctx: &mut Context,
+    split: &mut StateSplit,
+    active: &RcTextBuffer,
+    buffer: &RcTextBuffer,
+    index: usize,
+    size: Size,
+) -> bool {
+    const CLASSNAMES: [&str; 2] = ["pane-0", "pane-1"];
+
+    let focused = index == split.focused;
+    // If the other pane shows the active document too, it must not swallow
+    // the requests to scroll to the cursor, which are meant for the focused one.
+    let peek = !focused && Rc::ptr_eq(active, buffer);
+    let (visible, centered) = if peek {
+        let mut tb = buffer.borrow_mut();
+        (tb.take_cursor_visibility_request(), tb.take_cursor_center_request())
+    } else {
+        (false, false)
+    };
+
+    ctx.textarea(CLASSNAMES[index], buffer.clone());
+    ctx.attr_intrinsic_size(size);
+    if focused {
+        ctx.inherit_focus();
+        if split.wants_focus {
+            split.wants_focus = false;
+            ctx.steal_focus();
+        }
+    }
+    let stray_focus = !focused && !split.wants_focus && ctx.is_focused();
+
+    if centered {
+        buffer.borrow_mut().make_cursor_centered();
+    } else if visible {
+        buffer.borrow_mut().make_cursor_visible();
+    }
+    stray_focus
+}
+
+/// Splits the editor into two panes that both show the active document.
+/// If it's already split, only the direction changes.
+pub fn split_open(state: &mut State, direction: SplitDirection) {
+    if let Some(split) = &mut state.split {
+        split.direction = direction;
+        return;
+    }
+
+    let Some(doc) = state.documents.active() else {
+        return;
+    };
+    let other = doc.buffer.clone();
+    let other_cursor = other.borrow().cursor_logical_pos();
+    state.split = Some(StateSplit {
+        direction,
+        focused: 0,
+        other,
+        other_cursor,
+        wants_focus: true,
+        chord: false,
+    });
+}
+
+/// Moves the focus to the given pane, which makes its document the active one.
+pub fn split_focus(state: &mut State, index: usize) {
+    let Some(split) = &mut state.split else {
+        return;
+    };
+    let Some(doc) = state.documents.active() else {
+        return;
+    };
+    if index == split.focused {
+        return;
+    }
+
+    let buffer = doc.buffer.clone();
+    let cursor = buffer.borrow().cursor_logical_pos();
+    let other = mem::replace(&mut split.other, buffer.clone());
+    let other_cursor = mem::replace(&mut split.other_cursor, cursor);
+    split.focused = index;
+    split.wants_focus = true;
+
+    if Rc::ptr_eq(&other, &buffer) {
+        // Both panes show the same document, but each has its own cursor.
+        let mut tb = buffer.borrow_mut();
+        tb.clear_selection();
+        tb.clear_extra_cursors();
+        tb.cursor_move_to_logical(other_cursor);
+    } else {
+        state.documents.update_active(|doc| Rc::ptr_eq(&doc.buffer, &other));
+    }
+}
+
+/// Handles the key after the close shortcut while the editor is split, like Ctrl+W in vim:
+/// an arrow key (or h/j/k/l) focuses the pane in that direction, w the other pane,
+/// v and s change the direction of the split and q closes it.
+pub fn split_handle_chord(ctx: &mut Context, state: &mut State) {
+    let Some(key) = ctx.keyboard_input() else {
+        return;
+    };
+    let Some(split) = &mut state.split else {
+        return;
+    };
+    split.chord = false;
+    let other = 1 - split.focused;
+
+    if key == vk::LEFT || key == vk::UP || key == vk::H || key == vk::K {
+        split_focus(state, 0);
+    } else if key == vk::RIGHT || key == vk::DOWN || key == vk::L || key == vk::J {
+        split_focus(state, 1);
+    } else if key == vk::W || key == kbmod::CTRL | vk::W {
+        split_focus(state, other);
+    } else if key == vk::V {
+        split_open(state, SplitDirection::Vertical);
+    } else if key == vk::S {
+        split_open(state, SplitDirection::Horizontal);
+    } else if key == vk::Q || key == vk::C {
+        state.split = None;
+    }
+
+    // Any other key just cancels the chord.
+    ctx.set_input_consumed();
+    ctx.needs_rerender();
+}
+
 fn draw_search(ctx: &mut Context, state: &mut State) {
     if let Err(err) = icu::init() {
         error_log_add(ctx, state, err);
@@ -54,6 +284,7 @@ fn draw_search(ctx: &mut Context, state: &mut State) {
 
     let Some(doc) = state.documents.active() else {
         state.wants_search.kind = StateSearchKind::Hidden;
+        state.search_cursor_origin = None;
         return;
     };
 
@@ -64,6 +295,15 @@ fn draw_search(ctx: &mut Context, state: &mut State) {
         state.wants_search.focus = false;
         focus = StateSearchKind::Search;
 
+        if !state
+            .search_cursor_origin
+            .as_ref()
+            .is_some_and(|(buffer, _)| buffer.ptr_eq(&Rc::downgrade(&doc.buffer)))
+        {
+            let pos = doc.buffer.borrow().cursor_logical_pos();
+            state.search_cursor_origin = Some((Rc::downgrade(&doc.buffer), pos));
+        }
+
         // If the selection is empty, focus the search input field.
         // Otherwise, focus the replace input field, if it exists.
         if let Some(selection) = doc.buffer.borrow_mut().extract_user_selection(false) {
@@ -77,8 +317,32 @@ fn draw_search(ctx: &mut Context, state: &mut State) {
     ctx.attr_background_rgba(ctx.indexed(IndexedColor::White));
     ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::Black));
     {
-        if ctx.contains_focus() && ctx.consume_shortcut(vk::ESCAPE) {
-            state.wants_search.kind = StateSearchKind::Hidden;
+        if ctx.contains_focus() {
+            if ctx.consume_shortcut(vk::ESCAPE) {
+                state.wants_search.kind = StateSearchKind::Hidden;
+
+                // Cancelling the search returns the cursor to where it was before.
+                if let Some((buffer, pos)) = state.search_cursor_origin.take()
+                    && buffer.ptr_eq(&Rc::downgrade(&doc.buffer))
+                {
+                    let mut tb = doc.buffer.borrow_mut();
+                    tb.clear_selection();
+                    tb.cursor_move_to_logical(pos);
+                    tb.make_cursor_visible();
+                }
+            } else if ctx.consume_shortcut(kbmod::ALT | vk::C) {
+                state.search_options.match_case = !state.search_options.match_case;
+                action = Some(SearchAction::Search);
+            } else if state.wants_search.kind == StateSearchKind::Replace {
+                // Step through the hits with yes/no/all.
+                if ctx.consume_shortcut(kbmod::ALT | vk::Y) {
+                    action = Some(SearchAction::Replace);
+                } else if ctx.consume_shortcut(kbmod::ALT | vk::N) {
+                    action = Some(SearchAction::Search);
+                } else if ctx.consume_shortcut(kbmod::ALT | vk::A) {
+                    action = Some(SearchAction::ReplaceAll);
+                }
+            }
         }
 
         ctx.table_begin("needle");
@@ -99,8 +363,12 @@ fn draw_search(ctx: &mut Context, state: &mut State) {
                 if focus == StateSearchKind::Search {
                     ctx.steal_focus();
                 }
-                if ctx.is_focused() && ctx.consume_shortcut(vk::RETURN) {
-                    action = Some(SearchAction::Search);
+                if ctx.is_focused() {
+                    if ctx.consume_shortcut(vk::RETURN) {
+                        action = Some(SearchAction::Search);
+                    } else if ctx.consume_shortcut(kbmod::SHIFT | vk::RETURN) {
+                        action = Some(SearchAction::SearchPrevious);
+                    }
                 }
             }
 
@@ -147,11 +415,19 @@ fn draw_search(ctx: &mut Context, state: &mut State) {
                 loc(LocId::SearchUseRegex),
                 &mut state.search_options.use_regex,
             );
-            if state.wants_search.kind == StateSearchKind::Replace
-                && ctx.button("replace-all", loc(LocId::SearchReplaceAll), ButtonStyle::default())
-            {
-                change = true;
-                change_action = Some(SearchAction::ReplaceAll);
+            if state.wants_search.kind == StateSearchKind::Replace {
+                if ctx.button("replace", loc(LocId::SearchReplace), ButtonStyle::default()) {
+                    change = true;
+                    change_action = Some(SearchAction::Replace);
+                }
+                if ctx.button("skip", loc(LocId::SearchSkip), ButtonStyle::default()) {
+                    change = true;
+                    change_action = Some(SearchAction::Search);
+                }
+                if ctx.button("replace-all", loc(LocId::SearchReplaceAll), ButtonStyle::default()) {
+                    change = true;
+                    change_action = Some(SearchAction::ReplaceAll);
+                }
             }
             if ctx.button("close", loc(LocId::SearchClose), ButtonStyle::default()) {
                 state.wants_search.kind = StateSearchKind::Hidden;
@@ -167,6 +443,15 @@ fn draw_search(ctx: &mut Context, state: &mut State) {
     }
     ctx.block_end();
 
+    // However the search got closed, the origin is of no use anymore.
+    if state.wants_search.kind == StateSearchKind::Hidden {
+        state.search_cursor_origin = None;
+        doc.buffer.borrow_mut().find_finish();
+        state.search_no_matches = false;
+        ctx.needs_rerender();
+        return;
+    }
+
     if let Some(action) = action {
         search_execute(ctx, state, action);
     }
@@ -174,6 +459,7 @@ fn draw_search(ctx: &mut Context, state: &mut State) {
 
 pub enum SearchAction {
     Search,
+    SearchPrevious,
     Replace,
     ReplaceAll,
 }
@@ -183,16 +469,20 @@ pub fn search_execute(ctx: &mut Context, state: &mut State, action: SearchAction
         return;
     };
 
+    let mut tb = doc.buffer.borrow_mut();
+    let replace_all = matches!(action, SearchAction::ReplaceAll);
+
     state.search_success = match action {
-        SearchAction::Search => {
-            doc.buffer.borrow_mut().find_and_select(&state.search_needle, state.search_options)
+        SearchAction::Search => tb.find_and_select(&state.search_needle, state.search_options),
+        SearchAction::SearchPrevious => {
+            tb.find_and_select_prev(&state.search_needle, state.search_options)
         }
-        SearchAction::Replace => doc.buffer.borrow_mut().find_and_replace(
+        SearchAction::Replace => tb.find_and_replace(
             &state.search_needle,
             state.search_options,
             state.search_replacement.as_bytes(),
         ),
-        SearchAction::ReplaceAll => doc.buffer.borrow_mut().find_and_replace_all(
+        SearchAction::ReplaceAll => tb.find_and_replace_all(
             &state.search_needle,
             state.search_options,
             state.search_replacement.as_bytes(),
@@ -200,10 +490,48 @@ pub fn search_execute(ctx: &mut Context, state: &mut State, action: SearchAction
     }
     .is_ok();
 
+    if state.search_success {
+        doc.jumps.mark();
+    }
+
+    // A successful search leaves the hit selected.
+    state.search_no_matches = state.search_success
+        && !replace_all
+        && !state.search_needle.is_empty()
+        && !tb.has_selection();
+
     ctx.needs_rerender();
 }
 
 pub fn draw_handle_save(ctx: &mut Context, state: &mut State) {
+    // Saving a read-only document must be forced, so that it can't be overwritten by accident.
+    // The same goes for one that failed to load completely, as saving it cuts the file off.
+    let confirm = state.documents.active().filter(|doc| doc.path.is_some()).and_then(|doc| {
+        if doc.is_incomplete() {
+            Some(LocId::IncompleteSaveDescription)
+        } else if doc.is_read_only() {
+            Some(LocId::ReadOnlySaveDescription)
+        } else {
+            None
+        }
+    });
+    if let Some(description) = confirm {
+        match draw_read_only_save_confirm(ctx, description) {
+            None => return,
+            Some(false) => {
+                state.wants_save = false;
+                ctx.needs_rerender();
+                return;
+            }
+            Some(true) => {}
+        }
+    }
+
+    if let Some(path) = state.documents.active().and_then(|doc| doc.path.clone()) {
+        format_before_save(state, &path);
+        backup_before_save(state, &path);
+    }
+
     if let Some(doc) = state.documents.active_mut() {
         if doc.path.is_some() {
             if let Err(err) = doc.save(None) {
@@ -220,6 +548,115 @@ pub fn draw_handle_save(ctx: &mut Context, state: &mut State) {
     state.wants_save = false;
 }
 
+/// Asks whether a read-only document should be saved anyway, explaining why with `description`.
+/// Returns `None` as long as the user hasn't made a choice.
+fn draw_read_only_save_confirm(ctx: &mut Context, description: LocId) -> Option<bool> {
+    let mut choice = None;
+
+    ctx.modal_begin("read-only-save", loc(LocId::ReadOnlySaveTitle));
+    ctx.attr_background_rgba(ctx.indexed(IndexedColor::Red));
+    ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::BrightWhite));
+    {
+        let contains_focus = ctx.contains_focus();
+
+        ctx.label("description", loc(description));
+        ctx.attr_overflow(Overflow::TruncateTail);
+        ctx.attr_padding(Rect::three(1, 2, 1));
+
+        ctx.table_begin("choices");
+        ctx.inherit_focus();
+        ctx.attr_padding(Rect::three(0, 2, 1));
+        ctx.attr_position(Position::Center);
+        ctx.table_set_cell_gap(Size { width: 2, height: 0 });
+        {
+            ctx.table_next_row();
+            ctx.inherit_focus();
+
+            if ctx.button("yes", loc(LocId::Yes), ButtonStyle::default()) {
+                choice = Some(true);
+            }
+            ctx.inherit_focus();
+
+            if ctx.button("no", loc(LocId::No), ButtonStyle::default()) {
+                choice = Some(false);
+            }
+        }
+        ctx.table_end();
+
+        if contains_focus {
+            if ctx.consume_shortcut(vk::Y) {
+                choice = Some(true);
+            } else if ctx.consume_shortcut(vk::N) {
+                choice = Some(false);
+            }
+        }
+    }
+    if ctx.modal_end() {
+        choice = Some(false);
+    }
+
+    choice
+}
+
+/// Runs the configured formatter over the active document, if it's a Go file that is about to be saved
+/// under `path`. If the formatter fails, the buffer is left untouched and the error is shown instead.
+pub fn format_before_save(state: &mut State, path: &Path) {
+    let config = state.documents.config();
+    let tool = config.go_formatter;
+    if !config.go_format_on_save || path.extension().is_none_or(|ext| ext != "go") {
+        return;
+    }
+    let Some(doc) = state.documents.active() else {
+        return;
+    };
+    // A read-only document is saved as it is shown.
+    if doc.loading.is_some() || doc.is_read_only() {
+        return;
+    }
+
+    let res = {
+        let mut tb = doc.buffer.borrow_mut();
+        let mut input = Vec::with_capacity(tb.text_length());
+        loop {
+            let chunk = tb.read_forward(input.len());
+            if chunk.is_empty() {
+                break;
+            }
+            input.extend_from_slice(chunk);
+        }
+
+        formatter::run(tool, &input).map(|output| {
+            if !tb.is_crlf() {
+                tb.replace_all(&output);
+                return;
+            }
+            // The formatters emit LF newlines.
+            let mut crlf = Vec::with_capacity(output.len() + output.len() / 16);
+            for &b in &output {
+                if b == b'\n' {
+                    crlf.push(b'\r');
+                }
+                crlf.push(b);
+            }
+            tb.replace_all(&crlf);
+        })
+    };
+
+    if let Err(err) = res {
+        state.status_message =
+            loc(LocId::FormatterFailed).replace("{tool}", tool).replace("{error}", &err);
+    }
+}
+
+/// Backs up the file at `path` before it gets overwritten, if configured.
+/// The save goes ahead even if this fails. The user is only warned about it.
+pub fn backup_before_save(state: &mut State, path: &Path) {
+    if let Err(err) = state.documents.write_backup(path) {
+        let err = FormatApperr::from(err).to_string();
+        state.status_message = loc(LocId::BackupFailed).replace("{error}", &err);
+    }
+}
+
 pub fn draw_handle_wants_close(ctx: &mut Context, state: &mut State) {
     let Some(doc) = state.documents.active() else {
         state.wants_close = false;
@@ -248,7 +685,13 @@ pub fn draw_handle_wants_close(ctx: &mut Context, state: &mut State) {
         let contains_focus = ctx.contains_focus();
 
         ctx.label("description", loc(LocId::UnsavedChangesDialogDescription));
-        ctx.attr_padding(Rect::three(1, 2, 1));
+        ctx.attr_padding(Rect::three(1, 2, 0));
+
+        // When quitting with several modified documents, this tells them apart.
+        ctx.label("filename", &doc.filename);
+        ctx.attr_overflow(Overflow::TruncateMiddle);
+        ctx.attr_padding(Rect::three(0, 2, 1));
+        ctx.attr_position(Position::Center);
 
         ctx.table_begin("choices");
         ctx.inherit_focus();
@@ -274,16 +717,18 @@ pub fn draw_handle_wants_close(ctx: &mut Context, state: &mut State) {
             ) {
                 action = Action::Discard;
             }
-            if ctx.button("cancel", loc(LocId::Cancel), ButtonStyle::default()) {
+            if ctx.button("cancel", loc(LocId::Cancel), ButtonStyle::default().accelerator('C')) {
                 action = Action::Cancel;
             }
 
-            // Handle accelerator shortcuts
+            // Handle accelerator shortcuts. Y is accepted as an alias for S.
             if contains_focus {
-                if ctx.consume_shortcut(vk::S) {
+                if ctx.consume_shortcut(vk::S) || ctx.consume_shortcut(vk::Y) {
                     action = Action::Save;
                 } else if ctx.consume_shortcut(vk::N) {
                     action = Action::Discard;
+                } else if ctx.consume_shortcut(vk::C) {
+                    action = Action::Cancel;
                 }
             }
         }
@@ -311,10 +756,144 @@ pub fn draw_handle_wants_close(ctx: &mut Context, state: &mut State) {
     ctx.needs_rerender();
 }
 
+pub fn draw_dialog_disk_changed(ctx: &mut Context, state: &mut State) {
+    enum Action {
+        None,
+        Reload,
+        Keep,
+        Compare,
+    }
+    let mut action = Action::None;
+
+    let Some(buffer) = state.disk_changed.first().cloned() else {
+        return;
+    };
+    // If the document was closed in the meantime, there's nothing left to decide.
+    if !state.documents.update_active(|doc| Rc::ptr_eq(&doc.buffer, &buffer)) {
+        state.disk_changed.remove(0);
+        ctx.needs_rerender();
+        return;
+    }
+    let Some(doc) = state.documents.active() else {
+        return;
+    };
+
+    ctx.modal_begin("disk-changed", loc(LocId::DiskChangedTitle));
+    {
+        let contains_focus = ctx.contains_focus();
+
+        ctx.label("description", loc(LocId::DiskChangedDescription));
+        ctx.attr_padding(Rect::three(1, 2, 0));
+
+        ctx.label("filename", &doc.filename);
+        ctx.attr_overflow(Overflow::TruncateMiddle);
+        ctx.attr_padding(Rect::three(0, 2, 1));
+        ctx.attr_position(Position::Center);
+
+        ctx.table_begin("choices");
+        ctx.inherit_focus();
+        ctx.attr_padding(Rect::three(0, 2, 1));
+        ctx.attr_position(Position::Center);
+        ctx.table_set_cell_gap(Size { width: 2, height: 0 });
+        {
+            ctx.table_next_row();
+            ctx.inherit_focus();
+
+            if ctx.button(
+                "reload",
+                loc(LocId::DiskChangedReload),
+                ButtonStyle::default().accelerator('R'),
+            ) {
+                action = Action::Reload;
+            }
+            ctx.inherit_focus();
+            if ctx.button(
+                "keep",
+                loc(LocId::DiskChangedKeep),
+                ButtonStyle::default().accelerator('K'),
+            ) {
+                action = Action::Keep;
+            }
+            if ctx.button(
+                "compare",
+                loc(LocId::DiskChangedCompare),
+                ButtonStyle::default().accelerator('C'),
+            ) {
+                action = Action::Compare;
+            }
+
+            if contains_focus {
+                if ctx.consume_shortcut(vk::R) {
+                    action = Action::Reload;
+                } else if ctx.consume_shortcut(vk::K) {
+                    action = Action::Keep;
+                } else if ctx.consume_shortcut(vk::C) {
+                    action = Action::Compare;
+                }
+            }
+        }
+        ctx.table_end();
+    }
+    if ctx.modal_end() {
+        action = Action::Keep;
+    }
+
+    let result = match action {
+        Action::None => return,
+        Action::Reload => state.documents.active_mut().map_or(Ok(()), |doc| doc.reload()),
+        // The change on disk was already taken note of, so this just leaves the buffer alone.
+        Action::Keep => Ok(()),
+        Action::Compare => open_disk_version(state),
+    };
+    if let Err(err) = result {
+        error_log_add(ctx, state, err);
+    }
+
+    state.disk_changed.remove(0);
+    ctx.needs_rerender();
+}
+
+// Opens the file, as it's on disk, in a read-only tab
+// and shows it side by side with the active document.
+fn open_disk_version(state: &mut State) -> apperr::Result<()> {
+    let Some(doc) = state.documents.active() else {
+        return Ok(());
+    };
+    let Some(path) = doc.path.clone() else {
+        return Ok(());
+    };
+    let filename = format!("{} {}", doc.filename, loc(LocId::DiskChangedOnDisk));
+    let buffer = doc.buffer.clone();
+    let cursor = buffer.borrow().cursor_logical_pos();
+
+    let mut file = DocumentManager::open_for_reading(&path)?;
+    let disk = state.documents.add_untitled()?;
+    let result = {
+        let mut tb = disk.buffer.borrow_mut();
+        tb.detect_syntax(path.extension().and_then(|e| e.to_str()));
+        tb.read_file(&mut file, None)
+    };
+    if let Err(err) = result {
+        state.documents.remove_active();
+        return Err(err);
+    }
+    disk.filename = filename;
+    disk.set_read_only(true);
+
+    // The version on disk goes to the left, the one with the unsaved changes to the right.
+    state.split = None;
+    split_open(state, SplitDirection::Vertical);
+    if let Some(split) = &mut state.split {
+        split.other = buffer;
+        split.other_cursor = cursor;
+    }
+    Ok(())
+}
+
 pub fn draw_goto_menu(ctx: &mut Context, state: &mut State) {
     let mut done = false;
 
-    if let Some(doc) = state.documents.active_mut() {
+    if state.documents.active().is_some() {
         ctx.modal_begin("goto", loc(LocId::FileGoto));
         {
             if ctx.editline("goto-line", &mut state.goto_target) {
@@ -330,10 +909,8 @@ pub fn draw_goto_menu(ctx: &mut Context, state: &mut State) {
 
             if ctx.consume_shortcut(vk::RETURN) {
                 match validate_goto_point(&state.goto_target) {
-                    Ok(point) => {
-                        let mut buf = doc.buffer.borrow_mut();
-                        buf.cursor_move_to_logical(point);
-                        buf.make_cursor_visible();
+                    Ok((y, x)) => {
+                        goto_point(state, y, x);
                         done = true;
                     }
                     Err(_) => state.goto_invalid = true,
@@ -354,13 +931,267 @@ pub fn draw_goto_menu(ctx: &mut Context, state: &mut State) {
     }
 }
 
-fn validate_goto_point(line: &str) -> Result<Point, ParseIntError> {
-    let mut coords = [0; 2];
-    let (y, x) = line.split_once(':').unwrap_or((line, "0"));
-    // Using a loop here avoids 2 copies of the str->int code.
-    // This makes the binary more compact.
-    for (i, s) in [x, y].iter().enumerate() {
-        coords[i] = s.parse::<CoordType>()?.saturating_sub(1);
+// Moves the cursor of the active document to a point returned by validate_goto_point().
+fn goto_point(state: &mut State, y: CoordType, x: Option<CoordType>) {
+    let Some(doc) = state.documents.active() else {
+        return;
+    };
+
+    let mut buf = doc.buffer.borrow_mut();
+    let last = buf.logical_line_count() - 1;
+    let line = y.clamp(0, last);
+    if line != y && y != CoordType::MAX {
+        state.status_message =
+            loc(LocId::GotoLineClamped).replace("{line}", &(line + 1).to_string());
+    }
+
+    buf.cursor_move_to_logical(Point { x: x.unwrap_or(0), y: line });
+    if x.is_none() {
+        // Without a column, go to the first non-whitespace character.
+        let pos = buf.indent_end_logical_pos();
+        buf.cursor_move_to_logical(pos);
+    }
+    buf.make_cursor_centered();
+    doc.jumps.mark();
+}
+
+/// Commands that only exist in the command prompt, in addition to the ones from the keymap.
+const PROMPT_COMMANDS: [&str; 8] = ["w", "q", "wq", "set", "set!", "goto", "theme", "theme!"];
+
+/// How many lines the command prompt remembers for recall with the up arrow.
+const COMMAND_HISTORY_LIMIT: usize = 50;
+
+pub fn draw_command_prompt(ctx: &mut Context, state: &mut State) {
+    let mut done = false;
+
+    ctx.table_begin("command-prompt");
+    ctx.attr_focus_well();
+    ctx.attr_background_rgba(state.menubar_color_bg);
+    ctx.attr_foreground_rgba(state.menubar_color_fg);
+    ctx.table_set_cell_gap(Size { width: 1, height: 0 });
+    ctx.attr_intrinsic_size(Size { width: COORD_TYPE_SAFE_MAX, height: 1 });
+    ctx.attr_padding(Rect::two(0, 1));
+    {
+        ctx.table_next_row();
+        ctx.label("label", ":");
+
+        if ctx.editline("command", &mut state.command_prompt_text) {
+            state.command_prompt_invalid = false;
+        }
+        if state.command_prompt_invalid {
+            ctx.attr_background_rgba(ctx.indexed(IndexedColor::Red));
+            ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::BrightWhite));
+        }
+        ctx.attr_intrinsic_size(Size { width: COORD_TYPE_SAFE_MAX, height: 1 });
+        ctx.steal_focus();
+
+        if ctx.consume_shortcut(vk::RETURN) {
+            let line = state.command_prompt_text.trim().to_string();
+            command_history_add(state, &line);
+
+            // Macros record the line instead of the keys typed into the prompt.
+            let recording = state.macro_recording.is_some();
+            match run_command_line(ctx, state, &line) {
+                Ok(()) => {
+                    if recording {
+                        state.macro_record_prompt(Some(&line));
+                    }
+                    done = true;
+                }
+                Err(err) => {
+                    state.status_message = err.to_string();
+                    state.command_prompt_invalid = true;
+                }
+            }
+            ctx.needs_rerender();
+        } else if ctx.consume_shortcut(vk::ESCAPE) {
+            done = true;
+        } else if ctx.consume_shortcut(vk::TAB) {
+            complete_command(state);
+            ctx.needs_rerender();
+        } else if ctx.consume_shortcut(vk::UP) {
+            command_history_recall(state, -1);
+            ctx.needs_rerender();
+        } else if ctx.consume_shortcut(vk::DOWN) {
+            command_history_recall(state, 1);
+            ctx.needs_rerender();
+        }
+    }
+    ctx.table_end();
+
+    if done {
+        state.wants_command_prompt = false;
+        state.wants_editor_focus = true;
+        state.command_prompt_text.clear();
+        state.command_prompt_invalid = false;
+        ctx.needs_rerender();
+    }
+}
+
+fn command_history_add(state: &mut State, line: &str) {
+    if !line.is_empty() && state.command_history.last().is_none_or(|last| last != line) {
+        if state.command_history.len() >= COMMAND_HISTORY_LIMIT {
+            state.command_history.remove(0);
+        }
+        state.command_history.push(line.to_string());
+    }
+    state.command_history_index = state.command_history.len();
+}
+
+// Steps through the history. Stepping past the newest entry leaves an empty prompt.
+fn command_history_recall(state: &mut State, delta: isize) {
+    let len = state.command_history.len();
+    let index = state.command_history_index.saturating_add_signed(delta).min(len);
+    if index == state.command_history_index {
+        return;
+    }
+
+    state.command_history_index = index;
+    state.command_prompt_text = state.command_history.get(index).cloned().unwrap_or_default();
+    state.command_prompt_invalid = false;
+}
+
+// Completes the command name, as far as it's unambiguous. If several commands match,
+// they're listed on the status line.
+fn complete_command(state: &mut State) {
+    let prefix = state.command_prompt_text.trim_start();
+    if prefix.contains(' ') {
+        return;
+    }
+
+    let mut matches: Vec<&str> = PROMPT_COMMANDS
+        .iter()
+        .copied()
+        .chain(Command::names())
+        .filter(|name| name.starts_with(prefix))
+        .collect();
+    matches.sort_unstable();
+
+    let Some(&first) = matches.first() else {
+        state.status_message = ConfigError::UnknownCommand(prefix.to_string()).to_string();
+        return;
+    };
+
+    if matches.len() == 1 {
+        state.command_prompt_text = format!("{first} ");
+    } else {
+        let common = matches.iter().fold(first, |common, name| {
+            let len = common.bytes().zip(name.bytes()).take_while(|(a, b)| a == b).count();
+            &common[..len]
+        });
+        state.command_prompt_text = common.to_string();
+        state.status_message = matches.join(" ");
+    }
+}
+
+// Runs a line like "w", "set tab_size=2", "goto 120:5" or the name of a command from the keymap.
+pub fn run_command_line(
+    ctx: &mut Context,
+    state: &mut State,
+    line: &str,
+) -> Result<(), ConfigError> {
+    let line = line.strip_prefix(':').unwrap_or(line).trim();
+    let (name, args) = match line.split_once(char::is_whitespace) {
+        Some((name, args)) => (name, args.trim()),
+        None => (line, ""),
+    };
+    // Settings only apply to this session, unless "set!" or "theme!" saves them to the config file.
+    let (name, persist) = match name.strip_suffix('!') {
+        Some(name @ ("set" | "theme")) => (name, true),
+        _ => (name, false),
+    };
+
+    match name {
+        "" => {}
+        "w" => _ = run_command(ctx, state, Command::Save),
+        "q" => _ = run_command(ctx, state, Command::Exit),
+        "wq" => {
+            // Only exit if the save is going to happen right away and not need a dialog first.
+            let save_now = state
+                .documents
+                .active()
+                .is_some_and(|doc| doc.path.is_some() && !doc.is_read_only());
+            _ = run_command(ctx, state, Command::Save);
+            if save_now {
+                _ = run_command(ctx, state, Command::Exit);
+            }
+        }
+        "set" => {
+            let Some((key, value)) = config::parse_line(args) else {
+                return Err(ConfigError::SetUsage);
+            };
+            let key = match key {
+                "tabwidth" | "ts" => "tab_size",
+                _ => key,
+            };
+            set_option(ctx, state, key, value, persist)?;
+        }
+        "goto" => {
+            let invalid = || ConfigError::InvalidValue(name.to_string());
+            let (y, x) = validate_goto_point(args).map_err(|_| invalid())?;
+            goto_point(state, y, x);
+        }
+        "theme" => set_option(ctx, state, "theme", args, persist)?,
+        // "play_macro 5" plays the macro 5 times.
+        "play_macro" if !args.is_empty() => {
+            let count = args
+                .parse::<usize>()
+                .ok()
+                .filter(|&count| count > 0)
+                .ok_or_else(|| ConfigError::InvalidValue(name.to_string()))?;
+            if run_command(ctx, state, Command::PlayMacro) && state.wants_macro_playback != 0 {
+                state.wants_macro_playback = count;
+            }
+        }
+        _ => {
+            let command = Command::from_name(name)
+                .ok_or_else(|| ConfigError::UnknownCommand(name.to_string()))?;
+            _ = run_command(ctx, state, command);
+        }
+    }
+    Ok(())
+}
+
+// Changes a setting for this session. With `persist`, it's also written back to the config file.
+fn set_option(
+    ctx: &mut Context,
+    state: &mut State,
+    key: &str,
+    value: &str,
+    persist: bool,
+) -> Result<(), ConfigError> {
+    let mut config = state.documents.config().clone();
+    config.set(key, value)?;
+    ctx.set_theme(config.theme);
+    ctx.set_color_mode(config.color_mode());
+
+    if let Some(doc) = state.documents.active() {
+        config.apply_setting(key, &mut doc.buffer.borrow_mut());
+    }
+    state.documents.set_config(config);
+
+    if persist && let Err(err) = EditorConfig::write_back(key, value) {
+        error_log_add(ctx, state, err);
     }
-    Ok(Point { x: coords[0], y: coords[1] })
+    Ok(())
+}
+
+// Parses "line[:column]" into a 0-based line and column. The column is optional.
+// A leading ":" is allowed (":42") and "$" stands for the last line (CoordType::MAX).
+fn validate_goto_point(line: &str) -> Result<(CoordType, Option<CoordType>), ParseIntError> {
+    let line = line.trim();
+    let line = line.strip_prefix(':').unwrap_or(line);
+    let (y, x) = match line.split_once(':') {
+        Some((y, x)) => (y, Some(x)),
+        None => (line, None),
+    };
+    let y = match y {
+        "$" => CoordType::MAX,
+        _ => y.parse::<CoordType>()?.saturating_sub(1),
+    };
+    let x = match x {
+        Some(x) => Some(x.parse::<CoordType>()?.saturating_sub(1).max(0)),
+        None => None,
+    };
+    Ok((y, x))
 }
@@ -2,24 +2,35 @@
 // Licensed under the MIT License.
 
 use std::cmp::Ordering;
+use std::ffi::OsStr;
 use std::fs;
 use std::path::{Path, PathBuf};
 
 use edit::arena::scratch_arena;
-use edit::framebuffer::IndexedColor;
+use edit::framebuffer::{Attributes, IndexedColor};
 use edit::helpers::*;
 use edit::input::{kbmod, vk};
 use edit::tui::*;
 use edit::{icu, path};
 
+use crate::draw_editor::{backup_before_save, format_before_save};
 use crate::localization::*;
 use crate::state::*;
 
 pub fn draw_file_picker(ctx: &mut Context, state: &mut State) {
-    // The save dialog is pre-filled with the current document filename.
+    // The save dialog is pre-filled with the current document's directory and filename.
     if state.wants_file_picker == StateFilePicker::SaveAs {
         state.wants_file_picker = StateFilePicker::SaveAsShown;
 
+        if let Some(dir) = state.documents.active().and_then(|doc| doc.dir.as_ref())
+            && dir.as_path() != state.file_picker_pending_dir.as_path()
+        {
+            state.file_picker_pending_dir = dir.clone();
+            state.file_picker_pending_dir_revision =
+                state.file_picker_pending_dir_revision.wrapping_add(1);
+            state.file_picker_entries = None;
+        }
+
         if state.file_picker_pending_name.as_os_str().is_empty() {
             state.file_picker_pending_name =
                 state.documents.active().map_or("Untitled.txt", |doc| doc.filename.as_str()).into();
@@ -64,6 +75,11 @@ pub fn draw_file_picker(ctx: &mut Context, state: &mut State) {
             let name_changed = ctx.editline("name", &mut state.file_picker_pending_name);
             ctx.inherit_focus();
 
+            if ctx.is_focused() && ctx.consume_shortcut(vk::TAB) {
+                complete_path(state);
+                ctx.needs_rerender();
+            }
+
             if ctx.contains_focus() {
                 if name_changed && ctx.is_focused() {
                     update_autocomplete_suggestions(state);
@@ -179,12 +195,11 @@ pub fn draw_file_picker(ctx: &mut Context, state: &mut State) {
         if activated {
             doit = draw_file_picker_update_path(state);
 
-            // Check if the file already exists and show an overwrite warning in that case.
-            if state.wants_file_picker != StateFilePicker::Open
-                && let Some(path) = doit.as_deref()
-                && path.exists()
+            // Saving over an existing file and opening a file that doesn't exist need confirmation.
+            if let Some(path) = doit.as_deref()
+                && path.exists() != (state.wants_file_picker == StateFilePicker::Open)
             {
-                state.file_picker_overwrite_warning = doit.take();
+                state.file_picker_confirm = doit.take();
             }
         }
     }
@@ -192,16 +207,27 @@ pub fn draw_file_picker(ctx: &mut Context, state: &mut State) {
         done = true;
     }
 
-    if state.file_picker_overwrite_warning.is_some() {
+    if state.file_picker_confirm.is_some() {
         let mut save;
 
-        ctx.modal_begin("overwrite", loc(LocId::FileOverwriteWarning));
-        ctx.attr_background_rgba(ctx.indexed(IndexedColor::Red));
-        ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::BrightWhite));
+        if state.wants_file_picker == StateFilePicker::Open {
+            ctx.modal_begin("create", loc(LocId::FileCreatePrompt));
+        } else {
+            ctx.modal_begin("overwrite", loc(LocId::FileOverwriteWarning));
+            ctx.attr_background_rgba(ctx.indexed(IndexedColor::Red));
+            ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::BrightWhite));
+        }
         {
             let contains_focus = ctx.contains_focus();
 
-            ctx.label("description", loc(LocId::FileOverwriteWarningDescription));
+            ctx.label(
+                "description",
+                loc(if state.wants_file_picker == StateFilePicker::Open {
+                    LocId::FileCreatePromptDescription
+                } else {
+                    LocId::FileOverwriteWarningDescription
+                }),
+            );
             ctx.attr_overflow(Overflow::TruncateTail);
             ctx.attr_padding(Rect::three(1, 2, 1));
 
@@ -218,7 +244,7 @@ pub fn draw_file_picker(ctx: &mut Context, state: &mut State) {
                 ctx.inherit_focus();
 
                 if ctx.button("no", loc(LocId::No), ButtonStyle::default()) {
-                    state.file_picker_overwrite_warning = None;
+                    state.file_picker_confirm = None;
                 }
             }
             ctx.table_end();
@@ -226,26 +252,26 @@ pub fn draw_file_picker(ctx: &mut Context, state: &mut State) {
             if contains_focus {
                 save |= ctx.consume_shortcut(vk::Y);
                 if ctx.consume_shortcut(vk::N) {
-                    state.file_picker_overwrite_warning = None;
+                    state.file_picker_confirm = None;
                 }
             }
         }
         if ctx.modal_end() {
-            state.file_picker_overwrite_warning = None;
+            state.file_picker_confirm = None;
         }
 
         if save {
-            doit = state.file_picker_overwrite_warning.take();
+            doit = state.file_picker_confirm.take();
         }
     }
 
     if let Some(path) = doit {
         let res = if state.wants_file_picker == StateFilePicker::Open {
             state.documents.add_file_path(&path).map(|_| ())
-        } else if let Some(doc) = state.documents.active_mut() {
-            doc.save(Some(path))
         } else {
-            Ok(())
+            format_before_save(state, &path);
+            backup_before_save(state, &path);
+            state.documents.active_mut().map_or(Ok(()), |doc| doc.save(Some(path)))
         };
         match res {
             Ok(..) => {
@@ -260,7 +286,7 @@ pub fn draw_file_picker(ctx: &mut Context, state: &mut State) {
         state.wants_file_picker = StateFilePicker::None;
         state.file_picker_pending_name = Default::default();
         state.file_picker_entries = Default::default();
-        state.file_picker_overwrite_warning = Default::default();
+        state.file_picker_confirm = Default::default();
         state.file_picker_autocomplete = Default::default();
     }
 }
@@ -268,7 +294,7 @@ pub fn draw_file_picker(ctx: &mut Context, state: &mut State) {
 // Returns Some(path) if the path refers to a file.
 fn draw_file_picker_update_path(state: &mut State) -> Option<PathBuf> {
     let old_path = state.file_picker_pending_dir.as_path();
-    let path = old_path.join(&state.file_picker_pending_name);
+    let path = old_path.join(path::expand_home(&state.file_picker_pending_name));
     let path = path::normalize(&path);
 
     let (dir, name) = if path.is_dir() {
@@ -406,3 +432,147 @@ fn update_autocomplete_suggestions(state: &mut State) {
 
     state.file_picker_autocomplete = matches;
 }
+
+/// Completes the last component of the typed path against the file system, like a shell would.
+/// A unique match is filled in entirely. Otherwise, the longest common prefix of
+/// all matches is filled in and the matches are offered as suggestions.
+fn complete_path(state: &mut State) {
+    let typed = state.file_picker_pending_name.clone();
+    let ends_with_separator = typed
+        .as_os_str()
+        .as_encoded_bytes()
+        .last()
+        .is_some_and(|&c| std::path::is_separator(c as char));
+    let (dir, prefix) = if typed.as_os_str().is_empty() || ends_with_separator {
+        (typed.as_path(), OsStr::new(""))
+    } else {
+        match (typed.parent(), typed.file_name()) {
+            (Some(dir), Some(name)) => (dir, name),
+            _ => return,
+        }
+    };
+    let prefix = prefix.as_encoded_bytes();
+
+    let dir_path = state.file_picker_pending_dir.as_path().join(path::expand_home(dir));
+    let Ok(iter) = fs::read_dir(dir_path) else {
+        return;
+    };
+    let mut matches: Vec<_> = iter
+        .flatten()
+        .filter(|entry| entry.file_name().as_encoded_bytes().starts_with(prefix))
+        .map(|entry| {
+            let mut name = entry.file_name();
+            if fs::metadata(entry.path()).is_ok_and(|m| m.is_dir()) {
+                name.push("/");
+            }
+            name
+        })
+        .collect();
+    matches.sort_by(|a, b| icu::compare_strings(a.as_encoded_bytes(), b.as_encoded_bytes()));
+
+    let Some(first) = matches.first() else {
+        return;
+    };
+    let first = first.as_encoded_bytes();
+    let mut len = matches.iter().fold(first.len(), |len, name| {
+        first[..len].iter().zip(name.as_encoded_bytes()).take_while(|(a, b)| a == b).count()
+    });
+    // Don't cut a multi-byte character in half.
+    while len < first.len() && (first[len] & 0xc0) == 0x80 {
+        len -= 1;
+    }
+    // SAFETY: `first` is a valid `OsStr` and `len` is at a character boundary.
+    let common = unsafe { OsStr::from_encoded_bytes_unchecked(&first[..len]) };
+
+    state.file_picker_pending_name = dir.join(common);
+    state.file_picker_autocomplete = if matches.len() > 1 {
+        matches.iter().take(5).map(|name| DisplayablePathBuf::from_path(dir.join(name))).collect()
+    } else {
+        Vec::new()
+    };
+}
+
+pub fn draw_recent_files(ctx: &mut Context, state: &mut State) {
+    if state.recent_files.is_none() {
+        draw_recent_files_refresh(state);
+    }
+
+    let mut open = None;
+
+    ctx.modal_begin("recent-files", loc(LocId::FileRecent));
+    {
+        let width = (ctx.size().width - 20).max(10);
+        let height = (ctx.size().height - 10).max(10);
+
+        ctx.scrollarea_begin("scrollarea", Size { width, height });
+        ctx.attr_background_rgba(ctx.indexed_alpha(IndexedColor::Black, 1, 4));
+        ctx.inherit_focus();
+        {
+            let files = state.recent_files.as_ref().unwrap();
+            if files.is_empty() {
+                ctx.label("empty", loc(LocId::FileRecentEmpty));
+                ctx.attr_padding(Rect::two(0, 2));
+            }
+
+            ctx.list_begin("files");
+            ctx.inherit_focus();
+
+            for file in files {
+                ctx.styled_list_item_begin();
+                ctx.attr_overflow(Overflow::TruncateTail);
+                if !file.exists {
+                    ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::BrightBlack));
+                }
+                ctx.styled_label_add_text(&file.filename);
+                ctx.styled_label_add_text("   ");
+                ctx.styled_label_set_attributes(Attributes::Italic);
+                ctx.styled_label_add_text(file.dir.as_str());
+
+                if ctx.styled_list_item_end(false) == ListSelection::Activated {
+                    open = Some(file.path.clone());
+                }
+            }
+
+            ctx.list_end();
+        }
+        ctx.scrollarea_end();
+    }
+    let mut done = ctx.modal_end();
+
+    // Files that no longer exist are opened anyway, as a new file under the same name.
+    if let Some(path) = open {
+        match state.documents.add_file_path(&path) {
+            Ok(..) => {
+                ctx.needs_rerender();
+                done = true;
+            }
+            Err(err) => error_log_add(ctx, state, err),
+        }
+    }
+
+    if done {
+        state.wants_recent_files = false;
+        state.recent_files = None;
+    }
+}
+
+fn draw_recent_files_refresh(state: &mut State) {
+    let files = state
+        .documents
+        .history()
+        .entries()
+        .iter()
+        .map(|entry| {
+            let path = entry.path.clone();
+            let filename = path.file_name().unwrap_or_default().to_string_lossy().into_owned();
+            let dir = path.parent().map(ToOwned::to_owned).unwrap_or_default();
+            StateRecentFile {
+                filename,
+                dir: DisplayablePathBuf::from_path(dir),
+                exists: path.is_file(),
+                path,
+            }
+        })
+        .collect();
+    state.recent_files = Some(files);
+}
@@ -2,10 +2,13 @@
 // Licensed under the MIT License.
 
 use edit::arena_format;
+use edit::buffer::MoveLineDirection;
 use edit::helpers::*;
 use edit::input::{kbmod, vk};
 use edit::tui::*;
 
+use crate::draw_editor::split_open;
+use crate::keymap::Command;
 use crate::localization::*;
 use crate::state::*;
 
@@ -38,24 +41,49 @@ pub fn draw_menubar(ctx: &mut Context, state: &mut State) {
 }
 
 fn draw_menu_file(ctx: &mut Context, state: &mut State) {
-    if ctx.menubar_menu_button(loc(LocId::FileNew), 'N', kbmod::CTRL | vk::N) {
+    if ctx.menubar_menu_button(loc(LocId::FileNew), 'N', state.keymap.shortcut(Command::New)) {
         draw_add_untitled_document(ctx, state);
     }
-    if ctx.menubar_menu_button(loc(LocId::FileOpen), 'O', kbmod::CTRL | vk::O) {
+    if ctx.menubar_menu_button(loc(LocId::FileOpen), 'O', state.keymap.shortcut(Command::Open)) {
         state.wants_file_picker = StateFilePicker::Open;
     }
+    if ctx.menubar_menu_button(
+        loc(LocId::FileRecent),
+        'R',
+        state.keymap.shortcut(Command::RecentFiles),
+    ) {
+        state.wants_recent_files = true;
+    }
     if state.documents.active().is_some() {
-        if ctx.menubar_menu_button(loc(LocId::FileSave), 'S', kbmod::CTRL | vk::S) {
+        if ctx.menubar_menu_button(loc(LocId::FileSave), 'S', state.keymap.shortcut(Command::Save))
+        {
             state.wants_save = true;
         }
-        if ctx.menubar_menu_button(loc(LocId::FileSaveAs), 'A', vk::NULL) {
+        if ctx.menubar_menu_button(
+            loc(LocId::FileSaveAs),
+            'A',
+            state.keymap.shortcut(Command::SaveAs),
+        ) {
             state.wants_file_picker = StateFilePicker::SaveAs;
         }
-        if ctx.menubar_menu_button(loc(LocId::FileClose), 'C', kbmod::CTRL | vk::W) {
+        if state.documents.active().is_some_and(|doc| doc.path.is_some())
+            && ctx.menubar_menu_button(
+                loc(LocId::FileReopenWithEncoding),
+                'E',
+                state.keymap.shortcut(Command::ReopenWithEncoding),
+            )
+        {
+            state.wants_encoding_change = StateEncodingChange::Reopen;
+        }
+        if ctx.menubar_menu_button(
+            loc(LocId::FileClose),
+            'C',
+            state.keymap.shortcut(Command::Close),
+        ) {
             state.wants_close = true;
         }
     }
-    if ctx.menubar_menu_button(loc(LocId::FileExit), 'X', kbmod::CTRL | vk::Q) {
+    if ctx.menubar_menu_button(loc(LocId::FileExit), 'X', state.keymap.shortcut(Command::Exit)) {
         state.wants_exit = true;
     }
     ctx.menubar_menu_end();
@@ -82,15 +110,34 @@ fn draw_menu_edit(ctx: &mut Context, state: &mut State) {
         ctx.needs_rerender();
     }
     if ctx.menubar_menu_button(loc(LocId::EditPaste), 'P', kbmod::CTRL | vk::V) {
+        if let Some(system_clipboard) = &state.system_clipboard {
+            system_clipboard.read_into(ctx.clipboard_mut());
+        }
         tb.paste(ctx.clipboard_ref());
         ctx.needs_rerender();
     }
+    if ctx.menubar_menu_button(
+        loc(LocId::EditPasteReindented),
+        'I',
+        state.keymap.shortcut(Command::PasteReindented),
+    ) {
+        if let Some(system_clipboard) = &state.system_clipboard {
+            system_clipboard.read_into(ctx.clipboard_mut());
+        }
+        tb.paste_reindented(ctx.clipboard_ref());
+        ctx.needs_rerender();
+    }
     if state.wants_search.kind != StateSearchKind::Disabled {
-        if ctx.menubar_menu_button(loc(LocId::EditFind), 'F', kbmod::CTRL | vk::F) {
+        if ctx.menubar_menu_button(loc(LocId::EditFind), 'F', state.keymap.shortcut(Command::Find))
+        {
             state.wants_search.kind = StateSearchKind::Search;
             state.wants_search.focus = true;
         }
-        if ctx.menubar_menu_button(loc(LocId::EditReplace), 'L', kbmod::CTRL | vk::R) {
+        if ctx.menubar_menu_button(
+            loc(LocId::EditReplace),
+            'L',
+            state.keymap.shortcut(Command::Replace),
+        ) {
             state.wants_search.kind = StateSearchKind::Replace;
             state.wants_search.focus = true;
         }
@@ -99,6 +146,35 @@ fn draw_menu_edit(ctx: &mut Context, state: &mut State) {
         tb.select_all();
         ctx.needs_rerender();
     }
+    if ctx.menubar_menu_button(
+        loc(LocId::EditMatchingBracket),
+        'B',
+        state.keymap.shortcut(Command::MatchingBracket),
+    ) {
+        if tb.jump_to_matching_bracket() {
+            tb.make_cursor_visible();
+            doc.jumps.mark();
+        } else {
+            state.status_message = loc(LocId::NoMatchingBracket).to_string();
+            state.command_failed = true;
+        }
+        ctx.needs_rerender();
+    }
+    if ctx.menubar_menu_button(loc(LocId::EditToggleComment), 'M', kbmod::CTRL | vk::OEM_2) {
+        tb.toggle_line_comment();
+        ctx.needs_rerender();
+    }
+    if ctx.menubar_menu_button(loc(LocId::EditDuplicateLines), 'D', kbmod::ALT_SHIFT | vk::DOWN) {
+        tb.duplicate_selected_lines(MoveLineDirection::Down);
+        tb.make_cursor_visible();
+        ctx.needs_rerender();
+    }
+    if ctx.menubar_menu_button(loc(LocId::EditAddNextOccurrence), 'N', kbmod::CTRL | vk::D) {
+        if tb.add_cursor_at_next_occurrence() {
+            tb.make_cursor_visible();
+        }
+        ctx.needs_rerender();
+    }
     ctx.menubar_menu_end();
 }
 
@@ -111,21 +187,140 @@ fn draw_menu_view(ctx: &mut Context, state: &mut State) {
         if ctx.menubar_menu_button(loc(LocId::ViewFocusStatusbar), 'S', vk::NULL) {
             state.wants_statusbar_focus = true;
         }
-        if ctx.menubar_menu_button(loc(LocId::ViewGoToFile), 'F', kbmod::CTRL | vk::P) {
+        if ctx.menubar_menu_button(
+            loc(LocId::ViewGoToFile),
+            'F',
+            state.keymap.shortcut(Command::GoToFile),
+        ) {
             state.wants_go_to_file = true;
         }
-        if ctx.menubar_menu_button(loc(LocId::FileGoto), 'G', kbmod::CTRL | vk::G) {
+        if ctx.menubar_menu_button(
+            loc(LocId::FileGoto),
+            'G',
+            state.keymap.shortcut(Command::GotoLine),
+        ) {
             state.wants_goto = true;
         }
+        if ctx.menubar_menu_button(
+            loc(LocId::ViewToggleFold),
+            'K',
+            state.keymap.shortcut(Command::ToggleFold),
+        ) {
+            if tb.toggle_fold() {
+                tb.make_cursor_visible();
+            } else {
+                state.status_message = loc(LocId::NoFoldRegion).to_string();
+                state.command_failed = true;
+            }
+            ctx.needs_rerender();
+        }
+        if ctx.menubar_menu_button(
+            loc(LocId::ViewUnfoldAll),
+            'A',
+            state.keymap.shortcut(Command::UnfoldAll),
+        ) {
+            tb.unfold_all();
+            ctx.needs_rerender();
+        }
         if ctx.menubar_menu_checkbox(loc(LocId::ViewWordWrap), 'W', kbmod::ALT | vk::Z, word_wrap) {
             tb.set_word_wrap(!word_wrap);
             ctx.needs_rerender();
         }
+        let margin = tb.is_margin_enabled();
+        let relative = margin && tb.is_margin_relative();
+        // Not showing the cycle_line_numbers shortcut, because it cycles through both checkboxes.
+        if ctx.menubar_menu_checkbox(loc(LocId::ViewLineNumbers), 'L', vk::NULL, margin) {
+            tb.set_margin_enabled(!margin);
+            ctx.needs_rerender();
+        }
+        if ctx.menubar_menu_checkbox(loc(LocId::ViewRelativeLineNumbers), 'R', vk::NULL, relative) {
+            tb.set_margin_enabled(true);
+            tb.set_margin_relative(!relative);
+            ctx.needs_rerender();
+        }
+        let brackets = tb.is_bracket_highlight_enabled();
+        if ctx.menubar_menu_checkbox(loc(LocId::ViewBracketHighlight), 'B', vk::NULL, brackets) {
+            tb.set_bracket_highlight_enabled(!brackets);
+            ctx.needs_rerender();
+        }
+        let occurrences = tb.is_occurrence_highlight_enabled();
+        if ctx.menubar_menu_checkbox(
+            loc(LocId::ViewOccurrenceHighlight),
+            'U',
+            vk::NULL,
+            occurrences,
+        ) {
+            tb.set_occurrence_highlight_enabled(!occurrences);
+            ctx.needs_rerender();
+        }
+        let whitespace = tb.is_whitespace_visible();
+        if ctx.menubar_menu_checkbox(
+            loc(LocId::ViewShowWhitespace),
+            'E',
+            state.keymap.shortcut(Command::ToggleWhitespace),
+            whitespace,
+        ) {
+            tb.set_whitespace_visible(!whitespace);
+            ctx.needs_rerender();
+        }
+        let read_only = doc.is_read_only();
+        let toggle_read_only =
+            ctx.menubar_menu_checkbox(loc(LocId::ViewReadOnly), 'D', vk::NULL, read_only);
+        if ctx.menubar_menu_button(
+            loc(LocId::ViewCommandPrompt),
+            'C',
+            state.keymap.shortcut(Command::Prompt),
+        ) {
+            state.wants_command_prompt = true;
+        }
+        let split = state.split.as_ref().map(|split| split.direction);
+        let mut wants_split = None;
+        if ctx.menubar_menu_checkbox(
+            loc(LocId::ViewSplitVertical),
+            'V',
+            state.keymap.shortcut(Command::SplitVertical),
+            split == Some(SplitDirection::Vertical),
+        ) {
+            wants_split = Some(SplitDirection::Vertical);
+        }
+        if ctx.menubar_menu_checkbox(
+            loc(LocId::ViewSplitHorizontal),
+            'H',
+            state.keymap.shortcut(Command::SplitHorizontal),
+            split == Some(SplitDirection::Horizontal),
+        ) {
+            wants_split = Some(SplitDirection::Horizontal);
+        }
+        if ctx.menubar_menu_button(loc(LocId::ViewSetOption), 'O', vk::NULL) {
+            state.wants_command_prompt = true;
+            state.command_prompt_text = "set ".to_string();
+        }
+
+        // The document applies the flag to its buffer, which is still borrowed here.
+        // The same goes for splitting, which reads the cursor position.
+        drop(tb);
+        if toggle_read_only && let Some(doc) = state.documents.active_mut() {
+            doc.set_read_only(!read_only);
+            ctx.needs_rerender();
+        }
+        // Picking the current direction again closes the split.
+        if let Some(direction) = wants_split {
+            if split == Some(direction) {
+                state.split = None;
+            } else {
+                split_open(state, direction);
+            }
+            ctx.needs_rerender();
+        }
     }
     
     // AI Assistant menu item
     if !state.ai_dock_visible {
-        if ctx.menubar_menu_button("Open AI Assistant", 'I', kbmod::CTRL_ALT | vk::B) {
+        if ctx.menubar_menu_button(
+            "Open AI Assistant",
+            'I',
+            state.keymap.shortcut(Command::ToggleAiDock),
+        ) {
             state.ai_dock_visible = true;
             state.ai_dock_size = AiDockSize::Default;
             ctx.needs_rerender();
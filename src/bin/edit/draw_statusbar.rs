@@ -26,7 +26,15 @@ pub fn draw_statusbar(ctx: &mut Context, state: &mut State) {
 
         ctx.table_next_row();
 
-        if ctx.button("newline", if tb.is_crlf() { "CRLF" } else { "LF" }, ButtonStyle::default()) {
+        let mut newline = if tb.is_crlf() { "CRLF" } else { "LF" };
+        let newline_buf;
+        if tb.has_mixed_newlines() {
+            // Until the file is saved, remind the user that it had mixed newlines.
+            newline_buf = arena_format!(ctx.arena(), "{} ({})", newline, loc(LocId::NewlinesMixed));
+            newline = &newline_buf;
+        }
+
+        if ctx.button("newline", newline, ButtonStyle::default()) {
             let is_crlf = tb.is_crlf();
             tb.normalize_newlines(!is_crlf);
         }
@@ -147,16 +155,68 @@ pub fn draw_statusbar(ctx: &mut Context, state: &mut State) {
             }
         }
 
+        if let Some(language) = tb.syntax_language() {
+            ctx.label("language", language.name);
+        }
+
+        if doc.is_read_only() {
+            ctx.label("read-only", loc(LocId::ViewReadOnly));
+        }
+
+        if state.macro_count != 0 {
+            ctx.label("macro-count", &arena_format!(ctx.arena(), "{}×", state.macro_count));
+        }
+
+        if state.macro_recording.is_some() {
+            ctx.label("recording", loc(LocId::MacroRecording));
+            ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::BrightRed));
+        }
+
+        if state.search_no_matches {
+            ctx.label("no-matches", loc(LocId::SearchNoMatches));
+            ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::BrightRed));
+        }
+
+        if let Some(percent) = doc.loading_progress() {
+            ctx.label(
+                "loading",
+                &loc(LocId::LoadingProgress).replace("{percent}", &percent.to_string()),
+            );
+        }
+
+        if !state.status_message.is_empty() {
+            ctx.label("message", &state.status_message);
+            ctx.attr_overflow(Overflow::TruncateTail);
+            ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::BrightYellow));
+        } else if let Some(message) =
+            doc.syntax_check.as_ref().and_then(|check| check.message(tb.cursor_logical_pos().y))
+        {
+            ctx.label("syntax-error", message);
+            ctx.attr_overflow(Overflow::TruncateTail);
+            ctx.attr_foreground_rgba(ctx.indexed(IndexedColor::BrightRed));
+        }
+
+        // The column is where the cursor is displayed, so that it matches other editors and compilers
+        // when tabs are involved, and not where it is in terms of characters.
         ctx.label(
             "location",
             &arena_format!(
                 ctx.arena(),
                 "{}:{}",
                 tb.cursor_logical_pos().y + 1,
-                tb.cursor_logical_pos().x + 1
+                tb.cursor_display_column() + 1
             ),
         );
 
+        let lines = tb.logical_line_count();
+        let percent = (tb.cursor_logical_pos().y + 1) * 100 / lines.max(1);
+        ctx.label(
+            "line-count",
+            &loc(LocId::StatusbarLineCount)
+                .replace("{lines}", &lines.to_string())
+                .replace("{percent}", &percent.to_string()),
+        );
+
         #[cfg(feature = "debug-latency")]
         ctx.label(
             "stats",
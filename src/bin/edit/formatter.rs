@@ -0,0 +1,36 @@
+// Copyright (c) Pavel Sich.
+// Licensed under the MIT License.
+
+//! Formatting documents with external tools, like `gofmt`, before they're saved.
+
+use std::io::Write as _;
+use std::process::{Command, Stdio};
+use std::thread;
+
+/// Pipes `input` through `program` and returns its output.
+/// If the tool fails, e.g. due to a syntax error, the error is the first line it printed.
+pub fn run(program: &str, input: &[u8]) -> Result<Vec<u8>, String> {
+    let mut child = Command::new(program)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .map_err(|err| err.to_string())?;
+
+    // The input is written from another thread. Otherwise, we'd deadlock
+    // if the tool fills up the stdout pipe before it has read all of its input.
+    let mut stdin = child.stdin.take().unwrap();
+    let output = thread::scope(|scope| {
+        scope.spawn(move || stdin.write_all(input));
+        child.wait_with_output()
+    })
+    .map_err(|err| err.to_string())?;
+
+    if output.status.success() {
+        return Ok(output.stdout);
+    }
+
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    let message = stderr.lines().map(str::trim).find(|line| !line.is_empty());
+    Err(message.map_or_else(|| output.status.to_string(), ToOwned::to_owned))
+}
@@ -0,0 +1,213 @@
+// Copyright (c) Pavel Sich.
+// Licensed under the MIT License.
+
+//! Remembers where the cursor was in each file across sessions.
+//! The same list, being sorted by last use, doubles as the recent files list.
+//!
+//! The history is stored in `history` next to the config file, one file per line,
+//! most recently used first: `<line> <column> <scroll> <path>`. All numbers are 0-based.
+//! Only the [`HISTORY_LIMIT`] most recently used files are kept.
+//!
+//! Several instances of the editor may run at once. Saving merges the files used in this
+//! session into the history on disk, instead of overwriting what the others saved.
+
+use std::collections::HashSet;
+use std::{fs, process};
+use std::path::{Path, PathBuf};
+
+use edit::apperr;
+use edit::helpers::{CoordType, Point};
+
+use crate::config::EditorConfig;
+
+/// How many files are remembered at most. The least recently used ones are forgotten first.
+const HISTORY_LIMIT: usize = 1000;
+
+#[derive(Clone)]
+pub struct FileState {
+    pub path: PathBuf,
+    /// The logical cursor position.
+    pub cursor: Point,
+    /// The first visible (visual) line.
+    pub scroll: CoordType,
+}
+
+#[derive(Default)]
+pub struct History {
+    // Most recently used first.
+    entries: Vec<FileState>,
+    // The files that were remembered or touched since loading.
+    changed: HashSet<PathBuf>,
+}
+
+impl History {
+    /// Returns the path to the history file, which lives next to the config file.
+    pub fn path() -> Option<PathBuf> {
+        Some(EditorConfig::path()?.with_file_name("history"))
+    }
+
+    /// Reads the history file. A missing or unreadable file results in an empty history.
+    pub fn load() -> Self {
+        let text = Self::path().and_then(|path| fs::read_to_string(path).ok());
+        text.map_or_else(Self::default, |text| Self::parse(&text))
+    }
+
+    pub fn save(&self) -> apperr::Result<()> {
+        let Some(path) = Self::path() else {
+            return Ok(());
+        };
+        if let Some(parent) = path.parent() {
+            fs::create_dir_all(parent)?;
+        }
+
+        let mut merged =
+            fs::read_to_string(&path).map_or_else(|_| Self::default(), |text| Self::parse(&text));
+        merged.merge(self);
+
+        // Written to a temporary file first, so that a crash can't leave a truncated history behind.
+        let temp = path.with_file_name(format!("history.{}.tmp", process::id()));
+        fs::write(&temp, merged.serialize())?;
+        if let Err(err) = fs::rename(&temp, &path) {
+            _ = fs::remove_file(&temp);
+            return Err(err.into());
+        }
+        Ok(())
+    }
+
+    /// Returns the remembered files, most recently used first.
+    pub fn entries(&self) -> &[FileState] {
+        &self.entries
+    }
+
+    pub fn get(&self, path: &Path) -> Option<&FileState> {
+        self.entries.iter().find(|entry| entry.path == path)
+    }
+
+    /// Adds or updates the entry for a file and makes it the most recently used one.
+    pub fn remember(&mut self, state: FileState) {
+        self.changed.insert(state.path.clone());
+        self.entries.retain(|entry| entry.path != state.path);
+        self.entries.insert(0, state);
+        self.entries.truncate(HISTORY_LIMIT);
+    }
+
+    /// Makes the file the most recently used one, keeping its state or adding it if it's new.
+    pub fn touch(&mut self, path: &Path) {
+        match self.entries.iter().position(|entry| entry.path == path) {
+            Some(index) => {
+                self.changed.insert(path.to_path_buf());
+                self.entries[..=index].rotate_right(1);
+            }
+            None => self.remember(FileState {
+                path: path.to_path_buf(),
+                cursor: Default::default(),
+                scroll: 0,
+            }),
+        }
+    }
+
+    // Lines that can't be parsed are skipped.
+    fn parse(text: &str) -> Self {
+        let mut entries = Vec::new();
+
+        for line in text.lines() {
+            let mut parts = line.splitn(4, ' ');
+            let mut number = || parts.next()?.parse::<CoordType>().ok();
+            let (Some(y), Some(x), Some(scroll)) = (number(), number(), number()) else {
+                continue;
+            };
+            let Some(path) = parts.next().filter(|path| !path.is_empty()) else {
+                continue;
+            };
+            entries.push(FileState { path: PathBuf::from(path), cursor: Point { x, y }, scroll });
+        }
+
+        entries.truncate(HISTORY_LIMIT);
+        Self { entries, changed: HashSet::new() }
+    }
+
+    // Puts the files that `other` changed in front, in its order, and keeps the rest.
+    fn merge(&mut self, other: &Self) {
+        self.entries.retain(|entry| !other.changed.contains(&entry.path));
+        let changed = other.entries.iter().filter(|entry| other.changed.contains(&entry.path));
+        self.entries.splice(0..0, changed.cloned());
+        self.entries.truncate(HISTORY_LIMIT);
+    }
+
+    fn serialize(&self) -> String {
+        let mut text = String::new();
+        for entry in &self.entries {
+            // Paths that aren't valid UTF-8 or contain a newline can't be written down.
+            let Some(path) = entry.path.to_str().filter(|path| !path.contains('\n')) else {
+                continue;
+            };
+            let Point { x, y } = entry.cursor;
+            text.push_str(&format!("{y} {x} {} {path}\n", entry.scroll));
+        }
+        text
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse() {
+        let history =
+            History::parse("12 4 3 /tmp/some file.txt\nbogus\n1 2 /missing/scroll\n0 0 0 \n");
+        assert_eq!(history.entries.len(), 1);
+
+        let entry = history.get(Path::new("/tmp/some file.txt")).unwrap();
+        assert_eq!(entry.cursor, Point { x: 4, y: 12 });
+        assert_eq!(entry.scroll, 3);
+        assert_eq!(history.serialize(), "12 4 3 /tmp/some file.txt\n");
+    }
+
+    #[test]
+    fn test_remember() {
+        let mut history = History::default();
+        let state = |path: &str, y| FileState {
+            path: PathBuf::from(path),
+            cursor: Point { x: 0, y },
+            scroll: 0,
+        };
+
+        for i in 0..HISTORY_LIMIT + 1 {
+            history.remember(state(&format!("/{i}"), 0));
+        }
+        assert_eq!(history.entries.len(), HISTORY_LIMIT);
+        assert!(history.get(Path::new("/0")).is_none());
+
+        // Remembering a file again moves it to the front instead of adding a duplicate.
+        history.remember(state("/1", 5));
+        assert_eq!(history.entries.len(), HISTORY_LIMIT);
+        assert_eq!(history.entries[0].path, Path::new("/1"));
+        assert_eq!(history.get(Path::new("/1")).unwrap().cursor.y, 5);
+
+        history.touch(Path::new("/3"));
+        assert_eq!(history.entries().len(), HISTORY_LIMIT);
+        assert_eq!(history.entries()[0].path, Path::new("/3"));
+        assert_eq!(history.entries()[1].path, Path::new("/1"));
+
+        history.touch(Path::new("/new"));
+        assert_eq!(history.entries()[0].path, Path::new("/new"));
+        assert!(history.get(Path::new("/1")).is_some());
+    }
+
+    #[test]
+    fn test_merge() {
+        // Another instance saved "/a" and "/b" after this one loaded "/b" and "/c".
+        let mut disk = History::parse("1 0 0 /a\n2 0 0 /b\n3 0 0 /c\n");
+        let mut ours = History::parse("5 0 0 /b\n3 0 0 /c\n");
+        ours.remember(FileState {
+            path: PathBuf::from("/d"),
+            cursor: Point { x: 0, y: 4 },
+            scroll: 0,
+        });
+        ours.touch(Path::new("/c"));
+
+        disk.merge(&ours);
+        assert_eq!(disk.serialize(), "3 0 0 /c\n4 0 0 /d\n1 0 0 /a\n2 0 0 /b\n");
+    }
+}
@@ -0,0 +1,158 @@
+// Copyright (c) Pavel Sich.
+// Licensed under the MIT License.
+
+//! The jump list: where the cursor was before it jumped, so that it can go back there.
+//!
+//! Instead of every command pushing onto the list, [`JumpList::track`] is called once per
+//! frame and compares the cursor position with that of the last frame. Moves across
+//! [`JUMP_MIN_LINES`] or more count as jumps, no matter what caused them.
+//! Commands like goto line mark their shorter moves with [`JumpList::mark`].
+//!
+//! The positions aren't updated when the text is edited.
+//! Instead, they're clamped to the text when jumping back to them.
+
+use std::cell::Cell;
+
+use edit::helpers::{CoordType, Point};
+
+/// The oldest positions are forgotten beyond this.
+const CAPACITY: usize = 100;
+/// Cursor moves across this many lines are jumps.
+const JUMP_MIN_LINES: CoordType = 10;
+
+/// The jump list of a single document.
+#[derive(Default)]
+pub struct JumpList {
+    // Sorted by age. Each line is in the list only once, like in vim.
+    entries: Vec<Point>,
+    // The entry `back` and `forward` step from. `entries.len()` while they're not in use.
+    index: usize,
+    // The cursor position as of the last `track` call.
+    last: Option<Point>,
+    // Whether the next move is a jump, regardless of its distance.
+    marked: Cell<bool>,
+}
+
+impl JumpList {
+    /// Records the move from the last position to `pos`, if it was a jump.
+    pub fn track(&mut self, pos: Point) {
+        let marked = self.marked.replace(false);
+        if let Some(last) = self.last
+            && last != pos
+            && (marked || (pos.y - last.y).abs() >= JUMP_MIN_LINES)
+        {
+            self.push(last);
+        }
+        self.last = Some(pos);
+    }
+
+    /// Marks the cursor move that happens during this frame as a jump.
+    pub fn mark(&self) {
+        self.marked.set(true);
+    }
+
+    /// Must be called once the cursor moved to a position returned by
+    /// [`JumpList::back`] or [`JumpList::forward`], so that it isn't tracked as a new jump.
+    pub fn arrived(&mut self, pos: Point) {
+        self.marked.set(false);
+        self.last = Some(pos);
+    }
+
+    /// Returns the position before the one the cursor jumped to last.
+    /// `current` is remembered, so that [`JumpList::forward`] can come back to it.
+    pub fn back(&mut self, current: Point) -> Option<Point> {
+        if self.index == self.entries.len() {
+            self.insert(current);
+            self.index = self.entries.len() - 1;
+        }
+        self.entries[..self.index].iter().rposition(|p| p.y != current.y).map(|i| {
+            self.index = i;
+            self.entries[i]
+        })
+    }
+
+    /// Undoes [`JumpList::back`].
+    pub fn forward(&mut self, current: Point) -> Option<Point> {
+        let start = (self.index + 1).min(self.entries.len());
+        self.entries[start..].iter().position(|p| p.y != current.y).map(|i| {
+            self.index = start + i;
+            self.entries[self.index]
+        })
+    }
+
+    // A new jump forgets the positions that were stepped back over.
+    fn push(&mut self, pos: Point) {
+        self.entries.truncate(self.index);
+        self.insert(pos);
+        self.index = self.entries.len();
+    }
+
+    fn insert(&mut self, pos: Point) {
+        self.entries.retain(|p| p.y != pos.y);
+        if self.entries.len() >= CAPACITY {
+            self.entries.remove(0);
+        }
+        self.entries.push(pos);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn pt(y: CoordType) -> Point {
+        Point { x: 0, y }
+    }
+
+    fn list(lines: &[CoordType]) -> JumpList {
+        let mut jumps = JumpList::default();
+        for &y in lines {
+            jumps.track(pt(y));
+        }
+        jumps
+    }
+
+    #[test]
+    fn test_track() {
+        // Short moves aren't jumps, unless marked.
+        let mut jumps = list(&[0, 1, 2, 50, 52]);
+        jumps.mark();
+        jumps.track(pt(53));
+        assert_eq!(jumps.entries, [pt(2), pt(52)]);
+
+        // Each line is only in the list once.
+        jumps.track(pt(2));
+        jumps.track(pt(40));
+        assert_eq!(jumps.entries, [pt(52), pt(53), pt(2)]);
+
+        let mut jumps = JumpList::default();
+        for y in 0..=CAPACITY as CoordType + 1 {
+            jumps.track(pt(y * JUMP_MIN_LINES));
+        }
+        assert_eq!(jumps.entries.len(), CAPACITY);
+        assert_eq!(jumps.entries[0], pt(JUMP_MIN_LINES));
+    }
+
+    #[test]
+    fn test_back_forward() {
+        let mut jumps = list(&[0, 20, 40]);
+        assert_eq!(jumps.back(pt(40)), Some(pt(20)));
+        jumps.arrived(pt(20));
+        assert_eq!(jumps.back(pt(20)), Some(pt(0)));
+        jumps.arrived(pt(0));
+        assert_eq!(jumps.back(pt(0)), None);
+        assert_eq!(jumps.forward(pt(0)), Some(pt(20)));
+        jumps.arrived(pt(20));
+        assert_eq!(jumps.forward(pt(20)), Some(pt(40)));
+        jumps.arrived(pt(40));
+        assert_eq!(jumps.forward(pt(40)), None);
+
+        // Jumping after going back forgets the way forward.
+        assert_eq!(jumps.back(pt(40)), Some(pt(20)));
+        jumps.arrived(pt(20));
+        jumps.track(pt(80));
+        assert_eq!(jumps.entries, [pt(0), pt(20)]);
+        assert_eq!(jumps.forward(pt(80)), None);
+        assert_eq!(jumps.back(pt(80)), Some(pt(20)));
+    }
+}
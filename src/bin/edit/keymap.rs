@@ -0,0 +1,259 @@
+// Copyright (c) Pavel Sich.
+// Licensed under the MIT License.
+
+//! Maps keyboard shortcuts to named commands.
+//!
+//! Only the application-wide shortcuts go through the keymap. The keys for editing text,
+//! like Ctrl+Z or Ctrl+C, are handled by the text area itself and can't be rebound.
+//!
+//! In the config file, a binding is written as `keys.<shortcut> = <command>`,
+//! e.g. `keys.ctrl-s = save`. Binding a shortcut to `none` removes it.
+
+use edit::input::{InputKey, kbmod, vk};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Command {
+    New,
+    Open,
+    Save,
+    SaveAs,
+    ReopenWithEncoding,
+    Close,
+    CloseTab,
+    GoToFile,
+    RecentFiles,
+    Exit,
+    GotoLine,
+    RecordMacro,
+    PlayMacro,
+    PasteReindented,
+    MatchingBracket,
+    JumpBack,
+    JumpForward,
+    ToggleFold,
+    UnfoldAll,
+    CycleLineNumbers,
+    ToggleWhitespace,
+    Find,
+    Replace,
+    FindNext,
+    FindPrevious,
+    NextTab,
+    PreviousTab,
+    ActivateTab(usize),
+    ToggleAiDock,
+    ToggleFolderBrowser,
+    Prompt,
+    SplitVertical,
+    SplitHorizontal,
+    CloseSplit,
+}
+
+/// The names of all commands, as used in the config file.
+const COMMANDS: [(&str, Command); 42] = [
+    ("new", Command::New),
+    ("open", Command::Open),
+    ("save", Command::Save),
+    ("save_as", Command::SaveAs),
+    ("reopen_with_encoding", Command::ReopenWithEncoding),
+    ("close", Command::Close),
+    ("close_tab", Command::CloseTab),
+    ("go_to_file", Command::GoToFile),
+    ("recent_files", Command::RecentFiles),
+    ("exit", Command::Exit),
+    ("goto_line", Command::GotoLine),
+    ("record_macro", Command::RecordMacro),
+    ("play_macro", Command::PlayMacro),
+    ("paste_reindented", Command::PasteReindented),
+    ("matching_bracket", Command::MatchingBracket),
+    ("jump_back", Command::JumpBack),
+    ("jump_forward", Command::JumpForward),
+    ("toggle_fold", Command::ToggleFold),
+    ("unfold_all", Command::UnfoldAll),
+    ("cycle_line_numbers", Command::CycleLineNumbers),
+    ("toggle_whitespace", Command::ToggleWhitespace),
+    ("find", Command::Find),
+    ("replace", Command::Replace),
+    ("find_next", Command::FindNext),
+    ("find_previous", Command::FindPrevious),
+    ("next_tab", Command::NextTab),
+    ("previous_tab", Command::PreviousTab),
+    ("tab_1", Command::ActivateTab(0)),
+    ("tab_2", Command::ActivateTab(1)),
+    ("tab_3", Command::ActivateTab(2)),
+    ("tab_4", Command::ActivateTab(3)),
+    ("tab_5", Command::ActivateTab(4)),
+    ("tab_6", Command::ActivateTab(5)),
+    ("tab_7", Command::ActivateTab(6)),
+    ("tab_8", Command::ActivateTab(7)),
+    ("tab_9", Command::ActivateTab(8)),
+    ("toggle_ai_dock", Command::ToggleAiDock),
+    ("toggle_folder_browser", Command::ToggleFolderBrowser),
+    ("command_prompt", Command::Prompt),
+    ("split_vertical", Command::SplitVertical),
+    ("split_horizontal", Command::SplitHorizontal),
+    ("close_split", Command::CloseSplit),
+];
+
+impl Command {
+    pub fn from_name(name: &str) -> Option<Self> {
+        COMMANDS.iter().find(|(n, _)| *n == name).map(|&(_, command)| command)
+    }
+
+    /// Returns the names of all commands, e.g. for completion in the command prompt.
+    pub fn names() -> impl Iterator<Item = &'static str> {
+        COMMANDS.iter().map(|&(name, _)| name)
+    }
+}
+
+/// The outcome of [`Keymap::bind`].
+#[derive(Debug, PartialEq, Eq)]
+pub enum BindError {
+    UnknownShortcut,
+    UnknownCommand,
+}
+
+pub struct Keymap {
+    bindings: Vec<(InputKey, Command)>,
+}
+
+impl Default for Keymap {
+    fn default() -> Self {
+        // On macOS, Alt+Left/Right move by words. VS Code's Ctrl+- can't be used either,
+        // because most terminals send it as Ctrl+_, which is indistinguishable from Ctrl+/.
+        // Ctrl+T is vim's "pop tag stack" and Ctrl+U sits right next to it.
+        let (jump_back, jump_forward) = if cfg!(target_os = "macos") {
+            (kbmod::CTRL | vk::T, kbmod::CTRL | vk::U)
+        } else {
+            (kbmod::ALT | vk::LEFT, kbmod::ALT | vk::RIGHT)
+        };
+
+        Self {
+            bindings: vec![
+                (kbmod::CTRL | vk::N, Command::New),
+                (kbmod::CTRL | vk::O, Command::Open),
+                (kbmod::CTRL | vk::S, Command::Save),
+                (kbmod::CTRL_SHIFT | vk::S, Command::SaveAs),
+                (kbmod::CTRL | vk::W, Command::Close),
+                (kbmod::ALT | vk::W, Command::CloseTab),
+                (kbmod::CTRL | vk::P, Command::GoToFile),
+                (kbmod::CTRL | vk::E, Command::RecentFiles),
+                (kbmod::CTRL | vk::Q, Command::Exit),
+                (kbmod::CTRL | vk::G, Command::GotoLine),
+                (kbmod::ALT | vk::Q, Command::RecordMacro),
+                (kbmod::ALT | vk::P, Command::PlayMacro),
+                (kbmod::ALT_SHIFT | vk::V, Command::PasteReindented),
+                (kbmod::CTRL | vk::B, Command::MatchingBracket),
+                (jump_back, Command::JumpBack),
+                (jump_forward, Command::JumpForward),
+                (kbmod::CTRL | vk::K, Command::ToggleFold),
+                (kbmod::CTRL | vk::L, Command::CycleLineNumbers),
+                (kbmod::CTRL_ALT | vk::W, Command::ToggleWhitespace),
+                (kbmod::CTRL | vk::F, Command::Find),
+                (kbmod::CTRL | vk::R, Command::Replace),
+                (vk::F3, Command::FindNext),
+                (kbmod::SHIFT | vk::F3, Command::FindPrevious),
+                (kbmod::CTRL | vk::TAB, Command::NextTab),
+                (kbmod::CTRL | vk::NEXT, Command::NextTab),
+                (kbmod::CTRL_SHIFT | vk::TAB, Command::PreviousTab),
+                (kbmod::CTRL | vk::PRIOR, Command::PreviousTab),
+                (kbmod::CTRL | vk::N1, Command::ActivateTab(0)),
+                (kbmod::CTRL | vk::N2, Command::ActivateTab(1)),
+                (kbmod::CTRL | vk::N3, Command::ActivateTab(2)),
+                (kbmod::CTRL | vk::N4, Command::ActivateTab(3)),
+                (kbmod::CTRL | vk::N5, Command::ActivateTab(4)),
+                (kbmod::CTRL | vk::N6, Command::ActivateTab(5)),
+                (kbmod::CTRL | vk::N7, Command::ActivateTab(6)),
+                (kbmod::CTRL | vk::N8, Command::ActivateTab(7)),
+                (kbmod::CTRL | vk::N9, Command::ActivateTab(8)),
+                (kbmod::CTRL_ALT | vk::B, Command::ToggleAiDock),
+                (vk::F4, Command::ToggleFolderBrowser),
+                (kbmod::ALT | vk::X, Command::Prompt),
+            ],
+        }
+    }
+}
+
+impl Keymap {
+    /// Returns the command bound to the given key, if any.
+    pub fn lookup(&self, key: InputKey) -> Option<Command> {
+        self.bindings.iter().find(|(k, _)| *k == key).map(|&(_, command)| command)
+    }
+
+    /// Returns the first key bound to the given command, for display in the menus.
+    /// Returns [`vk::NULL`] if there's none.
+    pub fn shortcut(&self, command: Command) -> InputKey {
+        self.bindings.iter().find(|(_, c)| *c == command).map_or(vk::NULL, |&(key, _)| key)
+    }
+
+    /// Binds `shortcut`, e.g. `ctrl-shift-s`, to the command with the given name,
+    /// replacing whatever it was bound to before. The command `none` unbinds it.
+    /// Returns the key that was bound.
+    pub fn bind(&mut self, shortcut: &str, command: &str) -> Result<InputKey, BindError> {
+        let key = parse_shortcut(shortcut).ok_or(BindError::UnknownShortcut)?;
+        let command = match command {
+            "none" => None,
+            _ => Some(Command::from_name(command).ok_or(BindError::UnknownCommand)?),
+        };
+
+        self.bindings.retain(|(k, _)| *k != key);
+        if let Some(command) = command {
+            self.bindings.push((key, command));
+        }
+        Ok(key)
+    }
+}
+
+/// Parses a shortcut like `ctrl-s` or `shift+f3`. The modifiers may come in any order.
+fn parse_shortcut(shortcut: &str) -> Option<InputKey> {
+    let (modifiers, name) = shortcut.rsplit_once(['-', '+']).unwrap_or(("", shortcut));
+
+    let mut key = InputKey::from_name(name)?;
+    for modifier in modifiers.split(['-', '+']).filter(|m| !m.is_empty()) {
+        key = match modifier.to_ascii_lowercase().as_str() {
+            "ctrl" => kbmod::CTRL | key,
+            "alt" => kbmod::ALT | key,
+            "shift" => kbmod::SHIFT | key,
+            _ => return None,
+        };
+    }
+    Some(key)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_shortcut() {
+        assert!(parse_shortcut("ctrl-s") == Some(kbmod::CTRL | vk::S));
+        assert!(parse_shortcut("Shift+Ctrl+S") == Some(kbmod::CTRL_SHIFT | vk::S));
+        assert!(parse_shortcut("shift-f3") == Some(kbmod::SHIFT | vk::F3));
+        assert!(parse_shortcut("ctrl-pgdn") == Some(kbmod::CTRL | vk::NEXT));
+        assert!(parse_shortcut("f4") == Some(vk::F4));
+        assert!(parse_shortcut("ctrl-/") == Some(kbmod::CTRL | vk::OEM_2));
+        assert!(parse_shortcut("ctrl-shift-minus") == Some(kbmod::CTRL_SHIFT | vk::OEM_MINUS));
+        assert!(parse_shortcut("hyper-s").is_none());
+        assert!(parse_shortcut("ctrl-foo").is_none());
+        assert!(parse_shortcut("ctrl-f25").is_none());
+    }
+
+    #[test]
+    fn test_bind() {
+        let mut keymap = Keymap::default();
+        assert_eq!(keymap.lookup(kbmod::CTRL | vk::S), Some(Command::Save));
+
+        assert!(keymap.bind("ctrl-s", "find").is_ok());
+        assert_eq!(keymap.lookup(kbmod::CTRL | vk::S), Some(Command::Find));
+        assert!(keymap.shortcut(Command::Save) == vk::NULL);
+
+        assert!(keymap.bind("alt-s", "save").is_ok());
+        assert!(keymap.shortcut(Command::Save) == kbmod::ALT | vk::S);
+
+        assert!(keymap.bind("ctrl-q", "none").is_ok());
+        assert_eq!(keymap.lookup(kbmod::CTRL | vk::Q), None);
+
+        assert_eq!(keymap.bind("ctrl-q", "explode").err(), Some(BindError::UnknownCommand));
+        assert_eq!(keymap.bind("meta-q", "exit").err(), Some(BindError::UnknownShortcut));
+    }
+}
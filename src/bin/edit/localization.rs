@@ -21,8 +21,11 @@ pub enum LocId {
     File,
     FileNew,
     FileOpen,
+    FileRecent,
+    FileRecentEmpty,
     FileSave,
     FileSaveAs,
+    FileReopenWithEncoding,
     FileClose,
     FileExit,
     FileGoto,
@@ -34,14 +37,31 @@ pub enum LocId {
     EditCut,
     EditCopy,
     EditPaste,
+    EditPasteReindented,
     EditFind,
     EditReplace,
     EditSelectAll,
+    EditMatchingBracket,
+    EditToggleComment,
+    EditDuplicateLines,
+    EditAddNextOccurrence,
 
     // View menu
     View,
     ViewFocusStatusbar,
     ViewWordWrap,
+    ViewLineNumbers,
+    ViewRelativeLineNumbers,
+    ViewBracketHighlight,
+    ViewOccurrenceHighlight,
+    ViewShowWhitespace,
+    ViewToggleFold,
+    ViewUnfoldAll,
+    ViewReadOnly,
+    ViewSetOption,
+    ViewCommandPrompt,
+    ViewSplitVertical,
+    ViewSplitHorizontal,
     ViewGoToFile,
 
     // Help menu
@@ -53,6 +73,14 @@ pub enum LocId {
     UnsavedChangesDialogDescription,
     UnsavedChangesDialogYes,
     UnsavedChangesDialogNo,
+    DiskChangedTitle,
+    DiskChangedDescription,
+    DiskChangedReload,
+    DiskChangedKeep,
+    DiskChangedCompare,
+    DiskChangedOnDisk,
+    DiskChangedReloaded,
+    DiskChangedDeleted,
 
     // About dialog
     AboutDialogTitle,
@@ -76,8 +104,31 @@ pub enum LocId {
     SearchMatchCase,
     SearchWholeWord,
     SearchUseRegex,
+    SearchReplace,
+    SearchSkip,
     SearchReplaceAll,
     SearchClose,
+    SearchNoMatches,
+
+    NoMatchingBracket,
+    NoJumpPosition,
+    NoFoldRegion,
+    MacroRecording,
+    MacroStopped,
+    MacroNone,
+    GotoLineClamped,
+    SystemClipboardUnavailable,
+    NewlinesMixed,
+    LoadingProgress,
+    LoadingCancelled,
+    FormatterFailed,
+    BackupFailed,
+    StatusbarLineCount,
+    ConfigUnknownKey,
+    ConfigInvalidValue,
+    ConfigUnknownCommand,
+    ConfigKeyConflict,
+    ConfigSetUsage,
 
     EncodingReopen,
     EncodingConvert,
@@ -90,6 +141,12 @@ pub enum LocId {
 
     FileOverwriteWarning,
     FileOverwriteWarningDescription,
+    FileCreatePrompt,
+    FileCreatePromptDescription,
+    BufferReadOnly,
+    ReadOnlySaveTitle,
+    ReadOnlySaveDescription,
+    IncompleteSaveDescription,
 
     Count,
 }
@@ -116,7 +173,7 @@ enum LangId {
 }
 
 #[rustfmt::skip]
-const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
+static S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
     // Ctrl (the keyboard key)
     [
         /* en      */ "Ctrl",
@@ -273,6 +330,34 @@ const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
         /* zh_hans */ "打开文件…",
         /* zh_hant */ "開啟檔案…",
     ],
+    // FileRecent
+    [
+        /* en      */ "Open Recent…",
+        /* de      */ "Zuletzt geöffnet…",
+        /* es      */ "Abrir recientes…",
+        /* fr      */ "Ouvrir un fichier récent…",
+        /* it      */ "Apri recenti…",
+        /* ja      */ "最近使ったファイルを開く…",
+        /* ko      */ "최근 파일 열기…",
+        /* pt_br   */ "Abrir recentes…",
+        /* ru      */ "Открыть недавние…",
+        /* zh_hans */ "打开最近的文件…",
+        /* zh_hant */ "開啟最近的檔案…",
+    ],
+    // FileRecentEmpty
+    [
+        /* en      */ "No recently opened files",
+        /* de      */ "Keine zuletzt geöffneten Dateien",
+        /* es      */ "No hay archivos abiertos recientemente",
+        /* fr      */ "Aucun fichier ouvert récemment",
+        /* it      */ "Nessun file aperto di recente",
+        /* ja      */ "最近開いたファイルはありません",
+        /* ko      */ "최근에 연 파일이 없습니다",
+        /* pt_br   */ "Nenhum arquivo aberto recentemente",
+        /* ru      */ "Нет недавно открытых файлов",
+        /* zh_hans */ "没有最近打开的文件",
+        /* zh_hant */ "沒有最近開啟的檔案",
+    ],
     // FileSave
     [
         /* en      */ "Save",
@@ -301,6 +386,20 @@ const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
         /* zh_hans */ "另存为…",
         /* zh_hant */ "另存新檔…",
     ],
+    // FileReopenWithEncoding
+    [
+        /* en      */ "Reopen with Encoding…",
+        /* de      */ "Mit Kodierung erneut öffnen…",
+        /* es      */ "Reabrir con codificación…",
+        /* fr      */ "Rouvrir avec un encodage…",
+        /* it      */ "Riapri con codifica…",
+        /* ja      */ "エンコーディングを指定して再度開く…",
+        /* ko      */ "인코딩으로 다시 열기…",
+        /* pt_br   */ "Reabrir com Codificação…",
+        /* ru      */ "Открыть заново в кодировке…",
+        /* zh_hans */ "使用编码重新打开…",
+        /* zh_hant */ "使用編碼重新開啟…",
+    ],
     // FileClose
     [
         /* en      */ "Close File",
@@ -428,6 +527,20 @@ const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
         /* zh_hans */ "粘贴",
         /* zh_hant */ "貼上",
     ],
+    // EditPasteReindented
+    [
+        /* en      */ "Paste and Reindent",
+        /* de      */ "Einfügen und einrücken",
+        /* es      */ "Pegar y reindentar",
+        /* fr      */ "Coller et réindenter",
+        /* it      */ "Incolla e reindenta",
+        /* ja      */ "貼り付けてインデントを調整",
+        /* ko      */ "붙여넣고 들여쓰기 맞춤",
+        /* pt_br   */ "Colar e reindentar",
+        /* ru      */ "Вставить с отступами",
+        /* zh_hans */ "粘贴并重新缩进",
+        /* zh_hant */ "貼上並重新縮排",
+    ],
     // EditFind
     [
         /* en      */ "Find",
@@ -470,6 +583,62 @@ const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
         /* zh_hans */ "全选",
         /* zh_hant */ "全選"
     ],
+    // EditMatchingBracket
+    [
+        /* en      */ "Go to Matching Bracket",
+        /* de      */ "Zur passenden Klammer",
+        /* es      */ "Ir al corchete coincidente",
+        /* fr      */ "Aller au crochet correspondant",
+        /* it      */ "Vai alla parentesi corrispondente",
+        /* ja      */ "対応する括弧へ移動",
+        /* ko      */ "일치하는 괄호로 이동",
+        /* pt_br   */ "Ir para o colchete correspondente",
+        /* ru      */ "Перейти к парной скобке",
+        /* zh_hans */ "转到匹配的括号",
+        /* zh_hant */ "跳至相符的括號",
+    ],
+    // EditToggleComment
+    [
+        /* en      */ "Toggle Line Comment",
+        /* de      */ "Zeilenkommentar umschalten",
+        /* es      */ "Alternar comentario de línea",
+        /* fr      */ "Basculer le commentaire de ligne",
+        /* it      */ "Attiva/disattiva commento riga",
+        /* ja      */ "行コメントの切り替え",
+        /* ko      */ "줄 주석 전환",
+        /* pt_br   */ "Alternar comentário de linha",
+        /* ru      */ "Закомментировать/раскомментировать строки",
+        /* zh_hans */ "切换行注释",
+        /* zh_hant */ "切換行註解",
+    ],
+    // EditDuplicateLines
+    [
+        /* en      */ "Duplicate Line",
+        /* de      */ "Zeile duplizieren",
+        /* es      */ "Duplicar línea",
+        /* fr      */ "Dupliquer la ligne",
+        /* it      */ "Duplica riga",
+        /* ja      */ "行を複製",
+        /* ko      */ "줄 복제",
+        /* pt_br   */ "Duplicar linha",
+        /* ru      */ "Дублировать строку",
+        /* zh_hans */ "复制行",
+        /* zh_hant */ "複製行",
+    ],
+    // EditAddNextOccurrence
+    [
+        /* en      */ "Add Cursor to Next Occurrence",
+        /* de      */ "Cursor beim nächsten Vorkommen hinzufügen",
+        /* es      */ "Agregar cursor a la siguiente coincidencia",
+        /* fr      */ "Ajouter un curseur à l’occurrence suivante",
+        /* it      */ "Aggiungi cursore all’occorrenza successiva",
+        /* ja      */ "次の出現箇所にカーソルを追加",
+        /* ko      */ "다음 항목에 커서 추가",
+        /* pt_br   */ "Adicionar cursor à próxima ocorrência",
+        /* ru      */ "Добавить курсор к следующему вхождению",
+        /* zh_hans */ "将光标添加到下一个匹配项",
+        /* zh_hant */ "將游標新增至下一個相符項目",
+    ],
 
     // View (a menu bar item)
     [
@@ -513,6 +682,174 @@ const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
         /* zh_hans */ "自动换行",
         /* zh_hant */ "自動換行",
     ],
+    // ViewLineNumbers
+    [
+        /* en      */ "Line Numbers",
+        /* de      */ "Zeilennummern",
+        /* es      */ "Números de línea",
+        /* fr      */ "Numéros de ligne",
+        /* it      */ "Numeri di riga",
+        /* ja      */ "行番号",
+        /* ko      */ "줄 번호",
+        /* pt_br   */ "Números de linha",
+        /* ru      */ "Номера строк",
+        /* zh_hans */ "行号",
+        /* zh_hant */ "行號",
+    ],
+    // ViewRelativeLineNumbers
+    [
+        /* en      */ "Relative Line Numbers",
+        /* de      */ "Relative Zeilennummern",
+        /* es      */ "Números de línea relativos",
+        /* fr      */ "Numéros de ligne relatifs",
+        /* it      */ "Numeri di riga relativi",
+        /* ja      */ "相対行番号",
+        /* ko      */ "상대 줄 번호",
+        /* pt_br   */ "Números de linha relativos",
+        /* ru      */ "Относительные номера строк",
+        /* zh_hans */ "相对行号",
+        /* zh_hant */ "相對行號",
+    ],
+    // ViewBracketHighlight
+    [
+        /* en      */ "Highlight Matching Brackets",
+        /* de      */ "Passende Klammern hervorheben",
+        /* es      */ "Resaltar corchetes coincidentes",
+        /* fr      */ "Surligner les crochets correspondants",
+        /* it      */ "Evidenzia parentesi corrispondenti",
+        /* ja      */ "対応する括弧を強調表示",
+        /* ko      */ "일치하는 괄호 강조",
+        /* pt_br   */ "Realçar colchetes correspondentes",
+        /* ru      */ "Подсвечивать парные скобки",
+        /* zh_hans */ "突出显示匹配的括号",
+        /* zh_hant */ "醒目提示相符的括號",
+    ],
+    // ViewOccurrenceHighlight
+    [
+        /* en      */ "Highlight Word Under Cursor",
+        /* de      */ "Wort unter dem Cursor hervorheben",
+        /* es      */ "Resaltar la palabra bajo el cursor",
+        /* fr      */ "Surligner le mot sous le curseur",
+        /* it      */ "Evidenzia la parola sotto il cursore",
+        /* ja      */ "カーソル位置の単語を強調表示",
+        /* ko      */ "커서 위치의 단어 강조",
+        /* pt_br   */ "Realçar a palavra sob o cursor",
+        /* ru      */ "Подсвечивать слово под курсором",
+        /* zh_hans */ "突出显示光标处的单词",
+        /* zh_hant */ "醒目提示游標處的單字",
+    ],
+    // ViewShowWhitespace
+    [
+        /* en      */ "Show Whitespace",
+        /* de      */ "Leerzeichen anzeigen",
+        /* es      */ "Mostrar espacios en blanco",
+        /* fr      */ "Afficher les espaces",
+        /* it      */ "Mostra spazi vuoti",
+        /* ja      */ "空白文字を表示",
+        /* ko      */ "공백 표시",
+        /* pt_br   */ "Mostrar espaços em branco",
+        /* ru      */ "Показывать пробелы",
+        /* zh_hans */ "显示空白字符",
+        /* zh_hant */ "顯示空白字元",
+    ],
+    // ViewToggleFold
+    [
+        /* en      */ "Fold/Unfold Block",
+        /* de      */ "Block ein-/ausklappen",
+        /* es      */ "Plegar/desplegar bloque",
+        /* fr      */ "Replier/déplier le bloc",
+        /* it      */ "Comprimi/espandi blocco",
+        /* ja      */ "ブロックの折りたたみ/展開",
+        /* ko      */ "블록 접기/펼치기",
+        /* pt_br   */ "Recolher/expandir bloco",
+        /* ru      */ "Свернуть/развернуть блок",
+        /* zh_hans */ "折叠/展开块",
+        /* zh_hant */ "摺疊/展開區塊",
+    ],
+    // ViewUnfoldAll
+    [
+        /* en      */ "Unfold All",
+        /* de      */ "Alle ausklappen",
+        /* es      */ "Desplegar todo",
+        /* fr      */ "Tout déplier",
+        /* it      */ "Espandi tutto",
+        /* ja      */ "すべて展開",
+        /* ko      */ "모두 펼치기",
+        /* pt_br   */ "Expandir tudo",
+        /* ru      */ "Развернуть все",
+        /* zh_hans */ "全部展开",
+        /* zh_hant */ "全部展開",
+    ],
+    // ViewReadOnly
+    [
+        /* en      */ "Read-Only",
+        /* de      */ "Schreibgeschützt",
+        /* es      */ "Solo lectura",
+        /* fr      */ "Lecture seule",
+        /* it      */ "Sola lettura",
+        /* ja      */ "読み取り専用",
+        /* ko      */ "읽기 전용",
+        /* pt_br   */ "Somente leitura",
+        /* ru      */ "Только чтение",
+        /* zh_hans */ "只读",
+        /* zh_hant */ "唯讀",
+    ],
+    // ViewSetOption
+    [
+        /* en      */ "Set Option…",
+        /* de      */ "Option setzen…",
+        /* es      */ "Establecer opción…",
+        /* fr      */ "Définir une option…",
+        /* it      */ "Imposta opzione…",
+        /* ja      */ "オプションを設定…",
+        /* ko      */ "옵션 설정…",
+        /* pt_br   */ "Definir opção…",
+        /* ru      */ "Задать параметр…",
+        /* zh_hans */ "设置选项…",
+        /* zh_hant */ "設定選項…",
+    ],
+    // ViewCommandPrompt
+    [
+        /* en      */ "Command Prompt…",
+        /* de      */ "Befehlszeile…",
+        /* es      */ "Línea de comandos…",
+        /* fr      */ "Invite de commandes…",
+        /* it      */ "Riga di comando…",
+        /* ja      */ "コマンド プロンプト…",
+        /* ko      */ "명령 프롬프트…",
+        /* pt_br   */ "Prompt de comando…",
+        /* ru      */ "Командная строка…",
+        /* zh_hans */ "命令提示符…",
+        /* zh_hant */ "命令提示字元…",
+    ],
+    // ViewSplitVertical
+    [
+        /* en      */ "Split Vertically",
+        /* de      */ "Vertikal teilen",
+        /* es      */ "Dividir verticalmente",
+        /* fr      */ "Diviser verticalement",
+        /* it      */ "Dividi verticalmente",
+        /* ja      */ "左右に分割",
+        /* ko      */ "세로로 분할",
+        /* pt_br   */ "Dividir verticalmente",
+        /* ru      */ "Разделить по вертикали",
+        /* zh_hans */ "垂直拆分",
+        /* zh_hant */ "垂直分割",
+    ],
+    // ViewSplitHorizontal
+    [
+        /* en      */ "Split Horizontally",
+        /* de      */ "Horizontal teilen",
+        /* es      */ "Dividir horizontalmente",
+        /* fr      */ "Diviser horizontalement",
+        /* it      */ "Dividi orizzontalmente",
+        /* ja      */ "上下に分割",
+        /* ko      */ "가로로 분할",
+        /* pt_br   */ "Dividir horizontalmente",
+        /* ru      */ "Разделить по горизонтали",
+        /* zh_hans */ "水平拆分",
+        /* zh_hant */ "水平分割",
+    ],
     // ViewGoToFile
     [
         /* en      */ "Go to File…",
@@ -613,6 +950,118 @@ const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
         /* zh_hans */ "不保存",
         /* zh_hant */ "不儲存",
     ],
+    // DiskChangedTitle
+    [
+        /* en      */ "File Changed on Disk",
+        /* de      */ "Datei auf dem Datenträger geändert",
+        /* es      */ "Archivo modificado en el disco",
+        /* fr      */ "Fichier modifié sur le disque",
+        /* it      */ "File modificato su disco",
+        /* ja      */ "ディスク上のファイルが変更されました",
+        /* ko      */ "디스크의 파일이 변경됨",
+        /* pt_br   */ "Arquivo alterado no disco",
+        /* ru      */ "Файл изменён на диске",
+        /* zh_hans */ "磁盘上的文件已更改",
+        /* zh_hant */ "磁碟上的檔案已變更",
+    ],
+    // DiskChangedDescription
+    [
+        /* en      */ "Another program changed this file, but it has unsaved changes:",
+        /* de      */ "Ein anderes Programm hat diese Datei geändert, sie enthält aber ungespeicherte Änderungen:",
+        /* es      */ "Otro programa modificó este archivo, pero tiene cambios sin guardar:",
+        /* fr      */ "Un autre programme a modifié ce fichier, mais il contient des modifications non enregistrées :",
+        /* it      */ "Un altro programma ha modificato questo file, ma contiene modifiche non salvate:",
+        /* ja      */ "別のプログラムがこのファイルを変更しましたが、未保存の変更があります:",
+        /* ko      */ "다른 프로그램이 이 파일을 변경했지만 저장하지 않은 변경 내용이 있습니다:",
+        /* pt_br   */ "Outro programa alterou este arquivo, mas ele tem alterações não salvas:",
+        /* ru      */ "Другая программа изменила этот файл, но в нём есть несохранённые изменения:",
+        /* zh_hans */ "另一个程序更改了此文件，但它有未保存的更改:",
+        /* zh_hant */ "另一個程式變更了此檔案，但它有未儲存的變更:",
+    ],
+    // DiskChangedReload
+    [
+        /* en      */ "Reload",
+        /* de      */ "Neu laden",
+        /* es      */ "Recargar",
+        /* fr      */ "Recharger",
+        /* it      */ "Ricarica",
+        /* ja      */ "再読み込み",
+        /* ko      */ "다시 로드",
+        /* pt_br   */ "Recarregar",
+        /* ru      */ "Перезагрузить",
+        /* zh_hans */ "重新加载",
+        /* zh_hant */ "重新載入",
+    ],
+    // DiskChangedKeep
+    [
+        /* en      */ "Keep Mine",
+        /* de      */ "Meine behalten",
+        /* es      */ "Conservar los míos",
+        /* fr      */ "Garder les miens",
+        /* it      */ "Mantieni i miei",
+        /* ja      */ "自分の変更を保持",
+        /* ko      */ "내 변경 내용 유지",
+        /* pt_br   */ "Manter os meus",
+        /* ru      */ "Оставить мои",
+        /* zh_hans */ "保留我的",
+        /* zh_hant */ "保留我的",
+    ],
+    // DiskChangedCompare
+    [
+        /* en      */ "Compare",
+        /* de      */ "Vergleichen",
+        /* es      */ "Comparar",
+        /* fr      */ "Comparer",
+        /* it      */ "Confronta",
+        /* ja      */ "比較",
+        /* ko      */ "비교",
+        /* pt_br   */ "Comparar",
+        /* ru      */ "Сравнить",
+        /* zh_hans */ "比较",
+        /* zh_hant */ "比較",
+    ],
+    // DiskChangedOnDisk (Appended to the file name of the copy that shows the file as it is on disk)
+    [
+        /* en      */ "(on disk)",
+        /* de      */ "(auf Datenträger)",
+        /* es      */ "(en disco)",
+        /* fr      */ "(sur disque)",
+        /* it      */ "(su disco)",
+        /* ja      */ "(ディスク上)",
+        /* ko      */ "(디스크)",
+        /* pt_br   */ "(no disco)",
+        /* ru      */ "(на диске)",
+        /* zh_hans */ "(磁盘上)",
+        /* zh_hant */ "(磁碟上)",
+    ],
+    // DiskChangedReloaded
+    [
+        /* en      */ "{filename} was changed on disk and reloaded",
+        /* de      */ "{filename} wurde auf dem Datenträger geändert und neu geladen",
+        /* es      */ "{filename} se modificó en el disco y se recargó",
+        /* fr      */ "{filename} a été modifié sur le disque et rechargé",
+        /* it      */ "{filename} è stato modificato su disco e ricaricato",
+        /* ja      */ "{filename} はディスク上で変更されたため再読み込みしました",
+        /* ko      */ "{filename}이(가) 디스크에서 변경되어 다시 로드되었습니다",
+        /* pt_br   */ "{filename} foi alterado no disco e recarregado",
+        /* ru      */ "{filename} изменён на диске и перезагружен",
+        /* zh_hans */ "{filename} 已在磁盘上更改并重新加载",
+        /* zh_hant */ "{filename} 已在磁碟上變更並重新載入",
+    ],
+    // DiskChangedDeleted
+    [
+        /* en      */ "{filename} was deleted on disk",
+        /* de      */ "{filename} wurde auf dem Datenträger gelöscht",
+        /* es      */ "{filename} se eliminó del disco",
+        /* fr      */ "{filename} a été supprimé du disque",
+        /* it      */ "{filename} è stato eliminato dal disco",
+        /* ja      */ "{filename} はディスクから削除されました",
+        /* ko      */ "{filename}이(가) 디스크에서 삭제되었습니다",
+        /* pt_br   */ "{filename} foi excluído do disco",
+        /* ru      */ "{filename} удалён с диска",
+        /* zh_hans */ "{filename} 已从磁盘中删除",
+        /* zh_hant */ "{filename} 已從磁碟中刪除",
+    ],
 
     // AboutDialogTitle
     [
@@ -815,6 +1264,34 @@ const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
         /* zh_hans */ "正则",
         /* zh_hant */ "正則",
     ],
+    // SearchReplace (button)
+    [
+        /* en      */ "Replace",
+        /* de      */ "Ersetzen",
+        /* es      */ "Reemplazar",
+        /* fr      */ "Remplacer",
+        /* it      */ "Sostituisci",
+        /* ja      */ "置換",
+        /* ko      */ "바꾸기",
+        /* pt_br   */ "Substituir",
+        /* ru      */ "Заменить",
+        /* zh_hans */ "替换",
+        /* zh_hant */ "取代",
+    ],
+    // SearchSkip (button)
+    [
+        /* en      */ "Skip",
+        /* de      */ "Überspringen",
+        /* es      */ "Omitir",
+        /* fr      */ "Ignorer",
+        /* it      */ "Salta",
+        /* ja      */ "スキップ",
+        /* ko      */ "건너뛰기",
+        /* pt_br   */ "Pular",
+        /* ru      */ "Пропустить",
+        /* zh_hans */ "跳过",
+        /* zh_hant */ "略過",
+    ],
     // SearchReplaceAll (button)
     [
         /* en      */ "Replace All",
@@ -843,6 +1320,287 @@ const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
         /* zh_hans */ "关闭",
         /* zh_hant */ "關閉",
     ],
+    // SearchNoMatches (status bar)
+    [
+        /* en      */ "No matches",
+        /* de      */ "Keine Treffer",
+        /* es      */ "Sin coincidencias",
+        /* fr      */ "Aucun résultat",
+        /* it      */ "Nessuna corrispondenza",
+        /* ja      */ "一致なし",
+        /* ko      */ "일치 항목 없음",
+        /* pt_br   */ "Nenhuma correspondência",
+        /* ru      */ "Нет совпадений",
+        /* zh_hans */ "无匹配项",
+        /* zh_hant */ "無相符項目",
+    ],
+
+    // NoMatchingBracket (status bar)
+    [
+        /* en      */ "No matching bracket",
+        /* de      */ "Keine passende Klammer",
+        /* es      */ "No hay corchete coincidente",
+        /* fr      */ "Aucun crochet correspondant",
+        /* it      */ "Nessuna parentesi corrispondente",
+        /* ja      */ "対応する括弧がありません",
+        /* ko      */ "일치하는 괄호 없음",
+        /* pt_br   */ "Nenhum colchete correspondente",
+        /* ru      */ "Нет парной скобки",
+        /* zh_hans */ "没有匹配的括号",
+        /* zh_hant */ "沒有相符的括號",
+    ],
+    // NoJumpPosition (status bar)
+    [
+        /* en      */ "No position to jump to",
+        /* de      */ "Keine Position zum Springen",
+        /* es      */ "No hay ninguna posición a la que saltar",
+        /* fr      */ "Aucune position vers laquelle sauter",
+        /* it      */ "Nessuna posizione a cui saltare",
+        /* ja      */ "ジャンプ先の位置がありません",
+        /* ko      */ "이동할 위치 없음",
+        /* pt_br   */ "Nenhuma posição para onde pular",
+        /* ru      */ "Нет позиции для перехода",
+        /* zh_hans */ "没有可跳转的位置",
+        /* zh_hant */ "沒有可跳轉的位置",
+    ],
+    // NoFoldRegion (status bar)
+    [
+        /* en      */ "Nothing to fold here",
+        /* de      */ "Hier gibt es nichts einzuklappen",
+        /* es      */ "No hay nada que plegar aquí",
+        /* fr      */ "Rien à replier ici",
+        /* it      */ "Niente da comprimere qui",
+        /* ja      */ "ここには折りたためるものがありません",
+        /* ko      */ "여기에는 접을 수 있는 것이 없습니다",
+        /* pt_br   */ "Nada para recolher aqui",
+        /* ru      */ "Здесь нечего сворачивать",
+        /* zh_hans */ "此处没有可折叠的内容",
+        /* zh_hant */ "此處沒有可摺疊的內容",
+    ],
+    // MacroRecording (status bar, while a macro is being recorded)
+    [
+        /* en      */ "Recording macro",
+        /* de      */ "Makro wird aufgezeichnet",
+        /* es      */ "Grabando macro",
+        /* fr      */ "Enregistrement de la macro",
+        /* it      */ "Registrazione macro",
+        /* ja      */ "マクロを記録中",
+        /* ko      */ "매크로 기록 중",
+        /* pt_br   */ "Gravando macro",
+        /* ru      */ "Запись макроса",
+        /* zh_hans */ "正在录制宏",
+        /* zh_hant */ "正在錄製巨集",
+    ],
+    // MacroStopped (status bar, {run} and {count} are numbers)
+    [
+        /* en      */ "Macro stopped in run {run} of {count}",
+        /* de      */ "Makro in Durchlauf {run} von {count} angehalten",
+        /* es      */ "Macro detenida en la ejecución {run} de {count}",
+        /* fr      */ "Macro arrêtée à l’exécution {run} sur {count}",
+        /* it      */ "Macro interrotta all’esecuzione {run} di {count}",
+        /* ja      */ "マクロは {count} 回中 {run} 回目で停止しました",
+        /* ko      */ "매크로가 {count}회 중 {run}회째에서 중지됨",
+        /* pt_br   */ "Macro interrompida na execução {run} de {count}",
+        /* ru      */ "Макрос остановлен на проходе {run} из {count}",
+        /* zh_hans */ "宏在第 {run} 次（共 {count} 次）运行时停止",
+        /* zh_hant */ "巨集在第 {run} 次（共 {count} 次）執行時停止",
+    ],
+    // MacroNone (status bar)
+    [
+        /* en      */ "No macro recorded",
+        /* de      */ "Kein Makro aufgezeichnet",
+        /* es      */ "No hay ninguna macro grabada",
+        /* fr      */ "Aucune macro enregistrée",
+        /* it      */ "Nessuna macro registrata",
+        /* ja      */ "記録されたマクロがありません",
+        /* ko      */ "기록된 매크로가 없습니다",
+        /* pt_br   */ "Nenhuma macro gravada",
+        /* ru      */ "Макрос не записан",
+        /* zh_hans */ "没有录制的宏",
+        /* zh_hant */ "沒有錄製的巨集",
+    ],
+    // GotoLineClamped (status bar)
+    [
+        /* en      */ "Line out of range, moved to line {line}",
+        /* de      */ "Zeile außerhalb des Bereichs, zu Zeile {line} gewechselt",
+        /* es      */ "Línea fuera de rango, se movió a la línea {line}",
+        /* fr      */ "Ligne hors limites, déplacé à la ligne {line}",
+        /* it      */ "Riga fuori intervallo, spostato alla riga {line}",
+        /* ja      */ "行が範囲外のため、{line} 行目に移動しました",
+        /* ko      */ "줄이 범위를 벗어나 {line}번째 줄로 이동했습니다",
+        /* pt_br   */ "Linha fora do intervalo, movido para a linha {line}",
+        /* ru      */ "Строка вне диапазона, выполнен переход к строке {line}",
+        /* zh_hans */ "行号超出范围，已移至第 {line} 行",
+        /* zh_hant */ "行號超出範圍，已移至第 {line} 行",
+    ],
+    // SystemClipboardUnavailable (status bar)
+    [
+        /* en      */ "System clipboard unavailable, using the internal clipboard",
+        /* de      */ "Systemzwischenablage nicht verfügbar, interne Zwischenablage wird verwendet",
+        /* es      */ "Portapapeles del sistema no disponible, se usa el portapapeles interno",
+        /* fr      */ "Presse-papiers système indisponible, utilisation du presse-papiers interne",
+        /* it      */ "Appunti di sistema non disponibili, verranno usati gli appunti interni",
+        /* ja      */ "システムのクリップボードを利用できないため、内部クリップボードを使用します",
+        /* ko      */ "시스템 클립보드를 사용할 수 없어 내부 클립보드를 사용합니다",
+        /* pt_br   */ "Área de transferência do sistema indisponível, usando a interna",
+        /* ru      */ "Системный буфер обмена недоступен, используется внутренний",
+        /* zh_hans */ "系统剪贴板不可用，正在使用内部剪贴板",
+        /* zh_hant */ "系統剪貼簿無法使用，正在使用內部剪貼簿",
+    ],
+    // NewlinesMixed (status bar, next to "LF" or "CRLF")
+    [
+        /* en      */ "mixed",
+        /* de      */ "gemischt",
+        /* es      */ "mixto",
+        /* fr      */ "mixte",
+        /* it      */ "misto",
+        /* ja      */ "混在",
+        /* ko      */ "혼합",
+        /* pt_br   */ "misto",
+        /* ru      */ "смешанные",
+        /* zh_hans */ "混合",
+        /* zh_hant */ "混合",
+    ],
+    // LoadingProgress (status bar, while a large file is loaded)
+    [
+        /* en      */ "Loading… {percent}%",
+        /* de      */ "Wird geladen… {percent}%",
+        /* es      */ "Cargando… {percent}%",
+        /* fr      */ "Chargement… {percent}%",
+        /* it      */ "Caricamento… {percent}%",
+        /* ja      */ "読み込み中… {percent}%",
+        /* ko      */ "불러오는 중… {percent}%",
+        /* pt_br   */ "Carregando… {percent}%",
+        /* ru      */ "Загрузка… {percent}%",
+        /* zh_hans */ "正在加载… {percent}%",
+        /* zh_hant */ "正在載入… {percent}%",
+    ],
+    // LoadingCancelled (status bar)
+    [
+        /* en      */ "Loading cancelled",
+        /* de      */ "Laden abgebrochen",
+        /* es      */ "Carga cancelada",
+        /* fr      */ "Chargement annulé",
+        /* it      */ "Caricamento annullato",
+        /* ja      */ "読み込みをキャンセルしました",
+        /* ko      */ "불러오기를 취소했습니다",
+        /* pt_br   */ "Carregamento cancelado",
+        /* ru      */ "Загрузка отменена",
+        /* zh_hans */ "已取消加载",
+        /* zh_hant */ "已取消載入",
+    ],
+    // FormatterFailed (status bar, {tool} is e.g. "gofmt", {error} is its error message)
+    [
+        /* en      */ "{tool} failed, the file was saved unformatted: {error}",
+        /* de      */ "{tool} ist fehlgeschlagen, die Datei wurde unformatiert gespeichert: {error}",
+        /* es      */ "{tool} falló, el archivo se guardó sin formato: {error}",
+        /* fr      */ "Échec de {tool}, le fichier a été enregistré sans mise en forme : {error}",
+        /* it      */ "{tool} non riuscito, il file è stato salvato senza formattazione: {error}",
+        /* ja      */ "{tool} に失敗したため、整形せずに保存しました: {error}",
+        /* ko      */ "{tool} 실패, 서식 없이 저장했습니다: {error}",
+        /* pt_br   */ "{tool} falhou, o arquivo foi salvo sem formatação: {error}",
+        /* ru      */ "Ошибка {tool}, файл сохранён без форматирования: {error}",
+        /* zh_hans */ "{tool} 失败，文件已按原样保存：{error}",
+        /* zh_hant */ "{tool} 失敗，檔案已按原樣儲存：{error}",
+    ],
+    // BackupFailed ({error} is replaced with the error message)
+    [
+        /* en      */ "Couldn't write the backup: {error}",
+        /* de      */ "Sicherungskopie konnte nicht geschrieben werden: {error}",
+        /* es      */ "No se pudo escribir la copia de seguridad: {error}",
+        /* fr      */ "Impossible d’écrire la sauvegarde : {error}",
+        /* it      */ "Impossibile scrivere il backup: {error}",
+        /* ja      */ "バックアップを書き込めませんでした: {error}",
+        /* ko      */ "백업을 쓸 수 없습니다: {error}",
+        /* pt_br   */ "Não foi possível gravar o backup: {error}",
+        /* ru      */ "Не удалось записать резервную копию: {error}",
+        /* zh_hans */ "无法写入备份：{error}",
+        /* zh_hant */ "無法寫入備份：{error}",
+    ],
+    // StatusbarLineCount (status bar, next to the cursor position; {percent} is how far into the file it is)
+    [
+        /* en      */ "{lines} lines, {percent}%",
+        /* de      */ "{lines} Zeilen, {percent} %",
+        /* es      */ "{lines} líneas, {percent} %",
+        /* fr      */ "{lines} lignes, {percent} %",
+        /* it      */ "{lines} righe, {percent}%",
+        /* ja      */ "{lines} 行、{percent}%",
+        /* ko      */ "{lines}줄, {percent}%",
+        /* pt_br   */ "{lines} linhas, {percent}%",
+        /* ru      */ "Строк: {lines}, {percent}%",
+        /* zh_hans */ "{lines} 行，{percent}%",
+        /* zh_hant */ "{lines} 行，{percent}%",
+    ],
+    // ConfigUnknownKey (status bar)
+    [
+        /* en      */ "Unknown setting: {key}",
+        /* de      */ "Unbekannte Einstellung: {key}",
+        /* es      */ "Ajuste desconocido: {key}",
+        /* fr      */ "Paramètre inconnu : {key}",
+        /* it      */ "Impostazione sconosciuta: {key}",
+        /* ja      */ "不明な設定: {key}",
+        /* ko      */ "알 수 없는 설정: {key}",
+        /* pt_br   */ "Configuração desconhecida: {key}",
+        /* ru      */ "Неизвестный параметр: {key}",
+        /* zh_hans */ "未知设置：{key}",
+        /* zh_hant */ "未知的設定：{key}",
+    ],
+    // ConfigInvalidValue (status bar)
+    [
+        /* en      */ "Invalid value for {key}",
+        /* de      */ "Ungültiger Wert für {key}",
+        /* es      */ "Valor no válido para {key}",
+        /* fr      */ "Valeur non valide pour {key}",
+        /* it      */ "Valore non valido per {key}",
+        /* ja      */ "{key} の値が無効です",
+        /* ko      */ "{key}의 값이 잘못되었습니다",
+        /* pt_br   */ "Valor inválido para {key}",
+        /* ru      */ "Недопустимое значение для {key}",
+        /* zh_hans */ "{key} 的值无效",
+        /* zh_hant */ "{key} 的值無效",
+    ],
+    // ConfigUnknownCommand (status bar)
+    [
+        /* en      */ "Unknown command: {command}",
+        /* de      */ "Unbekannter Befehl: {command}",
+        /* es      */ "Comando desconocido: {command}",
+        /* fr      */ "Commande inconnue : {command}",
+        /* it      */ "Comando sconosciuto: {command}",
+        /* ja      */ "不明なコマンド: {command}",
+        /* ko      */ "알 수 없는 명령: {command}",
+        /* pt_br   */ "Comando desconhecido: {command}",
+        /* ru      */ "Неизвестная команда: {command}",
+        /* zh_hans */ "未知命令：{command}",
+        /* zh_hant */ "未知的命令：{command}",
+    ],
+    // ConfigKeyConflict (status bar)
+    [
+        /* en      */ "{key} is bound more than once, using {command}",
+        /* de      */ "{key} ist mehrfach belegt, {command} wird verwendet",
+        /* es      */ "{key} está asignado más de una vez; se usa {command}",
+        /* fr      */ "{key} est attribué plusieurs fois, {command} est utilisé",
+        /* it      */ "{key} è assegnato più volte, viene usato {command}",
+        /* ja      */ "{key} が複数回割り当てられています。{command} を使用します",
+        /* ko      */ "{key}이(가) 여러 번 할당되었습니다. {command}을(를) 사용합니다",
+        /* pt_br   */ "{key} está atribuído mais de uma vez; usando {command}",
+        /* ru      */ "{key} назначено несколько раз, используется {command}",
+        /* zh_hans */ "{key} 被多次绑定，使用 {command}",
+        /* zh_hant */ "{key} 被多次繫結，使用 {command}",
+    ],
+    // ConfigSetUsage (status bar)
+    [
+        /* en      */ "Usage: set key=value, or set! key=value to also save it to the config file",
+        /* de      */ "Verwendung: set Schlüssel=Wert, oder set! Schlüssel=Wert, um es auch in der Konfigurationsdatei zu speichern",
+        /* es      */ "Uso: set clave=valor, o set! clave=valor para guardarlo también en el archivo de configuración",
+        /* fr      */ "Utilisation : set clé=valeur, ou set! clé=valeur pour l’enregistrer aussi dans le fichier de configuration",
+        /* it      */ "Uso: set chiave=valore, oppure set! chiave=valore per salvarlo anche nel file di configurazione",
+        /* ja      */ "使い方: set キー=値 (設定ファイルにも保存するには set! キー=値)",
+        /* ko      */ "사용법: set 키=값, 구성 파일에도 저장하려면 set! 키=값",
+        /* pt_br   */ "Uso: set chave=valor, ou set! chave=valor para salvar também no arquivo de configuração",
+        /* ru      */ "Использование: set ключ=значение или set! ключ=значение, чтобы также сохранить в файле конфигурации",
+        /* zh_hans */ "用法：set 键=值，或用 set! 键=值 同时保存到配置文件",
+        /* zh_hant */ "用法：set 鍵=值，或用 set! 鍵=值 同時儲存到設定檔",
+    ],
 
     // EncodingReopen
     [
@@ -959,6 +1717,90 @@ const S_LANG_LUT: [[&str; LangId::Count as usize]; LocId::Count as usize] = [
         /* zh_hans */ "文件已存在。要覆盖它吗？",
         /* zh_hant */ "檔案已存在。要覆蓋它嗎？",
     ],
+    // FileCreatePrompt
+    [
+        /* en      */ "Create New File",
+        /* de      */ "Neue Datei erstellen",
+        /* es      */ "Crear archivo nuevo",
+        /* fr      */ "Créer un nouveau fichier",
+        /* it      */ "Crea nuovo file",
+        /* ja      */ "新しいファイルの作成",
+        /* ko      */ "새 파일 만들기",
+        /* pt_br   */ "Criar novo arquivo",
+        /* ru      */ "Создать новый файл",
+        /* zh_hans */ "创建新文件",
+        /* zh_hant */ "建立新檔案",
+    ],
+    // FileCreatePromptDescription
+    [
+        /* en      */ "File does not exist. Do you want to create it?",
+        /* de      */ "Datei existiert nicht. Möchten Sie sie erstellen?",
+        /* es      */ "El archivo no existe. ¿Desea crearlo?",
+        /* fr      */ "Le fichier n’existe pas. Voulez-vous le créer ?",
+        /* it      */ "Il file non esiste. Vuoi crearlo?",
+        /* ja      */ "ファイルが存在しません。作成しますか？",
+        /* ko      */ "파일이 존재하지 않습니다. 만드시겠습니까?",
+        /* pt_br   */ "O arquivo não existe. Deseja criá-lo?",
+        /* ru      */ "Файл не существует. Создать его?",
+        /* zh_hans */ "文件不存在。要创建它吗？",
+        /* zh_hant */ "檔案不存在。要建立它嗎？",
+    ],
+    // BufferReadOnly
+    [
+        /* en      */ "Buffer is read-only",
+        /* de      */ "Puffer ist schreibgeschützt",
+        /* es      */ "El búfer es de solo lectura",
+        /* fr      */ "Le tampon est en lecture seule",
+        /* it      */ "Il buffer è di sola lettura",
+        /* ja      */ "バッファーは読み取り専用です",
+        /* ko      */ "버퍼가 읽기 전용입니다",
+        /* pt_br   */ "O buffer é somente leitura",
+        /* ru      */ "Буфер доступен только для чтения",
+        /* zh_hans */ "缓冲区为只读",
+        /* zh_hant */ "緩衝區為唯讀",
+    ],
+    // ReadOnlySaveTitle
+    [
+        /* en      */ "Save Read-Only File",
+        /* de      */ "Schreibgeschützte Datei speichern",
+        /* es      */ "Guardar archivo de solo lectura",
+        /* fr      */ "Enregistrer le fichier en lecture seule",
+        /* it      */ "Salva file di sola lettura",
+        /* ja      */ "読み取り専用ファイルの保存",
+        /* ko      */ "읽기 전용 파일 저장",
+        /* pt_br   */ "Salvar arquivo somente leitura",
+        /* ru      */ "Сохранение файла только для чтения",
+        /* zh_hans */ "保存只读文件",
+        /* zh_hant */ "儲存唯讀檔案",
+    ],
+    // ReadOnlySaveDescription
+    [
+        /* en      */ "This file is open in read-only mode. Save it anyway?",
+        /* de      */ "Diese Datei ist schreibgeschützt geöffnet. Trotzdem speichern?",
+        /* es      */ "Este archivo está abierto en modo de solo lectura. ¿Guardarlo de todos modos?",
+        /* fr      */ "Ce fichier est ouvert en lecture seule. L’enregistrer quand même ?",
+        /* it      */ "Questo file è aperto in sola lettura. Salvarlo comunque?",
+        /* ja      */ "このファイルは読み取り専用で開かれています。保存しますか？",
+        /* ko      */ "이 파일은 읽기 전용 모드로 열려 있습니다. 그래도 저장하시겠습니까?",
+        /* pt_br   */ "Este arquivo está aberto no modo somente leitura. Salvar mesmo assim?",
+        /* ru      */ "Файл открыт только для чтения. Всё равно сохранить?",
+        /* zh_hans */ "此文件以只读模式打开。仍要保存吗？",
+        /* zh_hant */ "此檔案以唯讀模式開啟。仍要儲存嗎？",
+    ],
+    // IncompleteSaveDescription
+    [
+        /* en      */ "This file couldn't be loaded completely. Saving it cuts it off. Save it anyway?",
+        /* de      */ "Diese Datei konnte nicht vollständig geladen werden. Beim Speichern wird sie abgeschnitten. Trotzdem speichern?",
+        /* es      */ "Este archivo no se pudo cargar por completo. Al guardarlo se recortará. ¿Guardarlo de todos modos?",
+        /* fr      */ "Ce fichier n’a pas pu être chargé entièrement. L’enregistrer le tronquera. L’enregistrer quand même ?",
+        /* it      */ "Non è stato possibile caricare completamente questo file. Salvandolo verrà troncato. Salvarlo comunque?",
+        /* ja      */ "このファイルは完全に読み込めませんでした。保存するとファイルが切り詰められます。保存しますか？",
+        /* ko      */ "이 파일을 완전히 불러오지 못했습니다. 저장하면 파일이 잘립니다. 그래도 저장하시겠습니까?",
+        /* pt_br   */ "Não foi possível carregar este arquivo por completo. Salvá-lo irá truncá-lo. Salvar mesmo assim?",
+        /* ru      */ "Файл не удалось загрузить полностью. При сохранении он будет обрезан. Всё равно сохранить?",
+        /* zh_hans */ "此文件未能完整加载。保存会截断该文件。仍要保存吗？",
+        /* zh_hant */ "此檔案未能完整載入。儲存會截斷該檔案。仍要儲存嗎？",
+    ],
 ];
 
 static mut S_LANG: LangId = LangId::en;
@@ -1,8 +1,10 @@
 // Copyright (c) Microsoft Corporation.
 // Licensed under the MIT License.
 
-#![feature(allocator_api, let_chains, linked_list_cursors, string_from_utf8_lossy_owned)]
+#![feature(allocator_api, let_chains, string_from_utf8_lossy_owned)]
 
+mod clipboard;
+mod config;
 mod documents;
 mod draw_ai_dock;
 mod draw_editor;
@@ -11,16 +13,23 @@ mod draw_folder_browser;
 mod draw_menubar;
 mod draw_statusbar;
 mod draw_tabbar;
+mod formatter;
+mod history;
+mod jumps;
+mod keymap;
 mod localization;
 mod state;
+mod syntax_check;
 
 use std::borrow::Cow;
 #[cfg(feature = "debug-latency")]
 use std::fmt::Write;
 use std::path::{Path, PathBuf};
-use std::time::Duration;
-use std::{env, process};
+use std::time::{Duration, Instant};
+use std::{env, mem, process};
 
+use config::EditorConfig;
+use documents::DiskChange;
 use draw_ai_dock::*;
 use draw_editor::*;
 use draw_filepicker::*;
@@ -36,6 +45,8 @@ use edit::oklab::oklab_blend;
 use edit::tui::*;
 use edit::vt::{self, Token};
 use edit::{apperr, arena_format, base64, path, sys, unicode};
+use history::History;
+use keymap::Command;
 use localization::*;
 use state::*;
 
@@ -44,15 +55,18 @@ const SCRATCH_ARENA_CAPACITY: usize = 128 * MEBI;
 #[cfg(target_pointer_width = "64")]
 const SCRATCH_ARENA_CAPACITY: usize = 512 * MEBI;
 
+/// How often the open files are checked for changes made by other programs.
+const DISK_POLL_INTERVAL: Duration = Duration::from_secs(1);
+
 fn main() -> process::ExitCode {
-    if cfg!(debug_assertions) {
-        let hook = std::panic::take_hook();
-        std::panic::set_hook(Box::new(move |info| {
-            drop(RestoreModes);
-            drop(sys::Deinit);
-            hook(info);
-        }));
-    }
+    // Release builds abort on panic, which skips all destructors. Without this hook the
+    // terminal would be left in the alternate screen with mouse reporting still enabled.
+    let hook = std::panic::take_hook();
+    std::panic::set_hook(Box::new(move |info| {
+        drop(RestoreModes);
+        drop(sys::Deinit);
+        hook(info);
+    }));
 
     match run() {
         Ok(()) => process::ExitCode::SUCCESS,
@@ -72,6 +86,13 @@ fn run() -> apperr::Result<()> {
     localization::init();
 
     let mut state = State::new()?;
+
+    // Read the settings before any document gets created, as they apply to new buffers.
+    let (config, errors) = EditorConfig::load(&mut state.keymap);
+    state.documents.set_config(config);
+    state.documents.set_history(History::load());
+    state.status_message = errors.iter().map(ToString::to_string).collect::<Vec<_>>().join(", ");
+
     if handle_args(&mut state)? {
         return Ok(());
     }
@@ -88,11 +109,8 @@ fn run() -> apperr::Result<()> {
 
     let _restore = setup_terminal(&mut tui, &mut state, &mut vt_parser);
 
-    state.menubar_color_bg = oklab_blend(
-        tui.indexed(IndexedColor::Background),
-        tui.indexed_alpha(IndexedColor::BrightBlue, 1, 2),
-    );
-    state.menubar_color_fg = tui.contrasted(state.menubar_color_bg);
+    tui.set_theme(state.documents.config().theme);
+    tui.set_color_mode(state.documents.config().color_mode());
     let floater_bg = oklab_blend(
         tui.indexed_alpha(IndexedColor::Background, 2, 3),
         tui.indexed_alpha(IndexedColor::Foreground, 1, 3),
@@ -122,7 +140,21 @@ fn run() -> apperr::Result<()> {
         // Process a batch of input.
         {
             let scratch = scratch_arena(None);
-            let read_timeout = vt_parser.read_timeout().min(tui.read_timeout());
+            let mut read_timeout = vt_parser.read_timeout().min(tui.read_timeout());
+            if state.documents.iter().any(|doc| doc.path.is_some()) {
+                // Wake up regularly to notice when other programs change the open files.
+                read_timeout = read_timeout.min(DISK_POLL_INTERVAL);
+            }
+            if let Some(timeout) =
+                state.documents.active().and_then(|doc| doc.syntax_check.as_ref()?.wake_up())
+            {
+                // Wake up to check the syntax once the user stops typing, and to pick up the results.
+                read_timeout = read_timeout.min(timeout);
+            }
+            if state.documents.is_loading() {
+                // Don't wait for input, so that the next chunk gets loaded right away.
+                read_timeout = Duration::ZERO;
+            }
             let Some(input) = sys::read_stdin(&scratch, read_timeout) else {
                 break;
             };
@@ -139,9 +171,16 @@ fn run() -> apperr::Result<()> {
             while {
                 let input = input_iter.next();
                 let more = input.is_some();
-                let mut ctx = tui.create_context(input);
 
-                draw(&mut ctx, &mut state);
+                // Counts aren't recorded, or else replaying the macro would leave one behind.
+                if let Some(recording) = &mut state.macro_recording
+                    && macro_count_digit(input.as_ref()).is_none()
+                    && let Some(step) = input.as_ref().and_then(MacroStep::from_input)
+                {
+                    recording.push(step);
+                }
+
+                draw_input(&mut tui, &mut state, input);
 
                 #[cfg(feature = "debug-latency")]
                 {
@@ -152,6 +191,10 @@ fn run() -> apperr::Result<()> {
             } {}
         }
 
+        if state.wants_macro_playback != 0 {
+            play_macro(&mut tui, &mut state);
+        }
+
         // Continue rendering until the layout has settled.
         // This can take >1 frame, if the input focus is tossed between different controls.
         while tui.needs_settling() {
@@ -229,6 +272,8 @@ fn run() -> apperr::Result<()> {
         }
     }
 
+    // There's no way to report errors anymore, and losing the cursor positions isn't worth bothering about.
+    _ = state.documents.save_history();
     Ok(())
 }
 
@@ -236,6 +281,8 @@ fn run() -> apperr::Result<()> {
 fn handle_args(state: &mut State) -> apperr::Result<bool> {
     let scratch = scratch_arena(None);
     let mut paths: Vec<PathBuf, &Arena> = Vec::new_in(&*scratch);
+    let mut dir = None;
+    let mut read_only = false;
     let mut cwd = env::current_dir()?;
 
     // The best CLI argument parser in the world.
@@ -246,19 +293,32 @@ fn handle_args(state: &mut State) -> apperr::Result<bool> {
         } else if arg == "-v" || arg == "--version" {
             print_version();
             return Ok(true);
+        } else if arg == "-r" || arg == "--readonly" {
+            read_only = true;
+            continue;
         } else if arg == "-" {
             paths.clear();
             break;
         }
         let p = cwd.join(Path::new(&arg));
         let p = path::normalize(&p);
-        if !p.is_dir() {
+        if p.is_dir() {
+            dir = Some(p);
+        } else {
             paths.push(p);
         }
     }
 
+    // A directory can't be edited as text. Its contents are listed in the folder browser instead.
+    if let Some(dir) = dir {
+        state.folder_browser_visible = true;
+        state.folder_browser_current_dir = DisplayablePathBuf::from_path(dir.clone());
+        state.folder_browser_entries = None;
+        cwd = dir;
+    }
+
     for p in &paths {
-        state.documents.add_file_path(p)?;
+        state.documents.add_file_path(p)?.set_read_only(read_only);
     }
     if let Some(parent) = paths.first().and_then(|p| p.parent()) {
         cwd = parent.to_path_buf();
@@ -266,6 +326,7 @@ fn handle_args(state: &mut State) -> apperr::Result<bool> {
 
     if let Some(mut file) = sys::open_stdin_if_redirected() {
         let doc = state.documents.add_untitled()?;
+        doc.set_read_only(read_only);
         let mut tb = doc.buffer.borrow_mut();
         tb.read_file(&mut file, None)?;
         tb.mark_as_dirty();
@@ -284,6 +345,7 @@ fn print_help() {
         "Options:\r\n",
         "    -h, --help       Print this help message\r\n",
         "    -v, --version    Print the version number\r\n",
+        "    -r, --readonly   Open the files in read-only mode\r\n",
         "\r\n",
         "Arguments:\r\n",
         "    FILE[:LINE[:COLUMN]]    The file to open, optionally with line and column (e.g., foo.txt:123:45)\r\n",
@@ -294,7 +356,156 @@ fn print_version() {
     sys::write_stdout(concat!("edit version ", env!("CARGO_PKG_VERSION"), "\r\n"));
 }
 
+/// Alt plus these is typed before the macro playback shortcut to repeat it,
+/// like a prefix argument in Emacs.
+const MACRO_COUNT_DIGITS: [input::InputKey; 10] =
+    [vk::N0, vk::N1, vk::N2, vk::N3, vk::N4, vk::N5, vk::N6, vk::N7, vk::N8, vk::N9];
+
+/// Returns the digit if `input` is one of Alt+0 to Alt+9, which give the next shortcut a count.
+fn macro_count_digit(input: Option<&input::Input>) -> Option<usize> {
+    match input {
+        Some(&input::Input::Keyboard(key)) => {
+            MACRO_COUNT_DIGITS.iter().position(|&digit| key == kbmod::ALT | digit)
+        }
+        _ => None,
+    }
+}
+
+fn draw_input(tui: &mut Tui, state: &mut State, input: Option<input::Input>) {
+    if let Some(digit) = macro_count_digit(input.as_ref()) {
+        state.macro_count = state.macro_count.saturating_mul(10).saturating_add(digit);
+        let mut ctx = tui.create_context(None);
+        draw(&mut ctx, state);
+        return;
+    }
+    // The count only applies to the shortcut that comes right after it.
+    let resets_macro_count = matches!(
+        input,
+        Some(input::Input::Keyboard(_) | input::Input::Text(_) | input::Input::Paste(_))
+    );
+
+    // Pick up whatever other applications copied before the textarea pastes it.
+    // Bracketed paste (`Input::Paste`) already carries its text and is left alone.
+    if let Some(input::Input::Keyboard(key)) = input
+        && (key == kbmod::CTRL | vk::V || key == kbmod::SHIFT | vk::INSERT)
+        && let Some(system_clipboard) = &state.system_clipboard
+    {
+        system_clipboard.read_into(tui.clipboard_mut());
+    }
+
+    let mut ctx = tui.create_context(input);
+    draw(&mut ctx, state);
+
+    if resets_macro_count {
+        state.macro_count = 0;
+    }
+}
+
+/// Runs the recorded macro again, `state.wants_macro_playback` times.
+/// Stops early if a step fails: a command that doesn't apply or reports an error
+/// (e.g. "No matching bracket"), a prompt line that's invalid, or a search that didn't find anything.
+fn play_macro(tui: &mut Tui, state: &mut State) {
+    let count = mem::take(&mut state.wants_macro_playback);
+    let steps = mem::take(&mut state.macro_steps);
+    state.macro_playing = true;
+    state.status_message.clear();
+
+    'outer: for run in 1..=count {
+        for step in &steps {
+            let search_no_matches = state.search_no_matches;
+            state.command_failed = false;
+
+            match step {
+                MacroStep::Command(command) => {
+                    let mut ctx = tui.create_context(None);
+                    draw(&mut ctx, state);
+                    state.command_failed |= !run_command(&mut ctx, state, *command);
+                    ctx.needs_rerender();
+                }
+                MacroStep::Prompt(line) => {
+                    let mut ctx = tui.create_context(None);
+                    draw(&mut ctx, state);
+                    if let Err(err) = run_command_line(&mut ctx, state, line) {
+                        state.status_message = err.to_string();
+                        state.command_failed = true;
+                    }
+                    ctx.needs_rerender();
+                }
+                MacroStep::Text(text) => draw_input(tui, state, Some(input::Input::Text(text))),
+                MacroStep::Paste(data) => {
+                    draw_input(tui, state, Some(input::Input::Paste(data.clone())))
+                }
+                MacroStep::Keyboard(key) => {
+                    draw_input(tui, state, Some(input::Input::Keyboard(*key)))
+                }
+            }
+            // The next step must go to wherever the focus ends up, e.g. a dialog that just opened.
+            while tui.needs_settling() {
+                let mut ctx = tui.create_context(None);
+                draw(&mut ctx, state);
+            }
+
+            if state.exit {
+                break 'outer;
+            }
+            if state.command_failed || (state.search_no_matches && !search_no_matches) {
+                let mut message = loc(LocId::MacroStopped)
+                    .replace("{run}", &run.to_string())
+                    .replace("{count}", &count.to_string());
+                if !state.status_message.is_empty() {
+                    message = format!("{message}: {}", state.status_message);
+                }
+                state.status_message = message;
+                break 'outer;
+            }
+        }
+    }
+
+    state.macro_steps = steps;
+    state.macro_playing = false;
+
+    // One more pass, so that the message above is shown.
+    let mut ctx = tui.create_context(None);
+    draw(&mut ctx, state);
+}
+
 fn draw(ctx: &mut Context, state: &mut State) {
+    if !state.status_message.is_empty() && ctx.keyboard_input().is_some() {
+        state.status_message.clear();
+    }
+    if state.documents.is_loading() {
+        draw_handle_loading(ctx, state);
+    }
+    if state.disk_poll_time.elapsed() >= DISK_POLL_INTERVAL {
+        draw_handle_disk_changes(ctx, state);
+    }
+    if let Some(doc) = state.documents.active_mut()
+        && doc.loading.is_none()
+        && let Some(check) = &mut doc.syntax_check
+        && check.poll(&mut doc.buffer.borrow_mut())
+    {
+        ctx.needs_rerender();
+    }
+    if state.split.as_ref().is_some_and(|split| split.chord) {
+        split_handle_chord(ctx, state);
+    }
+    // The moves of the last frame are tracked at the start of the next one,
+    // no matter where in the frame they happened.
+    if let Some(doc) = state.documents.active_mut() {
+        let pos = doc.buffer.borrow().cursor_logical_pos();
+        doc.jumps.track(pos);
+    }
+
+    // The theme can be changed at runtime, so the bar colors are picked anew for every frame.
+    state.menubar_color_bg = ctx.theme_color(
+        ctx.theme().statusbar,
+        oklab_blend(
+            ctx.indexed(IndexedColor::Background),
+            ctx.indexed_alpha(IndexedColor::BrightBlue, 1, 2),
+        ),
+    );
+    state.menubar_color_fg = ctx.contrasted(state.menubar_color_bg);
+
     draw_menubar(ctx, state);
     draw_tabbar(ctx, state);
     
@@ -318,7 +529,17 @@ fn draw(ctx: &mut Context, state: &mut State) {
         // Just editor taking full width
         draw_editor(ctx, state);
     }
-    
+
+    if let Some(doc) = state.documents.active()
+        && doc.buffer.borrow_mut().take_refused_edit()
+    {
+        state.status_message = loc(LocId::BufferReadOnly).to_string();
+        state.command_failed = true;
+    }
+
+    if state.wants_command_prompt {
+        draw_command_prompt(ctx, state);
+    }
     draw_statusbar(ctx, state);
     draw_ai_dock(ctx, state); // Draw AI dock above status bar
 
@@ -337,12 +558,18 @@ fn draw(ctx: &mut Context, state: &mut State) {
     if state.wants_save {
         draw_handle_save(ctx, state);
     }
+    if !state.disk_changed.is_empty() {
+        draw_dialog_disk_changed(ctx, state);
+    }
     if state.wants_encoding_change != StateEncodingChange::None {
         draw_dialog_encoding_change(ctx, state);
     }
     if state.wants_go_to_file {
         draw_go_to_file(ctx, state);
     }
+    if state.wants_recent_files {
+        draw_recent_files(ctx, state);
+    }
     if state.wants_about {
         draw_dialog_about(ctx, state);
     }
@@ -353,98 +580,206 @@ fn draw(ctx: &mut Context, state: &mut State) {
         draw_error_log(ctx, state);
     }
 
-    if let Some(key) = ctx.keyboard_input() {
+    if let Some(key) = ctx.keyboard_input()
+        && let Some(command) = state.keymap.lookup(key)
+    {
         // Shortcuts that are not handled as part of the textarea, etc.
+        if !run_command(ctx, state, command) {
+            return;
+        }
 
-        if key == kbmod::CTRL | vk::N {
-            draw_add_untitled_document(ctx, state);
-        } else if key == kbmod::CTRL | vk::O {
-            state.wants_file_picker = StateFilePicker::Open;
-        } else if key == kbmod::CTRL | vk::S {
-            state.wants_save = true;
-        } else if key == kbmod::CTRL_SHIFT | vk::S {
-            state.wants_file_picker = StateFilePicker::SaveAs;
-        } else if key == kbmod::CTRL | vk::W {
-            state.wants_close = true;
-        } else if key == kbmod::ALT | vk::W && state.documents.len() > 1 {
-            // Close current tab with Alt+W (only if multiple tabs open)
+        // Macros record the command instead of the key, which was recorded before it got here.
+        if let Some(steps) = &mut state.macro_recording
+            && !matches!(command, Command::RecordMacro | Command::PlayMacro)
+        {
+            if matches!(steps.last(), Some(MacroStep::Keyboard(k)) if *k == key) {
+                steps.pop();
+            }
+            steps.push(MacroStep::Command(command));
+        }
+
+        // All commands happen to require a rerender.
+        ctx.needs_rerender();
+        ctx.set_input_consumed();
+    }
+}
+
+/// Executes a command that was bound to a key in the [`keymap::Keymap`].
+/// Returns false if the command doesn't apply right now, in which case the key is left unhandled.
+fn run_command(ctx: &mut Context, state: &mut State, command: Command) -> bool {
+    let search_enabled = state.wants_search.kind != StateSearchKind::Disabled;
+    let tab_count = state.documents.len();
+
+    match command {
+        Command::New => draw_add_untitled_document(ctx, state),
+        Command::Open => state.wants_file_picker = StateFilePicker::Open,
+        Command::Save => state.wants_save = true,
+        Command::SaveAs => state.wants_file_picker = StateFilePicker::SaveAs,
+        // Can't reopen a file that doesn't exist.
+        Command::ReopenWithEncoding
+            if state.documents.active().is_some_and(|doc| doc.path.is_some()) =>
+        {
+            state.wants_encoding_change = StateEncodingChange::Reopen
+        }
+        // While the editor is split, the close shortcut is the prefix for the pane commands.
+        Command::Close => match &mut state.split {
+            Some(split) => split.chord = true,
+            None => state.wants_close = true,
+        },
+        // Closes the tab right away, unless it has unsaved changes (only if multiple tabs are open).
+        Command::CloseTab if tab_count > 1 => {
             let active_index = state.documents.active_index();
             if let Some(doc) = state.documents.active() {
                 if doc.buffer.borrow().is_dirty() {
-                    // If dirty, show close confirmation
                     state.wants_close = true;
                 } else {
-                    // Close without confirmation
                     state.documents.remove_at_index(active_index);
                 }
             }
-        } else if key == kbmod::CTRL | vk::P {
-            state.wants_go_to_file = true;
-        } else if key == kbmod::CTRL | vk::Q {
-            state.wants_exit = true;
-        } else if key == kbmod::CTRL | vk::G {
-            state.wants_goto = true;
-        } else if key == kbmod::CTRL | vk::F && state.wants_search.kind != StateSearchKind::Disabled
-        {
+        }
+        Command::GoToFile => state.wants_go_to_file = true,
+        Command::RecentFiles => state.wants_recent_files = true,
+        Command::Exit => state.wants_exit = true,
+        Command::GotoLine => state.wants_goto = true,
+        Command::RecordMacro if !state.macro_playing => {
+            // Don't record the shortcut or prompt line that stopped the recording.
+            if state.wants_command_prompt {
+                state.macro_record_prompt(None);
+            }
+            match state.macro_recording.take() {
+                Some(mut steps) => {
+                    if ctx.keyboard_input().and_then(|key| state.keymap.lookup(key))
+                        == Some(Command::RecordMacro)
+                    {
+                        steps.pop();
+                    }
+                    state.macro_steps = steps;
+                }
+                None => state.macro_recording = Some(Vec::new()),
+            }
+        }
+        // Plays the macro once, or as many times as typed with Alt+digits beforehand.
+        Command::PlayMacro if !state.macro_playing && state.macro_recording.is_none() => {
+            if state.macro_steps.is_empty() {
+                state.status_message = loc(LocId::MacroNone).to_string();
+                state.command_failed = true;
+            } else {
+                state.wants_macro_playback = state.macro_count.max(1);
+            }
+        }
+        Command::PasteReindented => {
+            if let Some(doc) = state.documents.active() {
+                if let Some(system_clipboard) = &state.system_clipboard {
+                    system_clipboard.read_into(ctx.clipboard_mut());
+                }
+                let clipboard = ctx.clipboard_ref();
+                let mut tb = doc.buffer.borrow_mut();
+                if tb.has_extra_cursors() {
+                    tb.for_each_cursor(|tb| tb.paste_reindented(clipboard));
+                } else {
+                    tb.paste_reindented(clipboard);
+                }
+                tb.make_cursor_visible();
+            }
+        }
+        Command::MatchingBracket => {
+            if let Some(doc) = state.documents.active() {
+                let mut tb = doc.buffer.borrow_mut();
+                if tb.jump_to_matching_bracket() {
+                    tb.make_cursor_visible();
+                    doc.jumps.mark();
+                } else {
+                    state.status_message = loc(LocId::NoMatchingBracket).to_string();
+                    state.command_failed = true;
+                }
+            }
+        }
+        Command::JumpBack | Command::JumpForward => {
+            if let Some(doc) = state.documents.active_mut() {
+                let mut tb = doc.buffer.borrow_mut();
+                let current = tb.cursor_logical_pos();
+                let target = if command == Command::JumpBack {
+                    doc.jumps.back(current)
+                } else {
+                    doc.jumps.forward(current)
+                };
+                match target {
+                    Some(pos) => {
+                        // The text may have been edited since, so the position may be clamped.
+                        tb.cursor_move_to_logical(pos);
+                        tb.make_cursor_centered();
+                        doc.jumps.arrived(tb.cursor_logical_pos());
+                    }
+                    None => {
+                        state.status_message = loc(LocId::NoJumpPosition).to_string();
+                        state.command_failed = true;
+                    }
+                }
+            }
+        }
+        Command::ToggleFold => {
+            if let Some(doc) = state.documents.active() {
+                let mut tb = doc.buffer.borrow_mut();
+                if tb.toggle_fold() {
+                    tb.make_cursor_visible();
+                } else {
+                    state.status_message = loc(LocId::NoFoldRegion).to_string();
+                    state.command_failed = true;
+                }
+            }
+        }
+        Command::UnfoldAll => {
+            if let Some(doc) = state.documents.active() {
+                doc.buffer.borrow_mut().unfold_all();
+            }
+        }
+        // Cycles through: line numbers -> relative line numbers -> no line numbers.
+        Command::CycleLineNumbers => {
+            if let Some(doc) = state.documents.active() {
+                let mut tb = doc.buffer.borrow_mut();
+                if !tb.is_margin_enabled() {
+                    tb.set_margin_enabled(true);
+                    tb.set_margin_relative(false);
+                } else if !tb.is_margin_relative() {
+                    tb.set_margin_relative(true);
+                } else {
+                    tb.set_margin_enabled(false);
+                }
+            }
+        }
+        Command::ToggleWhitespace => {
+            if let Some(doc) = state.documents.active() {
+                let mut tb = doc.buffer.borrow_mut();
+                let visible = tb.is_whitespace_visible();
+                tb.set_whitespace_visible(!visible);
+            }
+        }
+        Command::Find if search_enabled => {
             state.wants_search.kind = StateSearchKind::Search;
             state.wants_search.focus = true;
-        } else if key == kbmod::CTRL | vk::R && state.wants_search.kind != StateSearchKind::Disabled
-        {
+        }
+        Command::Replace if search_enabled => {
             state.wants_search.kind = StateSearchKind::Replace;
             state.wants_search.focus = true;
-        } else if key == vk::F3 {
-            search_execute(ctx, state, SearchAction::Search);
-        } else if key == kbmod::CTRL | vk::TAB && state.documents.len() > 1 {
-            // Switch to next tab
-            let active_index = state.documents.active_index();
-            let next_index = (active_index + 1) % state.documents.len();
-            state.documents.set_active_index(next_index);
-        } else if key == kbmod::CTRL_SHIFT | vk::TAB && state.documents.len() > 1 {
-            // Switch to previous tab
-            let active_index = state.documents.active_index();
-            let prev_index = if active_index == 0 { 
-                state.documents.len() - 1 
-            } else { 
-                active_index - 1 
-            };
-            state.documents.set_active_index(prev_index);
-        } else if key == kbmod::CTRL | vk::N1 && state.documents.len() > 0 {
-            state.documents.set_active_index(0);
-        } else if key == kbmod::CTRL | vk::N2 && state.documents.len() > 1 {
-            state.documents.set_active_index(1);
-        } else if key == kbmod::CTRL | vk::N3 && state.documents.len() > 2 {
-            state.documents.set_active_index(2);
-        } else if key == kbmod::CTRL | vk::N4 && state.documents.len() > 3 {
-            state.documents.set_active_index(3);
-        } else if key == kbmod::CTRL | vk::N5 && state.documents.len() > 4 {
-            state.documents.set_active_index(4);
-        } else if key == kbmod::CTRL | vk::N6 && state.documents.len() > 5 {
-            state.documents.set_active_index(5);
-        } else if key == kbmod::CTRL | vk::N7 && state.documents.len() > 6 {
-            state.documents.set_active_index(6);
-        } else if key == kbmod::CTRL | vk::N8 && state.documents.len() > 7 {
-            state.documents.set_active_index(7);
-        } else if key == kbmod::CTRL | vk::N9 && state.documents.len() > 8 {
-            state.documents.set_active_index(8);
-        } else if key == kbmod::CTRL_ALT | vk::B {
-            // Toggle AI dock
+        }
+        Command::FindNext => search_execute(ctx, state, SearchAction::Search),
+        Command::FindPrevious => search_execute(ctx, state, SearchAction::SearchPrevious),
+        Command::NextTab if tab_count > 1 => state.documents.cycle_active(1),
+        Command::PreviousTab if tab_count > 1 => state.documents.cycle_active(-1),
+        Command::ActivateTab(index) if index < tab_count => state.documents.set_active_index(index),
+        Command::ToggleAiDock => {
             state.ai_dock_visible = !state.ai_dock_visible;
-            if state.ai_dock_visible {
-                state.ai_dock_focused = true;
-            } else {
-                state.ai_dock_focused = false;
-            }
-        } else if key == vk::F4 {
-            // Toggle folder browser
-            toggle_folder_browser(state);
-        } else {
-            return;
+            state.ai_dock_focused = state.ai_dock_visible;
         }
-
-        // All of the above shortcuts happen to require a rerender.
-        ctx.needs_rerender();
-        ctx.set_input_consumed();
+        Command::ToggleFolderBrowser => toggle_folder_browser(state),
+        Command::Prompt => state.wants_command_prompt = true,
+        Command::SplitVertical => split_open(state, SplitDirection::Vertical),
+        Command::SplitHorizontal => split_open(state, SplitDirection::Horizontal),
+        Command::CloseSplit => state.split = None,
+        _ => return false,
     }
+
+    true
 }
 
 fn draw_handle_wants_exit(_ctx: &mut Context, state: &mut State) {
@@ -473,9 +808,74 @@ fn write_terminal_title(output: &mut ArenaString, filename: &str) {
     output.push_str("edit\x1b\\");
 }
 
+fn draw_handle_disk_changes(ctx: &mut Context, state: &mut State) {
+    state.disk_poll_time = Instant::now();
+
+    for index in 0..state.documents.len() {
+        let Some(doc) = state.documents.get_mut(index) else {
+            continue;
+        };
+        let Some(change) = doc.poll_disk_change() else {
+            continue;
+        };
+
+        let result = match change {
+            // Neither side gets clobbered. The user gets to decide.
+            DiskChange::Modified if doc.buffer.borrow().is_dirty() => {
+                state.disk_changed.push(doc.buffer.clone());
+                ctx.needs_rerender();
+                continue;
+            }
+            DiskChange::Modified => doc.reload().map(|()| LocId::DiskChangedReloaded),
+            DiskChange::Deleted => {
+                // The buffer is the only copy now, so closing it should ask to save it.
+                doc.buffer.borrow_mut().mark_as_dirty();
+                Ok(LocId::DiskChangedDeleted)
+            }
+        };
+        let filename = doc.filename.clone();
+
+        match result {
+            Ok(message) => state.status_message = loc(message).replace("{filename}", &filename),
+            Err(err) => error_log_add(ctx, state, err),
+        }
+        ctx.needs_rerender();
+    }
+}
+
+fn draw_handle_loading(ctx: &mut Context, state: &mut State) {
+    // Ctrl+C cancels loading the active document, which closes it, as it's incomplete.
+    if state.documents.active().is_some_and(|doc| doc.loading.is_some())
+        && ctx.consume_shortcut(kbmod::CTRL | vk::C)
+    {
+        state.documents.remove_active();
+        state.status_message = loc(LocId::LoadingCancelled).to_string();
+        ctx.needs_rerender();
+        return;
+    }
+
+    if let Err(err) = state.documents.load_pending() {
+        error_log_add(ctx, state, err);
+    }
+}
+
 const LARGE_CLIPBOARD_THRESHOLD: usize = 128 * KIBI;
 
 fn draw_handle_clipboard_change(ctx: &mut Context, state: &mut State) {
+    if let Some(system_clipboard) = &state.system_clipboard {
+        if system_clipboard.write(ctx.clipboard_ref().read()) {
+            ctx.clipboard_mut().mark_as_synchronized();
+            return;
+        }
+        // The tool failed on an earlier write (e.g. the display server went away).
+        // That one is lost, but this one can still go out via OSC 52. Don't try again.
+        state.system_clipboard = None;
+    }
+    if !state.system_clipboard_warned {
+        state.system_clipboard_warned = true;
+        state.status_message = loc(LocId::SystemClipboardUnavailable).to_string();
+    }
+
     let data_len = ctx.clipboard_ref().read().len();
 
     if state.osc_clipboard_always_send || data_len < LARGE_CLIPBOARD_THRESHOLD {
@@ -592,7 +992,10 @@ impl Drop for RestoreModes {
         // Same as in the beginning but in the reverse order.
         // It also includes DECSCUSR 0 to reset the cursor style and DECTCEM to show the cursor.
         // We specifically don't reset mode 1036, because most applications expect it to be set nowadays.
-        sys::write_stdout("\x1b[0 q\x1b[?25h\x1b]0;\x07\x1b[?1002;1006;2004l\x1b[?1049l");
+        // The kitty keyboard flags must be popped before leaving the ASB, because each screen has its own.
+        sys::write_stdout(
+            "\x1b[<u\x1b[>4m\x1b[0 q\x1b[?25h\x1b]0;\x07\x1b[?1002;1006;2004l\x1b[?1049l",
+        );
     }
 }
 
@@ -606,6 +1009,10 @@ fn setup_terminal(tui: &mut Tui, state: &mut State, vt_parser: &mut vt::Parser)
         // 2004: Bracketed Paste Mode
         // 1036: Xterm: "meta sends escape" (Alt keypresses should be encoded with ESC + char)
         "\x1b[?1049h\x1b[?1002;1006;2004h\x1b[?1036h",
+        // Xterm's modifyOtherKeys level 1 and the kitty keyboard protocol's "disambiguate" flag.
+        // Without them, shortcuts like Ctrl+Shift+S arrive as Ctrl+S. Terminals that support
+        // neither ignore these. See `parse_modified_key` in the input parser for the encodings.
+        "\x1b[>4;1m\x1b[>1u",
         // OSC 4 color table requests for indices 0 through 15 (base colors).
         "\x1b]4;0;?;1;?;2;?;3;?;4;?;5;?;6;?;7;?\x07",
         "\x1b]4;8;?;9;?;10;?;11;?;12;?;13;?;14;?;15;?\x07",
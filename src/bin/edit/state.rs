@@ -5,13 +5,19 @@ use std::borrow::Cow;
 use std::ffi::{OsStr, OsString};
 use std::mem;
 use std::path::{Path, PathBuf};
+use std::rc::Weak;
+use std::time::Instant;
 
+use edit::buffer::{RcTextBuffer, TextBufferCell};
 use edit::framebuffer::IndexedColor;
 use edit::helpers::*;
+use edit::input::{Input, InputKey};
 use edit::tui::*;
 use edit::{apperr, buffer, icu, sys};
 
+use crate::clipboard::SystemClipboard;
 use crate::documents::DocumentManager;
+use crate::keymap::{Command, Keymap};
 use crate::localization::*;
 
 #[repr(transparent)]
@@ -120,6 +126,63 @@ pub enum StateEncodingChange {
     Reopen,
 }
 
+#[derive(Clone, Copy, PartialEq, Eq)]
+pub enum SplitDirection {
+    /// The panes are side by side.
+    Vertical,
+    /// The panes are stacked on top of each other.
+    Horizontal,
+}
+
+/// The editor is split into two panes. The focused pane always shows the active document,
+/// so that the tabs, menus and the statusbar all apply to it without knowing about panes.
+pub struct StateSplit {
+    pub direction: SplitDirection,
+    /// Which pane has the focus. 0 is the left or top one.
+    pub focused: usize,
+    /// The document in the other pane and where its cursor was when it lost the focus.
+    /// Both panes may show the same document.
+    pub other: RcTextBuffer,
+    pub other_cursor: Point,
+    /// The focus was moved with the keyboard and the pane has yet to take it.
+    pub wants_focus: bool,
+    /// The close shortcut was pressed and the next key picks a pane command.
+    pub chord: bool,
+}
+
+/// An entry in the list of recently opened files.
+pub struct StateRecentFile {
+    pub path: PathBuf,
+    pub filename: String,
+    pub dir: DisplayablePathBuf,
+    /// Files that no longer exist are still listed, but greyed out.
+    pub exists: bool,
+}
+
+/// A step of a macro. Commands are recorded as they're dispatched, while input that's
+/// handled by the text area or a dialog, like typing, is recorded as is.
+/// Mouse input isn't recorded, because its coordinates are unlikely to mean the same on replay.
+pub enum MacroStep {
+    /// A command from the keymap, independent of the key it's bound to.
+    Command(Command),
+    /// A line run in the command prompt, e.g. `goto 10`.
+    Prompt(String),
+    Text(String),
+    Paste(Vec<u8>),
+    Keyboard(InputKey),
+}
+
+impl MacroStep {
+    pub fn from_input(input: &Input) -> Option<Self> {
+        match input {
+            Input::Text(text) => Some(Self::Text(text.to_string())),
+            Input::Paste(data) => Some(Self::Paste(data.clone())),
+            Input::Keyboard(key) => Some(Self::Keyboard(*key)),
+            _ => None,
+        }
+    }
+}
+
 #[derive(Clone, Copy, PartialEq, Eq)]
 pub enum AiDockSize {
     Minimized,  // Single line with title and up arrow
@@ -143,14 +206,19 @@ pub struct State {
     pub file_picker_pending_dir_revision: u64, // Bumped every time `file_picker_pending_dir` changes.
     pub file_picker_pending_name: PathBuf,
     pub file_picker_entries: Option<[Vec<DisplayablePathBuf>; 3]>, // ["..", directories, files]
-    pub file_picker_overwrite_warning: Option<PathBuf>,            // The path the warning is about.
+    pub file_picker_confirm: Option<PathBuf>, // A path to overwrite when saving, or to create when opening.
     pub file_picker_autocomplete: Vec<DisplayablePathBuf>,
 
+    pub split: Option<StateSplit>,
+
     pub wants_search: StateSearch,
     pub search_needle: String,
     pub search_replacement: String,
     pub search_options: buffer::SearchOptions,
     pub search_success: bool,
+    pub search_no_matches: bool,
+    // Restored when the search is cancelled, unless another document has become active since.
+    pub search_cursor_origin: Option<(Weak<TextBufferCell>, Point)>,
 
     pub wants_encoding_picker: bool,
     pub wants_encoding_change: StateEncodingChange,
@@ -159,14 +227,40 @@ pub struct State {
 
     pub wants_save: bool,
     pub wants_statusbar_focus: bool,
+    pub wants_editor_focus: bool,
     pub wants_indentation_picker: bool,
     pub wants_go_to_file: bool,
+    pub wants_recent_files: bool,
+    pub recent_files: Option<Vec<StateRecentFile>>,
     pub wants_about: bool,
     pub wants_close: bool,
     pub wants_exit: bool,
     pub wants_goto: bool,
     pub goto_target: String,
     pub goto_invalid: bool,
+    pub wants_command_prompt: bool,
+    pub command_prompt_text: String,
+    pub command_prompt_invalid: bool,
+    pub command_history: Vec<String>,
+    pub command_history_index: usize,
+
+    // Macros only live for the session. `macro_recording` is `Some` while one is being recorded.
+    pub macro_recording: Option<Vec<MacroStep>>,
+    pub macro_steps: Vec<MacroStep>,
+    pub macro_count: usize, // Typed with Alt+digits before playing the macro.
+    pub wants_macro_playback: usize, // How many times to play it.
+    pub macro_playing: bool,
+
+    // Documents whose files were changed by another program while they had unsaved changes.
+    pub disk_changed: Vec<RcTextBuffer>,
+    pub disk_poll_time: Instant,
+
+    // Shown on the status bar until the next keypress.
+    pub status_message: String,
+    // Set by commands that fail, e.g. with "No matching bracket", so that macro playback stops.
+    pub command_failed: bool,
+
+    pub keymap: Keymap,
 
     // AI Dock
     pub ai_dock_visible: bool,
@@ -186,6 +280,8 @@ pub struct State {
     pub osc_title_filename: String,
     pub osc_clipboard_sync: bool,
     pub osc_clipboard_always_send: bool,
+    pub system_clipboard: Option<SystemClipboard>,
+    pub system_clipboard_warned: bool, // The fallback to the internal clipboard is only announced once.
     pub exit: bool,
 }
 
@@ -206,14 +302,18 @@ impl State {
             file_picker_pending_dir_revision: 0,
             file_picker_pending_name: Default::default(),
             file_picker_entries: None,
-            file_picker_overwrite_warning: None,
+            file_picker_confirm: None,
             file_picker_autocomplete: Vec::new(),
 
+            split: None,
+
             wants_search: StateSearch { kind: StateSearchKind::Hidden, focus: false },
             search_needle: Default::default(),
             search_replacement: Default::default(),
             search_options: Default::default(),
             search_success: true,
+            search_no_matches: false,
+            search_cursor_origin: None,
 
             wants_encoding_picker: false,
             encoding_picker_needle: Default::default(),
@@ -221,15 +321,37 @@ impl State {
 
             wants_save: false,
             wants_statusbar_focus: false,
+            wants_editor_focus: false,
             wants_encoding_change: StateEncodingChange::None,
             wants_indentation_picker: false,
             wants_go_to_file: false,
+            wants_recent_files: false,
+            recent_files: None,
             wants_about: false,
             wants_close: false,
             wants_exit: false,
             wants_goto: false,
             goto_target: Default::default(),
             goto_invalid: false,
+            wants_command_prompt: false,
+            command_prompt_text: Default::default(),
+            command_prompt_invalid: false,
+            command_history: Default::default(),
+            command_history_index: 0,
+
+            macro_recording: None,
+            macro_steps: Vec::new(),
+            macro_count: 0,
+            wants_macro_playback: 0,
+            macro_playing: false,
+
+            disk_changed: Vec::new(),
+            disk_poll_time: Instant::now(),
+
+            status_message: Default::default(),
+            command_failed: false,
+
+            keymap: Default::default(),
 
             // AI Dock initialization
             ai_dock_visible: true,  // Make visible by default for testing
@@ -249,9 +371,27 @@ impl State {
             osc_title_filename: Default::default(),
             osc_clipboard_sync: false,
             osc_clipboard_always_send: false,
+            system_clipboard: SystemClipboard::detect(),
+            system_clipboard_warned: false,
             exit: false,
         })
     }
+
+    /// While recording a macro, replaces what went into the command prompt, starting with
+    /// the command that opened it, with the `line` that was run in it, if any.
+    pub fn macro_record_prompt(&mut self, line: Option<&str>) {
+        let Some(steps) = &mut self.macro_recording else {
+            return;
+        };
+        if let Some(index) =
+            steps.iter().rposition(|step| matches!(step, MacroStep::Command(Command::Prompt)))
+        {
+            steps.truncate(index);
+        }
+        if let Some(line) = line {
+            steps.push(MacroStep::Prompt(line.to_string()));
+        }
+    }
 }
 
 pub fn draw_add_untitled_document(ctx: &mut Context, state: &mut State) {
@@ -266,6 +406,7 @@ pub fn error_log_add(ctx: &mut Context, state: &mut State, err: apperr::Error) {
         state.error_log[state.error_log_index] = msg;
         state.error_log_index = (state.error_log_index + 1) % state.error_log.len();
         state.error_log_count = state.error_log.len().min(state.error_log_count + 1);
+        state.command_failed = true;
         ctx.needs_rerender();
     }
 }
@@ -0,0 +1,172 @@
+// Copyright (c) Pavel Sich.
+// Licensed under the MIT License.
+
+//! Checks Go files for syntax errors while they're being edited.
+//!
+//! Once the text hasn't changed for [`CHECK_DELAY`], a copy of it is piped through `gofmt -e`
+//! on another thread, so that typing doesn't lag. The lines it complains about are marked in
+//! the text buffer. Results for text that has changed in the meantime are thrown away.
+
+use std::io::Write as _;
+use std::process::{Command, Stdio};
+use std::sync::mpsc::{self, Receiver, TryRecvError};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use edit::buffer::TextBuffer;
+use edit::helpers::CoordType;
+
+/// How long the text must stay unchanged before it's checked.
+const CHECK_DELAY: Duration = Duration::from_millis(500);
+/// How often to look for the results of a running check.
+const RESULT_POLL_INTERVAL: Duration = Duration::from_millis(50);
+
+struct Diagnostic {
+    line: CoordType, // 0-based
+    message: String,
+}
+
+/// The syntax check of a single document.
+pub struct SyntaxCheck {
+    // The text buffer generation when `poll` last ran, and when it changed.
+    generation: u32,
+    changed: Instant,
+    // The generation that the running (or last) check was started for.
+    checked: Option<u32>,
+    running: Option<Receiver<Vec<Diagnostic>>>,
+    diagnostics: Vec<Diagnostic>,
+}
+
+impl SyntaxCheck {
+    pub fn new() -> Self {
+        Self {
+            generation: 0,
+            changed: Instant::now(),
+            checked: None,
+            running: None,
+            diagnostics: Vec::new(),
+        }
+    }
+
+    /// Needs to be called regularly, see [`SyntaxCheck::wake_up`].
+    /// Starts a check once the text has settled and marks the errors once it's done.
+    /// Returns true if the marks changed.
+    pub fn poll(&mut self, tb: &mut TextBuffer) -> bool {
+        let generation = tb.generation();
+        if generation != self.generation {
+            self.generation = generation;
+            self.changed = Instant::now();
+        }
+
+        if let Some(running) = &self.running {
+            match running.try_recv() {
+                Err(TryRecvError::Empty) => return false,
+                Err(TryRecvError::Disconnected) => self.running = None,
+                Ok(diagnostics) => {
+                    self.running = None;
+                    if self.checked == Some(generation) {
+                        tb.set_error_lines(diagnostics.iter().map(|d| d.line).collect());
+                        self.diagnostics = diagnostics;
+                        return true;
+                    }
+                }
+            }
+        }
+
+        if self.checked != Some(generation) && self.changed.elapsed() >= CHECK_DELAY {
+            let input = read_text(tb);
+            let (sender, receiver) = mpsc::channel();
+            thread::spawn(move || _ = sender.send(run_gofmt(&input)));
+            self.checked = Some(generation);
+            self.running = Some(receiver);
+        }
+
+        false
+    }
+
+    /// Returns how soon [`SyntaxCheck::poll`] needs to be called again, if at all.
+    pub fn wake_up(&self) -> Option<Duration> {
+        if self.running.is_some() {
+            Some(RESULT_POLL_INTERVAL)
+        } else if self.checked != Some(self.generation) {
+            Some(CHECK_DELAY.saturating_sub(self.changed.elapsed()))
+        } else {
+            None
+        }
+    }
+
+    /// Returns the first error reported for the given logical line.
+    pub fn message(&self, line: CoordType) -> Option<&str> {
+        self.diagnostics.iter().find(|d| d.line == line).map(|d| d.message.as_str())
+    }
+}
+
+fn read_text(tb: &TextBuffer) -> Vec<u8> {
+    let mut text = Vec::with_capacity(tb.text_length());
+    loop {
+        let chunk = tb.read_forward(text.len());
+        if chunk.is_empty() {
+            break;
+        }
+        text.extend_from_slice(chunk);
+    }
+    text
+}
+
+// If `gofmt` can't be run, e.g. because Go isn't installed, nothing gets marked.
+fn run_gofmt(input: &[u8]) -> Vec<Diagnostic> {
+    let Ok(mut child) = Command::new("gofmt")
+        .arg("-e")
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::piped())
+        .spawn()
+    else {
+        return Vec::new();
+    };
+
+    // Same as in `formatter::run`: The input is written from another thread,
+    // in case the tool fills up the stderr pipe before it has read all of its input.
+    let mut stdin = child.stdin.take().unwrap();
+    let output = thread::scope(|scope| {
+        scope.spawn(move || stdin.write_all(input));
+        child.wait_with_output()
+    });
+    let Ok(output) = output else {
+        return Vec::new();
+    };
+
+    String::from_utf8_lossy(&output.stderr).lines().filter_map(parse_error).collect()
+}
+
+// Parses an error like "<standard input>:12:5: expected ';', found foo". The column is optional.
+fn parse_error(line: &str) -> Option<Diagnostic> {
+    let rest = line.strip_prefix("<standard input>:")?;
+    let (number, rest) = rest.split_once(':')?;
+    let number = number.parse::<CoordType>().ok()?;
+    let message = match rest.split_once(':') {
+        Some((column, message)) if column.parse::<CoordType>().is_ok() => message,
+        _ => rest,
+    };
+    Some(Diagnostic { line: (number - 1).max(0), message: message.trim().to_string() })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_error() {
+        let d = parse_error("<standard input>:12:5: expected ';', found foo").unwrap();
+        assert_eq!(d.line, 11);
+        assert_eq!(d.message, "expected ';', found foo");
+
+        let d = parse_error("<standard input>:3: illegal character NUL").unwrap();
+        assert_eq!(d.line, 2);
+        assert_eq!(d.message, "illegal character NUL");
+
+        assert!(parse_error("main.go:1:1: expected 'package'").is_none());
+        assert!(parse_error("<standard input>:x:1: bogus").is_none());
+        assert!(parse_error("").is_none());
+    }
+}
@@ -0,0 +1,198 @@
+// Copyright (c) Pavel Sich.
+// Licensed under the MIT License.
+
+//! Bookkeeping for collapsed folds: which lines they hide and
+//! how that maps the visual rows of the text to the rows on screen.
+
+use std::ops::Range;
+
+use crate::helpers::CoordType;
+
+pub struct Fold {
+    /// The logical line that stays visible and shows the placeholder.
+    pub header: CoordType,
+    /// The last hidden logical line. The hidden lines are `header + 1..=end`.
+    pub end: CoordType,
+    /// Shown after the end of the header line, e.g. "… }".
+    pub placeholder: String,
+    /// The visual rows of the hidden lines. Maintained by the [`super::TextBuffer`].
+    pub rows: Range<CoordType>,
+}
+
+impl Fold {
+    pub fn hides(&self, line: CoordType) -> bool {
+        line > self.header && line <= self.end
+    }
+}
+
+/// The collapsed folds of a text buffer, sorted by line.
+/// They never overlap, because collapsing a fold absorbs the ones inside it.
+#[derive(Default)]
+pub struct Folds {
+    folds: Vec<Fold>,
+}
+
+impl Folds {
+    pub fn is_empty(&self) -> bool {
+        self.folds.is_empty()
+    }
+
+    pub fn clear(&mut self) {
+        self.folds.clear();
+    }
+
+    pub fn iter(&self) -> impl Iterator<Item = &Fold> {
+        self.folds.iter()
+    }
+
+    pub fn iter_mut(&mut self) -> impl Iterator<Item = &mut Fold> {
+        self.folds.iter_mut()
+    }
+
+    /// Returns the fold which hides the given logical line.
+    pub fn hiding(&self, line: CoordType) -> Option<&Fold> {
+        self.folds.iter().find(|fold| fold.hides(line))
+    }
+
+    pub fn insert(&mut self, fold: Fold) {
+        self.folds.retain(|f| f.end < fold.header || f.header > fold.end);
+        let index = self.folds.partition_point(|f| f.header < fold.header);
+        self.folds.insert(index, fold);
+    }
+
+    /// Expands the fold whose header is on the given logical line.
+    pub fn remove_at_header(&mut self, line: CoordType) -> bool {
+        let len = self.folds.len();
+        self.folds.retain(|fold| fold.header != line);
+        self.folds.len() != len
+    }
+
+    /// Expands the folds which hide any of the given logical lines.
+    pub fn remove_hiding(&mut self, lines: Range<CoordType>) -> bool {
+        let len = self.folds.len();
+        self.folds.retain(|fold| fold.end < lines.start || fold.header + 1 >= lines.end);
+        self.folds.len() != len
+    }
+
+    /// Updates the folds after the logical lines `y..=y + removed`
+    /// were replaced with the lines `y..=y + added`.
+    ///
+    /// Folds further down are moved. Folds touched by the edit are expanded, as their
+    /// extent isn't known anymore. Only an edit within the header line keeps its fold.
+    pub fn edited(&mut self, y: CoordType, removed: CoordType, added: CoordType) {
+        self.folds.retain_mut(|fold| {
+            if fold.end < y {
+                true
+            } else if fold.header > y + removed {
+                fold.header += added - removed;
+                fold.end += added - removed;
+                true
+            } else {
+                fold.header == y && removed == 0 && added == 0
+            }
+        });
+    }
+
+    /// The number of visual rows hidden by all folds together.
+    pub fn hidden_rows(&self) -> CoordType {
+        self.folds.iter().map(|fold| fold.rows.end - fold.rows.start).sum()
+    }
+
+    /// Returns the row on screen for the given visual row, and whether it's hidden.
+    /// Hidden rows are mapped to the last row of their fold's header.
+    pub fn display_row(&self, y: CoordType) -> (CoordType, bool) {
+        let mut hidden = 0;
+        for fold in &self.folds {
+            if y < fold.rows.start {
+                break;
+            }
+            if y < fold.rows.end {
+                return (fold.rows.start - 1 - hidden, true);
+            }
+            hidden += fold.rows.end - fold.rows.start;
+        }
+        (y - hidden, false)
+    }
+
+    /// The inverse of [`Folds::display_row`]: Returns the visual row shown at the given row on screen.
+    pub fn visual_row(&self, y: CoordType) -> CoordType {
+        let mut visual = y;
+        for fold in &self.folds {
+            if visual < fold.rows.start {
+                break;
+            }
+            visual += fold.rows.end - fold.rows.start;
+        }
+        visual
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn fold(header: CoordType, end: CoordType) -> Fold {
+        Fold { header, end, placeholder: String::new(), rows: header + 1..end + 1 }
+    }
+
+    fn headers(folds: &Folds) -> Vec<(CoordType, CoordType)> {
+        folds.iter().map(|f| (f.header, f.end)).collect()
+    }
+
+    #[test]
+    fn test_rows() {
+        let mut folds = Folds::default();
+        folds.insert(fold(10, 12));
+        folds.insert(fold(2, 5));
+        assert_eq!(folds.hidden_rows(), 5);
+
+        assert_eq!(folds.display_row(2), (2, false));
+        assert_eq!(folds.display_row(4), (2, true));
+        assert_eq!(folds.display_row(6), (3, false));
+        assert_eq!(folds.display_row(11), (7, true));
+        assert_eq!(folds.display_row(13), (8, false));
+
+        for y in [0, 2, 6, 10, 13, 20] {
+            assert_eq!(folds.visual_row(folds.display_row(y).0), y);
+        }
+    }
+
+    #[test]
+    fn test_insert() {
+        let mut folds = Folds::default();
+        folds.insert(fold(4, 6));
+        folds.insert(fold(8, 9));
+        folds.insert(fold(20, 30));
+
+        // An outer fold absorbs the inner ones.
+        folds.insert(fold(3, 10));
+        assert_eq!(headers(&folds), [(3, 10), (20, 30)]);
+
+        assert!(folds.remove_at_header(3));
+        assert!(!folds.remove_at_header(3));
+        assert!(!folds.remove_hiding(0..20));
+        assert!(folds.remove_hiding(25..26));
+        assert!(folds.is_empty());
+    }
+
+    #[test]
+    fn test_edited() {
+        let mut folds = Folds::default();
+        folds.insert(fold(2, 4));
+        folds.insert(fold(10, 12));
+        folds.insert(fold(20, 22));
+
+        // Typing on a header line keeps the fold.
+        folds.edited(10, 0, 0);
+        assert_eq!(headers(&folds), [(2, 4), (10, 12), (20, 22)]);
+
+        // Inserting 2 lines between the folds moves the ones below.
+        folds.edited(6, 0, 2);
+        assert_eq!(headers(&folds), [(2, 4), (12, 14), (22, 24)]);
+
+        // Splitting a header line expands its fold, and so does deleting across one.
+        folds.edited(12, 0, 1);
+        folds.edited(0, 3, 0);
+        assert_eq!(headers(&folds), [(20, 22)]);
+    }
+}
@@ -20,6 +20,7 @@
 //! The solution to the former is to keep line caches, which further complicates the architecture.
 //! There's no solution for the latter. However, there's a chance that the performance will still be sufficient.
 
+mod folds;
 mod gap_buffer;
 mod navigation;
 
@@ -33,14 +34,16 @@ use std::mem::{self, MaybeUninit};
 use std::ops::Range;
 use std::rc::Rc;
 use std::str;
+use std::time::{Duration, Instant};
 
+use folds::{Fold, Folds};
 pub use gap_buffer::GapBuffer;
 
 use crate::arena::{Arena, ArenaString, scratch_arena};
 use crate::cell::SemiRefCell;
 use crate::clipboard::Clipboard;
 use crate::document::{ReadableDocument, WriteableDocument};
-use crate::framebuffer::{Framebuffer, IndexedColor};
+use crate::framebuffer::{Attributes, Framebuffer, IndexedColor};
 use crate::helpers::*;
 use crate::oklab::oklab_blend;
 use crate::simd::memchr2;
@@ -58,6 +61,12 @@ const VISUAL_SPACE: &str = "･";
 const VISUAL_SPACE_PREFIX_ADD: usize = '･'.len_utf8() - 1;
 const VISUAL_TAB: &str = "￫       ";
 const VISUAL_TAB_PREFIX_ADD: usize = '￫'.len_utf8() - 1;
+const VISUAL_LINE_BREAK: &str = "¬";
+/// Consecutive writes/deletes are merged into a single undo entry,
+/// unless they're further apart in time than this.
+const HISTORY_MERGE_TIMEOUT: Duration = Duration::from_millis(500);
+/// How far up a typed `}` looks for its `{`. Typing shouldn't get slower the longer the file is.
+const SMART_DEDENT_MAX_LINES: CoordType = 1000;
 
 /// Stores statistics about the whole document.
 #[derive(Copy, Clone)]
@@ -94,6 +103,8 @@ struct HistoryEntry {
     selection_before: Option<TextBufferSelection>,
     /// [`TextBuffer::stats`] before the change was made.
     stats_before: TextBufferStatistics,
+    /// [`TextBuffer::scroll_y`] before the change was made.
+    scroll_before: CoordType,
     /// [`GapBuffer::generation`] before the change was made.
     ///
     /// **NOTE:** Entries with the same generation are grouped together.
@@ -179,12 +190,13 @@ struct ActiveEditGroupInfo {
 }
 
 /// Char- or word-wise navigation? Your choice.
+#[derive(Clone, Copy)]
 pub enum CursorMovement {
     Grapheme,
     Word,
 }
 
-/// See [`TextBuffer::move_selected_lines`].
+/// See [`TextBuffer::move_selected_lines`] and [`TextBuffer::duplicate_selected_lines`].
 pub enum MoveLineDirection {
     Up,
     Down,
@@ -212,6 +224,7 @@ pub struct TextBuffer {
     undo_stack: LinkedList<SemiRefCell<HistoryEntry>>,
     redo_stack: LinkedList<SemiRefCell<HistoryEntry>>,
     last_history_type: HistoryType,
+    last_history_time: Instant,
     last_save_generation: u32,
 
     active_edit_group: Option<ActiveEditGroupInfo>,
@@ -226,6 +239,9 @@ pub struct TextBuffer {
     // To avoid this, we cache the cursor position for rendering.
     // Must be cleared on every edit or reflow.
     cursor_for_rendering: Option<Cursor>,
+    // The offsets of the cursors besides `cursor`, in ascending order.
+    // Any edit or cursor movement that isn't applied to all cursors removes them.
+    extra_cursors: Vec<usize>,
     selection: Option<TextBufferSelection>,
     selection_generation: u32,
     search: Option<UnsafeCell<ActiveSearch>>,
@@ -233,19 +249,36 @@ pub struct TextBuffer {
     width: CoordType,
     margin_width: CoordType,
     margin_enabled: bool,
+    margin_relative: bool,
     word_wrap_column: CoordType,
     word_wrap_enabled: bool,
     tab_size: CoordType,
     indent_with_tabs: bool,
+    smart_indent: bool,
+    convert_pasted_indentation: bool,
     line_highlight_enabled: bool,
+    bracket_highlight_enabled: bool,
+    trailing_whitespace_highlight_enabled: bool,
+    whitespace_visible: bool,
+    occurrence_highlight_enabled: bool,
+    // Sorted logical line numbers, see `set_error_lines`.
+    error_lines: Vec<CoordType>,
+    folds: Folds,
+    trim_whitespace_on_save: bool,
     ruler: CoordType,
     encoding: &'static str,
     newlines_are_crlf: bool,
+    newlines_mixed: bool,
     insert_final_newline: bool,
     overtype: bool,
+    read_only: bool,
+    edit_refused: bool,
 
     syntax_highlighter: syntax::SyntaxHighlighter,
     wants_cursor_visibility: bool,
+    wants_cursor_centered: bool,
+    scroll_y: CoordType,
+    wants_scroll_y: Option<CoordType>,
 }
 
 impl TextBuffer {
@@ -265,6 +298,7 @@ impl TextBuffer {
             undo_stack: LinkedList::new(),
             redo_stack: LinkedList::new(),
             last_history_type: HistoryType::Other,
+            last_history_time: Instant::now(),
             last_save_generation: 0,
 
             active_edit_group: None,
@@ -275,6 +309,7 @@ impl TextBuffer {
             stats: TextBufferStatistics { logical_lines: 1, visual_lines: 1 },
             cursor: Default::default(),
             cursor_for_rendering: None,
+            extra_cursors: Vec::new(),
             selection: None,
             selection_generation: 0,
             search: None,
@@ -282,19 +317,35 @@ impl TextBuffer {
             width: 0,
             margin_width: 0,
             margin_enabled: false,
+            margin_relative: false,
             word_wrap_column: 0,
             word_wrap_enabled: false,
             tab_size: 4,
             indent_with_tabs: false,
+            smart_indent: true,
+            convert_pasted_indentation: false,
             line_highlight_enabled: false,
+            bracket_highlight_enabled: false,
+            trailing_whitespace_highlight_enabled: false,
+            whitespace_visible: false,
+            occurrence_highlight_enabled: false,
+            error_lines: Vec::new(),
+            folds: Folds::default(),
+            trim_whitespace_on_save: false,
             ruler: 0,
             encoding: "UTF-8",
             newlines_are_crlf: cfg!(windows), // Windows users want CRLF
+            newlines_mixed: false,
             insert_final_newline: false,
             overtype: false,
+            read_only: false,
+            edit_refused: false,
 
             syntax_highlighter: syntax::SyntaxHighlighter::default(),
             wants_cursor_visibility: false,
+            wants_cursor_centered: false,
+            scroll_y: 0,
+            wants_scroll_y: None,
         })
     }
 
@@ -311,8 +362,11 @@ impl TextBuffer {
 
     /// Number of visual lines in the document,
     /// that is, the number of lines after layout.
+    ///
+    /// Like all visual positions in the public API, this only counts
+    /// the lines on screen and skips the ones hidden by folds.
     pub fn visual_line_count(&self) -> CoordType {
-        self.stats.visual_lines
+        self.stats.visual_lines - self.folds.hidden_rows()
     }
 
     /// Does the buffer need to be saved?
@@ -349,10 +403,26 @@ impl TextBuffer {
         }
     }
 
-    /// Set the syntax highlighter based on a file extension
-    pub fn set_syntax_from_extension(&mut self, extension: &str) {
-        let language = syntax::Language::from_extension(extension);
-        self.syntax_highlighter = syntax::SyntaxHighlighter::new(language);
+    /// Picks the syntax highlighting based on the file `extension`,
+    /// or if that's unknown, based on a shebang line at the start of the contents.
+    pub fn detect_syntax(&mut self, extension: Option<&str>) {
+        let language = extension.and_then(syntax::language_from_extension).or_else(|| {
+            let chunk = self.read_forward(0);
+            let line = &chunk[..memchr2(b'\r', b'\n', chunk, 0)];
+            syntax::language_from_shebang(&String::from_utf8_lossy(line))
+        });
+        self.set_syntax_language(language);
+    }
+
+    /// The language used for syntax highlighting, if any.
+    pub fn syntax_language(&self) -> Option<&'static syntax::LanguageDef> {
+        self.syntax_highlighter.language()
+    }
+
+    /// Sets the language used for syntax highlighting.
+    /// Smart indentation only applies to languages with braces.
+    pub fn set_syntax_language(&mut self, language: Option<&'static syntax::LanguageDef>) {
+        self.syntax_highlighter = language.map(syntax::SyntaxHighlighter::new).unwrap_or_default();
     }
 
     /// The newline type used in the document. LF or CRLF.
@@ -360,6 +430,12 @@ impl TextBuffer {
         self.newlines_are_crlf
     }
 
+    /// Whether the file contained both LF and CRLF newlines when it was loaded.
+    /// They've been normalized to [`TextBuffer::is_crlf`], which the next save will write out.
+    pub fn has_mixed_newlines(&self) -> bool {
+        self.newlines_mixed
+    }
+
     /// Changes the newline type without normalizing the document.
     pub fn set_crlf(&mut self, crlf: bool) {
         self.newlines_are_crlf = crlf;
@@ -369,6 +445,10 @@ impl TextBuffer {
     ///
     /// NOTE: Cannot be undone.
     pub fn normalize_newlines(&mut self, crlf: bool) {
+        if self.refuse_edit() {
+            return;
+        }
+
         let newline: &[u8] = if crlf { b"\r\n" } else { b"\n" };
         let mut off = 0;
 
@@ -450,6 +530,28 @@ impl TextBuffer {
         self.overtype = overtype;
     }
 
+    /// If true, all operations that would modify the contents are ignored.
+    pub fn is_read_only(&self) -> bool {
+        self.read_only
+    }
+
+    /// Enables or disables modifications. See [`TextBuffer::is_read_only`].
+    pub fn set_read_only(&mut self, read_only: bool) {
+        self.read_only = read_only;
+    }
+
+    /// Returns whether an edit was ignored since the last call, because the buffer is read-only.
+    /// This allows the UI to tell the user why nothing happened.
+    pub fn take_refused_edit(&mut self) -> bool {
+        mem::take(&mut self.edit_refused)
+    }
+
+    /// Returns true if edits are ignored and remembers that one was attempted.
+    fn refuse_edit(&mut self) -> bool {
+        self.edit_refused |= self.read_only;
+        self.read_only
+    }
+
     /// Gets the logical cursor position, that is,
     /// the position in lines and graphemes per line.
     pub fn cursor_logical_pos(&self) -> Point {
@@ -459,7 +561,34 @@ impl TextBuffer {
     /// Gets the visual cursor position, that is,
     /// the position in laid out rows and columns.
     pub fn cursor_visual_pos(&self) -> Point {
-        self.cursor.visual_pos
+        self.visual_pos(self.cursor)
+    }
+
+    /// Gets the visual position of the given cursor, as it's shown on screen.
+    /// Unlike `cursor.visual_pos`, this accounts for the rows hidden by folds.
+    pub fn visual_pos(&self, cursor: Cursor) -> Point {
+        Point { x: cursor.visual_pos.x, y: self.folds.display_row(cursor.visual_pos.y).0 }
+    }
+
+    // The inverse of `visual_pos`: Turns a position on screen into a visual position.
+    fn unfolded_visual_pos(&self, pos: Point) -> Point {
+        Point { x: pos.x, y: self.folds.visual_row(pos.y) }
+    }
+
+    /// Gets the column the cursor is displayed at, relative to the start of its logical line.
+    /// Unlike the logical position, tabs and wide characters are expanded.
+    /// Unlike the visual position, word wrap is ignored.
+    pub fn cursor_display_column(&self) -> CoordType {
+        if self.word_wrap_column <= 0 {
+            return self.cursor.visual_pos.x;
+        }
+        let line_start = self.goto_line_start(self.cursor, self.cursor.logical_pos.y);
+        MeasurementConfig::new(&self.buffer)
+            .with_tab_size(self.tab_size)
+            .with_cursor(line_start)
+            .goto_offset(self.cursor.offset)
+            .visual_pos
+            .x
     }
 
     /// Gets the width of the left margin.
@@ -467,6 +596,11 @@ impl TextBuffer {
         self.margin_width
     }
 
+    /// Is the left margin enabled?
+    pub fn is_margin_enabled(&self) -> bool {
+        self.margin_enabled
+    }
+
     /// Is the left margin enabled?
     pub fn set_margin_enabled(&mut self, enabled: bool) -> bool {
         if self.margin_enabled == enabled {
@@ -478,6 +612,17 @@ impl TextBuffer {
         }
     }
 
+    /// Are line numbers shown relative to the cursor line?
+    pub fn is_margin_relative(&self) -> bool {
+        self.margin_relative
+    }
+
+    /// If enabled, the margin shows the distance to the cursor line instead of the line number.
+    /// The cursor line itself still shows its actual line number.
+    pub fn set_margin_relative(&mut self, relative: bool) {
+        self.margin_relative = relative;
+    }
+
     /// Gets the width of the text contents for layout.
     pub fn text_width(&self) -> CoordType {
         self.width - self.margin_width
@@ -494,11 +639,45 @@ impl TextBuffer {
         self.wants_cursor_visibility = true;
     }
 
+    /// Like [`TextBuffer::make_cursor_visible()`], but if the cursor is off-screen,
+    /// it asks to scroll it into the middle of the viewport instead of the nearest edge.
+    pub fn make_cursor_centered(&mut self) {
+        self.wants_cursor_visibility = true;
+        self.wants_cursor_centered = true;
+    }
+
     /// For the TUI code to retrieve a prior [`TextBuffer::make_cursor_visible()`] request.
     pub fn take_cursor_visibility_request(&mut self) -> bool {
         mem::take(&mut self.wants_cursor_visibility)
     }
 
+    /// For the TUI code to retrieve a prior [`TextBuffer::make_cursor_centered()`] request.
+    pub fn take_cursor_center_request(&mut self) -> bool {
+        mem::take(&mut self.wants_cursor_centered)
+    }
+
+    /// The first visible visual line, as last reported by the TUI code.
+    /// This is used to remember the scroll position of a file across sessions.
+    pub fn scroll_y(&self) -> CoordType {
+        self.scroll_y
+    }
+
+    /// For the TUI code to report the current scroll position.
+    pub fn set_scroll_y(&mut self, y: CoordType) {
+        self.scroll_y = y;
+    }
+
+    /// Asks the TUI code to scroll the text so that visual line `y` is at the top.
+    /// The cursor is kept visible regardless.
+    pub fn scroll_to(&mut self, y: CoordType) {
+        self.wants_scroll_y = Some(y);
+    }
+
+    /// For the TUI code to retrieve a prior [`TextBuffer::scroll_to()`] request.
+    pub fn take_scroll_request(&mut self) -> Option<CoordType> {
+        self.wants_scroll_y.take()
+    }
+
     /// Is word-wrap enabled?
     ///
     /// Technically, this is a misnomer, because it's line-wrapping.
@@ -581,11 +760,90 @@ impl TextBuffer {
         self.indent_with_tabs = indent_with_tabs;
     }
 
+    /// Returns whether braces affect the indentation of new lines.
+    pub fn is_smart_indent_enabled(&self) -> bool {
+        self.smart_indent
+    }
+
+    /// Sets whether braces affect the indentation of new lines.
+    /// If enabled, a newline after a `{` is indented by one more level,
+    /// and a `}` typed into an empty line is dedented to match its `{`.
+    /// Only applies if the [`TextBuffer::syntax_language`] has braces.
+    pub fn set_smart_indent(&mut self, enabled: bool) {
+        self.smart_indent = enabled;
+    }
+
+    fn smart_indent_applies(&self) -> bool {
+        self.smart_indent && self.syntax_language().is_some_and(|l| l.braces)
+    }
+
+    /// Sets whether [`TextBuffer::paste`] converts the indentation of the pasted
+    /// lines to tabs or spaces, see [`TextBuffer::set_indent_with_tabs`].
+    /// Otherwise, text is pasted verbatim.
+    pub fn set_convert_pasted_indentation(&mut self, enabled: bool) {
+        self.convert_pasted_indentation = enabled;
+    }
+
     /// Sets whether the line the cursor is on should be highlighted.
     pub fn set_line_highlight_enabled(&mut self, enabled: bool) {
         self.line_highlight_enabled = enabled;
     }
 
+    /// Sets whether spaces and tabs at the end of lines should be highlighted.
+    pub fn set_trailing_whitespace_highlight_enabled(&mut self, enabled: bool) {
+        self.trailing_whitespace_highlight_enabled = enabled;
+    }
+
+    /// Returns whether spaces, tabs and line breaks are drawn as visible glyphs.
+    pub fn is_whitespace_visible(&self) -> bool {
+        self.whitespace_visible
+    }
+
+    /// Sets whether spaces, tabs and line breaks should be drawn visibly everywhere,
+    /// not just within the selection. Only the rendering changes, not the text or its layout.
+    pub fn set_whitespace_visible(&mut self, visible: bool) {
+        self.whitespace_visible = visible;
+    }
+
+    /// Marks lines with errors, e.g. syntax errors found by an external tool, by underlining
+    /// them and coloring their line number. `lines` are 0-based logical line numbers.
+    /// The marks aren't moved along when the text changes. The caller should replace them.
+    pub fn set_error_lines(&mut self, mut lines: Vec<CoordType>) {
+        lines.sort_unstable();
+        lines.dedup();
+        self.error_lines = lines;
+    }
+
+    /// Whether [`TextBuffer::trim_trailing_whitespace`] should run before saving.
+    pub fn trims_whitespace_on_save(&self) -> bool {
+        self.trim_whitespace_on_save
+    }
+
+    /// Sets whether trailing whitespace should be removed before saving.
+    pub fn set_trim_whitespace_on_save(&mut self, enabled: bool) {
+        self.trim_whitespace_on_save = enabled;
+    }
+
+    /// Is the bracket pair at the cursor highlighted?
+    pub fn is_bracket_highlight_enabled(&self) -> bool {
+        self.bracket_highlight_enabled
+    }
+
+    /// Sets whether the bracket at the cursor and its partner should be highlighted.
+    pub fn set_bracket_highlight_enabled(&mut self, enabled: bool) {
+        self.bracket_highlight_enabled = enabled;
+    }
+
+    /// Are the other occurrences of the word under the cursor highlighted?
+    pub fn is_occurrence_highlight_enabled(&self) -> bool {
+        self.occurrence_highlight_enabled
+    }
+
+    /// Sets whether the other occurrences of the word under the cursor should be highlighted.
+    pub fn set_occurrence_highlight_enabled(&mut self, enabled: bool) {
+        self.occurrence_highlight_enabled = enabled;
+    }
+
     /// Sets a ruler column, e.g. 80.
     pub fn set_ruler(&mut self, column: CoordType) {
         self.ruler = column;
@@ -639,6 +897,8 @@ impl TextBuffer {
                 self.stats.visual_lines = self.stats.logical_lines;
             }
         }
+
+        self.folds_update_rows();
     }
 
     /// Replaces the entire buffer contents with the given `text`.
@@ -662,6 +922,7 @@ impl TextBuffer {
         self.last_history_type = HistoryType::Other;
         self.cursor = Default::default();
         self.set_selection(None);
+        self.folds.clear();
         self.mark_as_clean();
         self.reflow();
     }
@@ -678,6 +939,19 @@ impl TextBuffer {
         file: &mut File,
         encoding: Option<&'static str>,
     ) -> apperr::Result<()> {
+        self.read_file_head(file, encoding, usize::MAX).map(|_| ())
+    }
+
+    /// Like [`TextBuffer::read_file`], but stops after about `limit` bytes of UTF-8 text.
+    /// Returns true if the end of the file wasn't reached yet, in which case the remainder
+    /// can be loaded piece by piece with [`TextBuffer::read_file_append`].
+    /// Files in other encodings are always read in full.
+    pub fn read_file_head(
+        &mut self,
+        file: &mut File,
+        encoding: Option<&'static str>,
+        limit: usize,
+    ) -> apperr::Result<bool> {
         let scratch = scratch_arena(None);
         let mut buf = scratch.alloc_uninit().transpose();
         let mut first_chunk_len = 0;
@@ -695,8 +969,8 @@ impl TextBuffer {
         if let Some(encoding) = encoding {
             self.encoding = encoding;
         } else {
-            let bom = detect_bom(unsafe { buf[..first_chunk_len].assume_init_ref() });
-            self.encoding = bom.unwrap_or("UTF-8");
+            let head = unsafe { buf[..first_chunk_len].assume_init_ref() };
+            self.encoding = detect_bom(head).unwrap_or_else(|| sniff_encoding(head));
         }
 
         // TODO: Since reading the file can fail, we should ensure that we also reset the cursor here.
@@ -704,8 +978,10 @@ impl TextBuffer {
         self.buffer.clear();
 
         let done = read == 0;
-        if self.encoding == "UTF-8" {
-            self.read_file_as_utf8(file, &mut buf, first_chunk_len, done)?;
+        let mut more = false;
+        // "UTF-8 BOM" isn't known to ICU. The BOM is detected while reading.
+        if self.encoding.starts_with("UTF-8") {
+            more = self.read_file_as_utf8(file, &mut buf, first_chunk_len, done, limit)?;
         } else {
             self.read_file_with_icu(file, &mut buf, first_chunk_len, done)?;
         }
@@ -777,8 +1053,11 @@ impl TextBuffer {
                 }
             }
 
-            // We'll assume CRLF if more than half of the lines end in CRLF.
-            let newlines_are_crlf = crlf_count >= lines / 2;
+            // We'll assume CRLF if at least half of the lines end in CRLF.
+            // A file without any newlines keeps the default.
+            let newlines_are_crlf =
+                if lines == 0 { self.newlines_are_crlf } else { crlf_count * 2 >= lines };
+            let newlines_mixed = crlf_count != 0 && crlf_count != lines;
 
             // We'll assume tabs if there are more lines starting with tabs than with spaces.
             let indent_with_tabs = tab_indentations > space_indentations;
@@ -811,13 +1090,73 @@ impl TextBuffer {
             self.stats.logical_lines = lines + 1;
             self.stats.visual_lines = self.stats.logical_lines;
             self.newlines_are_crlf = newlines_are_crlf;
+            self.newlines_mixed = newlines_mixed;
             self.insert_final_newline = final_newline;
             self.indent_with_tabs = indent_with_tabs;
             self.tab_size = tab_size;
         }
 
         self.recalc_after_content_swap();
-        Ok(())
+
+        // Mixed newlines are unified right away, so that the editor only ever deals with one kind.
+        // The buffer is still considered to be unmodified, as merely viewing a file shouldn't prompt to save it.
+        // Partially loaded files are unified once `read_file_append` reaches the end.
+        if self.newlines_mixed && !more {
+            self.normalize_newlines(self.newlines_are_crlf);
+            self.mark_as_clean();
+        }
+        Ok(more)
+    }
+
+    /// Appends up to `limit` more bytes of a file opened with [`TextBuffer::read_file_head`].
+    /// Returns false once the end of the file has been reached.
+    ///
+    /// The appended text is not part of the undo history.
+    /// Once the end is reached, mixed newlines are unified like in [`TextBuffer::read_file`].
+    pub fn read_file_append(&mut self, file: &mut File, limit: usize) -> apperr::Result<bool> {
+        let clean = !self.is_dirty();
+        // A CRLF may be split across two chunks.
+        let mut prev = self.read_backward(self.text_length()).last().copied().unwrap_or(0);
+        let gap = self.buffer.allocate_gap(self.text_length(), limit, 0);
+        let len = gap.len().min(limit);
+        let read = file.read(&mut gap[..len])?;
+        if read == 0 {
+            if self.newlines_mixed {
+                // Loading files are read-only, but this isn't a user edit.
+                let read_only = mem::replace(&mut self.read_only, false);
+                self.normalize_newlines(self.newlines_are_crlf);
+                self.read_only = read_only;
+            }
+            // Even an empty read changes the generation.
+            if clean {
+                self.mark_as_clean();
+            }
+            return Ok(false);
+        }
+
+        let chunk = &gap[..read];
+        let (_, lines) = simd::lines_fwd(chunk, 0, 0, CoordType::MAX);
+        let final_newline = chunk[read - 1] == b'\n';
+        if !self.newlines_mixed && lines > 0 {
+            for &c in chunk {
+                if c == b'\n' && (prev == b'\r') != self.newlines_are_crlf {
+                    self.newlines_mixed = true;
+                    break;
+                }
+                prev = c;
+            }
+        }
+        self.buffer.commit_gap(read);
+
+        self.stats.logical_lines += lines;
+        self.stats.visual_lines += lines;
+        self.insert_final_newline = final_newline;
+        self.recalc_after_content_changed();
+
+        if clean {
+            self.mark_as_clean();
+        }
+        Ok(true)
     }
 
     fn read_file_as_utf8(
@@ -826,7 +1165,8 @@ impl TextBuffer {
         buf: &mut [MaybeUninit<u8>; 4 * KIBI],
         first_chunk_len: usize,
         done: bool,
-    ) -> apperr::Result<()> {
+        limit: usize,
+    ) -> apperr::Result<bool> {
         {
             let mut first_chunk = unsafe { buf[..first_chunk_len].assume_init_ref() };
             if first_chunk.starts_with(b"\xEF\xBB\xBF") {
@@ -838,7 +1178,7 @@ impl TextBuffer {
         }
 
         if done {
-            return Ok(());
+            return Ok(false);
         }
 
         // If we don't have file metadata, the input may be a pipe or a socket.
@@ -857,12 +1197,19 @@ impl TextBuffer {
         }
 
         loop {
+            let remaining = limit.saturating_sub(self.text_length());
+            if remaining == 0 {
+                return Ok(true);
+            }
+
             let gap = self.buffer.allocate_gap(self.text_length(), chunk_size, 0);
             if gap.is_empty() {
                 break;
             }
 
-            let read = file.read(gap)?;
+            // The gap may be larger than requested.
+            let len = gap.len().min(remaining);
+            let read = file.read(&mut gap[..len])?;
             if read == 0 {
                 break;
             }
@@ -871,7 +1218,7 @@ impl TextBuffer {
             chunk_size = extra_chunk_size;
         }
 
-        Ok(())
+        Ok(false)
     }
 
     fn read_file_with_icu(
@@ -958,6 +1305,7 @@ impl TextBuffer {
             self.write_file_with_icu(file)?;
         }
 
+        self.newlines_mixed = false;
         self.mark_as_clean();
         Ok(())
     }
@@ -1000,6 +1348,7 @@ impl TextBuffer {
     }
 
     fn set_selection(&mut self, selection: Option<TextBufferSelection>) -> u32 {
+        self.extra_cursors.clear();
         self.selection = selection.filter(|s| s.beg != s.end);
         self.selection_generation = self.selection_generation.wrapping_add(1);
         self.selection_generation
@@ -1012,7 +1361,8 @@ impl TextBuffer {
 
     /// Moves the cursor to `visual_pos` and updates the selection to contain it.
     pub fn selection_update_visual(&mut self, visual_pos: Point) {
-        self.set_cursor_for_selection(self.cursor_move_to_visual_internal(self.cursor, visual_pos));
+        let pos = self.unfolded_visual_pos(visual_pos);
+        self.set_cursor_for_selection(self.cursor_move_to_visual_internal(self.cursor, pos));
     }
 
     /// Moves the cursor to `logical_pos` and updates the selection to contain it.
@@ -1024,11 +1374,8 @@ impl TextBuffer {
 
     /// Moves the cursor by `delta` and updates the selection to contain it.
     pub fn selection_update_delta(&mut self, granularity: CursorMovement, delta: CoordType) {
-        self.set_cursor_for_selection(self.cursor_move_delta_internal(
-            self.cursor,
-            granularity,
-            delta,
-        ));
+        let cursor = self.cursor_move_delta_internal(self.cursor, granularity, delta);
+        self.set_cursor_for_selection(self.cursor_skip_folds(cursor, delta > 0));
     }
 
     /// Select the current word.
@@ -1069,6 +1416,264 @@ impl TextBuffer {
         }));
     }
 
+    /// Finds the bracket matching the one right after the cursor, or if there's none there,
+    /// the one right before it. Returns the offsets of the bracket and its partner.
+    ///
+    /// Brackets inside strings and comments are skipped, as classified by the syntax highlighter.
+    /// Gives up after searching `max_lines` lines.
+    pub fn find_matching_bracket(&self, max_lines: CoordType) -> Option<(usize, usize)> {
+        let line_beg = self.goto_line_start(self.cursor, self.cursor.logical_pos.y);
+        let mut line = Vec::new();
+        let syntax = self.line_syntax(line_beg, &mut line);
+
+        let x = self.cursor.offset - line_beg.offset;
+        let pos = [Some(x), x.checked_sub(1)].into_iter().flatten().find(|&i| {
+            matches!(line.get(i), Some(b'(' | b')' | b'[' | b']' | b'{' | b'}'))
+                && is_code(&syntax, i)
+        })?;
+        let partner = self.find_bracket_partner(line_beg, pos, max_lines)?;
+        Some((line_beg.offset + pos, partner))
+    }
+
+    /// Finds the partner of the bracket at `pos` in the line starting at `line_beg`
+    /// and returns its offset. See [`TextBuffer::find_matching_bracket`].
+    fn find_bracket_partner(
+        &self,
+        mut line_beg: Cursor,
+        pos: usize,
+        max_lines: CoordType,
+    ) -> Option<usize> {
+        let mut line = Vec::new();
+        let mut syntax = self.line_syntax(line_beg, &mut line);
+        let (open, close) = match line[pos] {
+            b'(' | b')' => (b'(', b')'),
+            b'[' | b']' => (b'[', b']'),
+            _ => (b'{', b'}'),
+        };
+        let forward = line[pos] == open;
+
+        // `i` is the next index to check when searching forward,
+        // and one past it when searching backward.
+        let mut i = if forward { pos } else { pos + 1 };
+        let mut depth = 0;
+
+        for _ in 0..max_lines {
+            if forward {
+                while i < line.len() {
+                    if is_code(&syntax, i) {
+                        depth += (line[i] == open) as i32 - (line[i] == close) as i32;
+                        if depth == 0 {
+                            return Some(line_beg.offset + i);
+                        }
+                    }
+                    i += 1;
+                }
+
+                let next = self.goto_line_start(line_beg, line_beg.logical_pos.y + 1);
+                if next.logical_pos.y == line_beg.logical_pos.y {
+                    break;
+                }
+                line_beg = next;
+                syntax = self.line_syntax(line_beg, &mut line);
+                i = 0;
+            } else {
+                while i > 0 {
+                    i -= 1;
+                    if is_code(&syntax, i) {
+                        depth += (line[i] == close) as i32 - (line[i] == open) as i32;
+                        if depth == 0 {
+                            return Some(line_beg.offset + i);
+                        }
+                    }
+                }
+
+                if line_beg.logical_pos.y == 0 {
+                    break;
+                }
+                line_beg = self.goto_line_start(line_beg, line_beg.logical_pos.y - 1);
+                syntax = self.line_syntax(line_beg, &mut line);
+                i = line.len();
+            }
+        }
+
+        None
+    }
+
+    /// Moves the cursor onto the bracket matching the one at the cursor.
+    /// Returns false if there's no such bracket.
+    pub fn jump_to_matching_bracket(&mut self) -> bool {
+        match self.find_matching_bracket(CoordType::MAX) {
+            Some((_, partner)) => {
+                self.cursor_move_to_offset(partner);
+                true
+            }
+            None => false,
+        }
+    }
+
+    /// Collapses the block that starts on the cursor line, or expands it if it's collapsed.
+    /// Returns false if there's no block to fold.
+    ///
+    /// A block is delimited by the last bracket that's left open on the line and its partner.
+    /// On lines that don't open a bracket, it's the following lines that are indented deeper.
+    pub fn toggle_fold(&mut self) -> bool {
+        let y = self.cursor.logical_pos.y;
+
+        if !self.folds.remove_at_header(y) {
+            let Some(fold) = self.fold_region(y) else {
+                return false;
+            };
+            // Neither the selection nor any extra cursors should end up within the fold.
+            self.set_selection(None);
+            self.extra_cursors.clear();
+            self.folds.insert(fold);
+        }
+
+        self.folds_update_rows();
+        true
+    }
+
+    /// Expands all folds. Returns false if there were none.
+    pub fn unfold_all(&mut self) -> bool {
+        if self.folds.is_empty() {
+            return false;
+        }
+        self.folds.clear();
+        true
+    }
+
+    fn fold_region(&self, y: CoordType) -> Option<Fold> {
+        let line_beg = self.goto_line_start(self.cursor, y);
+        let mut line = Vec::new();
+        let syntax = self.line_syntax(line_beg, &mut line);
+
+        let mut open = Vec::new();
+        for (i, &b) in line.iter().enumerate() {
+            if is_code(&syntax, i) {
+                match b {
+                    b'(' | b'[' | b'{' => open.push(i),
+                    b')' | b']' | b'}' => _ = open.pop(),
+                    _ => {}
+                }
+            }
+        }
+
+        if let Some(&pos) = open.last()
+            && let Some(partner) = self.find_bracket_partner(line_beg, pos, CoordType::MAX)
+        {
+            let close = self.cursor_move_to_offset_internal(line_beg, partner);
+            let close_beg = self.goto_line_start(close, close.logical_pos.y);
+            let syntax = self.line_syntax(close_beg, &mut line);
+
+            // The closing line is folded away too, and shown in the placeholder instead.
+            // That is, unless it goes on to open another block, like `} else {`.
+            let rest = partner - close_beg.offset + 1;
+            let opens = (rest..line.len())
+                .any(|i| matches!(line[i], b'(' | b'[' | b'{') && is_code(&syntax, i));
+            let (end, placeholder) = if opens {
+                (close.logical_pos.y - 1, "…".to_string())
+            } else {
+                (close.logical_pos.y, format!("… {}", String::from_utf8_lossy(&line).trim()))
+            };
+
+            return (end > y).then_some(Fold { header: y, end, placeholder, rows: 0..0 });
+        }
+
+        // Otherwise, the block is made up of the lines that are indented deeper than this one.
+        // Blank lines in between belong to it, but not the ones at its end.
+        let indent = |line_beg: Cursor| {
+            let (chars, columns) = self.measure_indent_internal(line_beg.offset, CoordType::MAX);
+            let blank = matches!(
+                self.read_forward(line_beg.offset + chars as usize).first(),
+                None | Some(b'\r' | b'\n')
+            );
+            (!blank).then_some(columns)
+        };
+        let header_indent = indent(line_beg)?;
+        let mut end = y;
+        let mut next = line_beg;
+
+        loop {
+            let following = self.goto_line_start(next, next.logical_pos.y + 1);
+            if following.logical_pos.y == next.logical_pos.y {
+                break;
+            }
+            next = following;
+
+            match indent(next) {
+                None => {}
+                Some(columns) if columns > header_indent => end = next.logical_pos.y,
+                Some(_) => break,
+            }
+        }
+
+        (end > y).then_some(Fold { header: y, end, placeholder: "…".to_string(), rows: 0..0 })
+    }
+
+    /// Measures which visual rows the folds hide. Needs to be called whenever the folds
+    /// or the layout change. Also expands folds which no longer fit into the text.
+    fn folds_update_rows(&mut self) {
+        if self.folds.is_empty() {
+            return;
+        }
+
+        self.folds.remove_hiding(self.stats.logical_lines..CoordType::MAX);
+
+        let mut cursor = self.cursor;
+        let rows: Vec<_> = self
+            .folds
+            .iter()
+            .map(|fold| {
+                let beg = self
+                    .cursor_move_to_logical_internal(cursor, Point { x: 0, y: fold.header + 1 });
+                cursor = beg;
+
+                let end = if fold.end + 1 < self.stats.logical_lines {
+                    cursor =
+                        self.cursor_move_to_logical_internal(beg, Point { x: 0, y: fold.end + 1 });
+                    cursor.visual_pos.y
+                } else {
+                    self.stats.visual_lines
+                };
+
+                beg.visual_pos.y..end
+            })
+            .collect();
+
+        for (fold, rows) in self.folds.iter_mut().zip(rows) {
+            fold.rows = rows;
+        }
+    }
+
+    /// If `cursor` is inside a fold, this moves it past the fold in the direction of movement.
+    fn cursor_skip_folds(&self, cursor: Cursor, forward: bool) -> Cursor {
+        let Some(fold) = self.folds.hiding(cursor.logical_pos.y) else {
+            return cursor;
+        };
+
+        if forward && fold.end + 1 < self.stats.logical_lines {
+            self.cursor_move_to_logical_internal(cursor, Point { x: 0, y: fold.end + 1 })
+        } else {
+            self.cursor_move_to_logical_internal(
+                cursor,
+                Point { x: CoordType::MAX, y: fold.header },
+            )
+        }
+    }
+
+    /// Reads the logical line starting at `line_beg` into `text`
+    /// and returns the syntax classification of each of its bytes.
+    fn line_syntax(&self, line_beg: Cursor, text: &mut Vec<u8>) -> Vec<syntax::SyntaxElement> {
+        let line_end = self.line_end_offset(line_beg);
+        text.clear();
+        self.buffer.extract_raw(line_beg.offset..line_end, text, 0);
+
+        match str::from_utf8(text) {
+            Ok(str) => self.syntax_highlighter.highlight_line(str),
+            Err(_) => Vec::new(),
+        }
+    }
+
     /// Starts a new selection, if there's none already.
     pub fn start_selection(&mut self) {
         if self.selection.is_none() {
@@ -1088,6 +1693,24 @@ impl TextBuffer {
 
     /// Find the next occurrence of the given `pattern` and select it.
     pub fn find_and_select(&mut self, pattern: &str, options: SearchOptions) -> apperr::Result<()> {
+        self.find_and_select_impl(pattern, options, false)
+    }
+
+    /// Find the previous occurrence of the given `pattern` and select it.
+    pub fn find_and_select_prev(
+        &mut self,
+        pattern: &str,
+        options: SearchOptions,
+    ) -> apperr::Result<()> {
+        self.find_and_select_impl(pattern, options, true)
+    }
+
+    fn find_and_select_impl(
+        &mut self,
+        pattern: &str,
+        options: SearchOptions,
+        reverse: bool,
+    ) -> apperr::Result<()> {
         if let Some(search) = &mut self.search {
             let search = search.get_mut();
             // When the search input changes we must reset the search.
@@ -1122,6 +1745,18 @@ impl TextBuffer {
             return Ok(());
         }
 
+        if reverse {
+            // Searching backwards always starts at the beginning of the current hit or selection.
+            let offset = match self.selection {
+                Some(TextBufferSelection { beg, end }) => {
+                    self.cursor_move_to_logical_internal(self.cursor, beg.min(end)).offset
+                }
+                _ => self.cursor.offset,
+            };
+            self.find_select_prev(search, offset);
+            return Ok(());
+        }
+
         // If the user moved the cursor since the last search, but the needle remained the same,
         // we still need to move the start of the search to the new cursor position.
         let next_search_offset = match self.selection {
@@ -1169,11 +1804,18 @@ impl TextBuffer {
         options: SearchOptions,
         replacement: &[u8],
     ) -> apperr::Result<()> {
+        if self.refuse_edit() {
+            return Ok(());
+        }
+
         let scratch = scratch_arena(None);
         let mut search = self.find_construct_search(pattern, options)?;
         let mut offset = 0;
         let parsed_replacements = Self::find_parse_replacement(&scratch, &mut search, replacement);
 
+        // Group all replacements, so that they can be undone in one go.
+        self.edit_begin_grouping();
+
         loop {
             self.find_select_next(&mut search, offset, false);
             if !self.has_selection() {
@@ -1183,12 +1825,20 @@ impl TextBuffer {
             let replacement =
                 self.find_fill_replacement(&mut search, replacement, &parsed_replacements);
             self.write(&replacement, self.cursor, true);
+            // Continue after the replacement, so that it won't be matched again,
+            // even if it contains the pattern itself.
             offset = self.cursor.offset;
         }
 
+        self.edit_end_grouping();
         Ok(())
     }
 
+    /// Drops the cached search, which also stops highlighting its hits.
+    pub fn find_finish(&mut self) {
+        self.search = None;
+    }
+
     fn find_construct_search(
         &self,
         pattern: &str,
@@ -1269,6 +1919,42 @@ impl TextBuffer {
             hit = search.regex.next();
         }
 
+        self.find_select_hit(search, hit);
+    }
+
+    fn find_select_prev(&mut self, search: &mut ActiveSearch, offset: usize) {
+        if search.buffer_generation != self.buffer.generation() {
+            unsafe { search.regex.set_text(&mut search.text, 0) };
+            search.buffer_generation = self.buffer.generation();
+        } else {
+            search.regex.reset(0);
+        }
+
+        // ICU can't search backwards, so we scan forward and remember the last hit before `offset`.
+        // If there's none, we keep going to find the last hit in the document (= wrap around).
+        let mut prev = None;
+        let mut last = None;
+
+        for range in search.regex.by_ref() {
+            if range.start >= offset && prev.is_some() {
+                break;
+            }
+            if range.start < offset {
+                prev = Some(range.clone());
+            }
+            last = Some(range);
+        }
+
+        let hit = prev.or(last);
+        if let Some(range) = &hit {
+            // `find_select_next` expects the regex to be positioned at `next_search_offset`.
+            search.regex.reset(range.end);
+        }
+
+        self.find_select_hit(search, hit);
+    }
+
+    fn find_select_hit(&mut self, search: &mut ActiveSearch, hit: Option<Range<usize>>) {
         search.selection_generation = if let Some(range) = hit {
             // Now the search offset is no more at the start of the buffer.
             search.next_search_offset = range.end;
@@ -1503,6 +2189,13 @@ impl TextBuffer {
         result
     }
 
+    /// Returns the offset at which the line that starts at `line_beg` ends, including its newline.
+    /// Unlike seeking to the start of the next line, this works for the last line as well.
+    fn line_end_offset(&self, line_beg: Cursor) -> usize {
+        let next = self.goto_line_start(line_beg, line_beg.logical_pos.y + 1);
+        if next.logical_pos.y > line_beg.logical_pos.y { next.offset } else { self.text_length() }
+    }
+
     fn cursor_move_to_offset_internal(&self, mut cursor: Cursor, offset: usize) -> Cursor {
         if offset == cursor.offset {
             return cursor;
@@ -1630,7 +2323,7 @@ impl TextBuffer {
             }
             CursorMovement::Word => {
                 let doc = &self.buffer as &dyn ReadableDocument;
-                let mut offset = self.cursor.offset;
+                let mut offset = cursor.offset;
 
                 while delta != 0 {
                     if delta < 0 {
@@ -1660,12 +2353,14 @@ impl TextBuffer {
 
     /// Moves the cursor to the given visual position.
     pub fn cursor_move_to_visual(&mut self, pos: Point) {
+        let pos = self.unfolded_visual_pos(pos);
         unsafe { self.set_cursor(self.cursor_move_to_visual_internal(self.cursor, pos)) }
     }
 
-    /// Moves the cursor by the given delta.
+    /// Moves the cursor by the given delta. Folds are skipped over.
     pub fn cursor_move_delta(&mut self, granularity: CursorMovement, delta: CoordType) {
-        unsafe { self.set_cursor(self.cursor_move_delta_internal(self.cursor, granularity, delta)) }
+        let cursor = self.cursor_move_delta_internal(self.cursor, granularity, delta);
+        unsafe { self.set_cursor(self.cursor_skip_folds(cursor, delta > 0)) }
     }
 
     /// Sets the cursor to the given position, and clears the selection.
@@ -1705,27 +2400,453 @@ impl TextBuffer {
                 && cursor.visual_pos.y <= self.stats.visual_lines
         );
         self.cursor = cursor;
-    }
 
-    /// Extracts a rectangular region of the text buffer and writes it to the framebuffer.
-    /// The `destination` rect is framebuffer coordinates. The extracted region within this
-    /// text buffer has the given `origin` and the same size as the `destination` rect.
-    pub fn render(
-        &mut self,
-        origin: Point,
-        destination: Rect,
-        focused: bool,
-        fb: &mut Framebuffer,
-    ) -> Option<RenderResult> {
-        if destination.is_empty() {
-            return None;
+        // The cursor can't be inside a fold. Where moving past it isn't an option
+        // (see `cursor_skip_folds`), e.g. when going to a search hit, the fold is expanded.
+        let y = cursor.logical_pos.y;
+        if !self.folds.is_empty() && self.folds.remove_hiding(y..y + 1) {
+            self.folds_update_rows();
         }
+    }
 
-        let scratch = scratch_arena(None);
-        let width = destination.width();
-        let height = destination.height();
-        let line_number_width = self.margin_width.max(3) as usize - 3;
-        let text_width = width - self.margin_width;
+    /// Returns true if there are cursors besides the primary one.
+    pub fn has_extra_cursors(&self) -> bool {
+        !self.extra_cursors.is_empty()
+    }
+
+    /// Removes all cursors but the primary one. Returns true if there were any.
+    pub fn clear_extra_cursors(&mut self) -> bool {
+        let had = !self.extra_cursors.is_empty();
+        self.extra_cursors.clear();
+        had
+    }
+
+    /// Moves the cursor to the given visual position and leaves another cursor where it was.
+    /// If there's already a cursor at the position, it's removed instead.
+    pub fn add_cursor_at_visual(&mut self, pos: Point) {
+        let pos = self.unfolded_visual_pos(pos);
+        let target = self.cursor_move_to_visual_internal(self.cursor, pos);
+        let mut extras = mem::take(&mut self.extra_cursors);
+
+        if let Some(i) = extras.iter().position(|&off| off == target.offset) {
+            extras.remove(i);
+            self.extra_cursors = extras;
+        } else if target.offset == self.cursor.offset {
+            self.extra_cursors = extras;
+        } else {
+            extras.push(self.cursor.offset);
+            self.set_cursors(target, extras);
+        }
+    }
+
+    /// Adds a cursor `delta` visual rows above or below the cursor, at the given `column`.
+    pub fn add_cursor_vertically(&mut self, column: CoordType, delta: CoordType) {
+        let y = self.cursor_visual_pos().y + delta;
+        if y < 0 || y >= self.visual_line_count() {
+            return;
+        }
+
+        let pos = self.unfolded_visual_pos(Point { x: column, y });
+        let target = self.cursor_move_to_visual_internal(self.cursor, pos);
+        let mut extras = mem::take(&mut self.extra_cursors);
+        extras.push(self.cursor.offset);
+        self.set_cursors(target, extras);
+    }
+
+    /// Returns the range of the word the cursor is in.
+    /// If the cursor is right after a word, that's the one the user means.
+    fn word_at_cursor(&self) -> Option<Range<usize>> {
+        let word_at = |offset: usize| {
+            let range = navigation::word_select(&self.buffer, offset);
+            let first = self.read_forward(range.start).first().copied();
+            let is_word = !range.is_empty() && first.is_some_and(navigation::is_word_byte);
+            is_word.then_some(range)
+        };
+        word_at(self.cursor.offset).or_else(|| {
+            word_at(self.cursor.offset.checked_sub(1)?).filter(|r| r.end == self.cursor.offset)
+        })
+    }
+
+    /// Finds the next occurrence of the word at the cursor and adds a cursor there,
+    /// at the same position within the word. The search wraps around at the end of the buffer.
+    /// Returns false if the cursor isn't on a word or there are no further occurrences.
+    pub fn add_cursor_at_next_occurrence(&mut self) -> bool {
+        let Some(range) = self.word_at_cursor() else {
+            return false;
+        };
+
+        let mut word = Vec::new();
+        self.buffer.extract_raw(range.clone(), &mut word, 0);
+        let within = self.cursor.offset - range.start;
+
+        let mut line = Vec::new();
+        let mut line_beg = self.goto_line_start(self.cursor, self.cursor.logical_pos.y);
+        let mut wrapped = false;
+
+        // Every line is visited once, and the cursor's line twice,
+        // since there may be occurrences on either side of the cursor.
+        for _ in 0..=self.stats.logical_lines {
+            let line_end = self.line_end_offset(line_beg);
+            line.clear();
+            self.buffer.extract_raw(line_beg.offset..line_end, &mut line, 0);
+
+            let mut i = 0;
+            while let Some(pos) = line[i..].windows(word.len()).position(|w| w == word.as_slice()) {
+                let beg = i + pos;
+                let end = beg + word.len();
+                i = beg + 1;
+
+                let whole_word = (beg == 0 || !navigation::is_word_byte(line[beg - 1]))
+                    && line.get(end).is_none_or(|&b| !navigation::is_word_byte(b));
+                let offset = line_beg.offset + beg + within;
+                let ahead = wrapped || line_beg.offset + beg >= range.end;
+
+                if whole_word
+                    && ahead
+                    && offset != self.cursor.offset
+                    && !self.extra_cursors.contains(&offset)
+                {
+                    let target = self.cursor_move_to_offset_internal(line_beg, offset);
+                    let mut extras = mem::take(&mut self.extra_cursors);
+                    extras.push(self.cursor.offset);
+                    self.set_cursors(target, extras);
+                    return true;
+                }
+            }
+
+            if line_end >= self.text_length() {
+                if wrapped {
+                    break;
+                }
+                line_beg = Cursor::default();
+                wrapped = true;
+            } else {
+                line_beg = self.cursor_move_to_offset_internal(line_beg, line_end);
+            }
+        }
+
+        false
+    }
+
+    /// Runs `f` once for every cursor, with the cursor placed there, as a single undo step.
+    /// The cursors are processed from the last to the first, so that an edit
+    /// doesn't shift the offsets of the cursors that are yet to be processed.
+    /// A cursor whose position got deleted by the edit after it merges into that edit's cursor.
+    pub fn for_each_cursor(&mut self, mut f: impl FnMut(&mut Self)) {
+        let mut offsets = mem::take(&mut self.extra_cursors);
+        let primary = offsets.partition_point(|&off| off < self.cursor.offset);
+        offsets.insert(primary, self.cursor.offset);
+
+        self.set_selection(None);
+        self.edit_begin_grouping();
+
+        let mut done: Vec<usize> = Vec::with_capacity(offsets.len());
+        for &offset in offsets.iter().rev() {
+            if !done.is_empty() && offset > self.cursor.offset {
+                done.push(self.cursor.offset);
+                continue;
+            }
+
+            let len_before = self.text_length();
+            let cursor = self.cursor_move_to_offset_internal(self.cursor, offset);
+            self.set_cursor_internal(cursor);
+            self.last_history_type = HistoryType::Other;
+
+            f(self);
+
+            // The cursors behind this one move along with the text.
+            let delta = self.text_length() as isize - len_before as isize;
+            for off in &mut done {
+                *off = off.saturating_add_signed(delta).max(self.cursor.offset);
+            }
+            done.push(self.cursor.offset);
+        }
+
+        self.edit_end_grouping();
+
+        // `done` is in reverse order.
+        let primary = done.swap_remove(done.len() - 1 - primary);
+        let target = self.cursor_move_to_offset_internal(self.cursor, primary);
+        self.set_cursors(target, done);
+    }
+
+    /// Makes `cursor` the primary cursor and the `extras` the other ones.
+    fn set_cursors(&mut self, cursor: Cursor, mut extras: Vec<usize>) {
+        unsafe { self.set_cursor(cursor) };
+        extras.sort_unstable();
+        extras.dedup();
+        extras.retain(|&off| off != cursor.offset);
+        self.extra_cursors = extras;
+    }
+
+    fn render_extra_cursors(
+        &self,
+        visible_beg: Cursor,
+        visible_end: usize,
+        origin: Point,
+        destination: Rect,
+        fb: &mut Framebuffer,
+    ) {
+        let text_width = destination.width() - self.margin_width;
+        let bg = fb.indexed(IndexedColor::Foreground);
+        let fg = fb.contrasted(bg);
+        let mut cursor = visible_beg;
+
+        for &offset in &self.extra_cursors {
+            if offset < visible_beg.offset {
+                continue;
+            }
+            if offset > visible_end {
+                break;
+            }
+
+            cursor = self.cursor_move_to_offset_internal(cursor, offset);
+            let (row, folded) = self.folds.display_row(cursor.visual_pos.y);
+            let x = cursor.visual_pos.x - origin.x;
+            let y = row - origin.y;
+
+            if !folded && x >= 0 && x < text_width && y >= 0 && y < destination.height() {
+                let left = destination.left + self.margin_width + x;
+                let top = destination.top + y;
+                let rect = Rect { left, top, right: left + 1, bottom: top + 1 };
+                fb.blend_bg(rect, bg);
+                fb.blend_fg(rect, fg);
+            }
+        }
+    }
+
+    fn render_search_hits(
+        &self,
+        search: &mut ActiveSearch,
+        visible_beg: Cursor,
+        visible_end: usize,
+        origin: Point,
+        destination: Rect,
+        fb: &mut Framebuffer,
+    ) {
+        if search.no_matches {
+            return;
+        }
+
+        if search.buffer_generation != self.buffer.generation() {
+            unsafe { search.regex.set_text(&mut search.text, visible_beg.offset) };
+            search.buffer_generation = self.buffer.generation();
+        } else {
+            search.regex.reset(visible_beg.offset);
+        }
+
+        let text_width = destination.width() - self.margin_width;
+        let selection = match self.selection {
+            None => [Point::MIN, Point::MIN],
+            Some(TextBufferSelection { beg, end }) => minmax(beg, end),
+        };
+        let bg = fb.indexed_alpha(IndexedColor::BrightYellow, 1, 3);
+        let visual_top = self.folds.visual_row(origin.y);
+        let mut cursor = visible_beg;
+
+        for range in search.regex.by_ref() {
+            if range.start >= visible_end {
+                break;
+            }
+            if range.is_empty() {
+                continue;
+            }
+
+            let beg = self.cursor_move_to_offset_internal(cursor, range.start);
+            let end = self.cursor_move_to_offset_internal(beg, range.end);
+            cursor = end;
+
+            // The selected hit is already highlighted as a selection.
+            if beg.logical_pos == selection[0] && end.logical_pos == selection[1] {
+                continue;
+            }
+
+            for y in beg.visual_pos.y.max(visual_top)..=end.visual_pos.y {
+                let (row, folded) = self.folds.display_row(y);
+                let top = destination.top + row - origin.y;
+                if top >= destination.bottom {
+                    break;
+                }
+                if folded {
+                    continue;
+                }
+
+                let x_beg = if y == beg.visual_pos.y { beg.visual_pos.x } else { 0 };
+                let x_end =
+                    if y == end.visual_pos.y { end.visual_pos.x } else { COORD_TYPE_SAFE_MAX };
+                let x_beg = x_beg.max(origin.x);
+                let x_end = x_end.min(origin.x + text_width);
+                if x_beg >= x_end {
+                    continue;
+                }
+
+                let left = destination.left + self.margin_width - origin.x;
+                fb.blend_bg(
+                    Rect { left: left + x_beg, top, right: left + x_end, bottom: top + 1 },
+                    bg,
+                );
+            }
+        }
+
+        // `find_select_next` expects the regex to be positioned at `next_search_offset`.
+        search.regex.reset(search.next_search_offset);
+    }
+
+    fn render_bracket_pair(
+        &self,
+        visible_beg: Cursor,
+        visible_end: usize,
+        origin: Point,
+        destination: Rect,
+        fb: &mut Framebuffer,
+    ) {
+        // If the partner isn't on screen, it can't be more than a screen's worth of lines away.
+        let Some((bracket, partner)) = self.find_matching_bracket(destination.height()) else {
+            return;
+        };
+        let visible = visible_beg.offset..visible_end;
+        if !visible.contains(&bracket) || !visible.contains(&partner) {
+            return;
+        }
+
+        let text_width = destination.width() - self.margin_width;
+        let bg = fb.indexed_alpha(IndexedColor::BrightCyan, 1, 3);
+
+        for offset in [bracket, partner] {
+            let pos = self.cursor_move_to_offset_internal(visible_beg, offset).visual_pos;
+            let (row, folded) = self.folds.display_row(pos.y);
+            let x = pos.x - origin.x;
+            let y = row - origin.y;
+
+            if !folded && x >= 0 && x < text_width && y >= 0 && y < destination.height() {
+                let left = destination.left + self.margin_width + x;
+                let top = destination.top + y;
+                fb.blend_bg(Rect { left, top, right: left + 1, bottom: top + 1 }, bg);
+            }
+        }
+    }
+
+    /// Finds the other occurrences of the word at the cursor in the lines from `visible_beg`
+    /// up to `visible_end` and returns their offset ranges.
+    /// Only whole words match, and only where the syntax highlighter sees them as the same kind
+    /// of token, so that e.g. a variable doesn't light up inside comments and strings.
+    fn find_occurrences(&self, visible_beg: Cursor, visible_end: usize) -> Vec<Range<usize>> {
+        let mut occurrences = Vec::new();
+        let Some(range) = self.word_at_cursor() else {
+            return occurrences;
+        };
+
+        let mut word = Vec::new();
+        self.buffer.extract_raw(range.clone(), &mut word, 0);
+
+        let mut line = Vec::new();
+        let element_at = |syntax: &[syntax::SyntaxElement], off: usize| {
+            syntax.get(off).copied().unwrap_or(syntax::SyntaxElement::None)
+        };
+
+        let cursor_line = self.goto_line_start(self.cursor, self.cursor.logical_pos.y);
+        let syntax = self.line_syntax(cursor_line, &mut line);
+        let element = element_at(&syntax, range.start - cursor_line.offset);
+        // Only identifiers are worth highlighting. Keywords, numbers, etc., would just be noise.
+        if !matches!(
+            element,
+            syntax::SyntaxElement::None
+                | syntax::SyntaxElement::Variable
+                | syntax::SyntaxElement::Function
+                | syntax::SyntaxElement::Type
+        ) {
+            return occurrences;
+        }
+
+        let mut line_beg = self.goto_line_start(visible_beg, visible_beg.logical_pos.y);
+
+        while line_beg.offset < visible_end {
+            let line_end = self.line_end_offset(line_beg);
+            // Each line is classified once, no matter how many matches it contains.
+            let syntax = self.line_syntax(line_beg, &mut line);
+
+            let mut i = 0;
+            while let Some(pos) = line[i..].windows(word.len()).position(|w| w == word.as_slice()) {
+                let beg = i + pos;
+                let end = beg + word.len();
+                i = end;
+
+                let whole_word = (beg == 0 || !navigation::is_word_byte(line[beg - 1]))
+                    && line.get(end).is_none_or(|&b| !navigation::is_word_byte(b));
+                if whole_word
+                    && line_beg.offset + beg != range.start
+                    && element_at(&syntax, beg) == element
+                {
+                    occurrences.push(line_beg.offset + beg..line_beg.offset + end);
+                }
+            }
+
+            if line_end >= self.text_length() {
+                break;
+            }
+            line_beg = self.cursor_move_to_offset_internal(line_beg, line_end);
+        }
+
+        occurrences
+    }
+
+    /// Highlights the other occurrences of the word at the cursor within the visible text,
+    /// see [`TextBuffer::find_occurrences`].
+    fn render_occurrences(
+        &self,
+        visible_beg: Cursor,
+        visible_end: usize,
+        origin: Point,
+        destination: Rect,
+        fb: &mut Framebuffer,
+    ) {
+        let text_width = destination.width() - self.margin_width;
+        let bg = fb.indexed_alpha(IndexedColor::Foreground, 1, 6);
+        let mut pos = self.goto_line_start(visible_beg, visible_beg.logical_pos.y);
+
+        for occurrence in self.find_occurrences(visible_beg, visible_end) {
+            // With word wrap, the word may be split across rows.
+            let beg = self.cursor_move_to_offset_internal(pos, occurrence.start);
+            let end = self.cursor_move_to_offset_internal(beg, occurrence.end);
+            pos = end;
+
+            for y in beg.visual_pos.y..=end.visual_pos.y {
+                let left = if y == beg.visual_pos.y { beg.visual_pos.x } else { 0 };
+                let right = if y == end.visual_pos.y { end.visual_pos.x } else { text_width };
+                let left = (left - origin.x).max(0);
+                let right = (right - origin.x).min(text_width);
+                let (row, folded) = self.folds.display_row(y);
+                let y = row - origin.y;
+
+                if !folded && left < right && y >= 0 && y < destination.height() {
+                    let left = destination.left + self.margin_width + left;
+                    let right = destination.left + self.margin_width + right;
+                    let top = destination.top + y;
+                    fb.blend_bg(Rect { left, top, right, bottom: top + 1 }, bg);
+                }
+            }
+        }
+    }
+
+    /// Extracts a rectangular region of the text buffer and writes it to the framebuffer.
+    /// The `destination` rect is framebuffer coordinates. The extracted region within this
+    /// text buffer has the given `origin` and the same size as the `destination` rect.
+    pub fn render(
+        &mut self,
+        origin: Point,
+        destination: Rect,
+        focused: bool,
+        fb: &mut Framebuffer,
+    ) -> Option<RenderResult> {
+        if destination.is_empty() {
+            return None;
+        }
+
+        let scratch = scratch_arena(None);
+        let width = destination.width();
+        let height = destination.height();
+        let line_number_width = self.margin_width.max(3) as usize - 3;
+        let text_width = width - self.margin_width;
         let mut visualizer_buf = [0xE2, 0x90, 0x80]; // U+2400 in UTF8
         let mut line = ArenaString::new_in(&scratch);
         let mut visual_pos_x_max = 0;
@@ -1734,8 +2855,9 @@ impl TextBuffer {
         let mut cursor = {
             let a = self.cursor;
             let b = self.cursor_for_rendering.unwrap_or_default();
-            let da = (a.visual_pos.y - origin.y).abs();
-            let db = (b.visual_pos.y - origin.y).abs();
+            let origin_y = self.folds.visual_row(origin.y);
+            let da = (a.visual_pos.y - origin_y).abs();
+            let db = (b.visual_pos.y - origin_y).abs();
             if da < db { a } else { b }
         };
 
@@ -1743,13 +2865,16 @@ impl TextBuffer {
             None => [Point::MIN, Point::MIN],
             Some(TextBufferSelection { beg, end }) => minmax(beg, end),
         };
+        let cursor_line = self.cursor.logical_pos.y;
+        let mut cursor_line_rows: Option<Range<CoordType>> = None;
+        let mut error_rows = Vec::new_in(&*scratch);
 
         line.reserve(width as usize * 2);
 
         for y in 0..height {
             line.clear();
 
-            let visual_line = origin.y + y;
+            let visual_line = self.folds.visual_row(origin.y + y);
             let mut cursor_beg =
                 self.cursor_move_to_visual_internal(cursor, Point { x: origin.x, y: visual_line });
             let cursor_end = self.cursor_move_to_visual_internal(
@@ -1757,6 +2882,25 @@ impl TextBuffer {
                 Point { x: origin.x + text_width, y: visual_line },
             );
 
+            // Without word wrap, long lines get cut off at the edges. Remember where that happened,
+            // before `cursor_beg` gets adjusted for wide glyphs below, so that we can mark it.
+            let (cut_left, cut_right) = if self.word_wrap_column <= 0 {
+                let next = self.read_forward(cursor_end.offset).first();
+                (
+                    origin.x > 0 && cursor_beg.visual_pos.x > 0,
+                    next.is_some_and(|&c| c != b'\r' && c != b'\n'),
+                )
+            } else {
+                (false, false)
+            };
+
+            // Whether this row ends with a line break that needs to be visualized.
+            let line_break = self.whitespace_visible
+                && self
+                    .read_forward(cursor_end.offset)
+                    .first()
+                    .is_some_and(|&c| c == b'\r' || c == b'\n');
+
             // Accelerate the next render pass by remembering where we started off.
             if y == 0 {
                 self.cursor_for_rendering = Some(cursor_beg);
@@ -1773,7 +2917,13 @@ impl TextBuffer {
                     line.push_str(&MARGIN_TEMPLATE[off..]);
                 } else if self.word_wrap_column <= 0 || cursor_beg.logical_pos.x == 0 {
                     // Regular line? Place "123 | " in the margin.
-                    _ = write!(line, "{:1$} │ ", cursor_beg.logical_pos.y + 1, line_number_width);
+                    let number = if self.margin_relative && cursor_beg.logical_pos.y != cursor_line
+                    {
+                        (cursor_beg.logical_pos.y - cursor_line).abs()
+                    } else {
+                        cursor_beg.logical_pos.y + 1
+                    };
+                    _ = write!(line, "{:1$} │ ", number, line_number_width);
                 } else {
                     // Wrapped line? Place " ... | " in the margin.
                     let number_width = (cursor_beg.logical_pos.y + 1).ilog10() as usize + 1;
@@ -1797,6 +2947,28 @@ impl TextBuffer {
                         fb.indexed_alpha(IndexedColor::Background, 1, 2),
                     );
                 }
+
+                if visual_line < self.stats.visual_lines && cursor_beg.logical_pos.y == cursor_line
+                {
+                    let start = cursor_line_rows.map_or(y, |r| r.start);
+                    cursor_line_rows = Some(start..y + 1);
+                }
+            }
+
+            // Underline the lines with errors. Their line numbers are colored further below.
+            if visual_line < self.stats.visual_lines
+                && self.error_lines.binary_search(&cursor_beg.logical_pos.y).is_ok()
+            {
+                let left = destination.left + self.margin_width - origin.x;
+                let top = destination.top + y;
+                let rect = Rect {
+                    left: left + cursor_beg.visual_pos.x.max(origin.x),
+                    top,
+                    right: left + cursor_end.visual_pos.x,
+                    bottom: top + 1,
+                };
+                fb.replace_attr(rect, Attributes::Underlined, Attributes::Underlined);
+                error_rows.push(y);
             }
 
             let mut selection_off = 0..0;
@@ -1841,9 +3013,12 @@ impl TextBuffer {
                     bottom: top + 1,
                 };
 
-                let mut bg = oklab_blend(
-                    fb.indexed(IndexedColor::Foreground),
-                    fb.indexed_alpha(IndexedColor::BrightBlue, 1, 2),
+                let mut bg = fb.theme_color(
+                    fb.theme().selection,
+                    oklab_blend(
+                        fb.indexed(IndexedColor::Foreground),
+                        fb.indexed_alpha(IndexedColor::BrightBlue, 1, 2),
+                    ),
                 );
                 if !focused {
                     bg = oklab_blend(bg, fb.indexed_alpha(IndexedColor::Background, 1, 2))
@@ -1853,6 +3028,36 @@ impl TextBuffer {
                 fb.blend_fg(rect, fg);
             }
 
+            // Highlight the spaces and tabs at the end of the line, as far as they're on this row.
+            if self.trailing_whitespace_highlight_enabled && cursor_beg.visual_pos.y == visual_line
+            {
+                let line_end = self.cursor_move_to_logical_internal(
+                    cursor_end,
+                    Point { x: CoordType::MAX, y: cursor_end.logical_pos.y },
+                );
+                let ws_beg = self.trailing_whitespace_start(line_end.offset);
+
+                if ws_beg < cursor_end.offset {
+                    let beg = self
+                        .cursor_move_to_offset_internal(cursor_beg, ws_beg.max(cursor_beg.offset));
+                    let left = destination.left + self.margin_width - origin.x;
+                    let top = destination.top + y;
+                    let rect = Rect {
+                        left: left + beg.visual_pos.x.max(origin.x),
+                        top,
+                        right: left + cursor_end.visual_pos.x,
+                        bottom: top + 1,
+                    };
+                    fb.blend_bg(
+                        rect,
+                        fb.theme_color(
+                            fb.theme().trailing_whitespace,
+                            fb.indexed_alpha(IndexedColor::BrightRed, 1, 2),
+                        ),
+                    );
+                }
+            }
+
             // Nothing to do if the entire line is empty.
             if cursor_beg.offset != cursor_end.offset {
                 // If we couldn't reach the left edge, we may have stopped short due to a wide glyph.
@@ -1891,7 +3096,8 @@ impl TextBuffer {
 
                         if ch == ' ' || ch == '\t' {
                             let is_tab = ch == '\t';
-                            let visualize = selection_off.contains(&global_off);
+                            let visualize =
+                                self.whitespace_visible || selection_off.contains(&global_off);
                             let mut whitespace = TAB_WHITESPACE;
                             let mut prefix_add = 0;
 
@@ -1907,7 +3113,7 @@ impl TextBuffer {
                                 if is_tab { self.tab_size_eval(cursor_line.column) } else { 1 };
 
                             if visualize {
-                                // If the whitespace is part of the selection,
+                                // If whitespace is visible, or it is part of the selection,
                                 // we replace " " with "･" and "\t" with "￫".
                                 (whitespace, prefix_add) = if is_tab {
                                     (VISUAL_TAB, VISUAL_TAB_PREFIX_ADD)
@@ -1921,7 +3127,7 @@ impl TextBuffer {
                                         + self.margin_width
                                         + cursor_line.visual_pos.x
                                         - origin.x;
-                                    let top = destination.top + cursor_line.visual_pos.y - origin.y;
+                                    let top = destination.top + y;
                                     Rect { left, top, right: left + 1, bottom: top + 1 }
                                 };
                                 fb.blend_fg(
@@ -1951,7 +3157,7 @@ impl TextBuffer {
                                 let left =
                                     destination.left + self.margin_width + cursor_line.visual_pos.x
                                         - origin.x;
-                                let top = destination.top + cursor_line.visual_pos.y - origin.y;
+                                let top = destination.top + y;
                                 Rect { left, top, right: left + 1, bottom: top + 1 }
                             };
                             let bg = fb.indexed(IndexedColor::Yellow);
@@ -1969,15 +3175,14 @@ impl TextBuffer {
                                 cursor_line = self.cursor_move_to_offset_internal(cursor_line, global_off);
                                 let highlight_rect = {
                                     let left = destination.left + self.margin_width + cursor_line.visual_pos.x - origin.x;
-                                    let top = destination.top + cursor_line.visual_pos.y - origin.y;
+                                    let top = destination.top + y;
                                     Rect { left, top, right: left + 1, bottom: top + 1 }
                                 };
                                 
-                                // Handle both IndexedColor and RGB colors
-                                let color = match syntax_element.color() {
-                                    syntax::SyntaxColor::Indexed(indexed_color) => fb.indexed(indexed_color),
-                                    syntax::SyntaxColor::Rgb(rgb_color) => rgb_color,
-                                };
+                                let color = fb.theme_color(
+                                    fb.theme().syntax(syntax_element),
+                                    fb.indexed(IndexedColor::Foreground),
+                                );
                                 fb.blend_fg(highlight_rect, color);
                             }
                             
@@ -1993,9 +3198,80 @@ impl TextBuffer {
 
             fb.replace_text(destination.top + y, destination.left, destination.right, &line);
 
+            if line_break {
+                let text_left = destination.left + self.margin_width;
+                let left = text_left + cursor_end.visual_pos.x - origin.x;
+                if left >= text_left && left < destination.right {
+                    let top = destination.top + y;
+                    fb.replace_text(top, left, left + 1, VISUAL_LINE_BREAK);
+                    fb.blend_fg(
+                        Rect { left, top, right: left + 1, bottom: top + 1 },
+                        fb.indexed_alpha(IndexedColor::Foreground, 1, 2),
+                    );
+                }
+            }
+
+            // After the end of a fold's header line, hint at what's folded away.
+            if let Some(fold) = self.folds.iter().find(|fold| fold.rows.start == visual_line + 1) {
+                let line_end = self.cursor_move_to_logical_internal(
+                    cursor_end,
+                    Point { x: CoordType::MAX, y: fold.header },
+                );
+                let text_left = destination.left + self.margin_width;
+                let left = text_left + line_end.visual_pos.x + 1 - origin.x;
+                if left >= text_left {
+                    let top = destination.top + y;
+                    fb.replace_text(top, left, destination.right, &fold.placeholder);
+                    fb.blend_fg(
+                        Rect { left, top, right: destination.right, bottom: top + 1 },
+                        fb.indexed(IndexedColor::BrightBlack),
+                    );
+                }
+            }
+
+            if cut_left || cut_right {
+                let top = destination.top + y;
+                let text_left = destination.left + self.margin_width;
+                let color = fb.indexed(IndexedColor::BrightBlack);
+                if cut_left {
+                    fb.replace_text(top, text_left, text_left + 1, "«");
+                    fb.blend_fg(
+                        Rect { left: text_left, top, right: text_left + 1, bottom: top + 1 },
+                        color,
+                    );
+                }
+                if cut_right && destination.right - 1 > text_left {
+                    let left = destination.right - 1;
+                    fb.replace_text(top, left, left + 1, "»");
+                    fb.blend_fg(Rect { left, top, right: left + 1, bottom: top + 1 }, color);
+                }
+            }
+
             cursor = cursor_end;
         }
 
+        // Highlight all other search hits that are on screen.
+        if let Some(search) = &self.search {
+            let search = unsafe { &mut *search.get() };
+            let visible_beg = self.cursor_for_rendering.unwrap_or_default();
+            self.render_search_hits(search, visible_beg, cursor.offset, origin, destination, fb);
+        }
+
+        if focused && self.bracket_highlight_enabled && self.selection.is_none() {
+            let visible_beg = self.cursor_for_rendering.unwrap_or_default();
+            self.render_bracket_pair(visible_beg, cursor.offset, origin, destination, fb);
+        }
+
+        if focused && self.occurrence_highlight_enabled && self.selection.is_none() {
+            let visible_beg = self.cursor_for_rendering.unwrap_or_default();
+            self.render_occurrences(visible_beg, cursor.offset, origin, destination, fb);
+        }
+
+        if focused && !self.extra_cursors.is_empty() {
+            let visible_beg = self.cursor_for_rendering.unwrap_or_default();
+            self.render_extra_cursors(visible_beg, cursor.offset, origin, destination, fb);
+        }
+
         // Colorize the margin that we wrote above.
         if self.margin_width > 0 {
             let margin = Rect {
@@ -2004,7 +3280,28 @@ impl TextBuffer {
                 right: destination.left + self.margin_width,
                 bottom: destination.bottom,
             };
-            fb.blend_fg(margin, 0x7f3f3f3f);
+            fb.blend_fg(margin, fb.theme_color(fb.theme().gutter, 0x7f3f3f3f));
+
+            // Make the cursor line's number stand out.
+            if let Some(rows) = cursor_line_rows {
+                let rect = Rect {
+                    left: destination.left,
+                    top: destination.top + rows.start,
+                    right: destination.left + line_number_width as CoordType,
+                    bottom: destination.top + rows.end,
+                };
+                fb.blend_fg(rect, fb.indexed(IndexedColor::Foreground));
+            }
+
+            for &y in &error_rows {
+                let rect = Rect {
+                    left: destination.left,
+                    top: destination.top + y,
+                    right: destination.left + line_number_width as CoordType,
+                    bottom: destination.top + y + 1,
+                };
+                fb.blend_fg(rect, fb.indexed(IndexedColor::BrightRed));
+            }
         }
 
         if self.ruler > 0 {
@@ -2019,8 +3316,7 @@ impl TextBuffer {
         }
 
         if focused {
-            let mut x = self.cursor.visual_pos.x;
-            let mut y = self.cursor.visual_pos.y;
+            let Point { mut x, mut y } = self.cursor_visual_pos();
 
             if self.word_wrap_column > 0 && x >= self.word_wrap_column {
                 // The line the cursor is on wraps exactly on the word wrap column which
@@ -2071,7 +3367,9 @@ impl TextBuffer {
 
     fn cut_copy(&mut self, clipboard: &mut Clipboard, cut: bool) {
         let line_copy = !self.has_selection();
-        let selection = self.extract_selection(cut);
+        // A cut turns into a copy if the buffer is read-only.
+        let delete = cut && !self.refuse_edit();
+        let selection = self.extract_selection(delete);
         clipboard.write(selection);
         clipboard.write_was_line_copy(line_copy);
     }
@@ -2082,20 +3380,194 @@ impl TextBuffer {
             return;
         }
 
-        let pos = self.cursor_logical_pos();
-        let at = if clipboard.is_line_copy() {
-            self.goto_line_start(self.cursor, pos.y)
+        if self.convert_pasted_indentation {
+            let text = self.reindent_pasted(data, None);
+            self.paste_text(&text, clipboard.is_line_copy());
         } else {
-            self.cursor
-        };
+            self.paste_text(data, clipboard.is_line_copy());
+        }
+    }
+
+    /// Like [`TextBuffer::paste`], but for languages with syntax highlighting, the pasted
+    /// lines are moved to the indentation of the cursor, keeping their relative indentation.
+    /// Their indentation is always converted to tabs or spaces, like the rest of the buffer.
+    pub fn paste_reindented(&mut self, clipboard: &Clipboard) {
+        let data = clipboard.read();
+        if data.is_empty() {
+            return;
+        }
+
+        let line_copy = clipboard.is_line_copy();
+        let mut target = None;
+
+        if self.syntax_language().is_some() {
+            let y = self.cursor.logical_pos.y;
+            let line_beg = self.goto_line_start(self.cursor, y);
+            // A line copy is inserted above the current line, so it gets that line's indentation.
+            let limit = if line_copy {
+                self.cursor_move_to_logical_internal(line_beg, Point { x: CoordType::MAX, y })
+                    .offset
+            } else {
+                self.cursor.offset
+            };
+            let (columns, indentation_end) = self.indentation_between(line_beg.offset, limit);
+
+            // If there's text before the cursor, the first line simply continues it.
+            // Otherwise, it starts right at the cursor and its own indentation is dropped.
+            let first_line = if line_copy {
+                PastedFirstLine::Indent
+            } else if indentation_end == limit {
+                PastedFirstLine::Trim
+            } else {
+                PastedFirstLine::Keep
+            };
+            target = Some((columns, first_line));
+        }
 
-        self.write(data, at, true);
+        let text = self.reindent_pasted(data, target);
+        self.paste_text(&text, line_copy);
+    }
+
+    fn paste_text(&mut self, text: &[u8], line_copy: bool) {
+        let pos = self.cursor_logical_pos();
+        let at = if line_copy { self.goto_line_start(self.cursor, pos.y) } else { self.cursor };
 
-        if clipboard.is_line_copy() {
+        self.write(text, at, true);
+
+        if line_copy {
             self.cursor_move_to_logical(Point { x: pos.x, y: pos.y + 1 });
         }
     }
 
+    /// Rewrites the indentation of each line in `text` with tabs or spaces, as configured.
+    /// With a `target`, the lines are also shifted so that the least indented one ends up
+    /// at an indentation of `target.0` columns. Blank lines are emptied in that case.
+    fn reindent_pasted(
+        &self,
+        text: &[u8],
+        target: Option<(CoordType, PastedFirstLine)>,
+    ) -> Vec<u8> {
+        let scratch = scratch_arena(None);
+        let mut indentation = ArenaString::new_in(&scratch);
+        let mut result = Vec::with_capacity(text.len());
+        let mut lines = Vec::new_in(&*scratch);
+
+        // Split `text` into lines, noting the width and length of their indentation.
+        // Bracketed paste uses CR as the line ending, which is why this doesn't use `unicode::newlines_forward`.
+        let mut offset = 0;
+        while offset < text.len() {
+            let line_end = memchr2(b'\r', b'\n', text, offset);
+            let mut end = line_end;
+            if end < text.len() {
+                end += if text[end..].starts_with(b"\r\n") { 2 } else { 1 };
+            }
+
+            let line = &text[offset..line_end];
+            let (columns, indentation_len) = self.measure_indentation(0, line);
+            lines.push((columns, line, indentation_len, &text[line_end..end]));
+            offset = end;
+        }
+
+        // The first line's indentation only counts if it was copied, too.
+        // It's usually missing when copying starts in front of its first word.
+        let first_line_counts = !matches!(target, Some((_, PastedFirstLine::Keep)));
+        let base = lines
+            .iter()
+            .enumerate()
+            .filter(|&(i, &(columns, line, len, _))| {
+                len < line.len() && (i > 0 || (first_line_counts && columns > 0))
+            })
+            .map(|(_, &(columns, ..))| columns)
+            .min()
+            .unwrap_or(0);
+
+        for (i, &(columns, line, len, newline)) in lines.iter().enumerate() {
+            let content = &line[len..];
+            let columns = match target {
+                None => columns,
+                Some((_, PastedFirstLine::Keep)) if i == 0 => {
+                    result.extend_from_slice(line);
+                    result.extend_from_slice(newline);
+                    continue;
+                }
+                Some((_, PastedFirstLine::Trim)) if i == 0 => 0,
+                Some(_) if content.is_empty() => 0,
+                Some((target, _)) => (target + columns - base).max(0),
+            };
+
+            indentation.clear();
+            self.push_indentation(&mut indentation, columns);
+            result.extend_from_slice(indentation.as_bytes());
+            result.extend_from_slice(content);
+            result.extend_from_slice(newline);
+        }
+
+        result
+    }
+
+    /// Replaces the entire contents with `text`, as a single undo step.
+    /// Only the part between the common prefix and suffix is rewritten, which keeps the
+    /// undo entry small and allows the cursor to stay where it was, as far as possible.
+    /// `text` must already use the buffer's newline style.
+    pub fn replace_all(&mut self, text: &[u8]) {
+        if self.refuse_edit() {
+            return;
+        }
+
+        let mut current = Vec::new();
+        self.buffer.extract_raw(0..self.text_length(), &mut current, 0);
+
+        let mut prefix = current.iter().zip(text).take_while(|(a, b)| a == b).count();
+        if prefix == current.len() && prefix == text.len() {
+            return;
+        }
+        let mut suffix = current[prefix..]
+            .iter()
+            .rev()
+            .zip(text[prefix..].iter().rev())
+            .take_while(|(a, b)| a == b)
+            .count();
+
+        // Don't split UTF-8 sequences or CRLF pairs, as the cursor can't be placed inside them.
+        let is_inside = |text: &[u8], off: usize| {
+            off > 0
+                && off < text.len()
+                && ((text[off] & 0xc0) == 0x80 || (text[off - 1] == b'\r' && text[off] == b'\n'))
+        };
+        while is_inside(&current, prefix) || is_inside(text, prefix) {
+            prefix -= 1;
+        }
+        while is_inside(&current, current.len() - suffix) || is_inside(text, text.len() - suffix) {
+            suffix -= 1;
+        }
+
+        let cursor = self.cursor;
+        let beg = self.cursor_move_to_offset_internal(self.cursor, prefix);
+        let end = self.cursor_move_to_offset_internal(beg, current.len() - suffix);
+        let middle = &text[prefix..text.len() - suffix];
+
+        self.set_selection(None);
+        self.last_history_type = HistoryType::Other;
+        self.edit_begin(HistoryType::Other, beg);
+        if end.offset > beg.offset {
+            self.edit_delete(end);
+        }
+        if !middle.is_empty() {
+            self.edit_write(middle);
+        }
+        self.edit_end();
+
+        // Text before and after the changed region is unchanged, so a cursor there can stay on
+        // the same character. Inside it, the logical position is the best guess we have.
+        if cursor.offset <= beg.offset {
+            self.cursor_move_to_offset(cursor.offset);
+        } else if cursor.offset >= end.offset {
+            self.cursor_move_to_offset(cursor.offset - end.offset + beg.offset + middle.len());
+        } else {
+            self.cursor_move_to_logical(cursor.logical_pos);
+        }
+    }
+
     /// Inserts the user input `text` at the current cursor position.
     /// Replaces tabs with whitespace if needed, etc.
     pub fn write_canon(&mut self, text: &[u8]) {
@@ -2109,12 +3581,19 @@ impl TextBuffer {
     }
 
     fn write(&mut self, text: &[u8], at: Cursor, raw: bool) {
+        if self.refuse_edit() {
+            return;
+        }
+
         let history_type = if raw { HistoryType::Other } else { HistoryType::Write };
         let mut edit_begun = false;
 
         // If we have an active selection, writing an empty `text`
         // will still delete the selection. As such, we check this first.
         if let Some((beg, end)) = self.selection_range_internal(false) {
+            // Don't merge the replacement of a selection into the preceding typing.
+            // Any text typed after it is merged into this step, however.
+            self.last_history_type = HistoryType::Other;
             self.edit_begin(history_type, beg);
             self.edit_delete(end);
             self.set_selection(None);
@@ -2131,7 +3610,22 @@ impl TextBuffer {
             return;
         }
 
+        if !raw
+            && !edit_begun
+            && !self.overtype
+            && self.smart_indent_applies()
+            && text == b"}"
+            && self.smart_dedent(at)
+        {
+            return;
+        }
+
         if !edit_begun {
+            // A newline starts a new undo entry, so that undo removes one line at a time.
+            // The text typed after it is merged into that entry.
+            if memchr2(b'\r', b'\n', text, 0) < text.len() {
+                self.last_history_type = HistoryType::Other;
+            }
             self.edit_begin(history_type, at);
         }
 
@@ -2194,36 +3688,14 @@ impl TextBuffer {
                 // (If it doesn't, use a different terminal.)
                 let line_beg = self.goto_line_start(self.cursor, self.cursor.logical_pos.y);
                 let limit = self.cursor.offset;
-                let mut off = line_beg.offset;
-                let mut newline_indentation = 0;
-
-                'outer: while off < limit {
-                    let chunk = self.read_forward(off);
-                    let chunk = &chunk[..chunk.len().min(limit - off)];
-
-                    for &c in chunk {
-                        if c == b' ' {
-                            newline_indentation += 1;
-                        } else if c == b'\t' {
-                            newline_indentation += self.tab_size_eval(newline_indentation);
-                        } else {
-                            break 'outer;
-                        }
-                    }
-
-                    off += chunk.len();
-                }
+                let (mut newline_indentation, _) = self.indentation_between(line_beg.offset, limit);
 
-                // If tabs are enabled, add as many tabs as we can.
-                if self.indent_with_tabs {
-                    let tab_count = newline_indentation / self.tab_size;
-                    newline_buffer.push_repeat('\t', tab_count as usize);
-                    newline_indentation -= tab_count * self.tab_size;
+                // Opening a block? Indent the new line by one more level.
+                if self.smart_indent_applies() && self.opens_block_before(line_beg, limit) {
+                    newline_indentation += self.tab_size;
                 }
 
-                // If tabs are disabled, or if the indentation wasn't a multiple of the tab size,
-                // add spaces to make up the difference.
-                newline_buffer.push_repeat(' ', newline_indentation as usize);
+                self.push_indentation(&mut newline_buffer, newline_indentation);
             }
 
             self.edit_write(newline_buffer.as_bytes());
@@ -2265,21 +3737,144 @@ impl TextBuffer {
         self.edit_end();
     }
 
+    /// Appends whitespace for an indentation of `columns` to `buf`.
+    fn push_indentation(&self, buf: &mut ArenaString, mut columns: CoordType) {
+        // If tabs are enabled, add as many tabs as we can.
+        if self.indent_with_tabs {
+            let tab_count = columns / self.tab_size;
+            buf.push_repeat('\t', tab_count as usize);
+            columns -= tab_count * self.tab_size;
+        }
+
+        // If tabs are disabled, or if the indentation wasn't a multiple of the tab size,
+        // add spaces to make up the difference.
+        buf.push_repeat(' ', columns as usize);
+    }
+
+    /// Measures the indentation at the start of `text`, continuing from the given `column`.
+    /// Returns the column it ends at, and its length in bytes.
+    fn measure_indentation(&self, mut column: CoordType, text: &[u8]) -> (CoordType, usize) {
+        let mut len = 0;
+        for &c in text {
+            match c {
+                b' ' => column += 1,
+                b'\t' => column += self.tab_size_eval(column),
+                _ => break,
+            }
+            len += 1;
+        }
+        (column, len)
+    }
+
+    /// Measures the indentation at `beg`, up to `end` at most.
+    /// Returns its width in columns and the offset it ends at.
+    fn indentation_between(&self, beg: usize, end: usize) -> (CoordType, usize) {
+        let mut column = 0;
+        let mut off = beg;
+
+        while off < end {
+            let chunk = self.read_forward(off);
+            let chunk = &chunk[..chunk.len().min(end - off)];
+            let len;
+            (column, len) = self.measure_indentation(column, chunk);
+            off += len;
+            if len < chunk.len() {
+                break;
+            }
+        }
+
+        (column, off)
+    }
+
+    /// Whether the line starting at `line_beg` ends in a `{` before the offset `end`.
+    /// Whitespace and trailing comments are ignored, and a `{` inside a string or comment doesn't count.
+    fn opens_block_before(&self, line_beg: Cursor, end: usize) -> bool {
+        let mut line = Vec::new();
+        let syntax = self.line_syntax(line_beg, &mut line);
+        let end = end.saturating_sub(line_beg.offset).min(line.len());
+
+        (0..end)
+            .rev()
+            .find(|&i| {
+                !matches!(line[i], b' ' | b'\t')
+                    && !matches!(syntax.get(i), Some(syntax::SyntaxElement::Comment))
+            })
+            .is_some_and(|i| line[i] == b'{' && is_code(&syntax, i))
+    }
+
+    /// Writes a `}` at `at`. If it's the first non-whitespace character on the line,
+    /// the line gets the same indentation as the one with the matching `{`,
+    /// if it's at most [`SMART_DEDENT_MAX_LINES`] lines up. Returns false if nothing was written.
+    fn smart_dedent(&mut self, at: Cursor) -> bool {
+        let line_beg = self.goto_line_start(at, at.logical_pos.y);
+        let (chars, _) = self.measure_indent_internal(line_beg.offset, CoordType::MAX);
+        if at.logical_pos.x != chars {
+            return false;
+        }
+
+        // Find the matching `{` by counting braces backwards.
+        // Like for bracket matching, those in strings and comments don't count.
+        let mut depth = 0;
+        let mut open = None;
+        let mut line = Vec::new();
+        let mut y = at.logical_pos.y;
+        let min_y = (y - SMART_DEDENT_MAX_LINES).max(0);
+
+        'outer: while y > min_y {
+            y -= 1;
+            let beg = self.goto_line_start(line_beg, y);
+            let syntax = self.line_syntax(beg, &mut line);
+            for i in (0..line.len()).rev() {
+                match line[i] {
+                    _ if !is_code(&syntax, i) => {}
+                    b'}' => depth += 1,
+                    b'{' if depth == 0 => {
+                        open = Some(beg.offset + i);
+                        break 'outer;
+                    }
+                    b'{' => depth -= 1,
+                    _ => {}
+                }
+            }
+        }
+
+        let Some(open) = open else {
+            return false;
+        };
+
+        let open = self.cursor_move_to_offset_internal(line_beg, open);
+        let open_line_beg = self.goto_line_start(open, open.logical_pos.y);
+        let (_, columns) = self.measure_indent_internal(open_line_beg.offset, CoordType::MAX);
+
+        let scratch = scratch_arena(None);
+        let mut replacement = ArenaString::new_in(&scratch);
+        self.push_indentation(&mut replacement, columns);
+        replacement.push('}');
+
+        self.edit_begin(HistoryType::Write, line_beg);
+        self.edit_delete(at);
+        self.edit_write(replacement.as_bytes());
+        self.edit_end();
+        true
+    }
+
     /// Deletes 1 grapheme cluster from the buffer.
     /// `cursor_movements` is expected to be -1 for backspace and 1 for delete.
     /// If there's a current selection, it will be deleted and `cursor_movements` ignored.
     /// The selection is cleared after the call.
     /// Deletes characters from the buffer based on a delta from the cursor.
     pub fn delete(&mut self, granularity: CursorMovement, delta: CoordType) {
-        if delta == 0 {
+        if delta == 0 || self.refuse_edit() {
             return;
         }
 
+        let mut isolated = matches!(granularity, CursorMovement::Word);
         let mut beg;
         let mut end;
 
         if let Some(r) = self.selection_range_internal(false) {
             (beg, end) = r;
+            isolated = true;
         } else {
             if (delta < 0 && self.cursor.offset == 0)
                 || (delta > 0 && self.cursor.offset >= self.text_length())
@@ -2289,7 +3884,15 @@ impl TextBuffer {
             }
 
             beg = self.cursor;
-            end = self.cursor_move_delta_internal(beg, granularity, delta);
+            end = match granularity {
+                // When indenting with spaces, a backspace within the indentation
+                // deletes up to the previous tab stop, just like it would for a tab.
+                CursorMovement::Grapheme if delta == -1 && !self.indent_with_tabs => {
+                    self.indent_backspace_target(beg)
+                }
+                _ => None,
+            }
+            .unwrap_or_else(|| self.cursor_move_delta_internal(beg, granularity, delta));
             if beg.offset == end.offset {
                 return;
             }
@@ -2298,13 +3901,50 @@ impl TextBuffer {
             }
         }
 
+        // Deleting a word or a selection is a single undo step of its own.
+        if isolated {
+            self.last_history_type = HistoryType::Other;
+        }
+
         self.edit_begin(HistoryType::Delete, beg);
         self.edit_delete(end);
         self.edit_end();
 
+        if isolated {
+            self.last_history_type = HistoryType::Other;
+        }
         self.set_selection(None);
     }
 
+    /// If `cursor` is within the indentation of its line, this returns
+    /// the position up to which a backspace should delete spaces.
+    fn indent_backspace_target(&self, cursor: Cursor) -> Option<Cursor> {
+        let line_beg = self.goto_line_start(cursor, cursor.logical_pos.y);
+        let (chars, _) = self.measure_indent_internal(line_beg.offset, CoordType::MAX);
+        if cursor.logical_pos.x == 0 || cursor.logical_pos.x > chars {
+            return None;
+        }
+
+        let target = self.tab_size_prev_column(cursor.column);
+        let mut offset = cursor.offset;
+        let mut column = cursor.column;
+
+        // Only delete spaces. A tab is deleted as a whole by the regular code path anyway.
+        while column > target
+            && offset > line_beg.offset
+            && self.read_backward(offset).last() == Some(&b' ')
+        {
+            offset -= 1;
+            column -= 1;
+        }
+
+        if cursor.offset - offset > 1 {
+            Some(self.cursor_move_to_offset_internal(line_beg, offset))
+        } else {
+            None
+        }
+    }
+
     /// Returns the logical position of the first character on this line.
     /// Return `.x == 0` if there are no non-whitespace characters.
     pub fn indent_end_logical_pos(&self) -> Point {
@@ -2315,6 +3955,10 @@ impl TextBuffer {
 
     /// Indents/unindents the current selection or line.
     pub fn indent_change(&mut self, direction: CoordType) {
+        if self.refuse_edit() {
+            return;
+        }
+
         let selection = self.selection;
         let mut selection_beg = self.cursor.logical_pos;
         let mut selection_end = selection_beg;
@@ -2329,9 +3973,17 @@ impl TextBuffer {
             return;
         }
 
+        let first = selection_beg.y.min(selection_end.y);
+        let mut last = selection_beg.y.max(selection_end.y);
+
+        // A selection that ends at the start of a line doesn't include that line.
+        if last > first && selection_beg.max(selection_end).x == 0 {
+            last -= 1;
+        }
+
         self.edit_begin_grouping();
 
-        for y in selection_beg.y.min(selection_end.y)..=selection_beg.y.max(selection_end.y) {
+        for y in first..=last {
             self.cursor_move_to_logical(Point { x: 0, y });
 
             let line_start_offset = self.cursor.offset;
@@ -2340,8 +3992,6 @@ impl TextBuffer {
 
             self.cursor_move_to_logical(Point { x: curr_chars, y: self.cursor.logical_pos.y });
 
-            let delta;
-
             if direction < 0 {
                 // Unindent the line. If there's no indentation, skip.
                 if curr_columns <= 0 {
@@ -2353,20 +4003,28 @@ impl TextBuffer {
                     self.tab_size_prev_column(curr_columns),
                 );
 
-                delta = prev_chars - curr_chars;
-                self.delete(CursorMovement::Grapheme, delta);
+                self.delete(CursorMovement::Grapheme, prev_chars - curr_chars);
             } else {
                 // Indent the line. `self.cursor` is already at the level of indentation.
-                delta = self.tab_size_eval(curr_columns);
+                // Blank lines are skipped, so that we don't litter them with trailing whitespace.
+                let indent_end = line_start_offset + curr_chars as usize;
+                if matches!(self.read_forward(indent_end).first(), None | Some(b'\r' | b'\n')) {
+                    continue;
+                }
                 self.write_canon(b"\t");
             }
 
-            // As the lines get unindented, the selection should shift with them.
-            if y == selection_beg.y {
-                selection_beg.x += delta;
+            // The indentation may consist of tabs or spaces, so we measure what we got.
+            let (next_chars, _) = self.measure_indent_internal(line_start_offset, CoordType::MAX);
+            let delta = next_chars - curr_chars;
+
+            // As the lines get (un)indented, the selection should shift with them.
+            // A selection that starts at column 0 stays there, so that it covers the indentation.
+            if y == selection_beg.y && selection_beg.x > 0 {
+                selection_beg.x = (selection_beg.x + delta).max(0);
             }
-            if y == selection_end.y {
-                selection_end.x += delta;
+            if y == selection_end.y && selection_end.x > 0 {
+                selection_end.x = (selection_end.x + delta).max(0);
             }
         }
         self.edit_end_grouping();
@@ -2381,6 +4039,189 @@ impl TextBuffer {
         );
     }
 
+    /// Comments out the current selection or line using the language's line comment prefix.
+    /// If all of the lines are already commented, they get uncommented instead.
+    /// The prefix is inserted after the smallest indentation among the lines, so that the
+    /// markers line up and the code keeps its indentation. Blank lines are left alone.
+    pub fn toggle_line_comment(&mut self) {
+        if self.refuse_edit() {
+            return;
+        }
+        let Some(prefix) = self.syntax_language().and_then(|lang| lang.line_comment) else {
+            return;
+        };
+        let marker_text = [prefix.as_bytes(), b" "].concat();
+        let prefix = prefix.as_bytes();
+
+        let selection = self.selection;
+        let mut selection_beg = self.cursor.logical_pos;
+        let mut selection_end = selection_beg;
+
+        if let Some(TextBufferSelection { beg, end }) = &selection {
+            selection_beg = *beg;
+            selection_end = *end;
+        }
+
+        let first = selection_beg.y.min(selection_end.y);
+        let mut last = selection_beg.y.max(selection_end.y);
+
+        // A selection that ends at the start of a line doesn't include that line.
+        if last > first && selection_beg.max(selection_end).x == 0 {
+            last -= 1;
+        }
+
+        // For each non-blank line: Its number, the width of its indentation in characters,
+        // and the length of the comment marker, including a single trailing space, if any.
+        let mut lines = Vec::new();
+        let mut uncomment = true;
+        let mut text = Vec::new();
+        let mut line_beg = self.goto_line_start(self.cursor, first);
+
+        for y in first..=last {
+            let line_end = self.line_end_offset(line_beg);
+            text.clear();
+            self.buffer.extract_raw(line_beg.offset..line_end, &mut text, 0);
+            line_beg = self.cursor_move_to_offset_internal(line_beg, line_end);
+
+            let indent = text.iter().take_while(|&&c| c == b' ' || c == b'\t').count();
+            let code = &text[indent..];
+            if matches!(code.first(), None | Some(b'\r' | b'\n')) {
+                continue;
+            }
+
+            let mut marker = 0;
+            if code.starts_with(prefix) {
+                marker = prefix.len() + (code.get(prefix.len()) == Some(&b' ')) as usize;
+            }
+            uncomment &= marker > 0;
+            lines.push((y, indent as CoordType, marker as CoordType));
+        }
+
+        if lines.is_empty() {
+            return;
+        }
+
+        // Don't merge with whatever the user typed last.
+        self.last_history_type = HistoryType::Other;
+        self.edit_begin_grouping();
+
+        let min_indent = lines.iter().map(|&(_, indent, _)| indent).min().unwrap_or(0);
+
+        for &(y, indent, marker) in &lines {
+            let indent = if uncomment { indent } else { min_indent };
+            let beg = self.cursor_move_to_logical_internal(self.cursor, Point { x: indent, y });
+            let delta = if uncomment {
+                let end =
+                    self.cursor_move_to_logical_internal(beg, Point { x: indent + marker, y });
+                self.edit_begin(HistoryType::Delete, beg);
+                self.edit_delete(end);
+                self.edit_end();
+                -marker
+            } else {
+                self.edit_begin(HistoryType::Write, beg);
+                self.edit_write(&marker_text);
+                self.edit_end();
+                marker_text.len() as CoordType
+            };
+
+            // The selection shifts with the text that follows the marker.
+            // A selection that starts at column 0 stays there, so that it covers the indentation.
+            let shift = |pos: &mut Point| {
+                if pos.y == y && pos.x > 0 && pos.x >= indent {
+                    pos.x = (pos.x + delta).max(indent);
+                }
+            };
+            shift(&mut selection_beg);
+            shift(&mut selection_end);
+        }
+
+        self.edit_end_grouping();
+        self.last_history_type = HistoryType::Other;
+
+        self.set_cursor_internal(self.cursor_move_to_logical_internal(self.cursor, selection_end));
+        self.set_selection(
+            selection.map(|_| TextBufferSelection { beg: selection_beg, end: selection_end }),
+        );
+    }
+
+    /// Removes the spaces and tabs at the end of every line, as a single undo step.
+    /// The cursor and selection stay where they are, unless they were inside the removed whitespace,
+    /// in which case they move to the new end of their line.
+    pub fn trim_trailing_whitespace(&mut self) {
+        if self.refuse_edit() {
+            return;
+        }
+
+        let cursor = self.cursor.logical_pos;
+        let selection = self.selection;
+        let mut line = self.cursor_move_to_offset_internal(self.cursor, 0);
+        let mut modified = false;
+        // Each `edit_begin` would expand the fold it lands in. Trimming doesn't change
+        // which lines there are, so the folds are simply put aside until it's done.
+        let folds = mem::take(&mut self.folds);
+
+        loop {
+            let mut line_end = self.cursor_move_to_logical_internal(
+                line,
+                Point { x: CoordType::MAX, y: line.logical_pos.y },
+            );
+            let ws_beg = self.trailing_whitespace_start(line_end.offset).max(line.offset);
+
+            if ws_beg < line_end.offset {
+                if !modified {
+                    modified = true;
+                    // Don't merge with whatever the user deleted last.
+                    self.last_history_type = HistoryType::Other;
+                    self.edit_begin_grouping();
+                }
+                let beg = self.cursor_move_to_offset_internal(line, ws_beg);
+                self.edit_begin(HistoryType::Delete, beg);
+                self.edit_delete(line_end);
+                self.edit_end();
+                line_end = self.cursor;
+            }
+
+            let next = self.cursor_move_to_logical_internal(
+                line_end,
+                Point { x: 0, y: line_end.logical_pos.y + 1 },
+            );
+            if next.logical_pos.y == line_end.logical_pos.y {
+                break;
+            }
+            line = next;
+        }
+
+        self.folds = folds;
+        if !modified {
+            return;
+        }
+        self.folds_update_rows();
+        self.edit_end_grouping();
+        self.last_history_type = HistoryType::Other;
+
+        // Positions before the removed whitespace are unaffected and the rest gets clamped.
+        let clamp = |tb: &Self, pos| tb.cursor_move_to_logical_internal(tb.cursor, pos).logical_pos;
+        self.set_cursor_internal(self.cursor_move_to_logical_internal(self.cursor, cursor));
+        self.set_selection(
+            selection
+                .map(|s| TextBufferSelection { beg: clamp(self, s.beg), end: clamp(self, s.end) }),
+        );
+    }
+
+    /// Returns the offset at which the spaces and tabs that precede `end` start.
+    fn trailing_whitespace_start(&self, end: usize) -> usize {
+        let mut beg = end;
+        while beg > 0 {
+            let chunk = self.read_backward(beg);
+            let count = chunk.iter().rev().take_while(|&&c| c == b' ' || c == b'\t').count();
+            beg -= count;
+            if count < chunk.len() {
+                break;
+            }
+        }
+        beg
+    }
+
     fn measure_indent_internal(
         &self,
         mut offset: usize,
@@ -2422,6 +4263,10 @@ impl TextBuffer {
 
     /// Displaces the current, cursor or the selection, line(s) in the given direction.
     pub fn move_selected_lines(&mut self, direction: MoveLineDirection) {
+        if self.refuse_edit() {
+            return;
+        }
+
         let selection = self.selection;
         let cursor = self.cursor;
 
@@ -2488,6 +4333,60 @@ impl TextBuffer {
         }));
     }
 
+    /// Inserts a copy of the current, cursor or the selection, line(s) next to them.
+    /// The cursor and selection end up on the copy in the given direction.
+    pub fn duplicate_selected_lines(&mut self, direction: MoveLineDirection) {
+        if self.refuse_edit() {
+            return;
+        }
+
+        let selection = self.selection;
+        let cursor = self.cursor;
+
+        // If there's no selection, the line the cursor is on is duplicated. A selection
+        // that ends at the start of a line doesn't include that line, as in VS Code.
+        let [beg, end] = match self.selection {
+            Some(s) => {
+                let [beg, end] = minmax(s.beg, s.end);
+                [beg.y, if end.x == 0 && end.y > beg.y { end.y - 1 } else { end.y }]
+            }
+            None => [cursor.logical_pos.y, cursor.logical_pos.y],
+        };
+
+        let line_beg = self.cursor_move_to_logical_internal(cursor, Point { x: 0, y: beg });
+        let line_end = self.cursor_move_to_logical_internal(line_beg, Point { x: 0, y: end + 1 });
+        let mut lines = Vec::new();
+        self.buffer.extract_raw(line_beg.offset..line_end.offset, &mut lines, 0);
+
+        self.edit_begin_grouping();
+        {
+            // The copy is inserted above the lines, which pushes them down.
+            self.cursor_move_to_logical(Point { x: 0, y: beg });
+            self.edit_begin(HistoryType::Write, self.cursor);
+            self.write_raw(&lines);
+            // The last line of the file has no newline to copy along.
+            if !lines.ends_with(b"\n") {
+                self.write_canon(b"\n");
+            }
+            self.edit_end();
+        }
+        self.edit_end_grouping();
+
+        let delta = match direction {
+            MoveLineDirection::Up => 0,
+            MoveLineDirection::Down => end - beg + 1,
+        };
+        self.cursor_move_to_logical(Point {
+            x: cursor.logical_pos.x,
+            y: cursor.logical_pos.y + delta,
+        });
+        self.set_selection(selection.map(|mut s| {
+            s.beg.y += delta;
+            s.end.y += delta;
+            s
+        }));
+    }
+
     /// Extracts the contents of the current selection.
     /// May optionally delete it, if requested. This is meant to be used for Ctrl+X.
     fn extract_selection(&mut self, delete: bool) -> Vec<u8> {
@@ -2529,6 +4428,7 @@ impl TextBuffer {
             }
         }
 
+        let delete = delete && !self.refuse_edit();
         Some(self.extract_selection(delete))
     }
 
@@ -2575,6 +4475,7 @@ impl TextBuffer {
     /// Starts a new edit operation.
     /// This is used for tracking the undo/redo history.
     fn edit_begin(&mut self, history_type: HistoryType, cursor: Cursor) {
+        self.extra_cursors.clear();
         self.active_edit_depth += 1;
         if self.active_edit_depth > 1 {
             return;
@@ -2583,10 +4484,16 @@ impl TextBuffer {
         let cursor_before = self.cursor;
         self.set_cursor_internal(cursor);
 
+        let now = Instant::now();
+        let timed_out =
+            now.saturating_duration_since(self.last_history_time) > HISTORY_MERGE_TIMEOUT;
+        self.last_history_time = now;
+
         // If both the last and this are a Write/Delete operation, we skip allocating a new undo history item.
         if cursor_before.offset != cursor.offset
             || history_type != self.last_history_type
             || !matches!(history_type, HistoryType::Write | HistoryType::Delete)
+            || timed_out
         {
             self.redo_stack.clear();
             while self.undo_stack.len() > 1000 {
@@ -2598,6 +4505,7 @@ impl TextBuffer {
                 cursor_before: cursor_before.logical_pos,
                 selection_before: self.selection,
                 stats_before: self.stats,
+                scroll_before: self.scroll_y,
                 generation_before: self.buffer.generation(),
                 cursor: cursor.logical_pos,
                 deleted: Vec::new(),
@@ -2654,6 +4562,7 @@ impl TextBuffer {
         self.active_edit_off += text.len();
         self.cursor = self.cursor_move_to_offset_internal(self.cursor, self.active_edit_off);
         self.stats.logical_lines += self.cursor.logical_pos.y - logical_y_before;
+        self.folds.edited(logical_y_before, 0, self.cursor.logical_pos.y - logical_y_before);
     }
 
     /// Deletes the text between the current cursor position and `to`.
@@ -2683,6 +4592,7 @@ impl TextBuffer {
         self.buffer.allocate_gap(off, 0, count);
 
         self.stats.logical_lines += logical_y_before - to.logical_pos.y;
+        self.folds.edited(logical_y_before, to.logical_pos.y - logical_y_before, 0);
     }
 
     /// Finalizes the current edit operation
@@ -2744,6 +4654,12 @@ impl TextBuffer {
     }
 
     fn undo_redo(&mut self, undo: bool) {
+        if self.refuse_edit() {
+            return;
+        }
+
+        self.extra_cursors.clear();
+
         let buffer_generation = self.buffer.generation();
         let mut entry_buffer_generation = None;
 
@@ -2836,6 +4752,13 @@ impl TextBuffer {
                     }
                 }
 
+                let newlines = |text: &[u8]| text.iter().filter(|&&b| b == b'\n').count();
+                self.folds.edited(
+                    cursor.logical_pos.y,
+                    newlines(&change.deleted) as CoordType,
+                    newlines(&change.added) as CoordType,
+                );
+
                 // Restore the previous line statistics.
                 mem::swap(&mut self.stats, &mut change.stats_before);
 
@@ -2853,12 +4776,15 @@ impl TextBuffer {
                 // Can't use `set_cursor_internal` here, because we haven't updated the line stats yet.
                 self.cursor = cursor_before;
 
-                if self.undo_stack.is_empty() {
-                    self.last_history_type = HistoryType::Other;
-                }
+                // Scroll back to where the text was when the change was made.
+                self.wants_scroll_y = Some(mem::replace(&mut change.scroll_before, self.scroll_y));
             }
         }
 
+        // The next edit must not be merged into whatever entry is now at the top of the undo stack.
+        // It would otherwise also fail to invalidate the redo stack.
+        self.last_history_type = HistoryType::Other;
+
         if entry_buffer_generation.is_some() {
             self.recalc_after_content_changed();
         }
@@ -2875,6 +4801,22 @@ impl TextBuffer {
     }
 }
 
+// Brackets inside strings and comments don't count.
+fn is_code(syntax: &[syntax::SyntaxElement], i: usize) -> bool {
+    !matches!(syntax.get(i), Some(syntax::SyntaxElement::Comment | syntax::SyntaxElement::String))
+}
+
+/// What [`TextBuffer::paste_reindented`] does with the indentation of the first pasted line.
+#[derive(Clone, Copy)]
+enum PastedFirstLine {
+    /// Indent it like the other lines.
+    Indent,
+    /// Drop it, because the line is pasted at the cursor, which is already indented.
+    Trim,
+    /// Keep the line as is, because it continues the text before the cursor.
+    Keep,
+}
+
 pub enum Bom {
     None,
     UTF8,
@@ -2912,3 +4854,639 @@ fn detect_bom(bytes: &[u8]) -> Option<&'static str> {
     }
     None
 }
+
+/// Guesses the encoding of a file without a BOM from the first few KiB of it.
+fn sniff_encoding(bytes: &[u8]) -> &'static str {
+    // UTF-16 text consisting mostly of ASCII has a NUL in every other byte.
+    let units = bytes.len() / 2;
+    if units >= 2 {
+        let mut zeros = [0, 0];
+        for pair in bytes.chunks_exact(2) {
+            zeros[0] += (pair[0] == 0) as usize;
+            zeros[1] += (pair[1] == 0) as usize;
+        }
+        if zeros[1] * 2 > units && zeros[0] * 10 < units {
+            return "UTF-16LE";
+        }
+        if zeros[0] * 2 > units && zeros[1] * 10 < units {
+            return "UTF-16BE";
+        }
+    }
+
+    // A few stray bytes in an otherwise UTF-8 file shouldn't turn all of its other
+    // non-ASCII characters into mojibake. Latin-1 text rarely contains valid UTF-8 sequences.
+    let mut rest = bytes;
+    let mut valid = 0;
+    let mut invalid = 0;
+    loop {
+        let (text, error_len) = match str::from_utf8(rest) {
+            Ok(text) => (text, None),
+            Err(err) => {
+                (unsafe { str::from_utf8_unchecked(&rest[..err.valid_up_to()]) }, err.error_len())
+            }
+        };
+        valid += text.bytes().filter(|&b| b >= 0xc0).count();
+        // `None` is also returned if the sample ends in the middle of a sequence.
+        let Some(error_len) = error_len else {
+            break;
+        };
+        invalid += 1;
+        rest = &rest[text.len() + error_len..];
+    }
+
+    // Any byte sequence is valid Latin-1, which makes it a safe fallback.
+    // Without ICU we can't convert it though, and its bytes are kept as they are.
+    if invalid > valid && icu::init().is_ok() { "ISO-8859-1" } else { "UTF-8" }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    fn buffer(text: &str) -> TextBuffer {
+        let mut tb = TextBuffer::new(false).unwrap();
+        tb.write_raw(text.as_bytes());
+        tb
+    }
+
+    fn text(tb: &mut TextBuffer) -> String {
+        let mut text = String::new();
+        tb.save_as_string(&mut text);
+        text
+    }
+
+    fn type_text(tb: &mut TextBuffer, text: &str) {
+        for c in text.bytes() {
+            tb.write_canon(&[c]);
+        }
+    }
+
+    // Loads `contents` from a file, the first `limit` bytes at once and the rest `chunk` bytes at a time.
+    fn read(name: &str, contents: &[u8], limit: usize, chunk: usize) -> TextBuffer {
+        let path = std::env::temp_dir().join(format!("edit-test-{}-{name}", std::process::id()));
+        std::fs::write(&path, contents).unwrap();
+        let mut file = File::open(&path).unwrap();
+        let mut tb = TextBuffer::new(false).unwrap();
+        if tb.read_file_head(&mut file, None, limit).unwrap() {
+            while tb.read_file_append(&mut file, chunk).unwrap() {}
+        }
+        std::fs::remove_file(&path).unwrap();
+        tb
+    }
+
+    #[test]
+    fn test_read_file_newlines() {
+        let tb = read("lf", b"foo\n", usize::MAX, 0);
+        assert!(!tb.is_crlf());
+        assert!(!tb.has_mixed_newlines());
+        assert!(!tb.is_dirty());
+
+        // Mixed newlines are unified into the majority, CRLF in case of a tie.
+        let mut tb = read("mixed", b"foo\r\nbar\n", usize::MAX, 0);
+        assert!(tb.is_crlf());
+        assert!(tb.has_mixed_newlines());
+        assert!(!tb.is_dirty());
+        assert_eq!(text(&mut tb), "foo\r\nbar\r\n");
+
+        // ...also if the differing newlines come after the first chunk.
+        let lines = "foo\n".repeat(2 * KIBI);
+        let mut tb = read("mixed-chunks", format!("{lines}bar\r\n").as_bytes(), 4 * KIBI, 4 * KIBI);
+        assert!(!tb.is_crlf());
+        assert!(tb.has_mixed_newlines());
+        assert!(!tb.is_dirty());
+        assert_eq!(text(&mut tb), format!("{lines}bar\n"));
+
+        // A CRLF that's split between two chunks is still a CRLF.
+        let contents = b"foo\r\n".repeat(2 * KIBI);
+        let mut tb = read("crlf-chunks", &contents, 4 * KIBI, 1);
+        assert!(tb.is_crlf());
+        assert!(!tb.has_mixed_newlines());
+        assert_eq!(text(&mut tb).as_bytes(), contents);
+    }
+
+    #[test]
+    fn test_read_file_chunks() {
+        let lines = "foo\n".repeat(2 * KIBI);
+        let mut tb = read("chunks", format!("\u{feff}{lines}").as_bytes(), 4 * KIBI, 4 * KIBI);
+        assert!(!tb.is_dirty());
+        assert_eq!(tb.encoding(), "UTF-8 BOM");
+        assert_eq!(tb.logical_line_count(), 2 * KIBI as CoordType + 1);
+        assert_eq!(text(&mut tb), lines);
+
+        // Another program truncating the file halfway through just ends the load early.
+        let path = std::env::temp_dir().join(format!("edit-test-{}-truncated", std::process::id()));
+        std::fs::write(&path, &lines).unwrap();
+        let mut file = File::open(&path).unwrap();
+        let mut tb = TextBuffer::new(false).unwrap();
+        assert!(tb.read_file_head(&mut file, None, 4 * KIBI).unwrap());
+        File::create(&path).unwrap();
+        assert!(!tb.read_file_append(&mut file, 4 * KIBI).unwrap());
+        std::fs::remove_file(&path).unwrap();
+        assert_eq!(text(&mut tb), lines[..4 * KIBI]);
+    }
+
+    #[test]
+    fn test_sniff_encoding() {
+        let utf16le: Vec<u8> = "hello world".encode_utf16().flat_map(u16::to_le_bytes).collect();
+        let utf16be: Vec<u8> = "hello world".encode_utf16().flat_map(u16::to_be_bytes).collect();
+        assert_eq!(sniff_encoding(&utf16le), "UTF-16LE");
+        assert_eq!(sniff_encoding(&utf16be), "UTF-16BE");
+
+        // Latin-1 can only be converted with ICU.
+        let latin1 = if icu::init().is_ok() { "ISO-8859-1" } else { "UTF-8" };
+        assert_eq!(sniff_encoding(b"caf\xe9 na\xefve gar\xe7on"), latin1);
+
+        // A stray invalid byte doesn't outweigh the valid sequences.
+        assert_eq!(sniff_encoding(b"caf\xc3\xa9 na\xc3\xafve \xff"), "UTF-8");
+
+        // Neither does a sequence that's cut off at the end of the sample.
+        assert_eq!(sniff_encoding(b"na\xc3\xafve caf\xc3"), "UTF-8");
+        assert_eq!(sniff_encoding(b"caf\xc3"), "UTF-8");
+    }
+
+    #[test]
+    fn test_undo_newline() {
+        let mut tb = buffer("");
+        type_text(&mut tb, "foo\nbar\nbaz");
+
+        // Each undo removes one line, including the newline that started it.
+        tb.undo();
+        assert_eq!(text(&mut tb), "foo\nbar");
+        tb.undo();
+        assert_eq!(text(&mut tb), "foo");
+        tb.undo();
+        assert_eq!(text(&mut tb), "");
+    }
+
+    #[test]
+    fn test_smart_dedent() {
+        let mut tb = buffer("func f() {\n    if x {\n        s := \"{\"\n        ");
+        tb.set_syntax_language(syntax::language_from_extension("go"));
+
+        // The `{` in the string doesn't count.
+        tb.write_canon(b"}");
+        assert_eq!(text(&mut tb), "func f() {\n    if x {\n        s := \"{\"\n    }");
+
+        // Smart indentation can be turned off.
+        tb.set_smart_indent(false);
+        tb.write_canon(b"\n}");
+        assert!(text(&mut tb).ends_with("\n    }\n    }"));
+
+        // The `{` is only looked for so far up.
+        let lines = "x\n".repeat(SMART_DEDENT_MAX_LINES as usize);
+        let mut tb = go_buffer(&format!("if x {{\n{lines}    "));
+        tb.write_canon(b"}");
+        assert!(text(&mut tb).ends_with("\nx\n    }"));
+    }
+
+    #[test]
+    fn test_smart_indent() {
+        let mut tb = go_buffer("");
+
+        // A trailing comment doesn't hide the `{`...
+        tb.write_canon(b"if x { // y\nz");
+        assert_eq!(text(&mut tb), "if x { // y\n    z");
+
+        // ...but a `{` in a comment or string doesn't open a block.
+        tb.write_canon(b" // {\nz = \"{\"\nz");
+        assert_eq!(text(&mut tb), "if x { // y\n    z // {\n    z = \"{\"\n    z");
+    }
+
+    fn go_buffer(text: &str) -> TextBuffer {
+        let mut tb = buffer(text);
+        tb.set_syntax_language(syntax::language_from_extension("go"));
+        tb
+    }
+
+    fn select(tb: &mut TextBuffer, beg: Point, end: Point) {
+        tb.cursor_move_to_logical(beg);
+        tb.selection_update_logical(end);
+    }
+
+    #[test]
+    fn test_jump_to_matching_bracket() {
+        let mut tb = go_buffer("f(\")\") {\n}");
+        tb.cursor_move_to_logical(Point { x: 7, y: 0 });
+        assert!(tb.jump_to_matching_bracket());
+        assert_eq!(tb.cursor_logical_pos(), Point { x: 0, y: 1 });
+
+        // The `)` in the string doesn't count, also not on the last line.
+        tb.write_canon(b"g(\")\")");
+        tb.cursor_move_to_logical(Point { x: 1, y: 1 });
+        assert!(tb.jump_to_matching_bracket());
+        assert_eq!(tb.cursor_logical_pos(), Point { x: 5, y: 1 });
+    }
+
+    #[test]
+    fn test_toggle_line_comment() {
+        // Without a selection, only the cursor line is commented.
+        let mut tb = go_buffer("foo\nbar");
+        tb.cursor_move_to_logical(Point { x: 1, y: 1 });
+        tb.toggle_line_comment();
+        assert_eq!(text(&mut tb), "foo\n// bar");
+        assert_eq!(tb.cursor_logical_pos(), Point { x: 4, y: 1 });
+
+        // Commenting and uncommenting are one undo step each.
+        let mut tb = go_buffer("foo\nbar\nbaz");
+        select(&mut tb, Point { x: 0, y: 0 }, Point { x: 3, y: 2 });
+        tb.toggle_line_comment();
+        assert_eq!(text(&mut tb), "// foo\n// bar\n// baz");
+        tb.toggle_line_comment();
+        assert_eq!(text(&mut tb), "foo\nbar\nbaz");
+        tb.undo();
+        assert_eq!(text(&mut tb), "// foo\n// bar\n// baz");
+        tb.undo();
+        assert_eq!(text(&mut tb), "foo\nbar\nbaz");
+
+        // A selection that ends at the start of a line doesn't include it.
+        select(&mut tb, Point { x: 0, y: 0 }, Point { x: 0, y: 2 });
+        tb.toggle_line_comment();
+        assert_eq!(text(&mut tb), "// foo\n// bar\nbaz");
+    }
+
+    #[test]
+    fn test_toggle_line_comment_lines() {
+        // If some lines aren't commented, all of them get commented.
+        let mut tb = go_buffer("// foo\nbar");
+        select(&mut tb, Point { x: 0, y: 0 }, Point { x: 3, y: 1 });
+        tb.toggle_line_comment();
+        assert_eq!(text(&mut tb), "// // foo\n// bar");
+
+        // Blank lines are skipped.
+        let mut tb = go_buffer("foo\n\n  \nbar");
+        select(&mut tb, Point { x: 0, y: 0 }, Point { x: 3, y: 3 });
+        tb.toggle_line_comment();
+        assert_eq!(text(&mut tb), "// foo\n\n  \n// bar");
+
+        // The markers go after the smallest indentation and are removed after any indentation.
+        let mut tb = go_buffer("\tif x {\n\t\ty\n\t}");
+        select(&mut tb, Point { x: 0, y: 0 }, Point { x: 2, y: 2 });
+        tb.toggle_line_comment();
+        assert_eq!(text(&mut tb), "\t// if x {\n\t// \ty\n\t// }");
+        tb.toggle_line_comment();
+        assert_eq!(text(&mut tb), "\tif x {\n\t\ty\n\t}");
+        let mut tb = go_buffer("\t// if x {\n\t\t//y");
+        select(&mut tb, Point { x: 0, y: 0 }, Point { x: 5, y: 1 });
+        tb.toggle_line_comment();
+        assert_eq!(text(&mut tb), "\tif x {\n\t\ty");
+    }
+
+    fn cursors(tb: &TextBuffer) -> (usize, Vec<usize>) {
+        (tb.cursor.offset, tb.extra_cursors.clone())
+    }
+
+    #[test]
+    fn test_for_each_cursor() {
+        let mut tb = buffer("foo\nfoo\nfoo");
+        tb.cursor_move_to_logical(Point { x: 1, y: 0 });
+        tb.add_cursor_vertically(1, 1);
+        tb.add_cursor_vertically(1, 1);
+        assert_eq!(cursors(&tb), (9, vec![1, 5]));
+
+        tb.for_each_cursor(|tb| tb.write_canon(b"xy"));
+        assert_eq!(text(&mut tb), "fxyoo\nfxyoo\nfxyoo");
+        assert_eq!(cursors(&tb), (15, vec![3, 9]));
+
+        tb.for_each_cursor(|tb| tb.delete(CursorMovement::Grapheme, -1));
+        assert_eq!(text(&mut tb), "fxoo\nfxoo\nfxoo");
+        assert_eq!(cursors(&tb), (12, vec![2, 7]));
+
+        // Each edit across all cursors is a single undo step.
+        tb.undo();
+        assert_eq!(text(&mut tb), "fxyoo\nfxyoo\nfxyoo");
+        tb.undo();
+        assert_eq!(text(&mut tb), "foo\nfoo\nfoo");
+    }
+
+    #[test]
+    fn test_for_each_cursor_collapse() {
+        // Cursors that end up in the same spot merge into one.
+        let mut tb = buffer("abcd");
+        tb.cursor_move_to_offset(1);
+        tb.add_cursor_at_visual(Point { x: 2, y: 0 });
+        assert_eq!(cursors(&tb), (2, vec![1]));
+        tb.for_each_cursor(|tb| tb.delete(CursorMovement::Grapheme, -1));
+        assert_eq!(text(&mut tb), "cd");
+        assert_eq!(cursors(&tb), (0, vec![]));
+
+        // Overlapping deletions don't delete anything twice.
+        let mut tb = buffer("abcd");
+        tb.cursor_move_to_offset(1);
+        tb.add_cursor_at_visual(Point { x: 2, y: 0 });
+        tb.for_each_cursor(|tb| tb.delete(CursorMovement::Grapheme, -2));
+        assert_eq!(text(&mut tb), "cd");
+        assert_eq!(cursors(&tb), (0, vec![]));
+    }
+
+    #[test]
+    fn test_add_cursor_at_next_occurrence() {
+        let mut tb = buffer("foo bar foo\nfoo");
+        tb.cursor_move_to_logical(Point { x: 1, y: 0 });
+        assert!(tb.add_cursor_at_next_occurrence());
+        assert_eq!(cursors(&tb), (9, vec![1]));
+        // The last line has no newline.
+        assert!(tb.add_cursor_at_next_occurrence());
+        assert_eq!(cursors(&tb), (13, vec![1, 9]));
+        // Every occurrence already has a cursor.
+        assert!(!tb.add_cursor_at_next_occurrence());
+        assert_eq!(cursors(&tb), (13, vec![1, 9]));
+
+        // The search wraps around at the end.
+        let mut tb = buffer("foo bar foo\nfoo");
+        tb.cursor_move_to_logical(Point { x: 3, y: 1 });
+        assert!(tb.add_cursor_at_next_occurrence());
+        assert_eq!(cursors(&tb), (3, vec![15]));
+
+        // Without another occurrence or a word, nothing happens.
+        let mut tb = buffer("foo  bar");
+        tb.cursor_move_to_logical(Point { x: 6, y: 0 });
+        assert!(!tb.add_cursor_at_next_occurrence());
+        tb.cursor_move_to_logical(Point { x: 4, y: 0 });
+        assert!(!tb.add_cursor_at_next_occurrence());
+        assert_eq!(cursors(&tb), (4, vec![]));
+    }
+
+    #[test]
+    fn test_word_at_cursor() {
+        let mut tb = buffer("foo.bar  baz");
+        let mut word_at = |x| {
+            tb.cursor_move_to_logical(Point { x, y: 0 });
+            tb.word_at_cursor()
+        };
+        assert_eq!(word_at(0), Some(0..3));
+        assert_eq!(word_at(2), Some(0..3));
+        // Right after a word still counts as being on it.
+        assert_eq!(word_at(3), Some(0..3));
+        assert_eq!(word_at(4), Some(4..7));
+        // Whitespace isn't a word, but the end of the previous one is.
+        assert_eq!(word_at(7), Some(4..7));
+        assert_eq!(word_at(8), None);
+        assert_eq!(word_at(12), Some(9..12));
+    }
+
+    #[test]
+    fn test_find_occurrences() {
+        let mut tb = go_buffer("x := xy + x // x\ns := \"x\" + x");
+        tb.cursor_move_to_logical(Point::default());
+        let beg = tb.cursor;
+        let end = tb.text_length();
+
+        // Neither `xy` nor the ones in the comment and the string match, but the next line does.
+        assert_eq!(tb.find_occurrences(beg, end), vec![10..11, 28..29]);
+
+        // In a comment, it's the other way around.
+        tb.cursor_move_to_logical(Point { x: 15, y: 0 });
+        assert!(tb.find_occurrences(beg, end).is_empty());
+
+        // Keywords aren't highlighted at all.
+        let mut tb = go_buffer("if x {\n} else if y {\n}");
+        tb.cursor_move_to_logical(Point::default());
+        let beg = tb.cursor;
+        assert!(tb.find_occurrences(beg, tb.text_length()).is_empty());
+    }
+
+    #[test]
+    fn test_trim_trailing_whitespace() {
+        let mut tb = buffer("foo  \nbar\n\t\nbaz \t");
+        tb.cursor_move_to_logical(Point { x: 1, y: 1 });
+        tb.selection_update_logical(Point { x: 5, y: 3 });
+        tb.trim_trailing_whitespace();
+        assert_eq!(text(&mut tb), "foo\nbar\n\nbaz");
+
+        // The selection end was in the removed whitespace and is clamped.
+        let s = tb.selection.unwrap();
+        assert_eq!((s.beg, s.end), (Point { x: 1, y: 1 }, Point { x: 3, y: 3 }));
+        assert_eq!(tb.cursor_logical_pos(), Point { x: 3, y: 3 });
+
+        // All lines are restored in one step.
+        tb.undo();
+        assert_eq!(text(&mut tb), "foo  \nbar\n\t\nbaz \t");
+
+        // Without trailing whitespace, nothing changes.
+        let mut tb = buffer("foo\n  bar\n");
+        let undo_len = tb.undo_stack.len();
+        tb.trim_trailing_whitespace();
+        assert_eq!(text(&mut tb), "foo\n  bar\n");
+        assert_eq!(tb.undo_stack.len(), undo_len);
+    }
+
+    fn folds(tb: &TextBuffer) -> Vec<(CoordType, CoordType, &str)> {
+        tb.folds.iter().map(|f| (f.header, f.end, f.placeholder.as_str())).collect()
+    }
+
+    #[test]
+    fn test_toggle_fold() {
+        let mut tb = go_buffer("func f() {\n\tx\n\ty\n}\nz");
+        tb.cursor_move_to_logical(Point::default());
+        assert!(tb.toggle_fold());
+        assert_eq!(folds(&tb), vec![(0, 3, "… }")]);
+        assert_eq!(tb.visual_line_count(), 2);
+
+        // Toggling it again expands it.
+        assert!(tb.toggle_fold());
+        assert!(folds(&tb).is_empty());
+        assert_eq!(tb.visual_line_count(), 5);
+
+        // Without anything to fold, nothing happens.
+        tb.cursor_move_to_logical(Point { x: 0, y: 4 });
+        assert!(!tb.toggle_fold());
+    }
+
+    #[test]
+    fn test_toggle_fold_else() {
+        let mut tb = go_buffer("if x {\n\ty\n} else {\n\tz\n}");
+        tb.cursor_move_to_logical(Point::default());
+
+        // The `} else {` line goes on to open a block, so it stays visible.
+        assert!(tb.toggle_fold());
+        assert_eq!(folds(&tb), vec![(0, 1, "…")]);
+
+        // It can be folded on its own.
+        tb.cursor_move_to_logical(Point { x: 0, y: 2 });
+        assert!(tb.toggle_fold());
+        assert_eq!(folds(&tb), vec![(0, 1, "…"), (2, 4, "… }")]);
+        assert_eq!(tb.visual_line_count(), 2);
+    }
+
+    #[test]
+    fn test_toggle_fold_indentation() {
+        // Blank lines belong to the block, except for those at its end.
+        let mut tb = buffer("a:\n    b\n\n    c\n\nd");
+        tb.cursor_move_to_logical(Point::default());
+        assert!(tb.toggle_fold());
+        assert_eq!(folds(&tb), vec![(0, 3, "…")]);
+        assert_eq!(tb.visual_line_count(), 3);
+
+        // The last line isn't followed by anything indented deeper.
+        tb.cursor_move_to_logical(Point { x: 0, y: 5 });
+        assert!(!tb.toggle_fold());
+    }
+
+    #[test]
+    fn test_fold_cursor_movement() {
+        let mut tb = go_buffer("if x {\n\ty\n}\nz");
+        tb.cursor_move_to_logical(Point::default());
+        assert!(tb.toggle_fold());
+
+        // Moving the cursor skips over the fold in either direction.
+        tb.cursor_move_to_logical(Point { x: 6, y: 0 });
+        tb.cursor_move_delta(CursorMovement::Grapheme, 1);
+        assert_eq!(tb.cursor_logical_pos(), Point { x: 0, y: 3 });
+        tb.cursor_move_delta(CursorMovement::Grapheme, -1);
+        assert_eq!(tb.cursor_logical_pos(), Point { x: 6, y: 0 });
+
+        // Visual positions refer to the rows on screen.
+        tb.cursor_move_to_visual(Point { x: 0, y: 1 });
+        assert_eq!(tb.cursor_logical_pos(), Point { x: 0, y: 3 });
+        assert_eq!(tb.cursor_visual_pos(), Point { x: 0, y: 1 });
+
+        // Going into the fold directly expands it.
+        tb.cursor_move_to_logical(Point { x: 0, y: 1 });
+        assert!(folds(&tb).is_empty());
+        assert_eq!(tb.visual_line_count(), 4);
+    }
+
+    #[test]
+    fn test_fold_edits() {
+        let mut tb = go_buffer("a\nif x {\n\ty\n}\nz");
+        tb.cursor_move_to_logical(Point { x: 0, y: 1 });
+        assert!(tb.toggle_fold());
+
+        // Edits above the fold move it.
+        tb.cursor_move_to_logical(Point::default());
+        tb.write_canon(b"b\n");
+        assert_eq!(folds(&tb), vec![(2, 4, "… }")]);
+        assert_eq!(tb.visual_line_count(), 4);
+
+        // Edits within the header line keep it, but new lines expand it.
+        tb.cursor_move_to_logical(Point { x: CoordType::MAX, y: 2 });
+        tb.write_canon(b" ");
+        assert_eq!(folds(&tb), vec![(2, 4, "… }")]);
+        tb.write_canon(b"\n");
+        assert!(folds(&tb).is_empty());
+        assert_eq!(tb.visual_line_count(), 7);
+
+        // So does undoing an edit that touches it.
+        tb.cursor_move_to_logical(Point { x: 0, y: 2 });
+        assert!(tb.toggle_fold());
+        assert_eq!(folds(&tb), vec![(2, 5, "… }")]);
+        tb.undo();
+        assert!(folds(&tb).is_empty());
+        assert_eq!(tb.visual_line_count(), 6);
+    }
+
+    #[test]
+    fn test_trim_trailing_whitespace_folds() {
+        let mut tb = go_buffer("if x {  \n    y  \n}\nz");
+        tb.cursor_move_to_logical(Point::default());
+        assert!(tb.toggle_fold());
+        assert_eq!(tb.visual_line_count(), 2);
+
+        // The fold contains trailing whitespace, but isn't expanded to remove it.
+        tb.trim_trailing_whitespace();
+        assert_eq!(text(&mut tb), "if x {\n    y\n}\nz");
+        assert_eq!(tb.visual_line_count(), 2);
+    }
+
+    #[test]
+    fn test_undo_scroll() {
+        let mut tb = buffer("a\nb\n");
+        tb.set_scroll_y(5);
+        type_text(&mut tb, "x");
+        tb.set_scroll_y(40);
+
+        tb.undo();
+        assert_eq!(tb.take_scroll_request(), Some(5));
+        tb.redo();
+        assert_eq!(tb.take_scroll_request(), Some(40));
+    }
+
+    #[test]
+    fn test_duplicate_selected_lines() {
+        // Without a selection, the cursor line is duplicated, also the last one.
+        let mut tb = buffer("a\nb");
+        tb.cursor_move_to_logical(Point { x: 1, y: 1 });
+        tb.duplicate_selected_lines(MoveLineDirection::Down);
+        assert_eq!(text(&mut tb), "a\nb\nb");
+        assert_eq!(tb.cursor_logical_pos(), Point { x: 1, y: 2 });
+
+        let mut tb = buffer("a\nb\n");
+        tb.cursor_move_to_logical(Point::default());
+        tb.duplicate_selected_lines(MoveLineDirection::Up);
+        assert_eq!(text(&mut tb), "a\na\nb\n");
+        assert_eq!(tb.cursor_logical_pos(), Point { x: 0, y: 0 });
+
+        // The line that a selection ends at the start of isn't included.
+        let mut tb = buffer("a\nb\nc\n");
+        select(&mut tb, Point { x: 0, y: 0 }, Point { x: 0, y: 2 });
+        tb.duplicate_selected_lines(MoveLineDirection::Down);
+        assert_eq!(text(&mut tb), "a\nb\na\nb\nc\n");
+        let s = tb.selection.unwrap();
+        assert_eq!((s.beg, s.end), (Point { x: 0, y: 2 }, Point { x: 0, y: 4 }));
+
+        tb.undo();
+        assert_eq!(text(&mut tb), "a\nb\nc\n");
+    }
+
+    #[test]
+    fn test_move_selected_lines() {
+        // Unlike duplicating, moving includes the line that a selection ends at the start of.
+        let mut tb = buffer("a\nb\nc\nd\n");
+        select(&mut tb, Point { x: 0, y: 0 }, Point { x: 0, y: 1 });
+        tb.move_selected_lines(MoveLineDirection::Down);
+        assert_eq!(text(&mut tb), "c\na\nb\nd\n");
+    }
+
+    fn clipboard(text: &str, line_copy: bool) -> Clipboard {
+        let mut clipboard = Clipboard::default();
+        clipboard.write(text.as_bytes().to_vec());
+        clipboard.write_was_line_copy(line_copy);
+        clipboard
+    }
+
+    #[test]
+    fn test_paste_reindented() {
+        // A line copy goes above the cursor line and gets its indentation.
+        let mut tb = go_buffer("func f() {\n    y()\n}");
+        tb.cursor_move_to_logical(Point { x: 6, y: 1 });
+        tb.paste_reindented(&clipboard("\t\tx()\n", true));
+        assert_eq!(text(&mut tb), "func f() {\n    x()\n    y()\n}");
+
+        // At an indented cursor, the first line starts at the cursor and
+        // the others keep their indentation relative to the least indented one.
+        let mut tb = go_buffer("{\n    \n}");
+        tb.cursor_move_to_logical(Point { x: 4, y: 1 });
+        tb.paste_reindented(&clipboard("  if x {\n\ty\n}", false));
+        assert_eq!(text(&mut tb), "{\n    if x {\n        y\n    }\n}");
+
+        // After existing text, the first line is pasted as is.
+        // Its indentation is missing, as copying started in front of its first word.
+        let mut tb = go_buffer("    x := ");
+        tb.cursor_move_to_logical(Point { x: 9, y: 0 });
+        tb.paste_reindented(&clipboard("foo(\n\t\t\ta,\n\t\t)", false));
+        assert_eq!(text(&mut tb), "    x := foo(\n        a,\n    )");
+    }
+
+    #[test]
+    fn test_paste_convert_indentation() {
+        // Verbatim by default.
+        let mut tb = buffer("");
+        tb.set_indent_with_tabs(true);
+        tb.paste(&clipboard("a\n    b\n", false));
+        assert_eq!(text(&mut tb), "a\n    b\n");
+
+        // Spaces to tabs, with leftover spaces kept.
+        let mut tb = buffer("");
+        tb.set_indent_with_tabs(true);
+        tb.set_convert_pasted_indentation(true);
+        tb.paste(&clipboard("a\n    b\n      c\n", false));
+        assert_eq!(text(&mut tb), "a\n\tb\n\t  c\n");
+
+        // Tabs to spaces, according to the tab size.
+        let mut tb = buffer("");
+        tb.set_tab_size(2);
+        tb.set_convert_pasted_indentation(true);
+        tb.paste(&clipboard("a\n\tb\n \tc", false));
+        assert_eq!(text(&mut tb), "a\n  b\n  c");
+    }
+}
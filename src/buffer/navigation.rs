@@ -36,6 +36,11 @@ const fn construct_classifier(separators: &[u8]) -> [CharClass; 256] {
 const WORD_CLASSIFIER: [CharClass; 256] =
     construct_classifier(br#"`~!@#$%^&*()-=+[{]}\|;:'",.<>/?"#);
 
+/// Returns true if `byte` is part of a word, as opposed to whitespace or punctuation.
+pub fn is_word_byte(byte: u8) -> bool {
+    WORD_CLASSIFIER[byte as usize] == CharClass::Word
+}
+
 /// Finds the next word boundary given a document cursor offset.
 /// Returns the offset of the next word boundary.
 pub fn word_forward(doc: &dyn ReadableDocument, offset: usize) -> usize {
@@ -281,10 +286,14 @@ mod test {
         assert_eq!(word_forward(&"Hello,World".as_bytes(), 0), 5);
         assert_eq!(word_forward(&"   Hello".as_bytes(), 0), 8);
         assert_eq!(word_forward(&"\n\nHello".as_bytes(), 0), 1);
+        assert_eq!(word_forward(&"foo_bar2 baz".as_bytes(), 0), 8);
+        assert_eq!(word_forward(&"foo\n  bar".as_bytes(), 3), 9);
 
         assert_eq!(word_backward(&"Hello World".as_bytes(), 11), 6);
         assert_eq!(word_backward(&"Hello,World".as_bytes(), 10), 6);
         assert_eq!(word_backward(&"Hello   ".as_bytes(), 7), 0);
         assert_eq!(word_backward(&"Hello\n\n".as_bytes(), 7), 6);
+        assert_eq!(word_backward(&"baz foo_bar2".as_bytes(), 12), 4);
+        assert_eq!(word_backward(&"foo  \nbar".as_bytes(), 6), 0);
     }
 }
@@ -13,6 +13,7 @@ use crate::arena::{Arena, ArenaString};
 use crate::helpers::{CoordType, Point, Rect, Size};
 use crate::oklab::{oklab_blend, srgb_to_oklab};
 use crate::simd::{MemsetSafe, memset};
+use crate::theme::{Theme, ThemeColor};
 use crate::unicode::MeasurementConfig;
 
 // Same constants as used in the PCG family of RNGs.
@@ -79,6 +80,17 @@ pub const DEFAULT_THEME: [u32; INDEXED_COLORS_COUNT] = [
     0xffbebebe, // Foreground
 ];
 
+/// The colors a terminal is able to display.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ColorMode {
+    /// 24-bit colors.
+    TrueColor,
+    /// The xterm 256-color palette.
+    Palette256,
+    /// Only the 16 colors of the terminal's palette.
+    Palette16,
+}
+
 /// A shoddy framebuffer for terminal applications.
 ///
 /// The idea is that you create a [`Framebuffer`], draw a bunch of text and
@@ -105,6 +117,10 @@ pub struct Framebuffer {
     contrast_colors: [Cell<(u32, u32)>; CACHE_TABLE_SIZE],
     background_fill: u32,
     foreground_fill: u32,
+    /// The colors used for syntax highlighting and the editor chrome.
+    theme: Theme,
+    /// What `format_color()` downgrades colors to.
+    color_mode: ColorMode,
 }
 
 impl Framebuffer {
@@ -121,6 +137,8 @@ impl Framebuffer {
             contrast_colors: [const { Cell::new((0, 0)) }; CACHE_TABLE_SIZE],
             background_fill: DEFAULT_THEME[IndexedColor::Background as usize],
             foreground_fill: DEFAULT_THEME[IndexedColor::Foreground as usize],
+            theme: Theme::DARK,
+            color_mode: ColorMode::TrueColor,
         }
     }
 
@@ -142,6 +160,36 @@ impl Framebuffer {
         }
     }
 
+    /// Sets the theme, which takes effect with the next frame.
+    pub fn set_theme(&mut self, theme: Theme) {
+        self.theme = theme;
+    }
+
+    /// Returns the current theme.
+    pub fn theme(&self) -> &Theme {
+        &self.theme
+    }
+
+    /// Resolves a theme color against the palette.
+    /// `auto` is the color that is used for [`ThemeColor::Auto`].
+    #[inline]
+    pub fn theme_color(&self, color: ThemeColor, auto: u32) -> u32 {
+        match color {
+            ThemeColor::Auto => auto,
+            ThemeColor::Indexed(index) => self.indexed(index),
+            ThemeColor::Rgb(rgb) => rgb,
+        }
+    }
+
+    /// Sets the colors the terminal supports. Colors are downgraded to the nearest match on output.
+    pub fn set_color_mode(&mut self, mode: ColorMode) {
+        if self.color_mode != mode {
+            self.color_mode = mode;
+            // What's on screen was written with the previous mode. Trigger a full redraw.
+            self.buffers[(self.frame_counter & 1) ^ 1].fg_bitmap.fill(1);
+        }
+    }
+
     /// Begins a new frame with the given `size`.
     pub fn flip(&mut self, size: Size) {
         if size != self.buffers[0].bg_bitmap.size {
@@ -567,8 +615,70 @@ impl Framebuffer {
         let r = color & 0xff;
         let g = (color >> 8) & 0xff;
         let b = (color >> 16) & 0xff;
-        _ = write!(dst, "\x1b[{typ}8;2;{r};{g};{b}m");
+
+        match self.color_mode {
+            ColorMode::TrueColor => _ = write!(dst, "\x1b[{typ}8;2;{r};{g};{b}m"),
+            ColorMode::Palette256 => {
+                _ = write!(dst, "\x1b[{typ}8;5;{}m", nearest_palette_256(r, g, b));
+            }
+            ColorMode::Palette16 => {
+                // 30-37 and 40-47 select the regular colors, 90-97 and 100-107 the bright ones.
+                let idx = self.nearest_indexed(color);
+                let base = match (fg, idx < 8) {
+                    (true, true) => 30,
+                    (true, false) => 90,
+                    (false, true) => 40,
+                    (false, false) => 100,
+                };
+                _ = write!(dst, "\x1b[{}m", base + idx % 8);
+            }
+        }
     }
+
+    /// Returns the index of the palette color that is perceptually closest to `color`.
+    /// Since the palette is the one reported by the terminal, this respects its color scheme.
+    fn nearest_indexed(&self, color: u32) -> usize {
+        let target = srgb_to_oklab(color);
+        let distance = |c: u32| {
+            let c = srgb_to_oklab(c);
+            let (l, a, b) = (c.l - target.l, c.a - target.a, c.b - target.b);
+            l * l + a * a + b * b
+        };
+
+        (0..16)
+            .map(|i| (i, distance(self.indexed_colors[i])))
+            .min_by(|x, y| x.1.total_cmp(&y.1))
+            .map_or(0, |(i, _)| i)
+    }
+}
+
+/// Maps an RGB color to the closest entry of the xterm 256-color palette,
+/// considering both the 6x6x6 color cube (16-231) and the grayscale ramp (232-255).
+/// The first 16 entries are skipped, because their values depend on the terminal.
+fn nearest_palette_256(r: u32, g: u32, b: u32) -> u32 {
+    // The cube levels are 0, 95, 135, 175, 215, 255. These are the midpoints between them.
+    let cube_index = |v: u32| match v {
+        0..48 => 0,
+        48..115 => 1,
+        _ => (v - 35) / 40,
+    };
+    let cube_level = |i: u32| if i == 0 { 0 } else { 55 + 40 * i };
+    let distance = |cr: u32, cg: u32, cb: u32| {
+        let d = |x: u32, y: u32| (x as i32 - y as i32).pow(2);
+        d(cr, r) + d(cg, g) + d(cb, b)
+    };
+
+    let (ri, gi, bi) = (cube_index(r), cube_index(g), cube_index(b));
+    let cube = 16 + 36 * ri + 6 * gi + bi;
+    let cube_distance = distance(cube_level(ri), cube_level(gi), cube_level(bi));
+
+    // The grayscale ramp goes from 8 to 238 in steps of 10.
+    let avg = (r + g + b) / 3;
+    let gray_index = (avg.saturating_sub(3) / 10).min(23);
+    let gray_level = 8 + 10 * gray_index;
+    let gray_distance = distance(gray_level, gray_level, gray_level);
+
+    if gray_distance < cube_distance { 232 + gray_index } else { cube }
 }
 
 #[derive(Default)]
@@ -902,3 +1012,18 @@ impl Cursor {
         Self { pos: Point { x: -1, y: -1 }, overtype: false }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_nearest_palette_256() {
+        assert_eq!(nearest_palette_256(0, 0, 0), 16);
+        assert_eq!(nearest_palette_256(255, 255, 255), 231);
+        assert_eq!(nearest_palette_256(255, 0, 0), 196);
+        assert_eq!(nearest_palette_256(0xfd, 0x82, 0x73), 210);
+        assert_eq!(nearest_palette_256(128, 128, 128), 244);
+        assert_eq!(nearest_palette_256(10, 10, 10), 232);
+    }
+}
@@ -57,6 +57,47 @@ impl InputKey {
     pub(crate) const fn with_modifiers(&self, modifiers: InputKeyMod) -> Self {
         Self(self.0 | modifiers.0)
     }
+
+    /// Looks up a key by its name, like `s`, `5`, `f3`, `tab` or `pgdn`, ignoring case.
+    /// Modifiers aren't part of the name.
+    pub fn from_name(name: &str) -> Option<Self> {
+        const NAMES: [(&str, InputKey); 20] = [
+            ("backspace", vk::BACK),
+            ("tab", vk::TAB),
+            ("enter", vk::RETURN),
+            ("esc", vk::ESCAPE),
+            ("escape", vk::ESCAPE),
+            ("space", vk::SPACE),
+            ("pgup", vk::PRIOR),
+            ("pageup", vk::PRIOR),
+            ("pgdn", vk::NEXT),
+            ("pagedown", vk::NEXT),
+            ("end", vk::END),
+            ("home", vk::HOME),
+            ("left", vk::LEFT),
+            ("up", vk::UP),
+            ("right", vk::RIGHT),
+            ("down", vk::DOWN),
+            ("insert", vk::INSERT),
+            ("delete", vk::DELETE),
+            ("/", vk::OEM_2),
+            ("minus", vk::OEM_MINUS), // `-` separates the modifiers.
+        ];
+
+        let name = name.to_ascii_lowercase();
+        let mut chars = name.chars();
+        if let (Some(ch), None) = (chars.next(), chars.next())
+            && let Some(key) = Self::from_ascii(ch)
+        {
+            return Some(key);
+        }
+        if let Some(n) = name.strip_prefix('f').and_then(|n| n.parse::<u32>().ok())
+            && (1..=24).contains(&n)
+        {
+            return Some(Self(vk::F1.0 + n - 1));
+        }
+        NAMES.iter().find(|(n, _)| *n == name).map(|&(_, key)| key)
+    }
 }
 
 /// A keyboard modifier. Ctrl/Alt/Shift.
@@ -202,6 +243,11 @@ pub mod vk {
     pub const F22: InputKey = InputKey::new(0x85);
     pub const F23: InputKey = InputKey::new(0x86);
     pub const F24: InputKey = InputKey::new(0x87);
+
+    /// The `-_` key on US keyboards.
+    pub const OEM_MINUS: InputKey = InputKey::new(0xBD);
+    /// The `/?` key on US keyboards.
+    pub const OEM_2: InputKey = InputKey::new(0xBF);
 }
 
 /// Keyboard modifiers.
@@ -338,6 +384,8 @@ impl<'input> Iterator for Stream<'_, '_, 'input> {
                         let key = ch as u32 | 0x40;
                         return Some(Input::Keyboard(kbmod::CTRL | InputKey::new(key)));
                     }
+                    // Terminals send Ctrl+/ as Ctrl+_.
+                    '\x1f' => return Some(Input::Keyboard(kbmod::CTRL | vk::OEM_2)),
                     '\x7f' => return Some(Input::Keyboard(vk::BACK)),
                     _ => {}
                 },
@@ -345,6 +393,9 @@ impl<'input> Iterator for Stream<'_, '_, 'input> {
                     match ch {
                         '\0' => return Some(Input::Keyboard(vk::ESCAPE)),
                         '\n' => return Some(Input::Keyboard(kbmod::CTRL_ALT | vk::RETURN)),
+                        '0'..='9' => {
+                            return Some(Input::Keyboard(kbmod::ALT | InputKey::new(ch as u32)));
+                        }
                         ' '..='~' => {
                             let ch = ch as u32;
                             let key = ch & !0x20; // Shift a-z to A-Z
@@ -420,6 +471,14 @@ impl<'input> Iterator for Stream<'_, '_, 'input> {
                             const LUT_LEN: u16 = LUT.len() as u16;
 
                             match csi.params[0] {
+                                // xterm's modifyOtherKeys encoding: CSI 27 ; modifiers ; key ~
+                                27 if csi.param_count >= 3 => {
+                                    if let Some(key) = Self::parse_modified_key(csi.params[2]) {
+                                        return Some(Input::Keyboard(
+                                            key | Self::parse_modifiers(csi),
+                                        ));
+                                    }
+                                }
                                 0..LUT_LEN => {
                                     let vk = LUT[csi.params[0] as usize];
                                     if vk != 0 {
@@ -470,6 +529,12 @@ impl<'input> Iterator for Stream<'_, '_, 'input> {
                         'M' if csi.param_count == 0 => {
                             self.parser.x10_mouse_want = true;
                         }
+                        // The "fixterms" encoding, also used by kitty: CSI key ; modifiers u
+                        'u' if csi.private_byte == '\0' => {
+                            if let Some(key) = Self::parse_modified_key(csi.params[0]) {
+                                return Some(Input::Keyboard(key | Self::parse_modifiers(csi)));
+                            }
+                        }
                         't' if csi.params[0] == 8 => {
                             // Window Size
                             let width = (csi.params[2] as CoordType).clamp(1, 32767);
@@ -569,6 +634,24 @@ impl<'input> Stream<'_, '_, 'input> {
         }))
     }
 
+    /// Maps the code point that terminals report for keys with modifiers
+    /// (e.g. Ctrl+Shift+S, which can't be expressed as a control code) to a key.
+    fn parse_modified_key(code: u16) -> Option<InputKey> {
+        let key = match char::from_u32(code as u32)? {
+            'a'..='z' => InputKey::new(code as u32 & !0x20),
+            'A'..='Z' | '0'..='9' => InputKey::new(code as u32),
+            '-' | '_' => vk::OEM_MINUS,
+            '/' | '?' => vk::OEM_2,
+            '\t' => vk::TAB,
+            '\r' => vk::RETURN,
+            '\x1b' => vk::ESCAPE,
+            ' ' => vk::SPACE,
+            '\x7f' => vk::BACK,
+            _ => return None,
+        };
+        Some(key)
+    }
+
     fn parse_modifiers(csi: &vt::Csi) -> InputKeyMod {
         let mut modifiers = kbmod::NONE;
         let p1 = csi.params[1].saturating_sub(1);
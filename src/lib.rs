@@ -33,6 +33,7 @@ pub mod path;
 pub mod simd;
 pub mod syntax;
 pub mod sys;
+pub mod theme;
 pub mod tui;
 pub mod unicode;
 pub mod vt;
@@ -3,6 +3,7 @@
 
 //! Path related helpers.
 
+use std::borrow::Cow;
 use std::ffi::{OsStr, OsString};
 use std::path::{Component, MAIN_SEPARATOR_STR, Path, PathBuf};
 
@@ -44,6 +45,21 @@ pub fn normalize(path: &Path) -> PathBuf {
     res
 }
 
+/// Replaces a leading `~` with the user's home directory, like a shell would.
+/// Paths like `~user` aren't supported and are returned as-is.
+pub fn expand_home(path: &Path) -> Cow<'_, Path> {
+    let mut components = path.components();
+    if components.next() != Some(Component::Normal(OsStr::new("~"))) {
+        return Cow::Borrowed(path);
+    }
+
+    let var = if cfg!(windows) { "USERPROFILE" } else { "HOME" };
+    match std::env::var_os(var) {
+        Some(home) if !home.is_empty() => Cow::Owned(Path::new(&home).join(components.as_path())),
+        _ => Cow::Borrowed(path),
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use std::ffi::OsString;
@@ -69,6 +85,19 @@ mod tests {
         assert_eq!(norm("//"), "/");
     }
 
+    #[cfg(unix)]
+    #[test]
+    fn test_expand_home() {
+        let Some(home) = std::env::var_os("HOME").filter(|h| !h.is_empty()) else {
+            return;
+        };
+        let home = Path::new(&home);
+        assert_eq!(expand_home(Path::new("~")), home);
+        assert_eq!(expand_home(Path::new("~/a/b")), home.join("a/b"));
+        assert_eq!(expand_home(Path::new("~user/a")), Path::new("~user/a"));
+        assert_eq!(expand_home(Path::new("a/~")), Path::new("a/~"));
+    }
+
     #[cfg(windows)]
     #[test]
     fn test_windows() {
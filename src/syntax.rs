@@ -3,15 +3,9 @@
 
 //! Syntax highlighting for various programming languages.
 
-use regex::Regex;
-use crate::framebuffer::IndexedColor;
+use std::sync::Mutex;
 
-/// Color type that can be either indexed or RGB
-#[derive(Debug, Clone, Copy, PartialEq, Eq)]
-pub enum SyntaxColor {
-    Indexed(IndexedColor),
-    Rgb(u32),
-}
+use regex::Regex;
 
 /// Represents different types of syntax elements
 #[derive(Debug, Clone, Copy, PartialEq, Eq)]
@@ -25,41 +19,16 @@ pub enum SyntaxElement {
     Function,
     Variable,
     None,
-}
-
-impl SyntaxElement {
-    /// Returns the color to use for this syntax element
-    /// Uses custom RGB colors for strings and functions, IndexedColor for others
-    pub fn color(self) -> SyntaxColor {
-        match self {
-            SyntaxElement::Keyword => SyntaxColor::Indexed(IndexedColor::BrightMagenta),  // Purple for keywords
-            SyntaxElement::Type => SyntaxColor::Indexed(IndexedColor::BrightCyan),        // Bright cyan for types
-            SyntaxElement::String => SyntaxColor::Rgb(0xfffd8273),                       // Custom coral/salmon color
-            SyntaxElement::Comment => SyntaxColor::Indexed(IndexedColor::BrightBlack),    // Gray for comments
-            SyntaxElement::Number => SyntaxColor::Indexed(IndexedColor::BrightYellow),    // Yellow for numbers
-            SyntaxElement::Operator => SyntaxColor::Indexed(IndexedColor::White),         // White for operators
-            SyntaxElement::Function => SyntaxColor::Rgb(0xff75c2b3),                     // Custom teal green color
-            SyntaxElement::Variable => SyntaxColor::Indexed(IndexedColor::Foreground),    // Default foreground
-            SyntaxElement::None => SyntaxColor::Indexed(IndexedColor::Foreground),
-        }
-    }
 
-    /// Legacy method that returns IndexedColor for backward compatibility
-    pub fn indexed_color(self) -> IndexedColor {
-        match self.color() {
-            SyntaxColor::Indexed(color) => color,
-            SyntaxColor::Rgb(_) => match self {
-                SyntaxElement::String => IndexedColor::BrightRed,     // Fallback for strings
-                SyntaxElement::Function => IndexedColor::BrightGreen, // Fallback for functions
-                _ => IndexedColor::Foreground,
-            },
-        }
-    }
+    Count,
 }
 
+/// Number of variants in [`SyntaxElement`], not counting [`SyntaxElement::Count`].
+pub const SYNTAX_ELEMENT_COUNT: usize = SyntaxElement::Count as usize;
+
 /// A syntax highlighter for a specific programming language
 pub struct SyntaxHighlighter {
-    language: Language,
+    language: Option<&'static LanguageDef>,
     keyword_regex: Regex,
     type_regex: Regex,
     string_regex: Regex,
@@ -68,82 +37,307 @@ pub struct SyntaxHighlighter {
     function_regex: Regex,
 }
 
-/// Supported programming languages
-#[derive(Debug, Clone, Copy, PartialEq, Eq)]
-pub enum Language {
-    Rust,
-    Go,
-    C,
-    Cpp,
-    CSharp,
-    Unknown,
+/// Describes how to highlight a programming language.
+///
+/// Built-in definitions are picked by [`LanguageDef::extensions`] and
+/// [`LanguageDef::interpreters`]. Use [`register_language`] to add more.
+#[derive(Debug)]
+pub struct LanguageDef {
+    /// Display name, e.g. "Python".
+    pub name: &'static str,
+    /// File extensions without the leading dot, e.g. `["py", "pyw"]`.
+    pub extensions: &'static [&'static str],
+    /// Interpreter names found in shebang lines, e.g. `["python", "python3"]`.
+    pub interpreters: &'static [&'static str],
+    /// Whitespace separated list of keywords.
+    pub keywords: &'static str,
+    /// Whitespace separated list of built-in type names.
+    pub types: &'static str,
+    /// Starts a comment that runs until the end of the line, e.g. `//`.
+    pub line_comment: Option<&'static str>,
+    /// Start and end of a block comment, e.g. `("/*", "*/")`.
+    pub block_comment: Option<(&'static str, &'static str)>,
+    /// Characters that start and end a string literal.
+    pub string_delimiters: &'static [char],
+    /// Regex for number literals. `None` uses a pattern that suits most C-like languages.
+    pub number_pattern: Option<&'static str>,
+    /// Whether `name(` is highlighted as a function call.
+    pub functions: bool,
+    /// Whether blocks are delimited with braces. Enables smart indentation.
+    pub braces: bool,
+}
+
+const NUMBER_PATTERN: &str =
+    r"\b\d+\.?\d*([eE][+-]?\d+)?[fFdDlL]?\b|\b0[xX][0-9a-fA-F]+[lL]?\b|\b0[bB][01]+[lL]?\b";
+const FUNCTION_PATTERN: &str = r"\b([a-zA-Z_][a-zA-Z0-9_]*)\s*\(";
+
+pub static RUST: LanguageDef = LanguageDef {
+    name: "Rust",
+    extensions: &["rs"],
+    interpreters: &[],
+    keywords: "\
+        fn let mut struct enum trait impl for if else while loop match return use mod pub crate \
+        self super const static async await move unsafe extern dyn where type as in ref break \
+        continue",
+    types: "\
+        u8 u16 u32 u64 u128 i8 i16 i32 i64 i128 f32 f64 usize isize bool char String str Vec \
+        Option Result Box Rc Arc RefCell Cell",
+    line_comment: Some("//"),
+    block_comment: Some(("/*", "*/")),
+    string_delimiters: &['"', '\''],
+    number_pattern: None,
+    functions: true,
+    braces: true,
+};
+
+pub static GO: LanguageDef = LanguageDef {
+    name: "Go",
+    extensions: &["go"],
+    interpreters: &[],
+    keywords: "\
+        func var const type struct interface package import for if else switch case default \
+        return break continue go defer select chan map range fallthrough",
+    types: "\
+        int int8 int16 int32 int64 uint uint8 uint16 uint32 uint64 float32 float64 bool string \
+        byte rune error interface{}",
+    line_comment: Some("//"),
+    block_comment: Some(("/*", "*/")),
+    string_delimiters: &['"', '\'', '`'],
+    number_pattern: None,
+    functions: true,
+    braces: true,
+};
+
+pub static C: LanguageDef = LanguageDef {
+    name: "C",
+    extensions: &["c", "h"],
+    interpreters: &[],
+    keywords: "\
+        auto break case char const continue default do double else enum extern float for goto if \
+        inline int long register restrict return short signed sizeof static struct switch typedef \
+        union unsigned void volatile while _Bool _Complex _Imaginary",
+    types: "char short int long float double void signed unsigned size_t ptrdiff_t FILE NULL",
+    line_comment: Some("//"),
+    block_comment: Some(("/*", "*/")),
+    string_delimiters: &['"', '\''],
+    number_pattern: None,
+    functions: true,
+    braces: true,
+};
+
+pub static CPP: LanguageDef = LanguageDef {
+    name: "C++",
+    extensions: &["cpp", "cc", "cxx", "hpp", "hxx"],
+    interpreters: &[],
+    keywords: "\
+        alignas alignof and and_eq asm auto bitand bitor bool break case catch char char16_t \
+        char32_t class compl const constexpr const_cast continue decltype default delete do \
+        double dynamic_cast else enum explicit export extern false float for friend goto if \
+        inline int long mutable namespace new noexcept not not_eq nullptr operator or or_eq \
+        private protected public register reinterpret_cast return short signed sizeof static \
+        static_assert static_cast struct switch template this thread_local throw true try typedef \
+        typeid typename union unsigned using virtual void volatile wchar_t while xor xor_eq",
+    types: "\
+        std::string std::vector std::map std::set std::pair std::shared_ptr std::unique_ptr \
+        std::weak_ptr bool char short int long float double void size_t ptrdiff_t",
+    line_comment: Some("//"),
+    block_comment: Some(("/*", "*/")),
+    string_delimiters: &['"', '\''],
+    number_pattern: None,
+    functions: true,
+    braces: true,
+};
+
+pub static CSHARP: LanguageDef = LanguageDef {
+    name: "C#",
+    extensions: &["cs"],
+    interpreters: &[],
+    keywords: "\
+        abstract as base bool break byte case catch char checked class const continue decimal \
+        default delegate do double else enum event explicit extern false finally fixed float for \
+        foreach goto if implicit in int interface internal is lock long namespace new null object \
+        operator out override params private protected public readonly ref return sbyte sealed \
+        short sizeof stackalloc static string struct switch this throw true try typeof uint ulong \
+        unchecked unsafe ushort using virtual void volatile while",
+    types: "\
+        bool byte sbyte char decimal double float int uint long ulong short ushort object string \
+        var dynamic List Dictionary IEnumerable ICollection Array",
+    line_comment: Some("//"),
+    block_comment: Some(("/*", "*/")),
+    string_delimiters: &['"', '\''],
+    number_pattern: None,
+    functions: true,
+    braces: true,
+};
+
+pub static PYTHON: LanguageDef = LanguageDef {
+    name: "Python",
+    extensions: &["py", "pyw", "pyi"],
+    interpreters: &["python", "pypy"],
+    keywords: "\
+        False None True and as assert async await break class continue def del elif else except \
+        finally for from global if import in is lambda nonlocal not or pass raise return try \
+        while with yield",
+    types: "bool bytes bytearray complex dict float frozenset int list object set str tuple type",
+    line_comment: Some("#"),
+    block_comment: None,
+    string_delimiters: &['"', '\''],
+    number_pattern: Some(
+        r"\b\d[\d_]*\.?[\d_]*([eE][+-]?\d+)?[jJ]?\b|\b0[xX][0-9a-fA-F_]+\b|\b0[oO][0-7_]+\b|\b0[bB][01_]+\b",
+    ),
+    functions: true,
+    braces: false,
+};
+
+pub static JAVASCRIPT: LanguageDef = LanguageDef {
+    name: "JavaScript",
+    extensions: &["js", "mjs", "cjs", "jsx"],
+    interpreters: &["node", "nodejs", "deno", "bun"],
+    keywords: "\
+        async await break case catch class const continue debugger default delete do else export \
+        extends false finally for function if import in instanceof let new null of return static \
+        super switch this throw true try typeof undefined var void while with yield",
+    types: "\
+        Array BigInt Boolean Date Error Map Number Object Promise RegExp Set String Symbol \
+        WeakMap WeakSet",
+    line_comment: Some("//"),
+    block_comment: Some(("/*", "*/")),
+    string_delimiters: &['"', '\'', '`'],
+    number_pattern: None,
+    functions: true,
+    braces: true,
+};
+
+pub static JSON: LanguageDef = LanguageDef {
+    name: "JSON",
+    extensions: &["json", "jsonc"],
+    interpreters: &[],
+    keywords: "true false null",
+    types: "",
+    line_comment: None,
+    block_comment: None,
+    string_delimiters: &['"'],
+    number_pattern: Some(r"-?\b\d+(\.\d+)?([eE][+-]?\d+)?\b"),
+    functions: false,
+    braces: true,
+};
+
+static BUILTIN_LANGUAGES: [&LanguageDef; 8] =
+    [&RUST, &GO, &C, &CPP, &CSHARP, &PYTHON, &JAVASCRIPT, &JSON];
+
+/// Languages added via [`register_language`], keyed by lowercase extension.
+/// Unlike a thread local, this makes them visible to background threads, too.
+static REGISTERED_LANGUAGES: Mutex<Vec<(String, &'static LanguageDef)>> = Mutex::new(Vec::new());
+
+/// Associates the file extension `ext` (without the leading dot) with `def`.
+/// Registered languages take precedence over the built-in ones.
+pub fn register_language(ext: &str, def: &'static LanguageDef) {
+    let ext = ext.to_lowercase();
+    let mut list = REGISTERED_LANGUAGES.lock().unwrap();
+    list.retain(|(e, _)| *e != ext);
+    list.push((ext, def));
+}
+
+/// Detect language from file extension
+pub fn language_from_extension(ext: &str) -> Option<&'static LanguageDef> {
+    let ext = ext.to_lowercase();
+    let registered = REGISTERED_LANGUAGES.lock().unwrap();
+    registered
+        .iter()
+        .find(|(e, _)| *e == ext)
+        .map(|&(_, def)| def)
+        .or_else(|| BUILTIN_LANGUAGES.iter().copied().find(|def| def.extensions.contains(&&*ext)))
 }
 
-impl Language {
-    /// Detect language from file extension
-    pub fn from_extension(ext: &str) -> Self {
-        match ext.to_lowercase().as_str() {
-            "rs" => Language::Rust,
-            "go" => Language::Go,
-            "c" | "h" => Language::C,
-            "cpp" | "cc" | "cxx" | "hpp" | "hxx" => Language::Cpp,
-            "cs" => Language::CSharp,
-            _ => Language::Unknown,
+/// Detect language from a shebang line such as `#!/usr/bin/env python3`.
+pub fn language_from_shebang(line: &str) -> Option<&'static LanguageDef> {
+    let mut args = line.strip_prefix("#!")?.split_whitespace();
+    let mut interpreter = args.next()?.rsplit('/').next()?;
+    if interpreter == "env" {
+        // Skip options like `env -S`.
+        interpreter = args.find(|arg| !arg.starts_with('-'))?;
+    }
+
+    // "python3.12" should match "python".
+    let name = interpreter.trim_end_matches(|c: char| c.is_ascii_digit() || c == '.');
+    if name.is_empty() {
+        return None;
+    }
+
+    let matches = |def: &&'static LanguageDef| def.interpreters.contains(&name);
+    let registered = REGISTERED_LANGUAGES.lock().unwrap();
+    registered
+        .iter()
+        .map(|&(_, def)| def)
+        .find(matches)
+        .or_else(|| BUILTIN_LANGUAGES.iter().copied().find(matches))
+}
+
+/// Builds a regex that matches any of the given whitespace separated words.
+fn words_regex(words: &str) -> Regex {
+    if words.trim().is_empty() {
+        return Regex::new(r"$^").unwrap(); // Never matches
+    }
+
+    let mut pattern = String::from(r"\b(?:");
+    for (i, word) in words.split_whitespace().enumerate() {
+        if i != 0 {
+            pattern.push('|');
+        }
+        pattern.push_str(&regex::escape(word));
+        // A word like "interface{}" can't end at a word boundary.
+        if word.ends_with(|c: char| c.is_alphanumeric() || c == '_') {
+            pattern.push_str(r"\b");
         }
     }
+    pattern.push(')');
+    Regex::new(&pattern).unwrap()
 }
 
 impl SyntaxHighlighter {
     /// Create a new syntax highlighter for the given language
-    pub fn new(language: Language) -> Self {
-        let (keywords, types, comment_pattern, function_pattern) = match language {
-            Language::Rust => (
-                r"\b(?:fn|let|mut|struct|enum|trait|impl|for|if|else|while|loop|match|return|use|mod|pub|crate|self|super|const|static|async|await|move|unsafe|extern|dyn|where|type|as|in|ref|break|continue)\b",
-                r"\b(?:u8|u16|u32|u64|u128|i8|i16|i32|i64|i128|f32|f64|usize|isize|bool|char|String|str|Vec|Option|Result|Box|Rc|Arc|RefCell|Cell)\b",
-                r"//.*|/\*[\s\S]*?\*/",
-                r"\b([a-zA-Z_][a-zA-Z0-9_]*)\s*\(",
-            ),
-            Language::Go => (
-                r"\b(?:func|var|const|type|struct|interface|package|import|for|if|else|switch|case|default|return|break|continue|go|defer|select|chan|map|range|fallthrough)\b",
-                r"\b(?:int|int8|int16|int32|int64|uint|uint8|uint16|uint32|uint64|float32|float64|bool|string|byte|rune|error|interface\{\})\b",
-                r"//.*|/\*[\s\S]*?\*/",
-                r"\b([a-zA-Z_][a-zA-Z0-9_]*)\s*\(",
-            ),
-            Language::C => (
-                r"\b(?:auto|break|case|char|const|continue|default|do|double|else|enum|extern|float|for|goto|if|inline|int|long|register|restrict|return|short|signed|sizeof|static|struct|switch|typedef|union|unsigned|void|volatile|while|_Bool|_Complex|_Imaginary)\b",
-                r"\b(?:char|short|int|long|float|double|void|signed|unsigned|size_t|ptrdiff_t|FILE|NULL)\b",
-                r"//.*|/\*[\s\S]*?\*/",
-                r"\b([a-zA-Z_][a-zA-Z0-9_]*)\s*\(",
-            ),
-            Language::Cpp => (
-                r"\b(?:alignas|alignof|and|and_eq|asm|auto|bitand|bitor|bool|break|case|catch|char|char16_t|char32_t|class|compl|const|constexpr|const_cast|continue|decltype|default|delete|do|double|dynamic_cast|else|enum|explicit|export|extern|false|float|for|friend|goto|if|inline|int|long|mutable|namespace|new|noexcept|not|not_eq|nullptr|operator|or|or_eq|private|protected|public|register|reinterpret_cast|return|short|signed|sizeof|static|static_assert|static_cast|struct|switch|template|this|thread_local|throw|true|try|typedef|typeid|typename|union|unsigned|using|virtual|void|volatile|wchar_t|while|xor|xor_eq)\b",
-                r"\b(?:std::string|std::vector|std::map|std::set|std::pair|std::shared_ptr|std::unique_ptr|std::weak_ptr|bool|char|short|int|long|float|double|void|size_t|ptrdiff_t)\b",
-                r"//.*|/\*[\s\S]*?\*/",
-                r"\b([a-zA-Z_][a-zA-Z0-9_]*)\s*\(",
-            ),
-            Language::CSharp => (
-                r"\b(?:abstract|as|base|bool|break|byte|case|catch|char|checked|class|const|continue|decimal|default|delegate|do|double|else|enum|event|explicit|extern|false|finally|fixed|float|for|foreach|goto|if|implicit|in|int|interface|internal|is|lock|long|namespace|new|null|object|operator|out|override|params|private|protected|public|readonly|ref|return|sbyte|sealed|short|sizeof|stackalloc|static|string|struct|switch|this|throw|true|try|typeof|uint|ulong|unchecked|unsafe|ushort|using|virtual|void|volatile|while)\b",
-                r"\b(?:bool|byte|sbyte|char|decimal|double|float|int|uint|long|ulong|short|ushort|object|string|var|dynamic|List|Dictionary|IEnumerable|ICollection|Array)\b",
-                r"//.*|/\*[\s\S]*?\*/",
-                r"\b([a-zA-Z_][a-zA-Z0-9_]*)\s*\(",
-            ),
-            Language::Unknown => return Self::default(),
-        };
+    pub fn new(language: &'static LanguageDef) -> Self {
+        let mut comment_pattern = Vec::new();
+        if let Some(start) = language.line_comment {
+            comment_pattern.push(format!("{}.*", regex::escape(start)));
+        }
+        if let Some((start, end)) = language.block_comment {
+            let (start, end) = (regex::escape(start), regex::escape(end));
+            comment_pattern.push(format!(r"{start}[\s\S]*?{end}"));
+        }
+        if comment_pattern.is_empty() {
+            comment_pattern.push(r"$^".to_string());
+        }
+
+        let mut string_pattern = Vec::new();
+        for &delimiter in language.string_delimiters {
+            let d = regex::escape(delimiter.encode_utf8(&mut [0; 4]));
+            string_pattern.push(format!(r"{d}([^{d}\\]|\\.)*{d}"));
+        }
+        if string_pattern.is_empty() {
+            string_pattern.push(r"$^".to_string());
+        }
 
         Self {
-            language,
-            keyword_regex: Regex::new(keywords).unwrap(),
-            type_regex: Regex::new(types).unwrap(),
-            string_regex: Regex::new(r#""([^"\\]|\\.)*"|'([^'\\]|\\.)*'"#).unwrap(),
-            comment_regex: Regex::new(comment_pattern).unwrap(),
-            number_regex: Regex::new(r"\b\d+\.?\d*([eE][+-]?\d+)?[fFdDlL]?\b|\b0[xX][0-9a-fA-F]+[lL]?\b|\b0[bB][01]+[lL]?\b").unwrap(),
-            function_regex: Regex::new(function_pattern).unwrap(),
+            language: Some(language),
+            keyword_regex: words_regex(language.keywords),
+            type_regex: words_regex(language.types),
+            string_regex: Regex::new(&string_pattern.join("|")).unwrap(),
+            comment_regex: Regex::new(&comment_pattern.join("|")).unwrap(),
+            number_regex: Regex::new(language.number_pattern.unwrap_or(NUMBER_PATTERN)).unwrap(),
+            function_regex: Regex::new(if language.functions { FUNCTION_PATTERN } else { r"$^" })
+                .unwrap(),
         }
     }
 
+    /// The language this highlighter was created for, if any.
+    pub fn language(&self) -> Option<&'static LanguageDef> {
+        self.language
+    }
+
     /// Get the syntax element type for text at the given position
     pub fn get_syntax_element(&self, text: &str, position: usize) -> SyntaxElement {
-        if self.language == Language::Unknown {
+        if self.language.is_none() {
             return SyntaxElement::None;
         }
 
@@ -196,7 +390,7 @@ impl SyntaxHighlighter {
     pub fn highlight_line(&self, line: &str) -> Vec<SyntaxElement> {
         let mut result = vec![SyntaxElement::None; line.len()];
         
-        if self.language == Language::Unknown {
+        if self.language.is_none() {
             return result;
         }
 
@@ -264,7 +458,7 @@ impl SyntaxHighlighter {
 impl Default for SyntaxHighlighter {
     fn default() -> Self {
         Self {
-            language: Language::Unknown,
+            language: None,
             keyword_regex: Regex::new(r"$^").unwrap(), // Never matches
             type_regex: Regex::new(r"$^").unwrap(),
             string_regex: Regex::new(r"$^").unwrap(),
@@ -274,3 +468,62 @@ impl Default for SyntaxHighlighter {
         }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_from_extension() {
+        assert_eq!(language_from_extension("py").map(|l| l.name), Some("Python"));
+        assert_eq!(language_from_extension("JS").map(|l| l.name), Some("JavaScript"));
+        assert_eq!(language_from_extension("json").map(|l| l.name), Some("JSON"));
+        assert!(language_from_extension("txt").is_none());
+    }
+
+    #[test]
+    fn test_from_shebang() {
+        let name = |line| language_from_shebang(line).map(|l| l.name);
+        assert_eq!(name("#!/usr/bin/python3"), Some("Python"));
+        assert_eq!(name("#!/usr/bin/env python3.12"), Some("Python"));
+        assert_eq!(name("#!/usr/bin/env -S node --harmony"), Some("JavaScript"));
+        assert_eq!(name("#!/bin/sh"), None);
+        assert_eq!(name("import os"), None);
+    }
+
+    #[test]
+    fn test_go_empty_interface() {
+        let hl = SyntaxHighlighter::new(&GO);
+        assert_eq!(hl.get_syntax_element("var x interface{}", 6), SyntaxElement::Keyword);
+        assert_eq!(hl.get_syntax_element("var x interface{}", 15), SyntaxElement::Type);
+    }
+
+    #[test]
+    fn test_register_language() {
+        static TOML: LanguageDef = LanguageDef {
+            name: "TOML",
+            extensions: &[],
+            interpreters: &[],
+            keywords: "true false",
+            types: "",
+            line_comment: Some("#"),
+            block_comment: None,
+            string_delimiters: &['"', '\''],
+            number_pattern: None,
+            functions: false,
+            braces: false,
+        };
+
+        assert!(language_from_extension("toml").is_none());
+        register_language("toml", &TOML);
+        assert_eq!(language_from_extension("toml").map(|l| l.name), Some("TOML"));
+
+        // Other threads see it, too.
+        let name = std::thread::spawn(|| language_from_extension("toml").map(|l| l.name));
+        assert_eq!(name.join().unwrap(), Some("TOML"));
+
+        let hl = SyntaxHighlighter::new(&TOML);
+        assert_eq!(hl.get_syntax_element("a = true # yes", 4), SyntaxElement::Keyword);
+        assert_eq!(hl.get_syntax_element("a = true # yes", 11), SyntaxElement::Comment);
+    }
+}
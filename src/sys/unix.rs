@@ -381,6 +381,23 @@ pub fn file_id(file: Option<&File>, path: &Path) -> apperr::Result<FileId> {
     }
 }
 
+/// Gives `file` the owner and group of the file described by `metadata`, as far as we're allowed to.
+/// Only root may give files away, but the group can be changed to any group the user is in.
+pub fn copy_owner(file: &File, metadata: &std::fs::Metadata) {
+    use std::os::unix::fs::{MetadataExt as _, fchown};
+
+    if fchown(file, Some(metadata.uid()), Some(metadata.gid())).is_err() {
+        _ = fchown(file, None, Some(metadata.gid()));
+    }
+}
+
+/// Returns how many hard links point to `file`, or 1 if that can't be determined.
+pub fn link_count(file: &File) -> u64 {
+    use std::os::unix::fs::MetadataExt as _;
+
+    file.metadata().map_or(1, |metadata| metadata.nlink())
+}
+
 /// Reserves a virtual memory region of the given size.
 /// To commit the memory, use `virtual_commit`.
 /// To release the memory, use `virtual_release`.
@@ -491,6 +491,20 @@ fn file_id_from_handle(file: &File) -> apperr::Result<FileId> {
     }
 }
 
+/// New files inherit their owner and permissions from their directory on Windows.
+pub fn copy_owner(_file: &File, _metadata: &fs::Metadata) {}
+
+/// Returns how many hard links point to `file`, or 1 if that can't be determined.
+pub fn link_count(file: &File) -> u64 {
+    unsafe {
+        let mut info = MaybeUninit::<FileSystem::BY_HANDLE_FILE_INFORMATION>::uninit();
+        if FileSystem::GetFileInformationByHandle(file.as_raw_handle(), info.as_mut_ptr()) == 0 {
+            return 1;
+        }
+        info.assume_init().nNumberOfLinks as u64
+    }
+}
+
 /// Canonicalizes the given path.
 ///
 /// This differs from [`fs::canonicalize`] in that it strips the `\\?\` UNC
@@ -0,0 +1,220 @@
+// Copyright (c) Pavel Sich.
+// Licensed under the MIT License.
+
+//! Color themes for syntax highlighting and the editor chrome.
+//!
+//! A [`Theme`] only maps elements to colors. The syntax highlighter classifies text into
+//! [`SyntaxElement`]s and the colors are looked up while rendering, which means that
+//! switching the theme takes effect on the next frame without re-tokenizing anything.
+
+use crate::framebuffer::IndexedColor;
+use crate::syntax::{SYNTAX_ELEMENT_COUNT, SyntaxElement};
+
+/// A color as specified by a theme.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ThemeColor {
+    /// Derived from the terminal's palette. This is how the element was colored before themes existed.
+    Auto,
+    /// One of the terminal's palette colors, so that the theme follows the terminal's color scheme.
+    Indexed(IndexedColor),
+    /// A color in the framebuffer's `0xAABBGGRR` format.
+    Rgb(u32),
+}
+
+const INDEXED_COLOR_NAMES: [(&str, IndexedColor); 18] = [
+    ("black", IndexedColor::Black),
+    ("red", IndexedColor::Red),
+    ("green", IndexedColor::Green),
+    ("yellow", IndexedColor::Yellow),
+    ("blue", IndexedColor::Blue),
+    ("magenta", IndexedColor::Magenta),
+    ("cyan", IndexedColor::Cyan),
+    ("white", IndexedColor::White),
+    ("bright_black", IndexedColor::BrightBlack),
+    ("bright_red", IndexedColor::BrightRed),
+    ("bright_green", IndexedColor::BrightGreen),
+    ("bright_yellow", IndexedColor::BrightYellow),
+    ("bright_blue", IndexedColor::BrightBlue),
+    ("bright_magenta", IndexedColor::BrightMagenta),
+    ("bright_cyan", IndexedColor::BrightCyan),
+    ("bright_white", IndexedColor::BrightWhite),
+    ("background", IndexedColor::Background),
+    ("foreground", IndexedColor::Foreground),
+];
+
+impl ThemeColor {
+    /// Parses a color value as it appears in the config file:
+    /// * `auto`
+    /// * a palette color name like `bright_blue` or `foreground`
+    /// * a 256-color palette index from `0` to `255`
+    /// * a truecolor value in the form `#rrggbb`
+    pub fn parse(value: &str) -> Option<Self> {
+        let value = value.trim();
+
+        if value.eq_ignore_ascii_case("auto") {
+            return Some(Self::Auto);
+        }
+
+        if let Some(hex) = value.strip_prefix('#') {
+            if hex.len() != 6 {
+                return None;
+            }
+            let rgb = u32::from_str_radix(hex, 16).ok()?;
+            return Some(Self::Rgb(rgb_to_abgr(rgb)));
+        }
+
+        if let Ok(index) = value.parse::<u8>() {
+            return Some(Self::from_palette_index(index));
+        }
+
+        INDEXED_COLOR_NAMES
+            .iter()
+            .find(|(name, _)| name.eq_ignore_ascii_case(value))
+            .map(|&(_, color)| Self::Indexed(color))
+    }
+
+    /// Maps an index into the xterm 256-color palette to a color.
+    /// The first 16 entries refer to the terminal's palette, the rest have well-known values.
+    pub fn from_palette_index(index: u8) -> Self {
+        match index {
+            0..16 => Self::Indexed(INDEXED_COLOR_NAMES[index as usize].1),
+            16..232 => {
+                // A 6x6x6 color cube. The levels aren't evenly spaced: 0, 95, 135, 175, 215, 255.
+                let level = |i: u8| if i == 0 { 0 } else { 55 + 40 * i as u32 };
+                let i = index - 16;
+                let r = level(i / 36);
+                let g = level(i / 6 % 6);
+                let b = level(i % 6);
+                Self::Rgb(rgb_to_abgr(r << 16 | g << 8 | b))
+            }
+            232.. => {
+                // A grayscale ramp from 8 to 238.
+                let v = 8 + 10 * (index - 232) as u32;
+                Self::Rgb(rgb_to_abgr(v << 16 | v << 8 | v))
+            }
+        }
+    }
+}
+
+/// Converts `0xRRGGBB`, as written by humans, into the framebuffer's opaque `0xAABBGGRR`.
+fn rgb_to_abgr(rgb: u32) -> u32 {
+    0xff000000 | (rgb & 0xff) << 16 | (rgb & 0xff00) | (rgb >> 16) & 0xff
+}
+
+/// Assigns colors to syntax elements and parts of the UI.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Theme {
+    /// Indexed by [`SyntaxElement`].
+    pub syntax: [ThemeColor; SYNTAX_ELEMENT_COUNT],
+    /// The background of the menu and status bar.
+    pub statusbar: ThemeColor,
+    /// The line numbers.
+    pub gutter: ThemeColor,
+    /// The background of selected text.
+    pub selection: ThemeColor,
+    /// The background of spaces and tabs at the end of a line, if they're highlighted.
+    pub trailing_whitespace: ThemeColor,
+}
+
+impl Theme {
+    /// The default theme. It mostly uses palette colors, so it works with most dark terminal themes.
+    pub const DARK: Self = Self {
+        syntax: [
+            ThemeColor::Indexed(IndexedColor::BrightMagenta), // Keyword
+            ThemeColor::Indexed(IndexedColor::BrightCyan),    // Type
+            ThemeColor::Rgb(0xff7382fd),                      // String: coral
+            ThemeColor::Indexed(IndexedColor::BrightBlack),   // Comment
+            ThemeColor::Indexed(IndexedColor::BrightYellow),  // Number
+            ThemeColor::Indexed(IndexedColor::White),         // Operator
+            ThemeColor::Rgb(0xffb3c275),                      // Function: teal
+            ThemeColor::Indexed(IndexedColor::Foreground),    // Variable
+            ThemeColor::Indexed(IndexedColor::Foreground),    // None
+        ],
+        statusbar: ThemeColor::Auto,
+        gutter: ThemeColor::Auto,
+        selection: ThemeColor::Auto,
+        trailing_whitespace: ThemeColor::Auto,
+    };
+
+    /// A theme for terminals with a light background.
+    pub const LIGHT: Self = Self {
+        syntax: [
+            ThemeColor::Indexed(IndexedColor::Magenta),    // Keyword
+            ThemeColor::Indexed(IndexedColor::Blue),       // Type
+            ThemeColor::Rgb(0xff1515a3),                   // String: dark red
+            ThemeColor::Rgb(0xff808080),                   // Comment: gray
+            ThemeColor::Rgb(0xff588609),                   // Number: dark green
+            ThemeColor::Indexed(IndexedColor::Foreground), // Operator
+            ThemeColor::Rgb(0xff265e79),                   // Function: brown
+            ThemeColor::Indexed(IndexedColor::Foreground), // Variable
+            ThemeColor::Indexed(IndexedColor::Foreground), // None
+        ],
+        statusbar: ThemeColor::Rgb(0xfff0dcd0),
+        gutter: ThemeColor::Rgb(0x7fc0c0c0),
+        selection: ThemeColor::Rgb(0xffffd6ad),
+        trailing_whitespace: ThemeColor::Rgb(0xffc0c0ff),
+    };
+
+    /// Returns the built-in theme with the given name.
+    pub fn builtin(name: &str) -> Option<Self> {
+        match name {
+            "dark" => Some(Self::DARK),
+            "light" => Some(Self::LIGHT),
+            _ => None,
+        }
+    }
+
+    /// Returns the color for the given syntax element.
+    #[inline]
+    pub fn syntax(&self, element: SyntaxElement) -> ThemeColor {
+        self.syntax[element as usize]
+    }
+
+    /// Returns the color slot for an element by its config name, e.g. `keyword` or `selection`.
+    pub fn color_mut(&mut self, name: &str) -> Option<&mut ThemeColor> {
+        let element = match name {
+            "keyword" => SyntaxElement::Keyword,
+            "type" => SyntaxElement::Type,
+            "string" => SyntaxElement::String,
+            "comment" => SyntaxElement::Comment,
+            "number" => SyntaxElement::Number,
+            "operator" => SyntaxElement::Operator,
+            "function" => SyntaxElement::Function,
+            "identifier" => SyntaxElement::Variable,
+            "statusbar" => return Some(&mut self.statusbar),
+            "gutter" => return Some(&mut self.gutter),
+            "selection" => return Some(&mut self.selection),
+            "trailing_whitespace" => return Some(&mut self.trailing_whitespace),
+            _ => return None,
+        };
+        Some(&mut self.syntax[element as usize])
+    }
+}
+
+impl Default for Theme {
+    fn default() -> Self {
+        Self::DARK
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse() {
+        assert_eq!(ThemeColor::parse("auto"), Some(ThemeColor::Auto));
+        assert_eq!(
+            ThemeColor::parse("bright_blue"),
+            Some(ThemeColor::Indexed(IndexedColor::BrightBlue))
+        );
+        assert_eq!(ThemeColor::parse("#ff8000"), Some(ThemeColor::Rgb(0xff0080ff)));
+        assert_eq!(ThemeColor::parse("1"), Some(ThemeColor::Indexed(IndexedColor::Red)));
+        assert_eq!(ThemeColor::parse("16"), Some(ThemeColor::Rgb(0xff000000)));
+        assert_eq!(ThemeColor::parse("208"), Some(ThemeColor::Rgb(0xff0087ff)));
+        assert_eq!(ThemeColor::parse("255"), Some(ThemeColor::Rgb(0xffeeeeee)));
+        assert_eq!(ThemeColor::parse("256"), None);
+        assert_eq!(ThemeColor::parse("#fff"), None);
+        assert_eq!(ThemeColor::parse("purple"), None);
+    }
+}
@@ -154,10 +154,11 @@ use crate::buffer::{CursorMovement, MoveLineDirection, RcTextBuffer, TextBuffer,
 use crate::cell::*;
 use crate::clipboard::Clipboard;
 use crate::document::WriteableDocument;
-use crate::framebuffer::{Attributes, Framebuffer, INDEXED_COLORS_COUNT, IndexedColor};
+use crate::framebuffer::{Attributes, ColorMode, Framebuffer, INDEXED_COLORS_COUNT, IndexedColor};
 use crate::hash::*;
 use crate::helpers::*;
 use crate::input::{InputKeyMod, kbmod, vk};
+use crate::theme::{Theme, ThemeColor};
 use crate::{apperr, arena_format, input, simd, unicode};
 
 const ROOT_ID: u64 = 0x14057B7EF767814F; // Knuth's MMIX constant
@@ -429,6 +430,16 @@ impl Tui {
         self.framebuffer.set_indexed_colors(colors);
     }
 
+    /// Sets the color theme. See [`Framebuffer::set_theme()`].
+    pub fn set_theme(&mut self, theme: Theme) {
+        self.framebuffer.set_theme(theme);
+    }
+
+    /// Sets the colors the terminal supports. See [`Framebuffer::set_color_mode()`].
+    pub fn set_color_mode(&mut self, mode: ColorMode) {
+        self.framebuffer.set_color_mode(mode);
+    }
+
     /// Set up translations for Ctrl/Alt/Shift modifiers.
     pub fn setup_modifier_translations(&mut self, translations: ModifierTranslations) {
         self.modifier_translations = translations;
@@ -1376,6 +1387,27 @@ impl<'a> Context<'a, '_> {
         self.tui.framebuffer.contrasted(color)
     }
 
+    /// Returns the current color theme.
+    pub fn theme(&self) -> &Theme {
+        self.tui.framebuffer.theme()
+    }
+
+    /// Changes the color theme. It applies from the next frame on.
+    pub fn set_theme(&mut self, theme: Theme) {
+        self.tui.framebuffer.set_theme(theme);
+    }
+
+    /// Sets the colors the terminal supports. See [`Framebuffer::set_color_mode()`].
+    pub fn set_color_mode(&mut self, mode: ColorMode) {
+        self.tui.framebuffer.set_color_mode(mode);
+    }
+
+    /// Resolves a theme color. See [`Framebuffer::theme_color()`].
+    #[inline]
+    pub fn theme_color(&self, color: ThemeColor, auto: u32) -> u32 {
+        self.tui.framebuffer.theme_color(color, auto)
+    }
+
     /// Returns the clipboard.
     pub fn clipboard_ref(&self) -> &Clipboard {
         &self.tui.clipboard
@@ -2112,10 +2144,12 @@ impl<'a> Context<'a, '_> {
             content.buffer.borrow_mut().copy_from_str(*text);
         }
 
+        let mut scroll_y_prev = None;
         if let Some(node_prev) = self.tui.prev_node_map.get(node.id) {
             let node_prev = node_prev.borrow();
             if let NodeContent::Textarea(content_prev) = &node_prev.content {
                 content.scroll_offset = content_prev.scroll_offset;
+                scroll_y_prev = Some(content_prev.scroll_offset.y);
                 content.scroll_offset_y_drag_start = content_prev.scroll_offset_y_drag_start;
                 content.scroll_offset_x_max = content_prev.scroll_offset_x_max;
                 content.thumb_height = content_prev.thumb_height;
@@ -2128,16 +2162,22 @@ impl<'a> Context<'a, '_> {
                 }
 
                 let mut make_cursor_visible;
+                let center;
                 {
                     let mut tb = content.buffer.borrow_mut();
                     make_cursor_visible = tb.take_cursor_visibility_request();
+                    center = tb.take_cursor_center_request();
+                    if let Some(y) = tb.take_scroll_request() {
+                        content.scroll_offset.y = y;
+                        make_cursor_visible = true;
+                    }
                     make_cursor_visible |= tb.set_width(text_width);
                 }
 
                 make_cursor_visible |= self.textarea_handle_input(content, &node_prev, single_line);
 
                 if make_cursor_visible {
-                    self.textarea_make_cursor_visible(content, &node_prev);
+                    self.textarea_make_cursor_visible(content, &node_prev, center);
                 }
             } else {
                 debug_assert!(false);
@@ -2154,6 +2194,11 @@ impl<'a> Context<'a, '_> {
         }
 
         self.textarea_adjust_scroll_offset(content);
+        // Several textareas may show the same buffer. Only the focused one reports its
+        // scroll position, unless another one was just scrolled, e.g. with the mouse wheel.
+        if content.has_focus || scroll_y_prev.is_some_and(|y| y != content.scroll_offset.y) {
+            content.buffer.borrow_mut().set_scroll_y(content.scroll_offset.y);
+        }
 
         if single_line {
             node.attributes.fg = self.indexed(IndexedColor::Foreground);
@@ -2265,6 +2310,10 @@ impl<'a> Context<'a, '_> {
                                     if self.input_mouse_modifiers.contains(kbmod::SHIFT) {
                                         // TODO: Untested because Windows Terminal surprisingly doesn't support Shift+Click.
                                         tb.selection_update_visual(pos);
+                                    } else if self.input_mouse_modifiers.contains(kbmod::ALT)
+                                        && !single_line
+                                    {
+                                        tb.add_cursor_at_visual(pos);
                                     } else {
                                         tb.cursor_move_to_visual(pos);
                                     }
@@ -2307,6 +2356,12 @@ impl<'a> Context<'a, '_> {
             return false;
         }
 
+        if tb.has_extra_cursors() && self.textarea_handle_multi_cursor_input(tb) {
+            tc.preferred_column = tb.cursor_visual_pos().x;
+            self.set_input_consumed();
+            return true;
+        }
+
         let mut write: &[u8] = &[];
 
         if let Some(input) = &self.input_text {
@@ -2326,7 +2381,8 @@ impl<'a> Context<'a, '_> {
                     };
                     tb.delete(granularity, -1);
                 }
-                vk::TAB => {
+                // Ctrl+Tab is left to the application (e.g. for switching tabs).
+                vk::TAB if !modifiers.contains(kbmod::CTRL) => {
                     if single_line {
                         // If this is just a simple input field, don't consume Tab (= early return).
                         return false;
@@ -2354,7 +2410,7 @@ impl<'a> Context<'a, '_> {
                         make_cursor_visible = false;
                     }
                 }
-                vk::PRIOR => {
+                vk::PRIOR if !modifiers.contains(kbmod::CTRL) => {
                     let height = node_prev.inner.height() - 1;
 
                     // If the cursor was already on the first line,
@@ -2375,7 +2431,7 @@ impl<'a> Context<'a, '_> {
                         });
                     }
                 }
-                vk::NEXT => {
+                vk::NEXT if !modifiers.contains(kbmod::CTRL) => {
                     let height = node_prev.inner.height() - 1;
 
                     // If the cursor was already on the last line,
@@ -2400,6 +2456,20 @@ impl<'a> Context<'a, '_> {
                         tc.preferred_column = tb.cursor_visual_pos().x;
                     }
                 }
+                // Alt+Home/End always go to the start/end of the logical line,
+                // whereas plain Home/End stop at the wrapped rows first.
+                vk::HOME | vk::END if modifiers.contains(kbmod::ALT) => {
+                    let destination = Point {
+                        x: if key == vk::HOME { 0 } else { CoordType::MAX },
+                        y: tb.cursor_logical_pos().y,
+                    };
+
+                    if modifiers.contains(kbmod::SHIFT) {
+                        tb.selection_update_logical(destination);
+                    } else {
+                        tb.cursor_move_to_logical(destination);
+                    }
+                }
                 vk::END => {
                     let logical_before = tb.cursor_logical_pos();
                     let destination = if modifiers.contains(kbmod::CTRL) {
@@ -2488,7 +2558,8 @@ impl<'a> Context<'a, '_> {
                         }
                     }
                 }
-                vk::LEFT => {
+                // Alt+Left/Right are left to the keymap, unless they're for word navigation.
+                vk::LEFT if modifiers != kbmod::ALT || KBMOD_FOR_WORD_NAV == kbmod::ALT => {
                     let granularity = if modifiers.contains(KBMOD_FOR_WORD_NAV) {
                         CursorMovement::Word
                     } else {
@@ -2513,8 +2584,9 @@ impl<'a> Context<'a, '_> {
 
                             // If there's a selection we put the cursor above it.
                             if let Some((beg, _)) = tb.selection_range() {
-                                x = beg.visual_pos.x;
-                                y = beg.visual_pos.y - 1;
+                                let beg = tb.visual_pos(beg);
+                                x = beg.x;
+                                y = beg.y - 1;
                                 tc.preferred_column = x;
                             }
 
@@ -2544,13 +2616,12 @@ impl<'a> Context<'a, '_> {
                             });
                         }
                         kbmod::ALT => tb.move_selected_lines(MoveLineDirection::Up),
-                        kbmod::CTRL_ALT => {
-                            // TODO: Add cursor above
-                        }
+                        kbmod::ALT_SHIFT => tb.duplicate_selected_lines(MoveLineDirection::Up),
+                        kbmod::CTRL_ALT => tb.add_cursor_vertically(tc.preferred_column, -1),
                         _ => return false,
                     }
                 }
-                vk::RIGHT => {
+                vk::RIGHT if modifiers != kbmod::ALT || KBMOD_FOR_WORD_NAV == kbmod::ALT => {
                     let granularity = if modifiers.contains(KBMOD_FOR_WORD_NAV) {
                         CursorMovement::Word
                     } else {
@@ -2575,8 +2646,9 @@ impl<'a> Context<'a, '_> {
 
                             // If there's a selection we put the cursor below it.
                             if let Some((_, end)) = tb.selection_range() {
-                                x = end.visual_pos.x;
-                                y = end.visual_pos.y + 1;
+                                let end = tb.visual_pos(end);
+                                x = end.x;
+                                y = end.y + 1;
                                 tc.preferred_column = x;
                             }
 
@@ -2615,9 +2687,8 @@ impl<'a> Context<'a, '_> {
                             }
                         }
                         kbmod::ALT => tb.move_selected_lines(MoveLineDirection::Down),
-                        kbmod::CTRL_ALT => {
-                            // TODO: Add cursor above
-                        }
+                        kbmod::ALT_SHIFT => tb.duplicate_selected_lines(MoveLineDirection::Down),
+                        kbmod::CTRL_ALT => tb.add_cursor_vertically(tc.preferred_column, 1),
                         _ => return false,
                     }
                 }
@@ -2643,6 +2714,10 @@ impl<'a> Context<'a, '_> {
                     }
                     _ => return false,
                 },
+                vk::D => match modifiers {
+                    kbmod::CTRL if !single_line => _ = tb.add_cursor_at_next_occurrence(),
+                    _ => return false,
+                },
                 vk::F => match modifiers {
                     kbmod::ALT if cfg!(target_os = "macos") => {
                         // On macOS, terminals commonly emit the Emacs style
@@ -2671,6 +2746,10 @@ impl<'a> Context<'a, '_> {
                     kbmod::CTRL => tb.redo(),
                     _ => return false,
                 },
+                vk::OEM_2 => match modifiers {
+                    kbmod::CTRL => tb.toggle_line_comment(),
+                    _ => return false,
+                },
                 vk::Z => match modifiers {
                     kbmod::CTRL => tb.undo(),
                     kbmod::CTRL_SHIFT => tb.redo(),
@@ -2703,7 +2782,83 @@ impl<'a> Context<'a, '_> {
         make_cursor_visible
     }
 
-    fn textarea_make_cursor_visible(&self, tc: &mut TextareaContent, node_prev: &Node) {
+    /// Applies typing, deletion and simple cursor movement to all cursors of the text buffer.
+    /// Returns false for any other input, which is then handled as usual for the primary cursor.
+    fn textarea_handle_multi_cursor_input(&mut self, tb: &mut TextBuffer) -> bool {
+        if let Some(text) = self.input_text {
+            tb.for_each_cursor(|tb| tb.write_canon(text.as_bytes()));
+            return true;
+        }
+
+        let Some(input) = self.input_keyboard else {
+            return false;
+        };
+        let key = input.key();
+        let modifiers = input.modifiers();
+        let granularity = if modifiers.contains(KBMOD_FOR_WORD_NAV) {
+            CursorMovement::Word
+        } else {
+            CursorMovement::Grapheme
+        };
+
+        match key {
+            vk::ESCAPE if modifiers == kbmod::NONE => _ = tb.clear_extra_cursors(),
+            vk::RETURN if modifiers == kbmod::NONE => {
+                tb.for_each_cursor(|tb| tb.write_canon(b"\n"))
+            }
+            vk::BACK if modifiers == kbmod::NONE || modifiers == kbmod::CTRL => {
+                let granularity = if modifiers == kbmod::CTRL {
+                    CursorMovement::Word
+                } else {
+                    CursorMovement::Grapheme
+                };
+                tb.for_each_cursor(|tb| tb.delete(granularity, -1));
+            }
+            vk::DELETE if modifiers == kbmod::NONE || modifiers == kbmod::CTRL => {
+                let granularity = if modifiers == kbmod::CTRL {
+                    CursorMovement::Word
+                } else {
+                    CursorMovement::Grapheme
+                };
+                tb.for_each_cursor(|tb| tb.delete(granularity, 1));
+            }
+            vk::LEFT | vk::RIGHT
+                if !modifiers.contains(kbmod::SHIFT)
+                    && (modifiers != kbmod::ALT || KBMOD_FOR_WORD_NAV == kbmod::ALT) =>
+            {
+                let delta = if key == vk::LEFT { -1 } else { 1 };
+                tb.for_each_cursor(|tb| tb.cursor_move_delta(granularity, delta));
+            }
+            vk::UP | vk::DOWN if modifiers == kbmod::NONE => {
+                let delta = if key == vk::UP { -1 } else { 1 };
+                tb.for_each_cursor(|tb| {
+                    let pos = tb.cursor_visual_pos();
+                    tb.cursor_move_to_visual(Point { x: pos.x, y: pos.y + delta });
+                });
+            }
+            vk::HOME | vk::END if modifiers == kbmod::NONE => {
+                let x = if key == vk::HOME { 0 } else { CoordType::MAX };
+                tb.for_each_cursor(|tb| {
+                    let y = tb.cursor_logical_pos().y;
+                    tb.cursor_move_to_logical(Point { x, y });
+                });
+            }
+            vk::V if modifiers == kbmod::CTRL => {
+                let clipboard = self.clipboard_ref();
+                tb.for_each_cursor(|tb| tb.paste(clipboard));
+            }
+            _ => return false,
+        }
+
+        true
+    }
+
+    fn textarea_make_cursor_visible(
+        &self,
+        tc: &mut TextareaContent,
+        node_prev: &Node,
+        center: bool,
+    ) {
         let tb = tc.buffer.borrow();
         let mut scroll_x = tc.scroll_offset.x;
         let mut scroll_y = tc.scroll_offset.y;
@@ -2715,6 +2870,10 @@ impl<'a> Context<'a, '_> {
 
         let viewport_height = node_prev.inner.height();
         let cursor_y = tb.cursor_visual_pos().y;
+        // If the cursor is off-screen and centering was requested, put it into the middle.
+        if center && (cursor_y < scroll_y || cursor_y >= scroll_y + viewport_height) {
+            scroll_y = (cursor_y - viewport_height / 2).max(0);
+        }
         // Scroll up if the cursor is above the visible area.
         scroll_y = scroll_y.min(cursor_y);
         // Scroll down if the cursor is below the visible area.
@@ -3294,8 +3453,12 @@ impl<'a> Context<'a, '_> {
     }
 
     fn menubar_shortcut(&mut self, shortcut: InputKey) {
-        let shortcut_letter = shortcut.value() as u8 as char;
-        if shortcut_letter.is_ascii_uppercase() {
+        let shortcut_letter = match shortcut.key() {
+            vk::OEM_MINUS => '-',
+            vk::OEM_2 => '/',
+            key => key.value() as u8 as char,
+        };
+        if shortcut_letter.is_ascii_uppercase() || matches!(shortcut_letter, '-' | '/') {
             let mut shortcut_text = ArenaString::new_in(self.arena());
             if shortcut.modifiers_contains(kbmod::CTRL) {
                 shortcut_text.push_str(self.tui.modifier_translations.ctrl);
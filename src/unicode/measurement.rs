@@ -1017,6 +1017,36 @@ mod test {
         );
     }
 
+    #[test]
+    fn test_mixed_widths() {
+        // A combining accent (0 columns), a CJK character (2 columns) and an emoji (2 columns).
+        let text = "e\u{301}漢😀x".as_bytes();
+        let cursor = MeasurementConfig::new(&text).goto_logical(Point { x: 3, y: 0 });
+        assert_eq!(
+            cursor,
+            Cursor {
+                offset: 10,
+                logical_pos: Point { x: 3, y: 0 },
+                visual_pos: Point { x: 5, y: 0 },
+                column: 5,
+                wrap_opp: false,
+            }
+        );
+
+        // Targeting the second half of a wide character lands in front of it.
+        let cursor = MeasurementConfig::new(&text).goto_visual(Point { x: 2, y: 0 });
+        assert_eq!(
+            cursor,
+            Cursor {
+                offset: 3,
+                logical_pos: Point { x: 1, y: 0 },
+                visual_pos: Point { x: 1, y: 0 },
+                column: 1,
+                wrap_opp: false,
+            }
+        );
+    }
+
     #[test]
     fn test_crlf() {
         let text = "a\r\nbcd\r\ne".as_bytes();